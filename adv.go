@@ -1,8 +1,29 @@
 package ble
 
+import "time"
+
+// TxPowerUnavailable is the transmit power of an advertisement, which doesn't
+// report one [Vol 2, Part E, 7.7.65.13].
+const TxPowerUnavailable = 127
+
 // AdvHandler handles advertisement.
 type AdvHandler func(a Advertisement)
 
+// AdvDropPolicy tells which advertisements are dropped, when the AdvHandler
+// doesn't keep up with them, and their queue is full.
+//
+// With AdvBlock, the events wait for up to a second, and the new advertisement
+// is dropped after that. The events include the completion of HCI commands,
+// so the AdvHandler shouldn't send them, e.g. to stop scanning or to dial.
+type AdvDropPolicy int
+
+// AdvDropPolicy values.
+const (
+	AdvDropOldest AdvDropPolicy = iota // AdvDropOldest drops the oldest queued advertisement.
+	AdvDropNewest                      // AdvDropNewest drops the new advertisement.
+	AdvBlock                           // AdvBlock waits for the queue to have room, which holds up the other events.
+)
+
 // AdvFilter returns true if the advertisement matches specified condition.
 type AdvFilter func(a Advertisement) bool
 
@@ -19,6 +40,32 @@ type Advertisement interface {
 
 	RSSI() int
 	Addr() Addr
+
+	// PrimaryPHY returns the PHY of the advertisement on the primary channels.
+	PrimaryPHY() PHY
+
+	// SecondaryPHY returns the PHY of the extended advertisement on the
+	// secondary channels, or 0 if it isn't used.
+	SecondaryPHY() PHY
+
+	// SID returns the Advertising SID of the extended advertisement, or -1 if
+	// it doesn't have one.
+	SID() int
+
+	// TxPower returns the transmit power in dBm, which the controller reported
+	// for the extended advertisement, or TxPowerUnavailable.
+	TxPower() int
+
+	// PeriodicInterval returns the interval of the periodic advertising, which
+	// the advertiser runs, or 0 if there is none.
+	PeriodicInterval() time.Duration
+
+	// Data and ScanResponse return the raw advertising data and scan response
+	// data of the device, either of which may be nil. MergedData returns them
+	// merged into one, which the other methods parse.
+	Data() []byte
+	ScanResponse() []byte
+	MergedData() []byte
 }
 
 // ServiceData ...
@@ -0,0 +1,237 @@
+package ble
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNotBonded means the peer is not found in the bond store.
+var ErrNotBonded = errors.New("not bonded")
+
+// Key is a 128-bit key, such as LTK, IRK or CSRK, in wire (little-endian) order.
+type Key [16]byte
+
+// IsZero reports whether the key is absent.
+func (k Key) IsZero() bool { return k == Key{} }
+
+// MarshalText encodes the key as a hexadecimal string.
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(k[:])), nil
+}
+
+// UnmarshalText decodes the key from a hexadecimal string.
+func (k *Key) UnmarshalText(b []byte) error {
+	if len(b) != 2*len(k) {
+		return errors.New("invalid key length")
+	}
+	_, err := hex.Decode(k[:], b)
+	return err
+}
+
+// Bond holds the keys exchanged with a bonded peer during pairing [Vol 3, Part H, 3.6].
+type Bond struct {
+	// Address and AddressType identify the peer. It's the identity address,
+	// if the peer has distributed one.
+	Address     string `json:"address"`
+	AddressType uint8  `json:"addressType"`
+
+	// LTK, EDIV and Rand are distributed by the peer, and used to encrypt
+	// the link when the local device is the central.
+	LTK  Key    `json:"ltk"`
+	EDIV uint16 `json:"ediv"`
+	Rand uint64 `json:"rand"`
+
+	// LocalLTK, LocalEDIV and LocalRand are distributed to the peer, and used
+	// to encrypt the link when the local device is the peripheral.
+	// With LE Secure Connections, they are the same as LTK, EDIV and Rand.
+	LocalLTK  Key    `json:"localLTK"`
+	LocalEDIV uint16 `json:"localEDIV"`
+	LocalRand uint64 `json:"localRand"`
+
+	// IRK is the Identity Resolving Key of the peer.
+	IRK Key `json:"irk"`
+
+	// CSRK and LocalCSRK are the Connection Signature Resolving Keys of the
+	// peer and the local device.
+	CSRK      Key `json:"csrk"`
+	LocalCSRK Key `json:"localCSRK"`
+
+	// SignCounter is the lowest sign counter accepted in the next data signed
+	// by the peer, and LocalSignCounter is the sign counter of the next data
+	// signed by the local device [Vol 3, Part H, 2.4.5].
+	SignCounter      uint32 `json:"signCounter"`
+	LocalSignCounter uint32 `json:"localSignCounter"`
+
+	// KeySize is the encryption key size negotiated during pairing.
+	KeySize int `json:"keySize"`
+
+	// Authenticated reports whether the pairing was protected against MITM.
+	Authenticated bool `json:"authenticated"`
+
+	// SecureConnections reports whether LE Secure Connections was used.
+	SecureConnections bool `json:"secureConnections"`
+}
+
+// FilterPolicy selects the operations, which only accept the bonded devices.
+// The bonds are loaded into the white list of the controller, which filters
+// the devices by their identity addresses [Vol 6, Part B, 4.3].
+type FilterPolicy uint8
+
+// FilterPolicy values.
+const (
+	FilterScan      FilterPolicy = 1 << 0 // FilterScan ignores the advertisements of other devices.
+	FilterAdvertise FilterPolicy = 1 << 1 // FilterAdvertise ignores the scan and connection requests of other devices.
+	FilterInitiate  FilterPolicy = 1 << 2 // FilterInitiate connects to any bonded device, instead of the dialed one.
+)
+
+// A BondStore persists the keys of bonded peers.
+type BondStore interface {
+	// Find returns the bond of the peer with address a, or ErrNotBonded.
+	Find(a Addr) (*Bond, error)
+
+	// Save adds or replaces the bond of a peer.
+	Save(b *Bond) error
+
+	// Delete removes the bond of the peer with address a.
+	Delete(a Addr) error
+
+	// Bonds returns all the bonds in the store.
+	Bonds() ([]*Bond, error)
+}
+
+func bondKey(a string) string { return strings.ToLower(a) }
+
+// MemoryBondStore is a BondStore which keeps the bonds in memory.
+type MemoryBondStore struct {
+	sync.Mutex
+	bonds map[string]Bond
+}
+
+// NewMemoryBondStore returns an empty in-memory BondStore.
+func NewMemoryBondStore() *MemoryBondStore {
+	return &MemoryBondStore{bonds: make(map[string]Bond)}
+}
+
+// Find returns the bond of the peer with address a, or ErrNotBonded.
+func (s *MemoryBondStore) Find(a Addr) (*Bond, error) {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.bonds[bondKey(a.String())]
+	if !ok {
+		return nil, ErrNotBonded
+	}
+	return &b, nil
+}
+
+// Save adds or replaces the bond of a peer.
+func (s *MemoryBondStore) Save(b *Bond) error {
+	s.Lock()
+	defer s.Unlock()
+	s.bonds[bondKey(b.Address)] = *b
+	return nil
+}
+
+// Delete removes the bond of the peer with address a.
+func (s *MemoryBondStore) Delete(a Addr) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.bonds, bondKey(a.String()))
+	return nil
+}
+
+// Bonds returns all the bonds in the store.
+func (s *MemoryBondStore) Bonds() ([]*Bond, error) {
+	s.Lock()
+	defer s.Unlock()
+	bonds := make([]*Bond, 0, len(s.bonds))
+	for _, b := range s.bonds {
+		b := b
+		bonds = append(bonds, &b)
+	}
+	return bonds, nil
+}
+
+// FileBondStore is a BondStore which keeps the bonds in a JSON file.
+// The file is rewritten on every change.
+type FileBondStore struct {
+	mem  *MemoryBondStore
+	path string
+}
+
+// NewFileBondStore returns a BondStore backed by the JSON file at path.
+// The bonds in the file, if it exists, are loaded.
+func NewFileBondStore(path string) (*FileBondStore, error) {
+	s := &FileBondStore{mem: NewMemoryBondStore(), path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bonds []Bond
+	if err := json.Unmarshal(b, &bonds); err != nil {
+		return nil, err
+	}
+	for _, b := range bonds {
+		s.mem.bonds[bondKey(b.Address)] = b
+	}
+	return s, nil
+}
+
+// Find returns the bond of the peer with address a, or ErrNotBonded.
+func (s *FileBondStore) Find(a Addr) (*Bond, error) { return s.mem.Find(a) }
+
+// Bonds returns all the bonds in the store.
+func (s *FileBondStore) Bonds() ([]*Bond, error) { return s.mem.Bonds() }
+
+// Save adds or replaces the bond of a peer.
+func (s *FileBondStore) Save(b *Bond) error {
+	s.mem.Lock()
+	defer s.mem.Unlock()
+	s.mem.bonds[bondKey(b.Address)] = *b
+	return s.flush()
+}
+
+// Delete removes the bond of the peer with address a.
+func (s *FileBondStore) Delete(a Addr) error {
+	s.mem.Lock()
+	defer s.mem.Unlock()
+	delete(s.mem.bonds, bondKey(a.String()))
+	return s.flush()
+}
+
+// flush writes the bonds to the file. The caller must hold the lock.
+func (s *FileBondStore) flush() error {
+	bonds := make([]Bond, 0, len(s.mem.bonds))
+	for _, b := range s.mem.bonds {
+		bonds = append(bonds, b)
+	}
+	sort.Slice(bonds, func(i, j int) bool { return bonds[i].Address < bonds[j].Address })
+	b, err := json.MarshalIndent(bonds, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash never leaves a partial file.
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
@@ -0,0 +1,57 @@
+package ble
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileBondStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bonds.json")
+
+	s, err := NewFileBondStore(path)
+	if err != nil {
+		t.Fatalf("can't create store: %v", err)
+	}
+	b := &Bond{
+		Address:       "AA:BB:CC:DD:EE:FF",
+		LTK:           Key{0x01, 0x02, 0x03},
+		EDIV:          0x1234,
+		Rand:          0x0102030405060708,
+		KeySize:       16,
+		Authenticated: true,
+	}
+	if err := s.Save(b); err != nil {
+		t.Fatalf("can't save bond: %v", err)
+	}
+
+	// Reload the bonds from the file.
+	s, err = NewFileBondStore(path)
+	if err != nil {
+		t.Fatalf("can't load store: %v", err)
+	}
+	got, err := s.Find(NewAddr("aa:bb:cc:dd:ee:ff"))
+	if err != nil {
+		t.Fatalf("can't find bond: %v", err)
+	}
+	if *got != *b {
+		t.Errorf("bond = %+v, want %+v", *got, *b)
+	}
+
+	if err := s.Delete(NewAddr("aa:bb:cc:dd:ee:ff")); err != nil {
+		t.Fatalf("can't delete bond: %v", err)
+	}
+	s, err = NewFileBondStore(path)
+	if err != nil {
+		t.Fatalf("can't load store: %v", err)
+	}
+	if _, err := s.Find(NewAddr("aa:bb:cc:dd:ee:ff")); err != ErrNotBonded {
+		t.Errorf("Find() after Delete() returned %v, want %v", err, ErrNotBonded)
+	}
+}
@@ -3,6 +3,7 @@ package ble
 import (
 	"context"
 	"io"
+	"time"
 )
 
 // Conn implements a L2CAP connection.
@@ -38,4 +39,65 @@ type Conn interface {
 
 	// Disconnected returns a receiving channel, which is closed when the connection disconnects.
 	Disconnected() <-chan struct{}
+
+	// Pair initiates pairing with the remote device, or waits for the pairing
+	// initiated by the remote device, and returns when it completes. [Vol 3, Part H, 2.4]
+	Pair(ctx context.Context) error
+
+	// Encrypt encrypts the link, and returns when it's encrypted. A central
+	// encrypts the link with the LTK of the bonded peripheral, and fails with
+	// ErrNotBonded if there is none. A peripheral sends a Security Request,
+	// asking the central to encrypt the link or to pair. [Vol 3, Part H, 2.4.6]
+	Encrypt(ctx context.Context) error
+
+	// SecurityLevel returns the current security level of the link.
+	SecurityLevel() SecurityLevel
+
+	// KeySize returns the encryption key size in octets, or 0 if the link is not encrypted.
+	KeySize() int
+
+	// SetSecurityHandler sets the handler, which is called when the security
+	// level or the key size of the link changes.
+	SetSecurityHandler(h SecurityHandler)
+
+	// DialL2CAP opens an L2CAP connection-oriented channel to the PSM of the
+	// remote device, in the LE Credit Based Flow Control Mode. [Vol 3, Part A, 10]
+	DialL2CAP(psm uint16) (L2CAPChannel, error)
+
+	// DialL2CAPEnhanced opens up to five L2CAP connection-oriented channels to
+	// the PSM of the remote device with a single request, in the Enhanced Credit
+	// Based Flow Control Mode. The remote device may refuse some of the channels,
+	// in which case fewer channels are returned. [Vol 3, Part A, 4.25]
+	DialL2CAPEnhanced(psm uint16, n int) ([]L2CAPChannel, error)
+
+	// ReconfigureL2CAP changes the MTU and MPS of the channels opened in the
+	// Enhanced Credit Based Flow Control Mode. The MTU can't be decreased, and
+	// the MPS can only be decreased for a single channel. [Vol 3, Part A, 4.27]
+	ReconfigureL2CAP(chs []L2CAPChannel, mtu, mps int) error
+
+	// UpdateConnParams requests the connection interval between min and max,
+	// the peripheral latency in connection events, and the supervision timeout.
+	// It returns ErrConnParamsRejected, if the remote device rejects them.
+	UpdateConnParams(ctx context.Context, min, max time.Duration, latency int, timeout time.Duration) error
+
+	// ConnParams returns the current interval, peripheral latency and
+	// supervision timeout of the connection.
+	ConnParams() ConnParams
+
+	// SetConnParamsHandler sets the handler, which is called when the
+	// parameters of the connection change.
+	SetConnParamsHandler(h ConnParamsHandler)
+
+	// DataLength returns the maximum payload octets and transmission time of
+	// the link layer data packets in each direction. [Vol 6, Part B, 4.5.10]
+	DataLength() DataLength
+
+	// SetPHY sets the preferred PHYs of the connection for transmitting and
+	// receiving, and returns when the PHYs are updated, or ctx is done. Either
+	// tx or rx may be 0, if there is no preference. [Vol 2, Part E, 7.8.49]
+	SetPHY(ctx context.Context, tx, rx PHY, opts PHYOptions) error
+
+	// ReadPHY returns the current PHYs of the connection for transmitting and
+	// receiving. [Vol 2, Part E, 7.8.47]
+	ReadPHY() (tx, rx PHY, err error)
 }
@@ -0,0 +1,26 @@
+package ble
+
+import "time"
+
+// ConnParams are the parameters of a connection [Vol 6, Part B, 4.5.1].
+// For the current parameters of a connection, IntervalMin and IntervalMax are
+// both the connection interval.
+type ConnParams struct {
+	// IntervalMin and IntervalMax are the range of the connection interval.
+	IntervalMin time.Duration
+	IntervalMax time.Duration
+
+	// Latency is the number of connection events the peripheral may skip.
+	Latency int
+
+	// Timeout is the supervision timeout.
+	Timeout time.Duration
+}
+
+// ConnParamPolicy decides the connection parameters requested by the remote
+// device of a connection. It returns the parameters to use, which are either
+// the requested ones or clamped, or false to reject the request.
+type ConnParamPolicy func(c Conn, req ConnParams) (ConnParams, bool)
+
+// A ConnParamsHandler handles the changes of the parameters of a connection.
+type ConnParamsHandler func(p ConnParams)
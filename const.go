@@ -30,4 +30,7 @@ var (
 	ReconnectionAddrUUID  = UUID16(0x2A03)
 	PeferredParamsUUID    = UUID16(0x2A04)
 	ServiceChangedUUID    = UUID16(0x2A05)
+
+	ClientSupportedFeaturesUUID = UUID16(0x2B29)
+	ServerSupportedFeaturesUUID = UUID16(0x2B3A)
 )
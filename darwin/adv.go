@@ -1,6 +1,8 @@
 package darwin
 
 import (
+	"time"
+
 	"github.com/trustasia-com/ble"
 )
 
@@ -54,3 +56,35 @@ func (a *adv) RSSI() int {
 func (a *adv) Addr() ble.Addr {
 	return a.peerUUID
 }
+
+func (a *adv) PrimaryPHY() ble.PHY {
+	return ble.PHY1M
+}
+
+func (a *adv) SecondaryPHY() ble.PHY {
+	return 0
+}
+
+func (a *adv) SID() int {
+	return -1
+}
+
+func (a *adv) TxPower() int {
+	return ble.TxPowerUnavailable
+}
+
+func (a *adv) PeriodicInterval() time.Duration {
+	return 0
+}
+
+func (a *adv) Data() []byte {
+	return nil
+}
+
+func (a *adv) ScanResponse() []byte {
+	return nil
+}
+
+func (a *adv) MergedData() []byte {
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/trustasia-com/ble"
 	"github.com/JuulLabs-OSS/cbgo"
@@ -142,6 +143,70 @@ func (c *conn) Disconnected() <-chan struct{} {
 	return c.done
 }
 
+// Pair is not supported; CoreBluetooth pairs on demand when accessing
+// protected characteristics.
+func (c *conn) Pair(ctx context.Context) error {
+	return ble.ErrNotImplemented
+}
+
+// Encrypt is not supported; CoreBluetooth encrypts on demand when accessing
+// protected characteristics.
+func (c *conn) Encrypt(ctx context.Context) error {
+	return ble.ErrNotImplemented
+}
+
+// SecurityLevel is not reported by CoreBluetooth.
+func (c *conn) SecurityLevel() ble.SecurityLevel {
+	return ble.SecurityNone
+}
+
+// KeySize is not reported by CoreBluetooth.
+func (c *conn) KeySize() int {
+	return 0
+}
+
+// ConnParams is not supported.
+func (c *conn) ConnParams() ble.ConnParams { return ble.ConnParams{} }
+
+// SetConnParamsHandler is not supported; the handler is never called.
+func (c *conn) SetConnParamsHandler(h ble.ConnParamsHandler) {}
+
+// DataLength is not supported.
+func (c *conn) DataLength() ble.DataLength { return ble.DataLength{} }
+
+// SetPHY is not supported.
+func (c *conn) SetPHY(ctx context.Context, tx, rx ble.PHY, opts ble.PHYOptions) error {
+	return ble.ErrNotImplemented
+}
+
+// ReadPHY is not supported.
+func (c *conn) ReadPHY() (tx, rx ble.PHY, err error) {
+	return 0, 0, ble.ErrNotImplemented
+}
+
+// SetSecurityHandler is not supported; the handler is never called.
+func (c *conn) SetSecurityHandler(h ble.SecurityHandler) {}
+
+// DialL2CAP is not supported.
+func (c *conn) DialL2CAP(psm uint16) (ble.L2CAPChannel, error) {
+	return nil, ble.ErrNotImplemented
+}
+
+// DialL2CAPEnhanced is not supported.
+func (c *conn) DialL2CAPEnhanced(psm uint16, n int) ([]ble.L2CAPChannel, error) {
+	return nil, ble.ErrNotImplemented
+}
+
+// ReconfigureL2CAP is not supported.
+func (c *conn) ReconfigureL2CAP(chs []ble.L2CAPChannel, mtu, mps int) error {
+	return ble.ErrNotImplemented
+}
+
+// UpdateConnParams is not supported.
+func (c *conn) UpdateConnParams(ctx context.Context, min, max time.Duration, latency int, timeout time.Duration) error {
+	return ble.ErrNotImplemented
+}
+
 // processChrRead handles an incoming read response.  CoreBluetooth does not
 // distinguish explicit reads from unsolicited notifications.  This function
 // identifies which type the incoming message is.
@@ -88,16 +88,28 @@ func (d *Device) Option(opts ...ble.Option) error {
 
 // Scan ...
 func (d *Device) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
+	d.StartScan(allowDup, h)
+
+	<-ctx.Done()
+	d.StopScan()
+
+	return ctx.Err()
+}
+
+// StartScan starts scanning, which goes on until StopScan is called.
+func (d *Device) StartScan(allowDup bool, h ble.AdvHandler) error {
 	d.advHandler = h
 
 	d.cm.Scan(nil, &cbgo.CentralManagerScanOpts{
 		AllowDuplicates: allowDup,
 	})
+	return nil
+}
 
-	<-ctx.Done()
+// StopScan stops scanning.
+func (d *Device) StopScan() error {
 	d.cm.StopScan()
-
-	return ctx.Err()
+	return nil
 }
 
 // Dial ...
@@ -134,6 +146,16 @@ func (d *Device) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	}
 }
 
+// ListenL2CAP is not supported.
+func (d *Device) ListenL2CAP(psm uint16) (ble.L2CAPListener, error) {
+	return nil, ble.ErrNotImplemented
+}
+
+// SyncPeriodic is not supported.
+func (d *Device) SyncPeriodic(ctx context.Context, a ble.Addr, sid int) (<-chan ble.PeriodicReport, error) {
+	return nil, ble.ErrNotImplemented
+}
+
 // Stop ...
 func (d *Device) Stop() error {
 	return nil
@@ -187,7 +209,7 @@ func chrPropPerm(c *ble.Characteristic) (cbgo.CharacteristicProperties, cbgo.Att
 
 	if c.Property&ble.CharRead != 0 {
 		prop |= cbgo.CharacteristicPropertyRead
-		if ble.CharRead&c.Secure != 0 {
+		if ble.CharRead&c.Secure != 0 || c.Permission&(ble.PermReadEncrypted|ble.PermReadAuthenticated) != 0 {
 			perm |= cbgo.AttributePermissionsReadEncryptionRequired
 		} else {
 			perm |= cbgo.AttributePermissionsReadable
@@ -195,7 +217,7 @@ func chrPropPerm(c *ble.Characteristic) (cbgo.CharacteristicProperties, cbgo.Att
 	}
 	if c.Property&ble.CharWriteNR != 0 {
 		prop |= cbgo.CharacteristicPropertyWriteWithoutResponse
-		if c.Secure&ble.CharWriteNR != 0 {
+		if c.Secure&ble.CharWriteNR != 0 || c.Permission&(ble.PermWriteEncrypted|ble.PermWriteAuthenticated) != 0 {
 			perm |= cbgo.AttributePermissionsWriteEncryptionRequired
 		} else {
 			perm |= cbgo.AttributePermissionsWriteable
@@ -203,7 +225,7 @@ func chrPropPerm(c *ble.Characteristic) (cbgo.CharacteristicProperties, cbgo.Att
 	}
 	if c.Property&ble.CharWrite != 0 {
 		prop |= cbgo.CharacteristicPropertyWrite
-		if c.Secure&ble.CharWrite != 0 {
+		if c.Secure&ble.CharWrite != 0 || c.Permission&(ble.PermWriteEncrypted|ble.PermWriteAuthenticated) != 0 {
 			perm |= cbgo.AttributePermissionsWriteEncryptionRequired
 		} else {
 			perm |= cbgo.AttributePermissionsWriteable
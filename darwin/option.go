@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/trustasia-com/ble"
 	"github.com/trustasia-com/ble/linux/hci/cmd"
 	"github.com/trustasia-com/ble/linux/hci/evt"
 )
@@ -43,6 +44,46 @@ func (d *Device) SetListenerTimeout(dur time.Duration) error {
 	return errors.New("Not supported")
 }
 
+// SetConnParamPolicy sets the policy of the connection parameters.
+func (d *Device) SetConnParamPolicy(p ble.ConnParamPolicy) error {
+	return errors.New("Not supported")
+}
+
+// SetAutoDataLength sets whether the maximum data length is requested.
+func (d *Device) SetAutoDataLength(auto bool) error {
+	return errors.New("Not supported")
+}
+
+// SetDefaultPHY sets the preferred PHYs of the new connections.
+func (d *Device) SetDefaultPHY(tx, rx ble.PHY) error {
+	return errors.New("Not supported")
+}
+
+// SetScanCache sets the size and TTL of the scan cache.
+func (d *Device) SetScanCache(size int, ttl time.Duration) error {
+	return errors.New("Not supported")
+}
+
+// SetAdvQueue sets the depth and the drop policy of the advertisement queue.
+func (d *Device) SetAdvQueue(depth int, policy ble.AdvDropPolicy) error {
+	return errors.New("Not supported")
+}
+
+// SetEnhancedATT is not supported.
+func (d *Device) SetEnhancedATT(enable bool) error {
+	return errors.New("Not supported")
+}
+
+// SetExtendedScan sets the PHYs of the extended scanning.
+func (d *Device) SetExtendedScan(phys ble.PHY) error {
+	return errors.New("Not supported")
+}
+
+// SetSignalTimeout sets the RTX timer of the L2CAP signaling requests.
+func (d *Device) SetSignalTimeout(dur time.Duration) error {
+	return errors.New("Not supported")
+}
+
 // SetConnParams overrides default connection parameters.
 func (d *Device) SetConnParams(param cmd.LECreateConnection) error {
 	return errors.New("Not supported")
@@ -57,3 +98,53 @@ func (d *Device) SetScanParams(param cmd.LESetScanParameters) error {
 func (d *Device) SetAdvParams(param cmd.LESetAdvertisingParameters) error {
 	return errors.New("Not supported")
 }
+
+// SetBondStore is not supported; CoreBluetooth manages the bonds itself.
+func (d *Device) SetBondStore(s ble.BondStore) error {
+	return errors.New("Not supported")
+}
+
+// SetPairingAgent is not supported; CoreBluetooth interacts with the user itself.
+func (d *Device) SetPairingAgent(a ble.PairingAgent) error {
+	return errors.New("Not supported")
+}
+
+// SetIOCapability is not supported.
+func (d *Device) SetIOCapability(c ble.IOCapability) error {
+	return errors.New("Not supported")
+}
+
+// SetSecureConnectionsOnly is not supported.
+func (d *Device) SetSecureConnectionsOnly(enable bool) error {
+	return errors.New("Not supported")
+}
+
+// SetPrivacy is not supported; CoreBluetooth manages the local address itself.
+func (d *Device) SetPrivacy(interval time.Duration) error {
+	return errors.New("Not supported")
+}
+
+// SetLocalIRK is not supported.
+func (d *Device) SetLocalIRK(irk ble.Key) error {
+	return errors.New("Not supported")
+}
+
+// SetControllerPrivacy is not supported.
+func (d *Device) SetControllerPrivacy(enable bool) error {
+	return errors.New("Not supported")
+}
+
+// SetFilterPolicy is not supported.
+func (d *Device) SetFilterPolicy(p ble.FilterPolicy) error {
+	return errors.New("Not supported")
+}
+
+// SetRandomAddress is not supported; CoreBluetooth manages the local address itself.
+func (d *Device) SetRandomAddress(a ble.Addr) error {
+	return errors.New("Not supported")
+}
+
+// SetStaticRandomAddress is not supported; CoreBluetooth manages the local address itself.
+func (d *Device) SetStaticRandomAddress() error {
+	return errors.New("Not supported")
+}
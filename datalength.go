@@ -0,0 +1,12 @@
+package ble
+
+import "time"
+
+// DataLength is the maximum payload octets and transmission time of the link
+// layer data packets of a connection in each direction [Vol 6, Part B, 4.5.10].
+type DataLength struct {
+	TxOctets int
+	TxTime   time.Duration
+	RxOctets int
+	RxTime   time.Duration
+}
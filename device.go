@@ -42,4 +42,13 @@ type Device interface {
 
 	// Dial ...
 	Dial(ctx context.Context, a Addr) (Client, error)
+
+	// ListenL2CAP listens on the PSM for the L2CAP connection-oriented channels
+	// opened by remote devices. If psm is zero, a dynamic PSM is allocated.
+	ListenL2CAP(psm uint16) (L2CAPListener, error)
+
+	// SyncPeriodic synchronizes to the periodic advertising of the advertising
+	// set sid of the device a, and returns the channel of its reports. The
+	// channel is closed when the synchronization is lost or ctx is done.
+	SyncPeriodic(ctx context.Context, a Addr, sid int) (<-chan PeriodicReport, error)
 }
@@ -12,6 +12,9 @@ var ErrEIRPacketTooLong = errors.New("max packet length is 31")
 // ErrNotImplemented means the functionality is not implemented.
 var ErrNotImplemented = errors.New("not implemented")
 
+// ErrConnParamsRejected means the remote device rejected the connection parameters.
+var ErrConnParamsRejected = errors.New("connection parameters rejected")
+
 // ATTError is the error code of Attribute Protocol [Vol 3, Part F, 3.4.1.1].
 type ATTError byte
 
@@ -35,12 +38,14 @@ const (
 	ErrInsuffEnc         ATTError = 0x0f // ErrInsuffEnc means the attribute requires encryption before it can be read or written.
 	ErrUnsuppGrpType     ATTError = 0x10 // ErrUnsuppGrpType means the attribute type is not a supported grouping attribute as defined by a higher layer specification.
 	ErrInsuffResources   ATTError = 0x11 // ErrInsuffResources means insufficient resources to complete the request.
+	ErrValueNotAllowed   ATTError = 0x13 // ErrValueNotAllowed means the attribute parameter value was not allowed.
 )
 
 func (e ATTError) Error() string {
+	if s, ok := errName[e]; ok {
+		return s
+	}
 	switch i := int(e); {
-	case i < 0x11:
-		return errName[e]
 	case i >= 0x12 && i <= 0x7F: // Reserved for future use.
 		return fmt.Sprintf("reserved error code (0x%02X)", i)
 	case i >= 0x80 && i <= 0x9F: // Application error, defined by higher level.
@@ -72,4 +77,5 @@ var errName = map[ATTError]string{
 	ErrInsuffEnc:         "insufficient encryption",
 	ErrUnsuppGrpType:     "unsupported group type",
 	ErrInsuffResources:   "insufficient resources",
+	ErrValueNotAllowed:   "value not allowed",
 }
@@ -122,6 +122,15 @@ func Dial(ctx context.Context, a Addr) (Client, error) {
 	return defaultDevice.Dial(ctx, a)
 }
 
+// SyncPeriodic synchronizes to the periodic advertising of the advertising set
+// sid of the device a, and returns the channel of its reports.
+func SyncPeriodic(ctx context.Context, a Addr, sid int) (<-chan PeriodicReport, error) {
+	if defaultDevice == nil {
+		return nil, ErrDefaultDevice
+	}
+	return defaultDevice.SyncPeriodic(ctx, a, sid)
+}
+
 // Connect searches for and connects to a Peripheral which matches specified condition.
 func Connect(ctx context.Context, f AdvFilter) (Client, error) {
 	ctx2, cancel := context.WithCancel(ctx)
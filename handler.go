@@ -45,6 +45,20 @@ func (f NotifyHandlerFunc) ServeNotify(req Request, n Notifier) {
 	f(req, n)
 }
 
+// An AuthorizeHandler authorizes GATT requests to attributes which require authorization.
+type AuthorizeHandler interface {
+	// ServeAuthorize returns true if the read (or write, if write is true) request is authorized.
+	ServeAuthorize(req Request, write bool) bool
+}
+
+// AuthorizeHandlerFunc is an adapter to allow the use of ordinary functions as Handlers.
+type AuthorizeHandlerFunc func(req Request, write bool) bool
+
+// ServeAuthorize returns f(req, write).
+func (f AuthorizeHandlerFunc) ServeAuthorize(req Request, write bool) bool {
+	return f(req, write)
+}
+
 // Request ...
 type Request interface {
 	Conn() Conn
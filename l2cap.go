@@ -0,0 +1,74 @@
+package ble
+
+import (
+	"fmt"
+	"io"
+)
+
+// L2CAPChannel is an L2CAP connection-oriented channel [Vol 3, Part A, 3.4].
+// Each Write sends an SDU, and Read reads the data of the received SDUs.
+type L2CAPChannel interface {
+	io.ReadWriteCloser
+
+	// Conn returns the connection the channel is opened on.
+	Conn() Conn
+
+	// PSM returns the PSM the channel is connected to.
+	PSM() uint16
+
+	// RxMTU returns the MTU of the SDUs the local device can receive.
+	RxMTU() int
+
+	// TxMTU returns the MTU of the SDUs the remote device can receive.
+	TxMTU() int
+}
+
+// L2CAPListener accepts the L2CAP connection-oriented channels, which remote
+// devices open to a PSM of the local device [Vol 3, Part A, 10].
+type L2CAPListener interface {
+	// Accept waits for and returns the next channel opened to the PSM.
+	Accept() (L2CAPChannel, error)
+
+	// Close stops listening. The channels already accepted are not closed.
+	Close() error
+
+	// PSM returns the PSM the listener listens on.
+	PSM() uint16
+}
+
+// L2CAPError is the result of a failed L2CAP connection request [Vol 3, Part A, 4.23 & 4.26].
+type L2CAPError uint16
+
+// L2CAPError is the result of a failed L2CAP connection request [Vol 3, Part A, 4.23 & 4.26].
+const (
+	ErrL2CAPPSMNotSupported    L2CAPError = 0x0002 // LE_PSM not supported.
+	ErrL2CAPNoResources        L2CAPError = 0x0004 // No resources available.
+	ErrL2CAPAuthentication     L2CAPError = 0x0005 // Insufficient authentication.
+	ErrL2CAPAuthorization      L2CAPError = 0x0006 // Insufficient authorization.
+	ErrL2CAPEncKeySize         L2CAPError = 0x0007 // Insufficient encryption key size.
+	ErrL2CAPEncryption         L2CAPError = 0x0008 // Insufficient encryption.
+	ErrL2CAPInvalidSourceCID   L2CAPError = 0x0009 // Invalid Source CID.
+	ErrL2CAPSourceCIDAllocated L2CAPError = 0x000A // Source CID already allocated.
+	ErrL2CAPUnacceptableParams L2CAPError = 0x000B // Unacceptable parameters.
+	ErrL2CAPInvalidParams      L2CAPError = 0x000C // Invalid parameters.
+)
+
+var l2capErrName = map[L2CAPError]string{
+	ErrL2CAPPSMNotSupported:    "LE_PSM not supported",
+	ErrL2CAPNoResources:        "no resources available",
+	ErrL2CAPAuthentication:     "insufficient authentication",
+	ErrL2CAPAuthorization:      "insufficient authorization",
+	ErrL2CAPEncKeySize:         "insufficient encryption key size",
+	ErrL2CAPEncryption:         "insufficient encryption",
+	ErrL2CAPInvalidSourceCID:   "invalid source CID",
+	ErrL2CAPSourceCIDAllocated: "source CID already allocated",
+	ErrL2CAPUnacceptableParams: "unacceptable parameters",
+	ErrL2CAPInvalidParams:      "invalid parameters",
+}
+
+func (e L2CAPError) Error() string {
+	if s, ok := l2capErrName[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("L2CAP connection refused (0x%04X)", uint16(e))
+}
@@ -1,6 +1,10 @@
 package att
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/trustasia-com/ble"
+)
 
 var (
 	// ErrInvalidArgument means one or more of the arguments are invalid.
@@ -28,3 +32,29 @@ var rspOfReq = map[byte]byte{
 	ExecuteWriteRequestCode:    ExecuteWriteResponseCode,
 	HandleValueIndicationCode:  HandleValueConfirmationCode,
 }
+
+// The Authentication Signature of Signed Write Command follows the variable
+// length Attribute Value, which the generated accessors can't lay out.
+
+// AttributeValue ...
+func (r SignedWriteCommand) AttributeValue() []byte { return r[3 : len(r)-12] }
+
+// SetAttributeValue ...
+func (r SignedWriteCommand) SetAttributeValue(v []byte) { copy(r[3:len(r)-12], v) }
+
+// AuthenticationSignature ...
+func (r SignedWriteCommand) AuthenticationSignature() [12]byte {
+	b := [12]byte{}
+	copy(b[:], r[len(r)-12:])
+	return b
+}
+
+// SetAuthenticationSignature ...
+func (r SignedWriteCommand) SetAuthenticationSignature(v [12]byte) { copy(r[len(r)-12:], v[:]) }
+
+// signer is implemented by the connections which can sign data with the
+// Connection Signature Resolving Keys of a bond [Vol 3, Part H, 2.4.5].
+type signer interface {
+	SignData(m []byte) ([12]byte, error)
+	VerifySignedData(m []byte, sig [12]byte) (ble.SecurityLevel, error)
+}
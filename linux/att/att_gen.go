@@ -470,22 +470,6 @@ func (r SignedWriteCommand) AttributeHandle() uint16 { return binary.LittleEndia
 // SetAttributeHandle ...
 func (r SignedWriteCommand) SetAttributeHandle(v uint16) { binary.LittleEndian.PutUint16(r[1:], v) }
 
-// AttributeValue ...
-func (r SignedWriteCommand) AttributeValue() []byte { return r[3:] }
-
-// SetAttributeValue ...
-func (r SignedWriteCommand) SetAttributeValue(v []byte) { copy(r[3:], v) }
-
-// AuthenticationSignature ...
-func (r SignedWriteCommand) AuthenticationSignature() [12]byte {
-	b := [12]byte{}
-	copy(b[:], r[3:])
-	return b
-}
-
-// SetAuthenticationSignature ...
-func (r SignedWriteCommand) SetAuthenticationSignature(v [12]byte) { copy(r[3:3+12], v[:]) }
-
 // PrepareWriteRequestCode ...
 const PrepareWriteRequestCode = 0x16
 
@@ -11,4 +11,12 @@ type attr struct {
 	v  []byte
 	rh ble.ReadHandler
 	wh ble.WriteHandler
+
+	// Security required to access the attribute.
+	perm       ble.Permission
+	minKeySize int
+	ah         ble.AuthorizeHandler
+
+	// signed is set if the attribute accepts Signed Write Commands.
+	signed bool
 }
@@ -0,0 +1,47 @@
+package att
+
+import (
+	"github.com/trustasia-com/ble"
+)
+
+// EATTPSM is the LE_PSM of the Enhanced ATT bearers [Assigned Numbers, 5.4].
+const EATTPSM = 0x0027
+
+// NewEnhancedBearer returns an Enhanced ATT bearer on the L2CAP channel, which
+// is opened on l2c in the Enhanced Credit Based Flow Control Mode [Vol 3, Part F, 3.2.11].
+// The Client and the Server run on the bearer as they do on l2c, while
+// the ATT_MTU is the smaller of the MTUs of the channel [Vol 3, Part F, 3.2.8].
+func NewEnhancedBearer(l2c ble.Conn, ch ble.L2CAPChannel) ble.Conn {
+	return &enhancedBearer{Conn: l2c, ch: ch}
+}
+
+type enhancedBearer struct {
+	ble.Conn
+	ch ble.L2CAPChannel
+}
+
+func (b *enhancedBearer) Read(p []byte) (int, error)  { return b.ch.Read(p) }
+func (b *enhancedBearer) Write(p []byte) (int, error) { return b.ch.Write(p) }
+func (b *enhancedBearer) Close() error                { return b.ch.Close() }
+
+// RxMTU returns the MTU of the channel, which is large enough for any PDU
+// the remote device sends, even after it reconfigures the channel.
+func (b *enhancedBearer) RxMTU() int { return b.ch.RxMTU() }
+
+// TxMTU returns the ATT_MTU of the bearer.
+func (b *enhancedBearer) TxMTU() int {
+	if b.ch.RxMTU() < b.ch.TxMTU() {
+		return b.ch.RxMTU()
+	}
+	return b.ch.TxMTU()
+}
+
+// The MTU of an enhanced bearer is set by L2CAP, and can't be exchanged.
+func (b *enhancedBearer) SetRxMTU(mtu int) {}
+func (b *enhancedBearer) SetTxMTU(mtu int) {}
+
+// isEnhanced reports if l2c is an Enhanced ATT bearer.
+func isEnhanced(l2c ble.Conn) bool {
+	_, ok := l2c.(*enhancedBearer)
+	return ok
+}
@@ -0,0 +1,63 @@
+package att
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/trustasia-com/ble"
+)
+
+// testChannel is an L2CAP channel, which records the SDUs written to it.
+type testChannel struct {
+	ble.L2CAPChannel
+	rxMTU, txMTU int
+	tx           [][]byte
+	closed       bool
+}
+
+func (ch *testChannel) RxMTU() int { return ch.rxMTU }
+func (ch *testChannel) TxMTU() int { return ch.txMTU }
+func (ch *testChannel) Close() error {
+	ch.closed = true
+	return nil
+}
+
+func (ch *testChannel) Write(b []byte) (int, error) {
+	ch.tx = append(ch.tx, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestEnhancedBearer(t *testing.T) {
+	l2c := &testConn{level: ble.SecurityUnauthenticated, keySize: 16}
+	ch := &testChannel{rxMTU: 512, txMTU: 247}
+	b := NewEnhancedBearer(l2c, ch)
+	if !isEnhanced(b) || isEnhanced(l2c) {
+		t.Fatal("isEnhanced doesn't tell the bearers apart")
+	}
+
+	// The ATT_MTU is the smaller MTU of the channel, while the whole MTU of
+	// the channel is received. Exchanging the MTU doesn't change them.
+	b.SetRxMTU(23)
+	b.SetTxMTU(23)
+	if b.TxMTU() != 247 || b.RxMTU() != 512 {
+		t.Errorf("TxMTU, RxMTU = %d, %d, want 247, 512", b.TxMTU(), b.RxMTU())
+	}
+	ch.txMTU = 1024
+	if b.TxMTU() != 512 {
+		t.Errorf("TxMTU = %d, want 512", b.TxMTU())
+	}
+
+	// The PDUs go to the channel, while the link is still used otherwise.
+	if _, err := b.Write([]byte{ReadRequestCode, 0x03, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.tx) != 1 || !bytes.Equal(ch.tx[0], []byte{ReadRequestCode, 0x03, 0x00}) {
+		t.Errorf("written to channel %X", ch.tx)
+	}
+	if b.SecurityLevel() != ble.SecurityUnauthenticated || b.KeySize() != 16 {
+		t.Errorf("security of the bearer isn't the link's")
+	}
+	if err := b.Close(); err != nil || !ch.closed {
+		t.Errorf("Close() = %v, channel closed %v", err, ch.closed)
+	}
+}
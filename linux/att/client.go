@@ -23,6 +23,9 @@ type Client struct {
 	chTxBuf chan []byte
 	chErr   chan error
 	handler NotificationHandler
+
+	// done is closed once the bearer is closed.
+	done chan struct{}
 }
 
 // NewClient returns an Attribute Protocol Client.
@@ -31,9 +34,10 @@ func NewClient(l2c ble.Conn, h NotificationHandler) *Client {
 		l2c:     l2c,
 		rspc:    make(chan []byte),
 		chTxBuf: make(chan []byte, 1),
-		rxBuf:   make([]byte, ble.MaxMTU),
+		rxBuf:   make([]byte, maxInt(ble.MaxMTU, l2c.RxMTU())),
 		chErr:   make(chan error, 1),
 		handler: h,
+		done:    make(chan struct{}),
 	}
 	c.chTxBuf <- make([]byte, l2c.TxMTU(), l2c.TxMTU())
 	return c
@@ -42,7 +46,7 @@ func NewClient(l2c ble.Conn, h NotificationHandler) *Client {
 // ExchangeMTU informs the server of the client’s maximum receive MTU size and
 // request the server to respond with its maximum receive MTU size. [Vol 3, Part F, 3.4.2.1]
 func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
-	if clientRxMTU < ble.DefaultMTU || clientRxMTU > ble.MaxMTU {
+	if clientRxMTU < ble.DefaultMTU || clientRxMTU > ble.MaxMTU || isEnhanced(c.l2c) {
 		return 0, ErrInvalidArgument
 	}
 
@@ -89,6 +93,11 @@ func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
 	return txMTU, nil
 }
 
+// TxMTU returns the ATT_MTU of the bearer, which limits the size of the PDUs.
+func (c *Client) TxMTU() int {
+	return c.l2c.TxMTU()
+}
+
 // FindInformation obtains the mapping of attribute handles with their associated types.
 // This allows a Client to discover the list of attributes and their types on a server.
 // [Vol 3, Part F, 3.4.3.1 & 3.4.3.2]
@@ -405,6 +414,36 @@ func (c *Client) SignedWrite(handle uint16, value []byte, signature [12]byte) er
 	return c.sendCmd(req)
 }
 
+// WriteSigned is like SignedWrite, but signs the command with the CSRK the
+// local device has distributed to the server during bonding. [Vol 3, Part F, 3.4.5.4]
+func (c *Client) WriteSigned(handle uint16, value []byte) error {
+	if len(value) > c.l2c.TxMTU()-15 {
+		return ErrInvalidArgument
+	}
+	sc, ok := c.l2c.(signer)
+	if !ok {
+		return ble.ErrNotImplemented
+	}
+
+	// Acquire and reuse the txBuf, and release it after usage.
+	txBuf := <-c.chTxBuf
+	defer func() { c.chTxBuf <- txBuf }()
+
+	req := SignedWriteCommand(txBuf[:15+len(value)])
+	req.SetAttributeOpcode()
+	req.SetAttributeHandle(handle)
+	req.SetAttributeValue(value)
+
+	// The signature covers the opcode, the handle and the value.
+	sig, err := sc.SignData(req[:len(req)-12])
+	if err != nil {
+		return errors.Wrap(err, "can't sign command")
+	}
+	req.SetAuthenticationSignature(sig)
+
+	return c.sendCmd(req)
+}
+
 // PrepareWrite requests the server to prepare to write the value of an attribute.
 // The server will respond to this request with a Prepare Write Response, so that
 // the Client can verify that the value was received correctly.
@@ -508,6 +547,12 @@ func (c *Client) sendReq(b []byte) (rsp []byte, err error) {
 	}
 }
 
+// Closed returns a channel, which is closed once the bearer is closed, and
+// Loop returns.
+func (c *Client) Closed() <-chan struct{} {
+	return c.done
+}
+
 // Loop ...
 func (c *Client) Loop() {
 
@@ -531,6 +576,7 @@ func (c *Client) Loop() {
 		if err != nil {
 			// We don't expect any error from the bearer (L2CAP ACL-U)
 			// Pass it along to the pending request, if any, and escape.
+			close(c.done)
 			c.chErr <- err
 			return
 		}
@@ -592,6 +638,11 @@ func (c *Client) handleRequest(b []byte) {
 // ExchangeMTU informs the server of the client’s maximum receive MTU size and
 // request the server to respond with its maximum receive MTU size. [Vol 3, Part F, 3.4.2.1]
 func (c *Client) handleExchangeMTURequest(r ExchangeMTURequest) []byte {
+	// The request isn't allowed on an enhanced bearer. [Vol 3, Part F, 3.4.2.1]
+	if isEnhanced(c.l2c) {
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrReqNotSupp)
+	}
+
 	// Acquire and reuse the txBuf, and release it after usage.
 	// The same txBuf, or a newly allocate one, if the txMTU is changed,
 	// will be released back to the channel.
@@ -88,7 +88,7 @@ func genSvcAttr(s *ble.Service, h uint16) (uint16, []*attr) {
 	var aa []*attr
 
 	for _, c := range s.Characteristics {
-		h, aa = genCharAttr(c, h)
+		h, aa = genCharAttr(s, c, h)
 		attrs = append(attrs, aa...)
 	}
 
@@ -96,7 +96,7 @@ func genSvcAttr(s *ble.Service, h uint16) (uint16, []*attr) {
 	return h, attrs
 }
 
-func genCharAttr(c *ble.Characteristic, h uint16) (uint16, []*attr) {
+func genCharAttr(s *ble.Service, c *ble.Characteristic, h uint16) (uint16, []*attr) {
 	vh := h + 1
 
 	a := &attr{
@@ -111,12 +111,18 @@ func genCharAttr(c *ble.Characteristic, h uint16) (uint16, []*attr) {
 		v:   c.Value,
 		rh:  c.ReadHandler,
 		wh:  c.WriteHandler,
+
+		perm:       s.Permission | c.Permission,
+		minKeySize: maxInt(s.MinKeySize, c.MinKeySize),
+		ah:         c.AuthorizeHandler,
+
+		signed: c.Property&ble.CharSignedWrite != 0,
 	}
 
 	c.Handle = h
 	c.ValueHandle = vh
 	if c.NotifyHandler != nil || c.IndicateHandler != nil {
-		c.CCCD = newCCCD(c)
+		c.CCCD = newCCCD(c, va)
 		c.Descriptors = append(c.Descriptors, c.CCCD)
 	}
 
@@ -139,9 +145,20 @@ func genDescAttr(d *ble.Descriptor, h uint16) *attr {
 		v:   d.Value,
 		rh:  d.ReadHandler,
 		wh:  d.WriteHandler,
+
+		perm:       d.Permission,
+		minKeySize: d.MinKeySize,
+		ah:         d.AuthorizeHandler,
 	}
 }
 
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 // DumpAttributes ...
 func DumpAttributes(aa []*attr) {
 	logger.Debug("server", "db", "Generating attribute table:")
@@ -160,9 +177,19 @@ const (
 	cccIndicate = 0x0002
 )
 
-func newCCCD(c *ble.Characteristic) *ble.Descriptor {
+func newCCCD(c *ble.Characteristic, va *attr) *ble.Descriptor {
 	d := ble.NewDescriptor(ble.ClientCharacteristicConfigUUID)
 
+	// Notifications and indications disclose the value, so subscribing
+	// requires the same security as reading it.
+	if va.perm&ble.PermReadEncrypted != 0 {
+		d.Permission |= ble.PermWriteEncrypted
+	}
+	if va.perm&ble.PermReadAuthenticated != 0 {
+		d.Permission |= ble.PermWriteAuthenticated
+	}
+	d.MinKeySize = va.minKeySize
+
 	d.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
 		cccs := req.Conn().(*conn).cccs
 		ccc := cccs[c.Handle]
@@ -184,7 +211,7 @@ func newCCCD(c *ble.Characteristic) *ble.Descriptor {
 				rsp.SetStatus(ble.ErrUnlikely)
 				return
 			}
-			send := func(b []byte) (int, error) { return cn.svr.notify(c.ValueHandle, b) }
+			send := func(b []byte) (int, error) { return cn.svr.notify(va, b) }
 			cn.nn[c.Handle] = ble.NewNotifier(send)
 			go c.NotifyHandler.ServeNotify(req, cn.nn[c.Handle])
 		}
@@ -197,7 +224,7 @@ func newCCCD(c *ble.Characteristic) *ble.Descriptor {
 				rsp.SetStatus(ble.ErrUnlikely)
 				return
 			}
-			send := func(b []byte) (int, error) { return cn.svr.indicate(c.ValueHandle, b) }
+			send := func(b []byte) (int, error) { return cn.svr.indicate(va, b) }
 			cn.in[c.Handle] = ble.NewNotifier(send)
 			go c.IndicateHandler.ServeNotify(req, cn.in[c.Handle])
 		}
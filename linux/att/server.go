@@ -41,12 +41,17 @@ type Server struct {
 // NewServer returns an ATT (Attribute Protocol) server.
 func NewServer(db *DB, l2c ble.Conn) (*Server, error) {
 	mtu := l2c.RxMTU()
-	if mtu < ble.DefaultMTU || mtu > ble.MaxMTU {
+	if mtu < ble.DefaultMTU || (mtu > ble.MaxMTU && !isEnhanced(l2c)) {
 		return nil, fmt.Errorf("invalid MTU")
 	}
 	// Although the rxBuf is initialized with the capacity of rxMTU, it is
 	// not discovered, and only the default ATT_MTU (23 bytes) of it shall
-	// be used until remote central request ExchangeMTU.
+	// be used until remote central request ExchangeMTU. The ATT_MTU of an
+	// enhanced bearer is known once the bearer is established.
+	txMTU := ble.DefaultMTU
+	if isEnhanced(l2c) {
+		txMTU = l2c.TxMTU()
+	}
 	s := &Server{
 		conn: &conn{
 			Conn: l2c,
@@ -57,7 +62,7 @@ func NewServer(db *DB, l2c ble.Conn) (*Server, error) {
 		db: db,
 
 		rxMTU:     mtu,
-		txBuf:     make([]byte, ble.DefaultMTU, ble.DefaultMTU),
+		txBuf:     make([]byte, txMTU, txMTU),
 		chNotBuf:  make(chan []byte, 1),
 		chIndBuf:  make(chan []byte, 1),
 		chConfirm: make(chan bool),
@@ -65,20 +70,23 @@ func NewServer(db *DB, l2c ble.Conn) (*Server, error) {
 		dummyRspWriter: ble.NewResponseWriter(nil),
 	}
 	s.conn.svr = s
-	s.chNotBuf <- make([]byte, ble.DefaultMTU, ble.DefaultMTU)
-	s.chIndBuf <- make([]byte, ble.DefaultMTU, ble.DefaultMTU)
+	s.chNotBuf <- make([]byte, txMTU, txMTU)
+	s.chIndBuf <- make([]byte, txMTU, txMTU)
 	return s, nil
 }
 
 // notify sends notification to remote central.
-func (s *Server) notify(h uint16, data []byte) (int, error) {
+func (s *Server) notify(a *attr, data []byte) (int, error) {
+	if e := s.checkSecurity(a, false, s.conn.SecurityLevel(), s.conn.KeySize()); e != ble.ErrSuccess {
+		return 0, e
+	}
 	// Acquire and reuse notifyBuffer. Release it after usage.
 	nBuf := <-s.chNotBuf
 	defer func() { s.chNotBuf <- nBuf }()
 
 	rsp := HandleValueNotification(nBuf)
 	rsp.SetAttributeOpcode()
-	rsp.SetAttributeHandle(h)
+	rsp.SetAttributeHandle(a.h)
 	buf := bytes.NewBuffer(rsp.AttributeValue())
 	buf.Reset()
 	if len(data) > buf.Cap() {
@@ -89,14 +97,17 @@ func (s *Server) notify(h uint16, data []byte) (int, error) {
 }
 
 // indicate sends indication to remote central.
-func (s *Server) indicate(h uint16, data []byte) (int, error) {
+func (s *Server) indicate(a *attr, data []byte) (int, error) {
+	if e := s.checkSecurity(a, false, s.conn.SecurityLevel(), s.conn.KeySize()); e != ble.ErrSuccess {
+		return 0, e
+	}
 	// Acquire and reuse indicateBuffer. Release it after usage.
 	iBuf := <-s.chIndBuf
 	defer func() { s.chIndBuf <- iBuf }()
 
 	rsp := HandleValueIndication(iBuf)
 	rsp.SetAttributeOpcode()
-	rsp.SetAttributeHandle(h)
+	rsp.SetAttributeHandle(a.h)
 	buf := bytes.NewBuffer(rsp.AttributeValue())
 	buf.Reset()
 	if len(data) > buf.Cap() {
@@ -195,12 +206,13 @@ func (s *Server) handleRequest(b []byte) []byte {
 		resp = s.handleWriteRequest(b)
 	case WriteCommandCode:
 		s.handleWriteCommand(b)
+	case SignedWriteCommandCode:
+		s.handleSignedWriteCommand(b)
 	case PrepareWriteRequestCode:
 		resp = s.handlePrepareWriteRequest(b)
 	case ExecuteWriteRequestCode:
 		resp = s.handleExecuteWriteRequest(b)
-	case ReadMultipleRequestCode,
-		SignedWriteCommandCode:
+	case ReadMultipleRequestCode:
 		fallthrough
 	default:
 		resp = newErrorResponse(reqType, 0x0000, ble.ErrReqNotSupp)
@@ -211,6 +223,11 @@ func (s *Server) handleRequest(b []byte) []byte {
 
 // handle MTU Exchange request. [Vol 3, Part F, 3.4.2]
 func (s *Server) handleExchangeMTURequest(r ExchangeMTURequest) []byte {
+	// The request isn't allowed on an enhanced bearer. [Vol 3, Part F, 3.4.2.1]
+	if isEnhanced(s.conn.Conn) {
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrReqNotSupp)
+	}
+
 	// Validate the request.
 	switch {
 	case len(r) != 3:
@@ -355,6 +372,13 @@ func (s *Server) handleReadByTypeRequest(r ReadByTypeRequest) []byte {
 		if !a.typ.Equal(ble.UUID(r.AttributeType())) {
 			continue
 		}
+		if e := s.checkPerm(a, false, nil); e != ble.ErrSuccess {
+			// Return if the first value read cause an error.
+			if dlen == 0 {
+				return newErrorResponse(r.AttributeOpcode(), a.h, e)
+			}
+			break
+		}
 		v := a.v
 		if v == nil {
 			buf2 := bytes.NewBuffer(make([]byte, 0, len(s.txBuf)-2))
@@ -412,7 +436,11 @@ func (s *Server) handleReadRequest(r ReadRequest) []byte {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrInvalidHandle)
 	}
 
-	// Simple case. Read-only, no-authorization, no-authentication.
+	if e := s.checkPerm(a, false, nil); e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
+	}
+
+	// Simple case. Static value.
 	if a.v != nil {
 		binary.Write(buf, binary.LittleEndian, a.v)
 		return rsp[:1+buf.Len()]
@@ -444,7 +472,11 @@ func (s *Server) handleReadBlobRequest(r ReadBlobRequest) []byte {
 	buf := bytes.NewBuffer(rsp.PartAttributeValue())
 	buf.Reset()
 
-	// Simple case. Read-only, no-authorization, no-authentication.
+	if e := s.checkPerm(a, false, nil); e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
+	}
+
+	// Simple case. Static value.
 	if a.v != nil {
 		binary.Write(buf, binary.LittleEndian, a.v)
 		return rsp[:1+buf.Len()]
@@ -526,6 +558,9 @@ func (s *Server) handleWriteRequest(r WriteRequest) []byte {
 	if a == nil {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrWriteNotPerm)
 	}
+	if e := s.checkPerm(a, true, r.AttributeValue()); e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
+	}
 	if e := handleATT(a, s, r, ble.NewResponseWriter(nil)); e != ble.ErrSuccess {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
 	}
@@ -549,6 +584,9 @@ func (s *Server) handlePrepareWriteRequest(r PrepareWriteRequest) []byte {
 	if a == nil {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrWriteNotPerm)
 	}
+	if e := s.checkPerm(a, true, r.PartAttributeValue()); e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
+	}
 
 	if e := handleATT(a, s, r, ble.NewResponseWriter(nil)); e != ble.ErrSuccess {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
@@ -599,12 +637,96 @@ func (s *Server) handleWriteCommand(r WriteCommand) []byte {
 	if a == nil {
 		return nil
 	}
+	if e := s.checkPerm(a, true, r.AttributeValue()); e != ble.ErrSuccess {
+		return nil
+	}
 	if e := handleATT(a, s, r, s.dummyRspWriter); e != ble.ErrSuccess {
 		return nil
 	}
 	return nil
 }
 
+// handle Signed Write command. [Vol 3, Part F, 3.4.5.4]
+func (s *Server) handleSignedWriteCommand(r SignedWriteCommand) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 15:
+		return nil
+	}
+
+	a, ok := s.db.at(r.AttributeHandle())
+	if !ok || a == nil || !a.signed {
+		return nil
+	}
+
+	// On an encrypted link, the command is handled as a Write Command, as the
+	// client shall have used one instead [Vol 3, Part C, 10.4.1].
+	level, keySize := s.conn.SecurityLevel(), s.conn.KeySize()
+	if level < ble.SecurityUnauthenticated {
+		sc, ok := s.conn.Conn.(signer)
+		if !ok {
+			return nil
+		}
+		var err error
+		level, err = sc.VerifySignedData(r[:len(r)-12], r.AuthenticationSignature())
+		if err != nil {
+			logger.Debug("server", "signed write", err)
+			return nil
+		}
+		// The key size only applies to the encryption of the link.
+		keySize = a.minKeySize
+	}
+	if e := s.checkAccess(a, true, r.AttributeValue(), level, keySize); e != ble.ErrSuccess {
+		return nil
+	}
+	if a.wh == nil {
+		return nil
+	}
+	a.wh.ServeWrite(ble.NewRequest(s.conn, r.AttributeValue(), 0), s.dummyRspWriter)
+	return nil
+}
+
+// checkPerm checks the security of the link against the permissions of the
+// attribute [Vol 3, Part C, 10.3.1].
+func (s *Server) checkPerm(a *attr, write bool, data []byte) ble.ATTError {
+	return s.checkAccess(a, write, data, s.conn.SecurityLevel(), s.conn.KeySize())
+}
+
+// checkAccess checks the security level and the key size, with which the
+// request is protected, against the permissions of the attribute.
+func (s *Server) checkAccess(a *attr, write bool, data []byte, level ble.SecurityLevel, keySize int) ble.ATTError {
+	if e := s.checkSecurity(a, write, level, keySize); e != ble.ErrSuccess {
+		return e
+	}
+	if a.perm&ble.PermAuthorized != 0 {
+		if a.ah == nil || !a.ah.ServeAuthorize(ble.NewRequest(s.conn, data, 0), write) {
+			return ble.ErrAuthorization
+		}
+	}
+	return ble.ErrSuccess
+}
+
+// checkSecurity checks the security level and the key size against the
+// permissions of the attribute, which also apply to the notifications and
+// indications of its value.
+func (s *Server) checkSecurity(a *attr, write bool, level ble.SecurityLevel, keySize int) ble.ATTError {
+	enc, auth := ble.PermReadEncrypted, ble.PermReadAuthenticated
+	if write {
+		enc, auth = ble.PermWriteEncrypted, ble.PermWriteAuthenticated
+	}
+	if a.perm&(enc|auth) != 0 {
+		switch {
+		case a.perm&auth != 0 && level < ble.SecurityAuthenticated:
+			return ble.ErrAuthentication
+		case level < ble.SecurityUnauthenticated:
+			return ble.ErrInsuffEnc
+		case keySize < a.minKeySize:
+			return ble.ErrInsuffEncrKeySize
+		}
+	}
+	return ble.ErrSuccess
+}
+
 func newErrorResponse(op byte, h uint16, s ble.ATTError) []byte {
 	r := ErrorResponse(make([]byte, 5))
 	r.SetAttributeOpcode()
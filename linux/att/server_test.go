@@ -0,0 +1,138 @@
+package att
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/trustasia-com/ble"
+)
+
+// testConn is a link with a fixed security level.
+type testConn struct {
+	ble.Conn
+	level   ble.SecurityLevel
+	keySize int
+}
+
+func (c *testConn) RxMTU() int                       { return ble.DefaultMTU }
+func (c *testConn) SecurityLevel() ble.SecurityLevel { return c.level }
+func (c *testConn) KeySize() int                     { return c.keySize }
+
+func TestCheckAccess(t *testing.T) {
+	read := ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {})
+	write := ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {})
+	notify := ble.NotifyHandlerFunc(func(req ble.Request, n ble.Notifier) {})
+
+	s := ble.NewService(ble.UUID16(0x1800))
+	s.Permission = ble.PermWriteEncrypted
+
+	plain := s.NewCharacteristic(ble.UUID16(0x2A00))
+	plain.HandleRead(read)
+	plain.HandleWrite(write)
+	plain.HandleNotify(notify)
+
+	enc := s.NewCharacteristic(ble.UUID16(0x2A01))
+	enc.Permission = ble.PermReadEncrypted
+	enc.MinKeySize = 16
+	enc.HandleRead(read)
+	enc.HandleWrite(write)
+	enc.HandleNotify(notify)
+
+	auth := s.NewCharacteristic(ble.UUID16(0x2A02))
+	auth.Permission = ble.PermReadAuthenticated | ble.PermWriteAuthenticated
+	auth.HandleRead(read)
+	auth.HandleWrite(write)
+
+	writeOnly := s.NewCharacteristic(ble.UUID16(0x2A03))
+	writeOnly.HandleWrite(write)
+	readOnly := s.NewCharacteristic(ble.UUID16(0x2A04))
+	readOnly.HandleRead(read)
+
+	authorized := s.NewCharacteristic(ble.UUID16(0x2A05))
+	authorized.HandleRead(read)
+	authorized.HandleAuthorize(ble.AuthorizeHandlerFunc(func(req ble.Request, write bool) bool {
+		return !write
+	}))
+
+	// The user description precedes the CCCD, which is added by NewDB.
+	user := plain.NewDescriptor(ble.UUID16(0x2901))
+	user.HandleRead(read)
+	user.HandleWrite(write)
+
+	db := NewDB([]*ble.Service{s}, 1)
+	readReq := func(h uint16) []byte {
+		return []byte{ReadRequestCode, byte(h), byte(h >> 8)}
+	}
+	writeReq := func(h uint16) []byte {
+		return []byte{WriteRequestCode, byte(h), byte(h >> 8), 0x01, 0x00}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		req     []byte
+		level   ble.SecurityLevel
+		keySize int
+		want    ble.ATTError
+	}{
+		{"read plain", readReq(plain.ValueHandle), ble.SecurityNone, 0, ble.ErrSuccess},
+		{"write plain, encrypted service", writeReq(plain.ValueHandle), ble.SecurityNone, 0, ble.ErrInsuffEnc},
+		{"write plain, encrypted", writeReq(plain.ValueHandle), ble.SecurityUnauthenticated, 16, ble.ErrSuccess},
+		{"subscribe plain", writeReq(plain.ValueHandle + 2), ble.SecurityNone, 0, ble.ErrSuccess},
+		{"write user descriptor", writeReq(plain.ValueHandle + 1), ble.SecurityNone, 0, ble.ErrSuccess},
+		{"read encrypted", readReq(enc.ValueHandle), ble.SecurityNone, 0, ble.ErrInsuffEnc},
+		{"read encrypted, short key", readReq(enc.ValueHandle), ble.SecurityUnauthenticated, 7, ble.ErrInsuffEncrKeySize},
+		{"read encrypted, encrypted", readReq(enc.ValueHandle), ble.SecurityUnauthenticated, 16, ble.ErrSuccess},
+		{"subscribe encrypted", writeReq(enc.ValueHandle + 1), ble.SecurityNone, 0, ble.ErrInsuffEnc},
+		{"subscribe encrypted, short key", writeReq(enc.ValueHandle + 1), ble.SecurityUnauthenticated, 7, ble.ErrInsuffEncrKeySize},
+		{"subscribe encrypted, encrypted", writeReq(enc.ValueHandle + 1), ble.SecurityUnauthenticated, 16, ble.ErrSuccess},
+		{"read authenticated", readReq(auth.ValueHandle), ble.SecurityNone, 0, ble.ErrAuthentication},
+		{"read authenticated, unauthenticated", readReq(auth.ValueHandle), ble.SecurityUnauthenticated, 16, ble.ErrAuthentication},
+		{"read authenticated, authenticated", readReq(auth.ValueHandle), ble.SecurityAuthenticated, 16, ble.ErrSuccess},
+		{"write authenticated, unauthenticated", writeReq(auth.ValueHandle), ble.SecurityUnauthenticated, 16, ble.ErrAuthentication},
+		{"write authenticated, SC", writeReq(auth.ValueHandle), ble.SecuritySC, 16, ble.ErrSuccess},
+		{"read write-only", readReq(writeOnly.ValueHandle), ble.SecuritySC, 16, ble.ErrReadNotPerm},
+		{"write read-only", writeReq(readOnly.ValueHandle), ble.SecuritySC, 16, ble.ErrWriteNotPerm},
+		{"read authorized", readReq(authorized.ValueHandle), ble.SecurityNone, 0, ble.ErrSuccess},
+		{"write unauthorized", writeReq(authorized.ValueHandle), ble.SecuritySC, 16, ble.ErrAuthorization},
+	} {
+		s, err := NewServer(db, &testConn{level: tc.level, keySize: tc.keySize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp := s.handleRequest(tc.req)
+		got := ble.ErrSuccess
+		if rsp[0] == ErrorResponseCode {
+			got = ble.ATTError(rsp[4])
+			if h := binary.LittleEndian.Uint16(rsp[2:]); h != binary.LittleEndian.Uint16(tc.req[1:]) {
+				t.Errorf("%s: error on handle 0x%04X", tc.name, h)
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNotifySecurity(t *testing.T) {
+	a := &attr{h: 0x0003, perm: ble.PermReadAuthenticated, minKeySize: 16}
+	for _, tc := range []struct {
+		level   ble.SecurityLevel
+		keySize int
+		want    error
+	}{
+		{ble.SecurityNone, 0, ble.ErrAuthentication},
+		{ble.SecurityUnauthenticated, 16, ble.ErrAuthentication},
+		{ble.SecurityAuthenticated, 7, ble.ErrInsuffEncrKeySize},
+	} {
+		s, err := NewServer(NewDB(nil, 1), &testConn{level: tc.level, keySize: tc.keySize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.notify(a, []byte{0x01}); err != tc.want {
+			t.Errorf("notify at %v, %d: got %v, want %v", tc.level, tc.keySize, err, tc.want)
+		}
+		if _, err := s.indicate(a, []byte{0x01}); err != tc.want {
+			t.Errorf("indicate at %v, %d: got %v, want %v", tc.level, tc.keySize, err, tc.want)
+		}
+	}
+}
@@ -47,6 +47,17 @@ func NewDeviceWithNameAndHandler(name string, handler ble.NotifyHandler, opts ..
 
 	go loop(dev, srv, mtu)
 
+	// Accept the Enhanced ATT bearers, if enabled, and report them in the
+	// Server Supported Features.
+	if dev.EnhancedATT() {
+		if l, err := dev.ListenL2CAP(att.EATTPSM); err != nil {
+			log.Printf("can't listen for enhanced ATT bearers: %s", err)
+		} else {
+			srv.EnableEATT()
+			go loopEATT(l, srv)
+		}
+	}
+
 	return &Device{HCI: dev, Server: srv}, nil
 }
 
@@ -78,6 +89,25 @@ func loop(dev *hci.HCI, s *gatt.Server, mtu int) {
 	}
 }
 
+// loopEATT runs an ATT server on each Enhanced ATT bearer.
+func loopEATT(l ble.L2CAPListener, s *gatt.Server) {
+	for {
+		ch, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		as, err := att.NewServer(s.DB(), att.NewEnhancedBearer(ch.Conn(), ch))
+		s.Unlock()
+		if err != nil {
+			log.Printf("can't create ATT server: %s", err)
+			ch.Close()
+			continue
+		}
+		go as.Loop()
+	}
+}
+
 // Device ...
 type Device struct {
 	HCI    *hci.HCI
@@ -100,6 +130,17 @@ func (d *Device) SetServices(svcs []*ble.Service) error {
 	return d.Server.SetServices(svcs)
 }
 
+// NewAdvertisingSet creates an extended advertising set, which advertises
+// with its own data, parameters and address alongside the other sets.
+func (d *Device) NewAdvertisingSet(p hci.AdvertisingSetParams) (*hci.AdvertisingSet, error) {
+	return d.HCI.NewAdvertisingSet(p)
+}
+
+// ClearAdvertisingSets stops advertising, and removes all the advertising sets.
+func (d *Device) ClearAdvertisingSets() error {
+	return d.HCI.ClearAdvertisingSets()
+}
+
 // Stop stops gatt server.
 func (d *Device) Stop() error {
 	return d.HCI.Close()
@@ -169,17 +210,27 @@ func (d *Device) AdvertiseIBeacon(ctx context.Context, u ble.UUID, major, minor
 
 // Scan starts scanning. Duplicated advertisements will be filtered out if allowDup is set to false.
 func (d *Device) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
-	if err := d.HCI.SetAdvHandler(h); err != nil {
-		return err
-	}
-	if err := d.HCI.Scan(allowDup); err != nil {
+	if err := d.StartScan(allowDup, h); err != nil {
 		return err
 	}
 	<-ctx.Done()
-	d.HCI.StopScanning()
+	d.StopScan()
 	return ctx.Err()
 }
 
+// StartScan starts scanning, which goes on until StopScan is called.
+func (d *Device) StartScan(allowDup bool, h ble.AdvHandler) error {
+	if err := d.HCI.SetAdvHandler(h); err != nil {
+		return err
+	}
+	return d.HCI.Scan(allowDup)
+}
+
+// StopScan stops scanning.
+func (d *Device) StopScan() error {
+	return d.HCI.StopScanning()
+}
+
 // Dial ...
 func (d *Device) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	// d.HCI.Dial is a blocking call, although most of time it should return immediately.
@@ -188,6 +239,21 @@ func (d *Device) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	return cln, errors.Wrap(err, "can't dial")
 }
 
+// ListenL2CAP listens on the PSM for the L2CAP connection-oriented channels
+// opened by remote devices. If psm is zero, a dynamic PSM is allocated.
+func (d *Device) ListenL2CAP(psm uint16) (ble.L2CAPListener, error) {
+	return d.HCI.ListenL2CAP(psm)
+}
+
+// SyncPeriodic synchronizes to the periodic advertising of the advertising set
+// sid of the device a, and returns the channel of its reports. The device must
+// be scanning with the extended scanning, until the synchronization is
+// established.
+func (d *Device) SyncPeriodic(ctx context.Context, a ble.Addr, sid int) (<-chan ble.PeriodicReport, error) {
+	ch, err := d.HCI.SyncPeriodic(ctx, a, sid)
+	return ch, errors.Wrap(err, "can't sync periodic advertising")
+}
+
 // Address returns the listener's device address.
 func (d *Device) Address() ble.Addr {
 	return d.HCI.Addr()
@@ -2,6 +2,7 @@ package gatt
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -15,14 +16,25 @@ const (
 	cccIndicate = 0x0002
 )
 
+// Client Supported Features [Vol 3, Part G, 7.2].
+const clientFeatureEATT = 0x02
+
+// maxEATTBearers is the maximum number of Enhanced ATT bearers of a client.
+const maxEATTBearers = 5
+
+// ErrEATTNotSupported means the server doesn't support Enhanced ATT bearers.
+var ErrEATTNotSupported = errors.New("enhanced ATT bearers not supported")
+
 // NewClient returns a GATT Client.
 func NewClient(conn ble.Conn) (*Client, error) {
 	p := &Client{
-		subs: make(map[uint16]*sub),
-		conn: conn,
+		subs:      make(map[uint16]*sub),
+		conn:      conn,
+		chBearers: make(chan *att.Client, 1+maxEATTBearers),
 	}
 	p.ac = att.NewClient(conn, p)
 	go p.ac.Loop()
+	p.chBearers <- p.ac
 	return p, nil
 }
 
@@ -36,6 +48,11 @@ type Client struct {
 
 	ac   *att.Client
 	conn ble.Conn
+
+	// chBearers holds the idle ATT bearers, including ac and the Enhanced
+	// ATT bearers, to which the independent requests are spread.
+	eatt      int
+	chBearers chan *att.Client
 }
 
 // Addr returns the address of the client.
@@ -206,70 +223,195 @@ func (p *Client) DiscoverDescriptors(filter []ble.UUID, c *ble.Characteristic) (
 
 // ReadCharacteristic reads a characteristic value from a server. [Vol 3, Part G, 4.8.1]
 func (p *Client) ReadCharacteristic(c *ble.Characteristic) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
-	val, err := p.ac.Read(c.ValueHandle)
+	var val []byte
+	err := p.do(func(ac *att.Client) (err error) {
+		val, err = ac.Read(c.ValueHandle)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	p.Lock()
 	c.Value = val
+	p.Unlock()
 	return val, nil
 }
 
 // ReadLongCharacteristic reads a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.8.3]
 func (p *Client) ReadLongCharacteristic(c *ble.Characteristic) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
+	var buffer []byte
+	err := p.do(func(ac *att.Client) error {
+		// The maximum length of an attribute value shall be 512 octects [Vol 3, 3.2.9]
+		buffer = make([]byte, 0, 512)
 
-	// The maximum length of an attribute value shall be 512 octects [Vol 3, 3.2.9]
-	buffer := make([]byte, 0, 512)
+		read, err := ac.Read(c.ValueHandle)
+		if err != nil {
+			return err
+		}
+		buffer = append(buffer, read...)
 
-	read, err := p.ac.Read(c.ValueHandle)
+		for len(read) >= ac.TxMTU()-1 {
+			if read, err = ac.ReadBlob(c.ValueHandle, uint16(len(buffer))); err != nil {
+				return err
+			}
+			buffer = append(buffer, read...)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	buffer = append(buffer, read...)
-
-	for len(read) >= p.conn.TxMTU()-1 {
-		if read, err = p.ac.ReadBlob(c.ValueHandle, uint16(len(buffer))); err != nil {
-			return nil, err
-		}
-		buffer = append(buffer, read...)
-	}
 
+	p.Lock()
 	c.Value = buffer
+	p.Unlock()
 	return buffer, nil
 }
 
 // WriteCharacteristic writes a characteristic value to a server. [Vol 3, Part G, 4.9.3]
+// Writes without response to a characteristic with the CharSignedWrite property
+// are signed with the CSRK of the bond, unless the link is encrypted. [Vol 3, Part G, 4.9.2]
 func (p *Client) WriteCharacteristic(c *ble.Characteristic, v []byte, noRsp bool) error {
-	p.Lock()
-	defer p.Unlock()
 	if noRsp {
-		return p.ac.WriteCommand(c.ValueHandle, v)
+		// Sign the write, unless the link is already encrypted. Signed
+		// writes are only sent on the unenhanced bearer. [Vol 3, Part G, 4.9.2]
+		if c.Property&ble.CharSignedWrite != 0 && p.conn.SecurityLevel() < ble.SecurityUnauthenticated {
+			p.Lock()
+			err := p.ac.WriteSigned(c.ValueHandle, v)
+			p.Unlock()
+			if err == nil || c.Property&ble.CharWriteNR == 0 {
+				return err
+			}
+		}
+		return p.do(func(ac *att.Client) error { return ac.WriteCommand(c.ValueHandle, v) })
 	}
-	return p.ac.Write(c.ValueHandle, v)
+	return p.do(func(ac *att.Client) error { return ac.Write(c.ValueHandle, v) })
 }
 
 // ReadDescriptor reads a characteristic descriptor from a server. [Vol 3, Part G, 4.12.1]
 func (p *Client) ReadDescriptor(d *ble.Descriptor) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
-	val, err := p.ac.Read(d.Handle)
+	var val []byte
+	err := p.do(func(ac *att.Client) (err error) {
+		val, err = ac.Read(d.Handle)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	p.Lock()
 	d.Value = val
+	p.Unlock()
 	return val, nil
 }
 
 // WriteDescriptor writes a characteristic descriptor to a server. [Vol 3, Part G, 4.12.3]
 func (p *Client) WriteDescriptor(d *ble.Descriptor, v []byte) error {
+	return p.do(func(ac *att.Client) error { return ac.Write(d.Handle, v) })
+}
+
+// EnableEATT opens n Enhanced ATT bearers to the server, which it must support
+// as reported by its Server Supported Features. The reads and writes of the
+// characteristic values and descriptors are then spread across the idle
+// bearers, instead of waiting for each other. [Vol 3, Part G, 3.3 & 7.2]
+func (p *Client) EnableEATT(n int) error {
 	p.Lock()
 	defer p.Unlock()
-	return p.ac.Write(d.Handle, v)
+	if n < 1 || p.eatt+n > maxEATTBearers {
+		return fmt.Errorf("invalid number of bearers %d", n)
+	}
+
+	// Read Using Characteristic UUID [Vol 3, Part G, 4.8.2]
+	length, b, err := p.ac.ReadByType(0x0001, 0xFFFF, ble.ServerSupportedFeaturesUUID)
+	if err == ble.ErrAttrNotFound {
+		return ErrEATTNotSupported
+	}
+	if err != nil {
+		return fmt.Errorf("can't read server supported features: %s", err)
+	}
+	if length < 3 || b[2]&serverFeatureEATT == 0 {
+		return ErrEATTNotSupported
+	}
+
+	// Enable the feature on the server, if it keeps the client features.
+	length, b, err = p.ac.ReadByType(0x0001, 0xFFFF, ble.ClientSupportedFeaturesUUID)
+	switch {
+	case err == ble.ErrAttrNotFound:
+	case err != nil:
+		return fmt.Errorf("can't read client supported features: %s", err)
+	default:
+		h := binary.LittleEndian.Uint16(b[:2])
+		v := append([]byte(nil), b[2:length]...)
+		if len(v) == 0 {
+			v = []byte{0x00}
+		}
+		v[0] |= clientFeatureEATT
+		if err := p.ac.Write(h, v); err != nil {
+			return fmt.Errorf("can't write client supported features: %s", err)
+		}
+	}
+
+	chs, err := p.conn.DialL2CAPEnhanced(att.EATTPSM, n)
+	if err != nil {
+		return fmt.Errorf("can't open enhanced ATT bearers: %s", err)
+	}
+	for _, ch := range chs {
+		ac := att.NewClient(att.NewEnhancedBearer(p.conn, ch), p)
+		go p.loopEATT(ac)
+		p.eatt++
+		p.chBearers <- ac
+	}
+	return nil
+}
+
+// loopEATT runs an Enhanced ATT bearer until the channel is closed, in which
+// case another one may be opened by EnableEATT.
+func (p *Client) loopEATT(ac *att.Client) {
+	ac.Loop()
+	p.Lock()
+	p.eatt--
+	p.Unlock()
+}
+
+// bearer waits for an idle ATT bearer, and returns it with the function that
+// releases it. The closed Enhanced ATT bearers are dropped from the pool.
+func (p *Client) bearer() (*att.Client, func()) {
+	for {
+		ac := <-p.chBearers
+		if ac != p.ac && closed(ac) {
+			continue
+		}
+		return ac, func() {
+			if ac == p.ac || !closed(ac) {
+				p.chBearers <- ac
+			}
+		}
+	}
+}
+
+// do runs f on an idle ATT bearer. If f fails because an Enhanced ATT bearer
+// is closed by the server meanwhile, it's retried on the other bearers, and
+// eventually on the ATT bearer.
+func (p *Client) do(f func(ac *att.Client) error) error {
+	for {
+		ac, release := p.bearer()
+		err := f(ac)
+		release()
+		if err == nil || ac == p.ac || !closed(ac) {
+			return err
+		}
+	}
+}
+
+// closed reports whether the bearer of ac is closed.
+func closed(ac *att.Client) bool {
+	select {
+	case <-ac.Closed():
+		return true
+	default:
+		return false
+	}
 }
 
 // ReadRSSI retrieves the current RSSI value of remote peripheral. [Vol 2, Part E, 7.5.4]
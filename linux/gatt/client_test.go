@@ -0,0 +1,264 @@
+package gatt
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/att"
+)
+
+// testChannel is a bearer to the test server, which receives the requests
+// written to the bearer, and sends the responses.
+type testChannel struct {
+	ble.L2CAPChannel
+	id   byte
+	rx   chan []byte
+	reqs chan []byte
+	once sync.Once
+	done chan struct{}
+}
+
+func newTestChannel(id byte) *testChannel {
+	return &testChannel{
+		id:   id,
+		rx:   make(chan []byte, 4),
+		reqs: make(chan []byte, 4),
+		done: make(chan struct{}),
+	}
+}
+
+func (ch *testChannel) RxMTU() int { return ble.DefaultMTU }
+func (ch *testChannel) TxMTU() int { return ble.DefaultMTU }
+
+func (ch *testChannel) Read(b []byte) (int, error) {
+	select {
+	case p := <-ch.rx:
+		return copy(b, p), nil
+	case <-ch.done:
+		return 0, io.EOF
+	}
+}
+
+func (ch *testChannel) Write(b []byte) (int, error) {
+	select {
+	case <-ch.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	ch.reqs <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (ch *testChannel) Close() error {
+	ch.once.Do(func() { close(ch.done) })
+	return nil
+}
+
+// expect returns the next request sent on the bearer, which must have the
+// opcode.
+func (ch *testChannel) expect(t *testing.T, code byte) []byte {
+	t.Helper()
+	select {
+	case b := <-ch.reqs:
+		if b[0] != code {
+			t.Fatalf("bearer %d: request %X, want opcode 0x%02X", ch.id, b, code)
+		}
+		return b
+	case <-time.After(time.Second):
+		t.Fatalf("bearer %d: no request 0x%02X sent", ch.id, code)
+	}
+	return nil
+}
+
+// respond sends the response on the bearer.
+func (ch *testChannel) respond(b ...byte) { ch.rx <- b }
+
+// idle checks that no request is sent on the bearer for a while.
+func (ch *testChannel) idle(t *testing.T) {
+	t.Helper()
+	select {
+	case b := <-ch.reqs:
+		t.Fatalf("bearer %d: request %X sent, want none", ch.id, b)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// testConn is a link, whose ATT bearer is att, and which opens the Enhanced
+// ATT bearers eatt.
+type testConn struct {
+	ble.Conn
+	att  *testChannel
+	eatt []*testChannel
+}
+
+func (c *testConn) Read(b []byte) (int, error)  { return c.att.Read(b) }
+func (c *testConn) Write(b []byte) (int, error) { return c.att.Write(b) }
+func (c *testConn) Close() error                { return c.att.Close() }
+func (c *testConn) RxMTU() int                  { return ble.DefaultMTU }
+func (c *testConn) TxMTU() int                  { return ble.DefaultMTU }
+func (c *testConn) SetRxMTU(mtu int)            {}
+func (c *testConn) SetTxMTU(mtu int)            {}
+
+func (c *testConn) DialL2CAPEnhanced(psm uint16, n int) ([]ble.L2CAPChannel, error) {
+	if psm != att.EATTPSM || n > len(c.eatt) {
+		return nil, errors.New("refused")
+	}
+	var chs []ble.L2CAPChannel
+	for _, ch := range c.eatt[:n] {
+		chs = append(chs, ch)
+	}
+	return chs, nil
+}
+
+// newEATTClient returns a client with n Enhanced ATT bearers. The ATT bearer
+// has the id 0, and the Enhanced ATT bearers 1 to n.
+func newEATTClient(t *testing.T, n int) (*Client, *testConn) {
+	conn := &testConn{att: newTestChannel(0)}
+	for i := 1; i <= n; i++ {
+		conn.eatt = append(conn.eatt, newTestChannel(byte(i)))
+	}
+	t.Cleanup(func() {
+		conn.att.Close()
+		for _, ch := range conn.eatt {
+			ch.Close()
+		}
+	})
+	p, err := NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- p.EnableEATT(n) }()
+	// The server supports EATT, and doesn't keep the client features.
+	conn.att.expect(t, att.ReadByTypeRequestCode)
+	conn.att.respond(att.ReadByTypeResponseCode, 0x03, 0x10, 0x00, serverFeatureEATT)
+	conn.att.expect(t, att.ReadByTypeRequestCode)
+	conn.att.respond(att.ErrorResponseCode, att.ReadByTypeRequestCode, 0x01, 0x00, byte(ble.ErrAttrNotFound))
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return p, conn
+}
+
+// read reads the characteristic 0x0003 in the background, and sends the
+// value, which is the id of the bearer it's read on, or 0xFF if it fails, to
+// the channel.
+func read(p *Client, values chan<- byte) {
+	go func() {
+		v, err := p.ReadCharacteristic(&ble.Characteristic{ValueHandle: 0x0003})
+		if err != nil || len(v) != 1 {
+			values <- 0xFF
+			return
+		}
+		values <- v[0]
+	}()
+}
+
+// eattBearers returns the number of the Enhanced ATT bearers, once they're
+// no more than n.
+func eattBearers(p *Client, n int) int {
+	for i := 0; i < 100; i++ {
+		p.RLock()
+		eatt := p.eatt
+		p.RUnlock()
+		if eatt <= n {
+			return eatt
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return -1
+}
+
+func TestEATTBearerSelection(t *testing.T) {
+	p, conn := newEATTClient(t, 2)
+	bearers := append([]*testChannel{conn.att}, conn.eatt...)
+
+	// The concurrent reads are spread across the idle bearers.
+	values := make(chan byte, len(bearers))
+	for range bearers {
+		read(p, values)
+	}
+	for _, ch := range bearers {
+		ch.expect(t, att.ReadRequestCode)
+	}
+	for _, ch := range bearers {
+		ch.respond(att.ReadResponseCode, ch.id)
+	}
+	seen := map[byte]bool{}
+	for range bearers {
+		seen[<-values] = true
+	}
+	for _, ch := range bearers {
+		if !seen[ch.id] {
+			t.Errorf("bearer %d not used", ch.id)
+		}
+	}
+
+	// The bearers are released once the reads are done.
+	if n := len(p.chBearers); n != len(bearers) {
+		t.Errorf("%d idle bearers, want %d", n, len(bearers))
+	}
+}
+
+func TestEATTRetry(t *testing.T) {
+	p, conn := newEATTClient(t, 1)
+	eatt := conn.eatt[0]
+
+	// The first read waits on the ATT bearer, and the second one on the
+	// Enhanced ATT bearer, which the server closes.
+	values := make(chan byte, 2)
+	read(p, values)
+	conn.att.expect(t, att.ReadRequestCode)
+	read(p, values)
+	eatt.expect(t, att.ReadRequestCode)
+	eatt.Close()
+
+	// The second read is retried on the ATT bearer, once it's released.
+	conn.att.idle(t)
+	conn.att.respond(att.ReadResponseCode, conn.att.id)
+	conn.att.expect(t, att.ReadRequestCode)
+	conn.att.respond(att.ReadResponseCode, conn.att.id)
+	for i := 0; i < 2; i++ {
+		if v := <-values; v != conn.att.id {
+			t.Errorf("read on bearer %d, want %d", v, conn.att.id)
+		}
+	}
+
+	// The closed bearer isn't put back.
+	if n := len(p.chBearers); n != 1 {
+		t.Errorf("%d idle bearers, want 1", n)
+	}
+	if n := eattBearers(p, 0); n != 0 {
+		t.Errorf("%d Enhanced ATT bearers, want 0", n)
+	}
+}
+
+func TestEATTClosedBearerDropped(t *testing.T) {
+	p, conn := newEATTClient(t, 1)
+
+	// The ATT bearer is taken first, and put back after the Enhanced ATT
+	// bearer, which is then closed while it's idle.
+	ac, release := p.bearer()
+	if ac != p.ac {
+		t.Fatal("ATT bearer not selected first")
+	}
+	release()
+	conn.eatt[0].Close()
+	if n := eattBearers(p, 0); n != 0 {
+		t.Fatalf("%d Enhanced ATT bearers, want 0", n)
+	}
+
+	ac, release = p.bearer()
+	defer release()
+	if ac != p.ac {
+		t.Error("closed bearer selected")
+	}
+	if n := len(p.chBearers); n != 0 {
+		t.Errorf("%d idle bearers, want 0", n)
+	}
+}
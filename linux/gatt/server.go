@@ -34,6 +34,9 @@ type Server struct {
 
 	svcs []*ble.Service
 	db   *att.DB
+
+	// eatt is set if the Enhanced ATT bearers are accepted.
+	eatt bool
 }
 
 // AddService ...
@@ -50,15 +53,45 @@ func (s *Server) RemoveAllServices() error {
 	s.Lock()
 	defer s.Unlock()
 	s.svcs = defaultServices(s.name)
+	s.setFeatures()
 	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
 	return nil
 }
 
+// EnableEATT reports the support of the Enhanced ATT bearers in the Server
+// Supported Features. The bearers must be accepted on att.EATTPSM.
+func (s *Server) EnableEATT() {
+	s.Lock()
+	defer s.Unlock()
+	s.eatt = true
+	s.setFeatures()
+	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
+}
+
+// setFeatures sets the Server Supported Features of the default GATT service.
+func (s *Server) setFeatures() {
+	var f byte
+	if s.eatt {
+		f |= serverFeatureEATT
+	}
+	for _, svc := range s.svcs {
+		if !svc.UUID.Equal(ble.GATTUUID) {
+			continue
+		}
+		for _, c := range svc.Characteristics {
+			if c.UUID.Equal(ble.ServerSupportedFeaturesUUID) {
+				c.SetValue([]byte{f})
+			}
+		}
+	}
+}
+
 // SetServices ...
 func (s *Server) SetServices(svcs []*ble.Service) error {
 	s.Lock()
 	defer s.Unlock()
 	s.svcs = append(defaultServices(s.name), svcs...)
+	s.setFeatures()
 	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
 	return nil
 }
@@ -89,9 +122,61 @@ func defaultServicesWithHandler(name string, handler ble.NotifyHandler) []*ble.S
 		indicationHandler = handler.ServeNotify
 	}
 	gattSvc.NewCharacteristic(ble.ServiceChangedUUID).HandleIndicate(indicationHandler)
+
+	// The Enhanced ATT bearers are reported once enabled. [Vol 3, Part G, 7.4]
+	gattSvc.NewCharacteristic(ble.ServerSupportedFeaturesUUID).SetValue([]byte{0x00})
+	cf := &clientFeatures{m: make(map[string][]byte)}
+	c := gattSvc.NewCharacteristic(ble.ClientSupportedFeaturesUUID)
+	c.HandleRead(cf)
+	c.HandleWrite(cf)
+	c.Property &^= ble.CharWriteNR
 	return []*ble.Service{gapSvc, gattSvc}
 }
 
+// Server Supported Features [Vol 3, Part G, 7.4].
+const serverFeatureEATT = 0x01
+
+// clientFeatures keeps the Client Supported Features written by each client
+// until it disconnects. Once a feature is enabled, the client can't disable
+// it. [Vol 3, Part G, 7.2]
+type clientFeatures struct {
+	sync.Mutex
+	m map[string][]byte
+}
+
+func (f *clientFeatures) ServeRead(req ble.Request, rsp ble.ResponseWriter) {
+	f.Lock()
+	defer f.Unlock()
+	v, ok := f.m[req.Conn().RemoteAddr().String()]
+	if !ok {
+		v = []byte{0x00}
+	}
+	rsp.Write(v)
+}
+
+func (f *clientFeatures) ServeWrite(req ble.Request, rsp ble.ResponseWriter) {
+	f.Lock()
+	defer f.Unlock()
+	key := req.Conn().RemoteAddr().String()
+	old, ok := f.m[key]
+	v := req.Data()
+	for i := range old {
+		if i >= len(v) || old[i]&^v[i] != 0 {
+			rsp.SetStatus(ble.ErrValueNotAllowed)
+			return
+		}
+	}
+	f.m[key] = append([]byte(nil), v...)
+	if !ok {
+		go func() {
+			<-req.Conn().Disconnected()
+			f.Lock()
+			delete(f.m, key)
+			f.Unlock()
+		}()
+	}
+}
+
 func defaultHanderFunc(r ble.Request, n ble.Notifier) {
 	log.Printf("TODO: indicate client when the services are changed")
 	for {
@@ -2,6 +2,7 @@ package hci
 
 import (
 	"net"
+	"time"
 
 	"github.com/trustasia-com/ble"
 	"github.com/trustasia-com/ble/linux/adv"
@@ -22,8 +23,41 @@ const (
 	evtTypScanRsp       = 0x04 // Scan Response (SCAN_RSP).
 )
 
+// Event type bits of LE Extended Advertising Report [Vol 2, Part E, 7.7.65.13].
+const (
+	extEvtTypConnectable = 1 << 0
+	extEvtTypScannable   = 1 << 1
+	extEvtTypDirected    = 1 << 2
+	extEvtTypScanRsp     = 1 << 3
+	extEvtTypLegacy      = 1 << 4
+
+	// Data status of the report, in bits 5 and 6.
+	extEvtTypDataIncomplete = 1 << 5 // More fragments are to come.
+	extEvtTypDataTruncated  = 2 << 5 // No more fragments are to come.
+	extEvtTypDataStatus     = 3 << 5
+)
+
+// extReport is a report of LE Extended Advertising Report, with the data
+// reassembled from its fragments.
+type extReport struct {
+	eventType    uint16
+	addrType     uint8
+	addr         [6]byte
+	primaryPHY   uint8
+	secondaryPHY uint8
+	sid          uint8
+	txPower      int8
+	rssi         int8
+	interval     uint16
+	data         []byte
+}
+
 func newAdvertisement(e evt.LEAdvertisingReport, i int) *Advertisement {
-	return &Advertisement{e: e, i: i}
+	return &Advertisement{e: e, i: i, rssi: int(e.RSSI(i))}
+}
+
+func newExtAdvertisement(r *extReport) *Advertisement {
+	return &Advertisement{ext: r, rssi: int(r.rssi)}
 }
 
 // Advertisement implements ble.Advertisement and other functions that are only
@@ -33,14 +67,18 @@ type Advertisement struct {
 	i  int
 	sr *Advertisement
 
+	// rssi is the signal strength of the latest packet of the advertiser.
+	rssi int
+
+	// addr is the address of the advertiser, resolved to its identity
+	// address if possible.
+	addr ble.Addr
+
 	// cached packets.
 	p *adv.Packet
-}
 
-// setScanResponse ssociate sca response to the existing advertisement.
-func (a *Advertisement) setScanResponse(sr *Advertisement) {
-	a.sr = sr
-	a.p = nil // clear the cached.
+	// ext is the report, if it's from extended scanning.
+	ext *extReport
 }
 
 // packets returns the combined advertising packet and scan response (if presents)
@@ -89,47 +127,156 @@ func (a *Advertisement) SolicitedService() []ble.UUID {
 
 // Connectable indicates weather the remote peripheral is connectable.
 func (a *Advertisement) Connectable() bool {
+	if a.ext != nil {
+		return a.ext.eventType&extEvtTypConnectable != 0
+	}
 	return a.EventType() == evtTypAdvDirectInd || a.EventType() == evtTypAdvInd
 }
 
-// RSSI returns RSSI signal strength.
+// RSSI returns RSSI signal strength of the latest packet of the advertiser.
 func (a *Advertisement) RSSI() int {
-	return int(a.e.RSSI(a.i))
+	return a.rssi
+}
+
+// PrimaryPHY returns the PHY of the advertisement on the primary channels.
+func (a *Advertisement) PrimaryPHY() ble.PHY {
+	if a.ext != nil {
+		return phy(a.ext.primaryPHY)
+	}
+	return ble.PHY1M
+}
+
+// SecondaryPHY returns the PHY of the extended advertisement on the secondary
+// channels, or 0 if it isn't used.
+func (a *Advertisement) SecondaryPHY() ble.PHY {
+	if a.ext != nil {
+		return phy(a.ext.secondaryPHY)
+	}
+	return 0
+}
+
+// SID returns the Advertising SID of the extended advertisement, or -1 if it
+// doesn't have one.
+func (a *Advertisement) SID() int {
+	if a.ext == nil || a.ext.sid == 0xFF {
+		return -1
+	}
+	return int(a.ext.sid)
+}
+
+// TxPower returns the transmit power in dBm, which the controller reported
+// for the extended advertisement, or ble.TxPowerUnavailable.
+func (a *Advertisement) TxPower() int {
+	if a.ext == nil {
+		return ble.TxPowerUnavailable
+	}
+	return int(a.ext.txPower)
+}
+
+// PeriodicInterval returns the interval of the periodic advertising, which
+// the advertiser runs, or 0 if there is none.
+func (a *Advertisement) PeriodicInterval() time.Duration {
+	if a.ext == nil {
+		return 0
+	}
+	return time.Duration(a.ext.interval) * periodicIntervalUnit
+}
+
+// Truncated reports if the data of the extended advertisement is incomplete,
+// because the controller couldn't receive all of its fragments.
+// This is linux sepcific.
+func (a *Advertisement) Truncated() bool {
+	return a.ext != nil && a.ext.eventType&extEvtTypDataStatus == extEvtTypDataTruncated
 }
 
-// Addr returns the address of the remote peripheral.
+// Addr returns the address of the remote peripheral. If the peripheral uses
+// a Resolvable Private Address which can be resolved with an IRK in the bond
+// store, its identity address is returned as a ResolvedAddress.
 func (a *Advertisement) Addr() ble.Addr {
-	b := a.e.Address(a.i)
+	if a.addr != nil {
+		return a.addr
+	}
+	b := a.address()
 	addr := net.HardwareAddr([]byte{b[5], b[4], b[3], b[2], b[1], b[0]})
-	if a.e.AddressType(a.i) == 1 {
+	if t := a.AddressType(); t == 0x01 || t == 0x03 {
 		return RandomAddress{addr}
 	}
 	return addr
 }
 
-// EventType returns the event type of Advertisement.
+// address returns the address of the advertiser, in wire order.
+func (a *Advertisement) address() [6]byte {
+	if a.ext != nil {
+		return a.ext.addr
+	}
+	return a.e.Address(a.i)
+}
+
+// EventType returns the event type of Advertisement. The extended
+// advertisements are reported as the legacy ones with the same properties.
 // This is linux sepcific.
 func (a *Advertisement) EventType() uint8 {
-	return a.e.EventType(a.i)
+	if a.ext == nil {
+		return a.e.EventType(a.i)
+	}
+	t := a.ext.eventType
+	switch {
+	case t&extEvtTypScanRsp != 0:
+		return evtTypScanRsp
+	case t&extEvtTypConnectable != 0 && t&extEvtTypDirected != 0:
+		return evtTypAdvDirectInd
+	case t&extEvtTypConnectable != 0:
+		return evtTypAdvInd
+	case t&extEvtTypScannable != 0:
+		return evtTypAdvScanInd
+	}
+	return evtTypAdvNonconnInd
 }
 
 // AddressType returns the address type of the Advertisement.
 // This is linux sepcific.
 func (a *Advertisement) AddressType() uint8 {
+	if a.ext != nil {
+		return a.ext.addrType
+	}
 	return a.e.AddressType(a.i)
 }
 
-// Data returns the advertising data of the packet.
-// This is linux sepcific.
+// Data returns the raw advertising data, or nil if only the scan response
+// has been received.
 func (a *Advertisement) Data() []byte {
-	return a.e.Data(a.i)
+	if a.isScanResponse() {
+		return nil
+	}
+	return a.raw()
 }
 
-// ScanResponse returns the scan response of the packet, if it presents.
-// This is linux sepcific.
+// ScanResponse returns the raw scan response data, if it presents.
 func (a *Advertisement) ScanResponse() []byte {
-	if a.sr == nil {
-		return nil
+	if a.sr != nil {
+		return a.sr.raw()
 	}
-	return a.sr.Data()
+	if a.isScanResponse() {
+		return a.raw()
+	}
+	return nil
+}
+
+// MergedData returns the advertising data followed by the scan response data,
+// which the other methods parse.
+func (a *Advertisement) MergedData() []byte {
+	return a.packets().Bytes()
+}
+
+// isScanResponse reports if the packet is a scan response.
+func (a *Advertisement) isScanResponse() bool {
+	return a.EventType() == evtTypScanRsp
+}
+
+// raw returns the data of the packet.
+func (a *Advertisement) raw() []byte {
+	if a.ext != nil {
+		return a.ext.data
+	}
+	return a.e.Data(a.i)
 }
@@ -0,0 +1,131 @@
+package hci
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAdvCacheSize = 128
+	defaultAdvCacheTTL  = 30 * time.Second
+)
+
+// advCacheKey identifies an advertiser.
+type advCacheKey struct {
+	addrType uint8
+	addr     [6]byte
+}
+
+// advCacheEntry is the latest advertising data and scan response of an
+// advertiser, and when it was last seen.
+type advCacheEntry struct {
+	key  advCacheKey
+	ad   *Advertisement
+	sr   *Advertisement
+	rssi int
+	seen time.Time
+}
+
+// advCache caches the advertisements of up to size advertisers, which are
+// seen within ttl. The controller reports the advertising data and the scan
+// response separately, and the cache merges them into one advertisement.
+type advCache struct {
+	mu   sync.Mutex
+	size int
+	ttl  time.Duration
+	m    map[advCacheKey]*list.Element
+	l    *list.List // The most recently seen first.
+}
+
+func newAdvCache(size int, ttl time.Duration) *advCache {
+	return &advCache{
+		size: size,
+		ttl:  ttl,
+		m:    make(map[advCacheKey]*list.Element),
+		l:    list.New(),
+	}
+}
+
+// setLimits sets the number of advertisers and how long they are cached. If
+// ttl is 0, they don't expire.
+func (c *advCache) setLimits(size int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size, c.ttl = size, ttl
+	c.evict(time.Now())
+}
+
+// reset forgets all the advertisers.
+func (c *advCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = make(map[advCacheKey]*list.Element)
+	c.l.Init()
+}
+
+// add caches the advertising data or scan response, which is received at now,
+// and returns the advertisement merged with the cached one of the advertiser.
+// A scan response, whose advertising data isn't cached, is returned as it is.
+func (c *advCache) add(a *Advertisement, now time.Time) *Advertisement {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := advCacheKey{a.AddressType(), a.address()}
+	ent := c.get(k, now)
+	if ent == nil {
+		ent = &advCacheEntry{key: k}
+		c.m[k] = c.l.PushFront(ent)
+	}
+	ent.rssi, ent.seen = a.rssi, now
+	c.evict(now)
+
+	if !a.isScanResponse() {
+		a.sr = ent.sr
+		ent.ad = a
+		return a
+	}
+	ent.sr = a
+	if ent.ad == nil {
+		return a
+	}
+	m := *ent.ad
+	m.sr = a
+	m.rssi = ent.rssi
+	return &m
+}
+
+// get returns the entry of the advertiser, unless it has expired.
+func (c *advCache) get(k advCacheKey, now time.Time) *advCacheEntry {
+	e, ok := c.m[k]
+	if !ok {
+		return nil
+	}
+	ent := e.Value.(*advCacheEntry)
+	if c.expired(ent, now) {
+		c.remove(e)
+		return nil
+	}
+	c.l.MoveToFront(e)
+	return ent
+}
+
+// evict removes the expired advertisers, and the least recently seen ones
+// beyond the size of the cache.
+func (c *advCache) evict(now time.Time) {
+	for e := c.l.Back(); e != nil; e = c.l.Back() {
+		if c.l.Len() <= c.size && !c.expired(e.Value.(*advCacheEntry), now) {
+			return
+		}
+		c.remove(e)
+	}
+}
+
+func (c *advCache) expired(ent *advCacheEntry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(ent.seen) > c.ttl
+}
+
+func (c *advCache) remove(e *list.Element) {
+	delete(c.m, e.Value.(*advCacheEntry).key)
+	c.l.Remove(e)
+}
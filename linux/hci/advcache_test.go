@@ -0,0 +1,73 @@
+package hci
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testAdv(addr byte, eventType uint16, rssi int8, data ...byte) *Advertisement {
+	return newExtAdvertisement(&extReport{
+		eventType: eventType | extEvtTypLegacy,
+		addr:      [6]byte{addr},
+		sid:       0xFF,
+		rssi:      rssi,
+		data:      data,
+	})
+}
+
+func TestAdvCacheMerge(t *testing.T) {
+	c := newAdvCache(defaultAdvCacheSize, defaultAdvCacheTTL)
+	now := time.Now()
+
+	// A scan response without advertising data is reported as it is.
+	a := c.add(testAdv(1, extEvtTypScanRsp, -70, 0x02), now)
+	if a.Data() != nil || !bytes.Equal(a.ScanResponse(), []byte{0x02}) {
+		t.Errorf("Data() = %x, ScanResponse() = %x, want nil, 02", a.Data(), a.ScanResponse())
+	}
+
+	a = c.add(testAdv(1, extEvtTypConnectable|extEvtTypScannable, -60, 0x01), now)
+	if !bytes.Equal(a.Data(), []byte{0x01}) || !bytes.Equal(a.ScanResponse(), []byte{0x02}) {
+		t.Errorf("Data() = %x, ScanResponse() = %x, want 01, 02", a.Data(), a.ScanResponse())
+	}
+
+	a = c.add(testAdv(1, extEvtTypScanRsp, -50, 0x03), now)
+	if !bytes.Equal(a.Data(), []byte{0x01}) || !bytes.Equal(a.ScanResponse(), []byte{0x03}) {
+		t.Errorf("Data() = %x, ScanResponse() = %x, want 01, 03", a.Data(), a.ScanResponse())
+	}
+	if !bytes.Equal(a.MergedData(), []byte{0x01, 0x03}) {
+		t.Errorf("MergedData() = %x, want 0103", a.MergedData())
+	}
+	if !a.Connectable() || a.RSSI() != -50 {
+		t.Errorf("Connectable() = %v, RSSI() = %d, want true, -50", a.Connectable(), a.RSSI())
+	}
+
+	// Another advertiser isn't merged.
+	a = c.add(testAdv(2, extEvtTypConnectable|extEvtTypScannable, -60, 0x04), now)
+	if a.ScanResponse() != nil {
+		t.Errorf("ScanResponse() = %x, want nil", a.ScanResponse())
+	}
+}
+
+func TestAdvCacheEvict(t *testing.T) {
+	c := newAdvCache(2, time.Second)
+	now := time.Now()
+
+	c.add(testAdv(1, extEvtTypScannable, -60, 0x01), now)
+	c.add(testAdv(2, extEvtTypScannable, -60, 0x02), now)
+	c.add(testAdv(1, extEvtTypScannable, -60, 0x01), now)
+	c.add(testAdv(3, extEvtTypScannable, -60, 0x03), now)
+	if a := c.add(testAdv(1, extEvtTypScanRsp, -60, 0x11), now); a.Data() == nil {
+		t.Errorf("recently seen advertiser is evicted")
+	}
+	if a := c.add(testAdv(2, extEvtTypScanRsp, -60, 0x12), now); a.Data() != nil {
+		t.Errorf("least recently seen advertiser isn't evicted")
+	}
+
+	if a := c.add(testAdv(1, extEvtTypScanRsp, -60, 0x11), now.Add(2*time.Second)); a.Data() != nil {
+		t.Errorf("expired advertiser isn't evicted")
+	}
+	if c.l.Len() != 1 || len(c.m) != 1 {
+		t.Errorf("%d, %d advertisers cached, want 1", c.l.Len(), len(c.m))
+	}
+}
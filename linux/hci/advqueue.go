@@ -0,0 +1,207 @@
+package hci
+
+import (
+	"sync"
+	"time"
+
+	"github.com/trustasia-com/ble"
+)
+
+const defaultAdvQueueDepth = 256
+
+// advBlockTimeout bounds the wait of AdvBlock, so that an AdvHandler, which
+// sends HCI commands, doesn't hold up the events of their completion for good.
+const advBlockTimeout = time.Second
+
+// AdvQueueStats are the counters of the advertisements, which are queued for
+// the AdvHandler.
+type AdvQueueStats struct {
+	Delivered uint64 // Advertisements passed to the AdvHandler.
+	Dropped   uint64 // Advertisements dropped because the queue was full.
+	Blocked   uint64 // Times the events waited for the queue to have room.
+}
+
+// advQueue passes the advertisements from the event loop to the AdvHandler
+// in order. If the handler doesn't keep up, the queue is filled up to its
+// depth, and the advertisements are dropped or wait as the policy says.
+// The queue is flushed, whenever the handler changes or the scanning stops.
+type advQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	q       []*Advertisement // Ring of the queued advertisements.
+	head    int
+	n       int
+	gen     int // Incremented, when the queue is flushed.
+	handler ble.AdvHandler
+	policy  ble.AdvDropPolicy
+	timeout time.Duration // Bounds the wait of AdvBlock.
+	stats   AdvQueueStats
+	closed  bool
+}
+
+func newAdvQueue(depth int, policy ble.AdvDropPolicy) *advQueue {
+	q := &advQueue{
+		q:       make([]*Advertisement, depth),
+		policy:  policy,
+		timeout: advBlockTimeout,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// setLimits sets the depth and the drop policy of the queue. The queued
+// advertisements, which don't fit in, are dropped.
+func (q *advQueue) setLimits(depth int, policy ble.AdvDropPolicy) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := make([]*Advertisement, depth)
+	for q.n > depth {
+		q.drop()
+	}
+	for i := 0; i < q.n; i++ {
+		b[i] = q.q[(q.head+i)%len(q.q)]
+	}
+	q.q, q.head, q.policy = b, 0, policy
+	q.cond.Broadcast()
+}
+
+// setHandler sets the handler of the advertisements, and flushes the ones
+// queued for the previous handler.
+func (q *advQueue) setHandler(ah ble.AdvHandler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handler = ah
+	q.reset()
+}
+
+// handled returns true, if there is a handler of the advertisements.
+func (q *advQueue) handled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.handler != nil
+}
+
+// flush drops the queued advertisements, which are no longer wanted.
+func (q *advQueue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reset()
+}
+
+// reset empties the queue. It's called with q.mu held.
+func (q *advQueue) reset() {
+	for i := range q.q {
+		q.q[i] = nil
+	}
+	q.head, q.n = 0, 0
+	q.gen++
+	q.cond.Broadcast()
+}
+
+// push queues the advertisement. It's called from the event loop.
+func (q *advQueue) push(a *Advertisement) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.handler == nil {
+		return
+	}
+	if q.n == len(q.q) {
+		switch q.policy {
+		case ble.AdvDropNewest:
+			q.stats.Dropped++
+			return
+		case ble.AdvBlock:
+			q.stats.Blocked++
+			gen := q.gen
+			if !q.wait(q.timeout) {
+				q.stats.Dropped++
+				return
+			}
+			if q.gen != gen {
+				// The advertisement was meant for the flushed queue.
+				return
+			}
+		default:
+			q.drop()
+		}
+	}
+	if q.closed {
+		return
+	}
+	q.q[(q.head+q.n)%len(q.q)] = a
+	q.n++
+	q.cond.Broadcast()
+}
+
+// wait waits for up to d for the queue to have room. It's called with q.mu
+// held, and returns false, if the queue is still full.
+func (q *advQueue) wait(d time.Duration) bool {
+	expired := false
+	t := time.AfterFunc(d, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		expired = true
+		q.cond.Broadcast()
+	})
+	defer t.Stop()
+	for q.n == len(q.q) && !q.closed && !expired {
+		q.cond.Wait()
+	}
+	return q.n < len(q.q) || q.closed
+}
+
+// drop drops the oldest advertisement. It's called with q.mu held.
+func (q *advQueue) drop() {
+	q.q[q.head] = nil
+	q.head = (q.head + 1) % len(q.q)
+	q.n--
+	q.stats.Dropped++
+}
+
+// pop returns the oldest advertisement along with its handler, and waits for
+// one if the queue is empty. It returns false, once the queue is closed.
+func (q *advQueue) pop() (*Advertisement, ble.AdvHandler, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, nil, false
+	}
+	a := q.q[q.head]
+	q.q[q.head] = nil
+	q.head = (q.head + 1) % len(q.q)
+	q.n--
+	q.stats.Delivered++
+	q.cond.Broadcast()
+	return a, q.handler, true
+}
+
+// close stops the queue, and wakes up the waiting push and pop.
+func (q *advQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// advLoop passes the queued advertisements to the AdvHandler, until the
+// event loop stops.
+func (h *HCI) advLoop() {
+	for {
+		a, ah, ok := h.advQueue.pop()
+		if !ok {
+			return
+		}
+		ah(a)
+	}
+}
+
+// AdvQueueStats returns the counters of the advertisements, which are queued
+// for the AdvHandler.
+func (h *HCI) AdvQueueStats() AdvQueueStats {
+	h.advQueue.mu.Lock()
+	defer h.advQueue.mu.Unlock()
+	return h.advQueue.stats
+}
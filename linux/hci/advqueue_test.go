@@ -0,0 +1,133 @@
+package hci
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trustasia-com/ble"
+)
+
+// newTestAdvQueue returns a queue, whose handler ignores the advertisements.
+func newTestAdvQueue(depth int, policy ble.AdvDropPolicy) *advQueue {
+	q := newAdvQueue(depth, policy)
+	q.setHandler(func(a ble.Advertisement) {})
+	return q
+}
+
+// popAll returns the first data bytes of the queued advertisements.
+func popAll(q *advQueue) []byte {
+	var b []byte
+	for {
+		q.mu.Lock()
+		n := q.n
+		q.mu.Unlock()
+		if n == 0 {
+			return b
+		}
+		a, _, _ := q.pop()
+		b = append(b, a.Data()[0])
+	}
+}
+
+func TestAdvQueueDrop(t *testing.T) {
+	tests := []struct {
+		policy  ble.AdvDropPolicy
+		want    string
+		dropped uint64
+	}{
+		{ble.AdvDropOldest, "\x03\x04\x05", 2},
+		{ble.AdvDropNewest, "\x01\x02\x03", 2},
+	}
+	for _, tt := range tests {
+		q := newTestAdvQueue(3, tt.policy)
+		for i := 1; i <= 5; i++ {
+			q.push(testAdv(byte(i), 0, -60, byte(i)))
+		}
+		if got := string(popAll(q)); got != tt.want {
+			t.Errorf("policy %d: got %x, want %x", tt.policy, got, tt.want)
+		}
+		if q.stats.Dropped != tt.dropped || q.stats.Delivered != 3 {
+			t.Errorf("policy %d: stats %+v, want %d dropped, 3 delivered", tt.policy, q.stats, tt.dropped)
+		}
+	}
+}
+
+func TestAdvQueueBlock(t *testing.T) {
+	q := newTestAdvQueue(1, ble.AdvBlock)
+	q.push(testAdv(1, 0, -60, 1))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(testAdv(2, 0, -60, 2))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push didn't wait for the full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	for i := byte(1); i <= 2; i++ {
+		if a, _, ok := q.pop(); !ok || a.Data()[0] != i {
+			t.Fatalf("pop() = %v, %v, want advertisement %d", a, ok, i)
+		}
+	}
+	<-pushed
+	if q.stats.Dropped != 0 || q.stats.Blocked != 1 {
+		t.Errorf("stats %+v, want 0 dropped, 1 blocked", q.stats)
+	}
+
+	q.close()
+	if _, _, ok := q.pop(); ok {
+		t.Errorf("pop() succeeded on the closed queue")
+	}
+}
+
+func TestAdvQueueSetLimits(t *testing.T) {
+	q := newTestAdvQueue(4, ble.AdvDropOldest)
+	for i := 1; i <= 6; i++ {
+		q.push(testAdv(byte(i), 0, -60, byte(i)))
+	}
+	q.setLimits(2, ble.AdvDropNewest)
+	q.push(testAdv(7, 0, -60, 7))
+	if got := popAll(q); string(got) != "\x05\x06" {
+		t.Errorf("got %x, want 0506", got)
+	}
+}
+
+func TestAdvQueueFlush(t *testing.T) {
+	q := newAdvQueue(4, ble.AdvDropOldest)
+	q.push(testAdv(1, 0, -60, 1))
+	if got := popAll(q); len(got) != 0 {
+		t.Errorf("got %x without a handler, want none", got)
+	}
+
+	q.setHandler(func(a ble.Advertisement) {})
+	q.push(testAdv(1, 0, -60, 1))
+	q.setHandler(func(a ble.Advertisement) {})
+	q.push(testAdv(2, 0, -60, 2))
+	if got := popAll(q); string(got) != "\x02" {
+		t.Errorf("got %x after the handler changed, want 02", got)
+	}
+
+	q.push(testAdv(3, 0, -60, 3))
+	q.flush()
+	if got := popAll(q); len(got) != 0 {
+		t.Errorf("got %x after the flush, want none", got)
+	}
+}
+
+func TestAdvQueueBlockTimeout(t *testing.T) {
+	q := newTestAdvQueue(1, ble.AdvBlock)
+	q.timeout = 10 * time.Millisecond
+	q.push(testAdv(1, 0, -60, 1))
+
+	// Nobody pops, as the handler waits for the events held up by push.
+	q.push(testAdv(2, 0, -60, 2))
+	if got := popAll(q); string(got) != "\x01" {
+		t.Errorf("got %x, want 01", got)
+	}
+	if q.stats.Dropped != 1 || q.stats.Blocked != 1 {
+		t.Errorf("stats %+v, want 1 dropped, 1 blocked", q.stats)
+	}
+}
@@ -0,0 +1,559 @@
+package hci
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/adv"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// Advertising Event Properties [Vol 2, Part E, 7.8.53].
+const (
+	advPropConnectable    = 1 << 0
+	advPropScannable      = 1 << 1
+	advPropLegacy         = 1 << 4
+	advPropIncludeTxPower = 1 << 6
+)
+
+// Operations of the extended advertising and scan response data
+// [Vol 2, Part E, 7.8.54].
+const (
+	advDataIntermediate = 0x00
+	advDataFirst        = 0x01
+	advDataLast         = 0x02
+	advDataComplete     = 0x03
+)
+
+const (
+	maxAdvHandle         = 0xEF // Largest advertising handle.
+	maxExtAdvDataLength  = 1650 // Largest extended advertising data of a set.
+	extAdvFragmentLength = 251  // Largest data of a command.
+	advIntervalUnit      = 625 * time.Microsecond
+	advDurationUnit      = 10 * time.Millisecond
+	defaultAdvInterval   = 0x0020 // 20 ms
+)
+
+// AdvTxPowerNoPreference tells the controller to choose the transmit power
+// of an advertising set.
+const AdvTxPowerNoPreference = 127
+
+// AdvertisingSetParams are the parameters of an extended advertising set
+// [Vol 2, Part E, 7.8.53].
+type AdvertisingSetParams struct {
+	// Connectable and Scannable set the type of the advertising. Unless it
+	// uses the legacy PDUs, it can't be both connectable and scannable.
+	Connectable bool
+	Scannable   bool
+
+	// Legacy uses the legacy advertising PDUs, which carry up to 31 bytes
+	// of data, and are seen by the devices without extended scanning.
+	Legacy bool
+
+	// IntervalMin and IntervalMax are the range of the advertising interval,
+	// which is 20 ms if they're 0.
+	IntervalMin time.Duration
+	IntervalMax time.Duration
+
+	// PrimaryPHY is the PHY on the primary advertising channels, which is
+	// either ble.PHY1M or ble.PHYCoded. SecondaryPHY is the PHY on the
+	// secondary advertising channels. Both are LE 1M if they're 0.
+	PrimaryPHY   ble.PHY
+	SecondaryPHY ble.PHY
+
+	// TxPower is the preferred transmit power in dBm, or AdvTxPowerNoPreference.
+	// IncludeTxPower puts the transmit power in the advertising PDUs.
+	TxPower        int8
+	IncludeTxPower bool
+
+	// SID is the Advertising SID, which identifies the set to the scanners.
+	SID uint8
+
+	// Addr is the random address of the set. If it's nil, the set uses the
+	// address of the device.
+	Addr ble.Addr
+}
+
+// AdvertisingSet is an extended advertising set, which advertises with its own
+// data, parameters and address, alongside the other sets of the device.
+type AdvertisingSet struct {
+	h       *HCI
+	handle  uint8
+	legacy  bool
+	txPower int
+
+	// ownAddrType and ownAddr are the address the set advertises with.
+	// If privacy is set, it's the RPA of the device, which is rotated along
+	// with it. ownAddr is guarded by mu.
+	ownAddrType uint8
+	ownAddr     [6]byte
+	privacy     bool
+
+	// muEnable serializes enabling and disabling the set. mu guards the
+	// state, and chDone is closed when the enabled set stops advertising.
+	// mu is never held while a command is sent, since the events which
+	// stop the set are handled meanwhile. duration and maxEvents are the
+	// parameters the set is enabled with.
+	muEnable  sync.Mutex
+	mu        sync.Mutex
+	enabled   bool
+	removed   bool
+	chDone    chan struct{}
+	duration  uint16
+	maxEvents uint8
+}
+
+// NewAdvertisingSet creates an extended advertising set with the parameters.
+// The set advertises once it's enabled, and the controller runs the enabled
+// sets at the same time. The legacy advertising commands, which Advertise and
+// the related methods use, can't be used along with the advertising sets, so
+// the device must use the extended commands, as set up by OptExtendedScan.
+func (h *HCI) NewAdvertisingSet(p AdvertisingSetParams) (*AdvertisingSet, error) {
+	if !h.extended {
+		return nil, ErrLegacyMode
+	}
+	// The address of the set isn't changed by setRPA meanwhile.
+	h.muRadio.Lock()
+	defer h.muRadio.Unlock()
+	c, err := h.advSetParams(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &AdvertisingSet{
+		h:      h,
+		legacy: p.Legacy,
+		chDone: make(chan struct{}),
+	}
+	close(s.chDone)
+	if p.Addr != nil {
+		b, err := net.ParseMAC(p.Addr.String())
+		if err != nil {
+			return nil, ErrInvalidAddr
+		}
+		s.ownAddrType = 0x01
+		s.ownAddr = [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]}
+	} else {
+		s.ownAddrType, s.ownAddr = h.ownAddress()
+		s.privacy = h.privacy
+	}
+
+	// Reserve a handle for the set.
+	h.muAdvSets.Lock()
+	if len(h.advSets) >= h.numAdvSets {
+		h.muAdvSets.Unlock()
+		return nil, ErrNoAdvertisingSet
+	}
+	for ; s.handle < maxAdvHandle; s.handle++ {
+		if _, ok := h.advSets[s.handle]; !ok {
+			break
+		}
+	}
+	h.advSets[s.handle] = s
+	h.muAdvSets.Unlock()
+
+	c.AdvertisingHandle = s.handle
+	c.OwnAddressType = s.ownAddrType
+	rp := cmd.LESetExtendedAdvertisingParametersRP{}
+	if err := h.Send(c, &rp); err != nil {
+		h.muAdvSets.Lock()
+		s.remove()
+		h.muAdvSets.Unlock()
+		return nil, errors.Wrap(err, "can't set advertising parameters")
+	}
+	s.txPower = int(rp.SelectedTxPower)
+	if s.ownAddrType == 0x01 {
+		if err := h.Send(&cmd.LESetAdvertisingSetRandomAddress{
+			AdvertisingHandle: s.handle,
+			RandomAddress:     s.ownAddr,
+		}, nil); err != nil {
+			s.Remove()
+			return nil, errors.Wrap(err, "can't set random address")
+		}
+	}
+	return s, nil
+}
+
+// advSetParams returns the LE Set Extended Advertising Parameters command of
+// the parameters, without the handle and the own address type.
+func (h *HCI) advSetParams(p AdvertisingSetParams) (*cmd.LESetExtendedAdvertisingParameters, error) {
+	var props uint16
+	if p.Connectable {
+		props |= advPropConnectable
+	}
+	if p.Scannable {
+		props |= advPropScannable
+	}
+	if p.Legacy {
+		props |= advPropLegacy
+	}
+	if p.IncludeTxPower {
+		props |= advPropIncludeTxPower
+	}
+	switch {
+	case p.Legacy && p.Connectable && !p.Scannable:
+		return nil, errors.New("legacy connectable advertising must be scannable")
+	case !p.Legacy && p.Connectable && p.Scannable:
+		return nil, errors.New("extended advertising can't be both connectable and scannable")
+	case p.PrimaryPHY != 0 && p.PrimaryPHY != ble.PHY1M && p.PrimaryPHY != ble.PHYCoded:
+		return nil, fmt.Errorf("invalid primary PHY %v", p.PrimaryPHY)
+	case p.Legacy && p.PrimaryPHY == ble.PHYCoded:
+		return nil, errors.New("legacy advertising must use LE 1M PHY")
+	case p.SecondaryPHY != 0 && p.SecondaryPHY != ble.PHY1M && p.SecondaryPHY != ble.PHY2M && p.SecondaryPHY != ble.PHYCoded:
+		return nil, fmt.Errorf("invalid secondary PHY %v", p.SecondaryPHY)
+	case p.SID > 0x0F:
+		return nil, fmt.Errorf("invalid advertising SID %d", p.SID)
+	}
+
+	min, max := uint32(p.IntervalMin/advIntervalUnit), uint32(p.IntervalMax/advIntervalUnit)
+	if min == 0 {
+		min = defaultAdvInterval
+	}
+	if max == 0 {
+		max = min
+	}
+	if min < defaultAdvInterval || max > 0xFFFFFF || min > max {
+		return nil, fmt.Errorf("invalid advertising interval %v-%v", p.IntervalMin, p.IntervalMax)
+	}
+	c := &cmd.LESetExtendedAdvertisingParameters{
+		AdvertisingEventProperties:    props,
+		PrimaryAdvertisingIntervalMin: [3]byte{byte(min), byte(min >> 8), byte(min >> 16)},
+		PrimaryAdvertisingIntervalMax: [3]byte{byte(max), byte(max >> 8), byte(max >> 16)},
+		PrimaryAdvertisingChannelMap:  0x07, // ch37, ch38 and ch39.
+		AdvertisingTxPower:            p.TxPower,
+		PrimaryAdvertisingPHY:         phyValue(p.PrimaryPHY),
+		SecondaryAdvertisingPHY:       phyValue(p.SecondaryPHY),
+		AdvertisingSID:                p.SID,
+	}
+	if h.filterPolicy&ble.FilterAdvertise != 0 {
+		c.AdvertisingFilterPolicy = 0x03
+	}
+	return c, nil
+}
+
+// Handle returns the advertising handle of the set.
+func (s *AdvertisingSet) Handle() uint8 { return s.handle }
+
+// TxPower returns the transmit power in dBm, which the controller selected.
+func (s *AdvertisingSet) TxPower() int { return s.txPower }
+
+// SetData sets the advertising data, which is up to 1650 bytes, or 31 bytes
+// if the set uses the legacy PDUs. The data is sent to the controller in
+// fragments. The data of an enabled set can only be changed with a single
+// fragment of up to 251 bytes.
+func (s *AdvertisingSet) SetData(ad []byte) error {
+	frags, ops, err := s.fragment(ad)
+	if err != nil {
+		return err
+	}
+	for i := range frags {
+		if err := s.h.Send(&cmd.LESetExtendedAdvertisingData{
+			AdvertisingHandle:  s.handle,
+			Operation:          ops[i],
+			FragmentPreference: 0x01, // The controller should not fragment the data.
+			AdvertisingData:    frags[i],
+		}, nil); err != nil {
+			return errors.Wrap(err, "can't set advertising data")
+		}
+	}
+	return nil
+}
+
+// SetScanResponse sets the scan response data of a scannable set, which is
+// up to 1650 bytes, or 31 bytes if the set uses the legacy PDUs.
+func (s *AdvertisingSet) SetScanResponse(sr []byte) error {
+	frags, ops, err := s.fragment(sr)
+	if err != nil {
+		return err
+	}
+	for i := range frags {
+		if err := s.h.Send(&cmd.LESetExtendedScanResponseData{
+			AdvertisingHandle:  s.handle,
+			Operation:          ops[i],
+			FragmentPreference: 0x01, // The controller should not fragment the data.
+			ScanResponseData:   frags[i],
+		}, nil); err != nil {
+			return errors.Wrap(err, "can't set scan response data")
+		}
+	}
+	return nil
+}
+
+// fragment checks the length of the data, and splits it into the fragments
+// of the commands.
+func (s *AdvertisingSet) fragment(b []byte) ([][]byte, []uint8, error) {
+	max := s.h.maxAdvDataLen
+	if s.legacy {
+		max = adv.MaxEIRPacketLength
+	}
+	if len(b) > max {
+		return nil, nil, ble.ErrEIRPacketTooLong
+	}
+	frags, ops := fragmentAdvData(b)
+	return frags, ops, nil
+}
+
+// fragmentAdvData splits the data into fragments of up to 251 bytes, and
+// returns them with their operations [Vol 2, Part E, 7.8.54].
+func fragmentAdvData(b []byte) ([][]byte, []uint8) {
+	return fragmentData(b, extAdvFragmentLength)
+}
+
+// fragmentData splits the data into fragments of up to max bytes, and returns
+// them with their operations.
+func fragmentData(b []byte, max int) ([][]byte, []uint8) {
+	if len(b) <= max {
+		return [][]byte{b}, []uint8{advDataComplete}
+	}
+	var frags [][]byte
+	var ops []uint8
+	for op := uint8(advDataFirst); len(b) > 0; op = advDataIntermediate {
+		n := len(b)
+		if n > max {
+			n = max
+		} else {
+			op = advDataLast
+		}
+		frags = append(frags, b[:n])
+		ops = append(ops, op)
+		b = b[n:]
+	}
+	return frags, ops
+}
+
+// Enable starts advertising. The set stops after the duration, which is in
+// units of 10 ms, or the number of advertising events, unless they're 0. A
+// connectable set also stops when a connection is created.
+func (s *AdvertisingSet) Enable(duration time.Duration, maxEvents int) error {
+	d := duration / advDurationUnit
+	if duration < 0 || d > 0xFFFF || (duration > 0 && d == 0) {
+		return fmt.Errorf("invalid advertising duration %v", duration)
+	}
+	if maxEvents < 0 || maxEvents > 0xFF {
+		return fmt.Errorf("invalid number of advertising events %d", maxEvents)
+	}
+	s.muEnable.Lock()
+	defer s.muEnable.Unlock()
+
+	// The set is marked as advertising before it's enabled, since it might
+	// stop before the command completes.
+	s.mu.Lock()
+	if s.removed {
+		s.mu.Unlock()
+		return errors.New("advertising set removed")
+	}
+	if !s.enabled {
+		s.enabled = true
+		s.chDone = make(chan struct{})
+	}
+	s.duration, s.maxEvents = uint16(d), uint8(maxEvents)
+	s.mu.Unlock()
+	if err := s.h.Send(&cmd.LESetExtendedAdvertisingEnable{
+		Enable:                       1,
+		AdvertisingHandle:            []uint8{s.handle},
+		Duration:                     []uint16{uint16(d)},
+		MaxExtendedAdvertisingEvents: []uint8{uint8(maxEvents)},
+	}, nil); err != nil {
+		s.mu.Lock()
+		s.stopped()
+		s.mu.Unlock()
+		return errors.Wrap(err, "can't enable advertising set")
+	}
+	return nil
+}
+
+// Disable stops advertising.
+func (s *AdvertisingSet) Disable() error {
+	s.muEnable.Lock()
+	defer s.muEnable.Unlock()
+	s.mu.Lock()
+	enabled := s.enabled
+	s.mu.Unlock()
+	if !enabled {
+		return nil
+	}
+	if err := s.h.Send(&cmd.LESetExtendedAdvertisingEnable{
+		Enable:                       0,
+		AdvertisingHandle:            []uint8{s.handle},
+		Duration:                     []uint16{0},
+		MaxExtendedAdvertisingEvents: []uint8{0},
+	}, nil); err != nil {
+		return errors.Wrap(err, "can't disable advertising set")
+	}
+	s.mu.Lock()
+	s.stopped()
+	s.mu.Unlock()
+	return nil
+}
+
+// Done returns a receiving channel, which is closed when the set stops
+// advertising, because it's disabled, its duration or number of advertising
+// events is reached, or a connection is created.
+func (s *AdvertisingSet) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chDone
+}
+
+// stopped marks the set as not advertising. It's called with s.mu held.
+func (s *AdvertisingSet) stopped() {
+	if s.enabled {
+		s.enabled = false
+		close(s.chDone)
+	}
+}
+
+// Remove stops advertising, and removes the set from the controller.
+func (s *AdvertisingSet) Remove() error {
+	if err := s.Disable(); err != nil {
+		return err
+	}
+	if err := s.h.Send(&cmd.LERemoveAdvertisingSet{AdvertisingHandle: s.handle}, nil); err != nil {
+		return errors.Wrap(err, "can't remove advertising set")
+	}
+	s.h.muAdvSets.Lock()
+	s.remove()
+	s.h.muAdvSets.Unlock()
+	return nil
+}
+
+// remove forgets the set. It's called with h.muAdvSets held.
+func (s *AdvertisingSet) remove() {
+	s.mu.Lock()
+	s.removed = true
+	s.stopped()
+	s.mu.Unlock()
+	delete(s.h.advSets, s.handle)
+}
+
+// pauseAdvSets disables the enabled advertising sets, and returns the function
+// which enables them again. The sets can't be enabled or disabled until then.
+// They are enabled with their duration and number of advertising events,
+// which start over.
+func (h *HCI) pauseAdvSets() func() {
+	h.muAdvSets.Lock()
+	sets := make([]*AdvertisingSet, 0, len(h.advSets))
+	for _, s := range h.advSets {
+		sets = append(sets, s)
+	}
+	h.muAdvSets.Unlock()
+
+	disable := &cmd.LESetExtendedAdvertisingEnable{Enable: 0}
+	for _, s := range sets {
+		s.muEnable.Lock()
+		s.mu.Lock()
+		if s.enabled {
+			disable.AdvertisingHandle = append(disable.AdvertisingHandle, s.handle)
+			disable.Duration = append(disable.Duration, 0)
+			disable.MaxExtendedAdvertisingEvents = append(disable.MaxExtendedAdvertisingEvents, 0)
+		}
+		s.mu.Unlock()
+	}
+	if len(disable.AdvertisingHandle) > 0 {
+		h.Send(disable, nil)
+	}
+
+	return func() {
+		enable := &cmd.LESetExtendedAdvertisingEnable{Enable: 1}
+		for _, s := range sets {
+			s.mu.Lock()
+			if s.enabled {
+				enable.AdvertisingHandle = append(enable.AdvertisingHandle, s.handle)
+				enable.Duration = append(enable.Duration, s.duration)
+				enable.MaxExtendedAdvertisingEvents = append(enable.MaxExtendedAdvertisingEvents, s.maxEvents)
+			}
+			s.mu.Unlock()
+		}
+		if len(enable.AdvertisingHandle) > 0 {
+			h.Send(enable, nil)
+		}
+		for _, s := range sets {
+			s.muEnable.Unlock()
+		}
+	}
+}
+
+// setAdvSetsRPA sets the RPA of the device as the random address of the sets,
+// which advertise with it. The sets must be disabled.
+func (h *HCI) setAdvSetsRPA(rpa [6]byte) error {
+	h.muAdvSets.Lock()
+	sets := make([]*AdvertisingSet, 0, len(h.advSets))
+	for _, s := range h.advSets {
+		if s.privacy {
+			sets = append(sets, s)
+		}
+	}
+	h.muAdvSets.Unlock()
+
+	for _, s := range sets {
+		if err := h.Send(&cmd.LESetAdvertisingSetRandomAddress{
+			AdvertisingHandle: s.handle,
+			RandomAddress:     rpa,
+		}, nil); err != nil {
+			return errors.Wrapf(err, "can't set random address of advertising set %d", s.handle)
+		}
+		s.mu.Lock()
+		s.ownAddr = rpa
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// ClearAdvertisingSets stops advertising, and removes all the advertising sets.
+func (h *HCI) ClearAdvertisingSets() error {
+	if !h.extended {
+		return ErrLegacyMode
+	}
+	if err := h.Send(&cmd.LESetExtendedAdvertisingEnable{Enable: 0}, nil); err != nil {
+		return errors.Wrap(err, "can't disable advertising sets")
+	}
+	if err := h.Send(&cmd.LEClearAdvertisingSets{}, nil); err != nil {
+		return errors.Wrap(err, "can't clear advertising sets")
+	}
+	h.muAdvSets.Lock()
+	defer h.muAdvSets.Unlock()
+	for _, s := range h.advSets {
+		s.remove()
+	}
+	return nil
+}
+
+// handleLEAdvertisingSetTerminated handles a set, which stopped advertising
+// because its duration or number of advertising events is reached, or a
+// connection is created [Vol 2, Part E, 7.7.65.18].
+func (h *HCI) handleLEAdvertisingSetTerminated(b []byte) error {
+	e := evt.LEAdvertisingSetTerminated(b)
+	h.muAdvSets.Lock()
+	s, found := h.advSets[e.AdvertisingHandle()]
+	h.muAdvSets.Unlock()
+	if found {
+		s.mu.Lock()
+		s.stopped()
+		s.mu.Unlock()
+	}
+	if e.Status() != 0x00 {
+		return nil
+	}
+
+	// The connection is created with the address of the set, which is set
+	// before the connection is handed to Accept.
+	h.muConns.Lock()
+	c, pending := h.pendingSlaves[e.ConnectionHandle()]
+	delete(h.pendingSlaves, e.ConnectionHandle())
+	h.muConns.Unlock()
+	if !pending {
+		return nil
+	}
+	if found {
+		s.mu.Lock()
+		c.localAddrType, c.localAddr = s.ownAddrType, s.ownAddr
+		s.mu.Unlock()
+	}
+	h.accepted(c)
+	return nil
+}
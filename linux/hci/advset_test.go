@@ -0,0 +1,190 @@
+package hci
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+func TestFragmentAdvData(t *testing.T) {
+	tests := []struct {
+		n    int
+		lens []int
+		ops  []uint8
+	}{
+		{0, []int{0}, []uint8{advDataComplete}},
+		{251, []int{251}, []uint8{advDataComplete}},
+		{252, []int{251, 1}, []uint8{advDataFirst, advDataLast}},
+		{1650, []int{251, 251, 251, 251, 251, 251, 144}, []uint8{
+			advDataFirst, advDataIntermediate, advDataIntermediate, advDataIntermediate,
+			advDataIntermediate, advDataIntermediate, advDataLast}},
+	}
+	for _, tt := range tests {
+		b := make([]byte, tt.n)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		frags, ops := fragmentAdvData(b)
+		if len(frags) != len(tt.lens) || !bytes.Equal(ops, tt.ops) {
+			t.Errorf("%d bytes: %d fragments, ops %v, want %d, %v", tt.n, len(frags), ops, len(tt.lens), tt.ops)
+			continue
+		}
+		for i, f := range frags {
+			if len(f) != tt.lens[i] {
+				t.Errorf("%d bytes: fragment %d is %d bytes, want %d", tt.n, i, len(f), tt.lens[i])
+			}
+		}
+		if got := bytes.Join(frags, nil); !bytes.Equal(got, b) {
+			t.Errorf("%d bytes: fragments don't add up to the data", tt.n)
+		}
+	}
+}
+
+func TestExtendedAdvertisingEnable(t *testing.T) {
+	c := &cmd.LESetExtendedAdvertisingEnable{
+		Enable:                       1,
+		AdvertisingHandle:            []uint8{0, 1},
+		Duration:                     []uint16{0, 0x0102},
+		MaxExtendedAdvertisingEvents: []uint8{0, 5},
+	}
+	b := make([]byte, cmdBufSize)
+	if err := c.Marshal(b); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x01, 0x05}
+	if c.Len() != len(want) || !bytes.Equal(b[:c.Len()], want) {
+		t.Errorf("Marshal() = %X, want %X", b[:c.Len()], want)
+	}
+}
+
+func TestAdvSetParams(t *testing.T) {
+	h := &HCI{}
+	c, err := h.advSetParams(AdvertisingSetParams{
+		Connectable:  true,
+		IntervalMin:  100 * time.Millisecond,
+		SecondaryPHY: ble.PHY2M,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AdvertisingEventProperties != advPropConnectable ||
+		c.PrimaryAdvertisingIntervalMin != [3]byte{0xA0, 0, 0} ||
+		c.PrimaryAdvertisingIntervalMax != [3]byte{0xA0, 0, 0} ||
+		c.PrimaryAdvertisingPHY != 0x01 || c.SecondaryAdvertisingPHY != 0x02 {
+		t.Errorf("advSetParams() = %+v", c)
+	}
+
+	for _, p := range []AdvertisingSetParams{
+		{Connectable: true, Scannable: true},
+		{Legacy: true, Connectable: true},
+		{PrimaryPHY: ble.PHY2M},
+		{Legacy: true, PrimaryPHY: ble.PHYCoded},
+		{IntervalMin: 10 * time.Millisecond},
+		{IntervalMin: 50 * time.Millisecond, IntervalMax: 30 * time.Millisecond},
+		{SID: 0x10},
+	} {
+		if _, err := h.advSetParams(p); err == nil {
+			t.Errorf("advSetParams(%+v) succeeded", p)
+		}
+	}
+}
+
+func TestAdvertisingSetConnection(t *testing.T) {
+	s := &AdvertisingSet{handle: 1, ownAddrType: 0x01, ownAddr: [6]byte{1, 2, 3, 4, 5, 0xC6}}
+	h := &HCI{
+		muConns:       &sync.Mutex{},
+		conns:         make(map[uint16]*Conn),
+		pendingSlaves: make(map[uint16]*Conn),
+		advSets:       map[uint8]*AdvertisingSet{1: s},
+		chSlaveConn:   make(chan *Conn, 1),
+		pool:          NewPool(32, 2),
+		addr:          net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+	}
+
+	// A slave connection with handle 0x0040 to a public address.
+	e := []byte{0x01, 0x00, 0x40, 0x00, 0x01, 0x00, 0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6,
+		0x18, 0x00, 0x00, 0x00, 0x90, 0x01, 0x00}
+	if err := h.connected(evt.LEConnectionComplete(e), nil, [6]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.chSlaveConn:
+		t.Fatal("connection accepted before the set reported its address")
+	default:
+	}
+
+	// The set 1 terminated, as the connection 0x0040 was created.
+	if err := h.handleLEAdvertisingSetTerminated([]byte{0x12, 0x00, 0x01, 0x40, 0x00, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-h.chSlaveConn:
+		if typ, a := c.localAddress(); typ != s.ownAddrType || a != s.ownAddr {
+			t.Errorf("local address = %d %X, want %d %X", typ, a, s.ownAddrType, s.ownAddr)
+		}
+		close(c.chInPkt)
+	default:
+		t.Fatal("connection not accepted")
+	}
+}
+
+func TestExtendedMode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		phys     ble.PHY
+		features uint64
+		extended bool
+		err      error
+	}{
+		{"legacy", 0, leFeatureExtendedAdvertising, false, nil},
+		{"extended", ble.PHY1M, leFeatureExtendedAdvertising, true, nil},
+		{"extended not supported", ble.PHY1M, 0, false, ErrExtAdvNotSupported},
+	} {
+		h, err := NewHCI(ble.OptExtendedScan(tc.phys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.setAllowedCommands(1)
+		h.skt = &testSocket{
+			h:   h,
+			cmd: func(op int, b []byte) {},
+			rp: func(op int) []byte {
+				if op == (&cmd.LEReadLocalSupportedFeatures{}).OpCode() {
+					b := make([]byte, 8)
+					binary.LittleEndian.PutUint64(b, tc.features)
+					return b
+				}
+				return nil
+			},
+		}
+		if err := h.init(); err != tc.err {
+			t.Errorf("%s: init() = %v, want %v", tc.name, err, tc.err)
+		}
+		if h.extended != tc.extended {
+			t.Errorf("%s: extended = %v, want %v", tc.name, h.extended, tc.extended)
+		}
+		if tc.err != nil || tc.extended {
+			continue
+		}
+
+		// The extended commands are rejected without sending them.
+		h.skt = &testSocket{h: h, cmd: func(op int, b []byte) {
+			t.Errorf("%s: command 0x%04X sent", tc.name, op)
+		}}
+		if _, err := h.NewAdvertisingSet(AdvertisingSetParams{}); err != ErrLegacyMode {
+			t.Errorf("%s: NewAdvertisingSet() = %v, want %v", tc.name, err, ErrLegacyMode)
+		}
+		h.leFeatures |= leFeaturePeriodicAdvertising
+		if _, err := h.SyncPeriodic(context.Background(), ble.NewAddr("11:22:33:44:55:66"), 0); err != ErrLegacyMode {
+			t.Errorf("%s: SyncPeriodic() = %v, want %v", tc.name, err, ErrLegacyMode)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
@@ -29,3 +30,130 @@ func unmarshal(c commandRP, b []byte) error {
 	buf := bytes.NewBuffer(b)
 	return binary.Read(buf, binary.LittleEndian, c)
 }
+
+// Len returns the length of the command.
+func (c *LESetExtendedAdvertisingData) Len() int { return 4 + len(c.AdvertisingData) }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetExtendedAdvertisingData) Marshal(b []byte) error {
+	return marshalExtendedData(b, c.AdvertisingHandle, c.Operation, c.FragmentPreference, c.AdvertisingData)
+}
+
+// Len returns the length of the command.
+func (c *LESetExtendedScanResponseData) Len() int { return 4 + len(c.ScanResponseData) }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetExtendedScanResponseData) Marshal(b []byte) error {
+	return marshalExtendedData(b, c.AdvertisingHandle, c.Operation, c.FragmentPreference, c.ScanResponseData)
+}
+
+// marshalExtendedData serializes the parameters of the extended advertising
+// and scan response data, which is up to 251 bytes [Vol 2, Part E, 7.8.54].
+func marshalExtendedData(b []byte, handle, op, frag uint8, data []byte) error {
+	if len(data) > 251 {
+		return io.ErrShortWrite
+	}
+	if len(b) < 4+len(data) {
+		return io.ErrShortBuffer
+	}
+	b[0], b[1], b[2], b[3] = handle, op, frag, uint8(len(data))
+	copy(b[4:], data)
+	return nil
+}
+
+// Len returns the length of the command.
+func (c *LESetPeriodicAdvertisingData) Len() int { return 3 + len(c.AdvertisingData) }
+
+// Marshal serializes the command parameters into binary form. The data is up
+// to 252 bytes [Vol 2, Part E, 7.8.62].
+func (c *LESetPeriodicAdvertisingData) Marshal(b []byte) error {
+	if len(c.AdvertisingData) > 252 {
+		return io.ErrShortWrite
+	}
+	if len(b) < c.Len() {
+		return io.ErrShortBuffer
+	}
+	b[0], b[1], b[2] = c.AdvertisingHandle, c.Operation, uint8(len(c.AdvertisingData))
+	copy(b[3:], c.AdvertisingData)
+	return nil
+}
+
+// Len returns the length of the command.
+func (c *LESetExtendedAdvertisingEnable) Len() int { return 2 + 4*len(c.AdvertisingHandle) }
+
+// Marshal serializes the command parameters into binary form. The sets are
+// listed in AdvertisingHandle, Duration and MaxExtendedAdvertisingEvents,
+// which have the same length, and their parameters are interleaved.
+// Disabling without sets disables all of them.
+func (c *LESetExtendedAdvertisingEnable) Marshal(b []byte) error {
+	n := len(c.AdvertisingHandle)
+	if len(c.Duration) != n || len(c.MaxExtendedAdvertisingEvents) != n {
+		return errors.New("mismatched number of advertising sets")
+	}
+	if len(b) < c.Len() {
+		return io.ErrShortBuffer
+	}
+	b[0], b[1] = c.Enable, uint8(n)
+	for i := 0; i < n; i++ {
+		p := b[2+4*i:]
+		p[0] = c.AdvertisingHandle[i]
+		binary.LittleEndian.PutUint16(p[1:], c.Duration[i])
+		p[3] = c.MaxExtendedAdvertisingEvents[i]
+	}
+	return nil
+}
+
+// Len returns the length of the command.
+func (c *LESetExtendedScanParameters) Len() int { return 3 + 5*len(c.ScanType) }
+
+// Marshal serializes the command parameters into binary form. The parameters
+// of each PHY in ScanningPHYs, from the lowest bit, are interleaved in
+// ScanType, ScanInterval and ScanWindow, which have the same length.
+func (c *LESetExtendedScanParameters) Marshal(b []byte) error {
+	n := len(c.ScanType)
+	if len(c.ScanInterval) != n || len(c.ScanWindow) != n {
+		return errors.New("mismatched number of scanning PHYs")
+	}
+	if len(b) < c.Len() {
+		return io.ErrShortBuffer
+	}
+	b[0], b[1], b[2] = c.OwnAddressType, c.ScanningFilterPolicy, c.ScanningPHYs
+	for i := 0; i < n; i++ {
+		p := b[3+5*i:]
+		p[0] = c.ScanType[i]
+		binary.LittleEndian.PutUint16(p[1:], c.ScanInterval[i])
+		binary.LittleEndian.PutUint16(p[3:], c.ScanWindow[i])
+	}
+	return nil
+}
+
+// Len returns the length of the command.
+func (c *LEExtendedCreateConnection) Len() int { return 10 + 16*len(c.ScanInterval) }
+
+// Marshal serializes the command parameters into binary form. The parameters
+// of each PHY in InitiatingPHYs, from the lowest bit, are interleaved in
+// ScanInterval, ScanWindow and the connection parameters, which have the
+// same length.
+func (c *LEExtendedCreateConnection) Marshal(b []byte) error {
+	n := len(c.ScanInterval)
+	for _, p := range [][]uint16{c.ScanWindow, c.ConnIntervalMin, c.ConnIntervalMax, c.ConnLatency,
+		c.SupervisionTimeout, c.MinimumCELength, c.MaximumCELength} {
+		if len(p) != n {
+			return errors.New("mismatched number of initiating PHYs")
+		}
+	}
+	if len(b) < c.Len() {
+		return io.ErrShortBuffer
+	}
+	b[0], b[1], b[2] = c.InitiatorFilterPolicy, c.OwnAddressType, c.PeerAddressType
+	copy(b[3:9], c.PeerAddress[:])
+	b[9] = c.InitiatingPHYs
+	for i := 0; i < n; i++ {
+		p := b[10+16*i:]
+		for j, v := range []uint16{c.ScanInterval[i], c.ScanWindow[i], c.ConnIntervalMin[i], c.ConnIntervalMax[i],
+			c.ConnLatency[i], c.SupervisionTimeout[i], c.MinimumCELength[i], c.MaximumCELength[i]} {
+			binary.LittleEndian.PutUint16(p[2*j:], v)
+		}
+	}
+	return nil
+}
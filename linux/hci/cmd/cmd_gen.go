@@ -1560,3 +1560,962 @@ type LERemoteConnectionParameterRequestNegativeReplyRP struct {
 func (c *LERemoteConnectionParameterRequestNegativeReplyRP) Unmarshal(b []byte) error {
 	return unmarshal(c, b)
 }
+
+// LESetDataLength implements LE Set Data Length (0x08|0x0022) [Vol 2, Part E, 7.8.33]
+type LESetDataLength struct {
+	ConnectionHandle uint16
+	TxOctets         uint16
+	TxTime           uint16
+}
+
+func (c *LESetDataLength) String() string {
+	return "LE Set Data Length (0x08|0x0022)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetDataLength) OpCode() int { return 0x08<<10 | 0x0022 }
+
+// Len returns the length of the command.
+func (c *LESetDataLength) Len() int { return 6 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetDataLength) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetDataLengthRP returns the return parameter of LE Set Data Length
+type LESetDataLengthRP struct {
+	Status           uint8
+	ConnectionHandle uint16
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetDataLengthRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEReadSuggestedDefaultDataLength implements LE Read Suggested Default Data Length (0x08|0x0023) [Vol 2, Part E, 7.8.34]
+type LEReadSuggestedDefaultDataLength struct {
+}
+
+func (c *LEReadSuggestedDefaultDataLength) String() string {
+	return "LE Read Suggested Default Data Length (0x08|0x0023)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEReadSuggestedDefaultDataLength) OpCode() int { return 0x08<<10 | 0x0023 }
+
+// Len returns the length of the command.
+func (c *LEReadSuggestedDefaultDataLength) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEReadSuggestedDefaultDataLength) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEReadSuggestedDefaultDataLengthRP returns the return parameter of LE Read Suggested Default Data Length
+type LEReadSuggestedDefaultDataLengthRP struct {
+	Status               uint8
+	SuggestedMaxTxOctets uint16
+	SuggestedMaxTxTime   uint16
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEReadSuggestedDefaultDataLengthRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEWriteSuggestedDefaultDataLength implements LE Write Suggested Default Data Length (0x08|0x0024) [Vol 2, Part E, 7.8.35]
+type LEWriteSuggestedDefaultDataLength struct {
+	SuggestedMaxTxOctets uint16
+	SuggestedMaxTxTime   uint16
+}
+
+func (c *LEWriteSuggestedDefaultDataLength) String() string {
+	return "LE Write Suggested Default Data Length (0x08|0x0024)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEWriteSuggestedDefaultDataLength) OpCode() int { return 0x08<<10 | 0x0024 }
+
+// Len returns the length of the command.
+func (c *LEWriteSuggestedDefaultDataLength) Len() int { return 4 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEWriteSuggestedDefaultDataLength) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEWriteSuggestedDefaultDataLengthRP returns the return parameter of LE Write Suggested Default Data Length
+type LEWriteSuggestedDefaultDataLengthRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEWriteSuggestedDefaultDataLengthRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEAddDeviceToResolvingList implements LE Add Device To Resolving List (0x08|0x0027) [Vol 2, Part E, 7.8.38]
+type LEAddDeviceToResolvingList struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+	PeerIRK                 [16]byte
+	LocalIRK                [16]byte
+}
+
+func (c *LEAddDeviceToResolvingList) String() string {
+	return "LE Add Device To Resolving List (0x08|0x0027)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEAddDeviceToResolvingList) OpCode() int { return 0x08<<10 | 0x0027 }
+
+// Len returns the length of the command.
+func (c *LEAddDeviceToResolvingList) Len() int { return 39 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEAddDeviceToResolvingList) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEAddDeviceToResolvingListRP returns the return parameter of LE Add Device To Resolving List
+type LEAddDeviceToResolvingListRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEAddDeviceToResolvingListRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LERemoveDeviceFromResolvingList implements LE Remove Device From Resolving List (0x08|0x0028) [Vol 2, Part E, 7.8.39]
+type LERemoveDeviceFromResolvingList struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+}
+
+func (c *LERemoveDeviceFromResolvingList) String() string {
+	return "LE Remove Device From Resolving List (0x08|0x0028)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LERemoveDeviceFromResolvingList) OpCode() int { return 0x08<<10 | 0x0028 }
+
+// Len returns the length of the command.
+func (c *LERemoveDeviceFromResolvingList) Len() int { return 7 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LERemoveDeviceFromResolvingList) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LERemoveDeviceFromResolvingListRP returns the return parameter of LE Remove Device From Resolving List
+type LERemoveDeviceFromResolvingListRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LERemoveDeviceFromResolvingListRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEClearResolvingList implements LE Clear Resolving List (0x08|0x0029) [Vol 2, Part E, 7.8.40]
+type LEClearResolvingList struct {
+}
+
+func (c *LEClearResolvingList) String() string {
+	return "LE Clear Resolving List (0x08|0x0029)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEClearResolvingList) OpCode() int { return 0x08<<10 | 0x0029 }
+
+// Len returns the length of the command.
+func (c *LEClearResolvingList) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEClearResolvingList) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEClearResolvingListRP returns the return parameter of LE Clear Resolving List
+type LEClearResolvingListRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEClearResolvingListRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEReadResolvingListSize implements LE Read Resolving List Size (0x08|0x002A) [Vol 2, Part E, 7.8.41]
+type LEReadResolvingListSize struct {
+}
+
+func (c *LEReadResolvingListSize) String() string {
+	return "LE Read Resolving List Size (0x08|0x002A)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEReadResolvingListSize) OpCode() int { return 0x08<<10 | 0x002A }
+
+// Len returns the length of the command.
+func (c *LEReadResolvingListSize) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEReadResolvingListSize) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEReadResolvingListSizeRP returns the return parameter of LE Read Resolving List Size
+type LEReadResolvingListSizeRP struct {
+	Status            uint8
+	ResolvingListSize uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEReadResolvingListSizeRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetAddressResolutionEnable implements LE Set Address Resolution Enable (0x08|0x002D) [Vol 2, Part E, 7.8.44]
+type LESetAddressResolutionEnable struct {
+	AddressResolutionEnable uint8
+}
+
+func (c *LESetAddressResolutionEnable) String() string {
+	return "LE Set Address Resolution Enable (0x08|0x002D)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetAddressResolutionEnable) OpCode() int { return 0x08<<10 | 0x002D }
+
+// Len returns the length of the command.
+func (c *LESetAddressResolutionEnable) Len() int { return 1 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetAddressResolutionEnable) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetAddressResolutionEnableRP returns the return parameter of LE Set Address Resolution Enable
+type LESetAddressResolutionEnableRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetAddressResolutionEnableRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetResolvablePrivateAddressTimeout implements LE Set Resolvable Private Address Timeout (0x08|0x002E) [Vol 2, Part E, 7.8.45]
+type LESetResolvablePrivateAddressTimeout struct {
+	RPATimeout uint16
+}
+
+func (c *LESetResolvablePrivateAddressTimeout) String() string {
+	return "LE Set Resolvable Private Address Timeout (0x08|0x002E)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetResolvablePrivateAddressTimeout) OpCode() int { return 0x08<<10 | 0x002E }
+
+// Len returns the length of the command.
+func (c *LESetResolvablePrivateAddressTimeout) Len() int { return 2 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetResolvablePrivateAddressTimeout) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetResolvablePrivateAddressTimeoutRP returns the return parameter of LE Set Resolvable Private Address Timeout
+type LESetResolvablePrivateAddressTimeoutRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetResolvablePrivateAddressTimeoutRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEReadMaximumDataLength implements LE Read Maximum Data Length (0x08|0x002F) [Vol 2, Part E, 7.8.46]
+type LEReadMaximumDataLength struct {
+}
+
+func (c *LEReadMaximumDataLength) String() string {
+	return "LE Read Maximum Data Length (0x08|0x002F)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEReadMaximumDataLength) OpCode() int { return 0x08<<10 | 0x002F }
+
+// Len returns the length of the command.
+func (c *LEReadMaximumDataLength) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEReadMaximumDataLength) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEReadMaximumDataLengthRP returns the return parameter of LE Read Maximum Data Length
+type LEReadMaximumDataLengthRP struct {
+	Status               uint8
+	SupportedMaxTxOctets uint16
+	SupportedMaxTxTime   uint16
+	SupportedMaxRxOctets uint16
+	SupportedMaxRxTime   uint16
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEReadMaximumDataLengthRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEReadPHY implements LE Read PHY (0x08|0x0030) [Vol 2, Part E, 7.8.47]
+type LEReadPHY struct {
+	ConnectionHandle uint16
+}
+
+func (c *LEReadPHY) String() string {
+	return "LE Read PHY (0x08|0x0030)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEReadPHY) OpCode() int { return 0x08<<10 | 0x0030 }
+
+// Len returns the length of the command.
+func (c *LEReadPHY) Len() int { return 2 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEReadPHY) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEReadPHYRP returns the return parameter of LE Read PHY
+type LEReadPHYRP struct {
+	Status           uint8
+	ConnectionHandle uint16
+	TXPHY            uint8
+	RXPHY            uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEReadPHYRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetDefaultPHY implements LE Set Default PHY (0x08|0x0031) [Vol 2, Part E, 7.8.48]
+type LESetDefaultPHY struct {
+	AllPHYs uint8
+	TXPHYs  uint8
+	RXPHYs  uint8
+}
+
+func (c *LESetDefaultPHY) String() string {
+	return "LE Set Default PHY (0x08|0x0031)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetDefaultPHY) OpCode() int { return 0x08<<10 | 0x0031 }
+
+// Len returns the length of the command.
+func (c *LESetDefaultPHY) Len() int { return 3 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetDefaultPHY) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetDefaultPHYRP returns the return parameter of LE Set Default PHY
+type LESetDefaultPHYRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetDefaultPHYRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetPHY implements LE Set PHY (0x08|0x0032) [Vol 2, Part E, 7.8.49]
+type LESetPHY struct {
+	ConnectionHandle uint16
+	AllPHYs          uint8
+	TXPHYs           uint8
+	RXPHYs           uint8
+	PHYOptions       uint16
+}
+
+func (c *LESetPHY) String() string {
+	return "LE Set PHY (0x08|0x0032)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetPHY) OpCode() int { return 0x08<<10 | 0x0032 }
+
+// Len returns the length of the command.
+func (c *LESetPHY) Len() int { return 7 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetPHY) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetAdvertisingSetRandomAddress implements LE Set Advertising Set Random Address (0x08|0x0035) [Vol 2, Part E, 7.8.52]
+type LESetAdvertisingSetRandomAddress struct {
+	AdvertisingHandle uint8
+	RandomAddress     [6]byte
+}
+
+func (c *LESetAdvertisingSetRandomAddress) String() string {
+	return "LE Set Advertising Set Random Address (0x08|0x0035)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetAdvertisingSetRandomAddress) OpCode() int { return 0x08<<10 | 0x0035 }
+
+// Len returns the length of the command.
+func (c *LESetAdvertisingSetRandomAddress) Len() int { return 7 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetAdvertisingSetRandomAddress) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetAdvertisingSetRandomAddressRP returns the return parameter of LE Set Advertising Set Random Address
+type LESetAdvertisingSetRandomAddressRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetAdvertisingSetRandomAddressRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetExtendedAdvertisingParameters implements LE Set Extended Advertising Parameters (0x08|0x0036) [Vol 2, Part E, 7.8.53]
+type LESetExtendedAdvertisingParameters struct {
+	AdvertisingHandle             uint8
+	AdvertisingEventProperties    uint16
+	PrimaryAdvertisingIntervalMin [3]byte
+	PrimaryAdvertisingIntervalMax [3]byte
+	PrimaryAdvertisingChannelMap  uint8
+	OwnAddressType                uint8
+	PeerAddressType               uint8
+	PeerAddress                   [6]byte
+	AdvertisingFilterPolicy       uint8
+	AdvertisingTxPower            int8
+	PrimaryAdvertisingPHY         uint8
+	SecondaryAdvertisingMaxSkip   uint8
+	SecondaryAdvertisingPHY       uint8
+	AdvertisingSID                uint8
+	ScanRequestNotificationEnable uint8
+}
+
+func (c *LESetExtendedAdvertisingParameters) String() string {
+	return "LE Set Extended Advertising Parameters (0x08|0x0036)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedAdvertisingParameters) OpCode() int { return 0x08<<10 | 0x0036 }
+
+// Len returns the length of the command.
+func (c *LESetExtendedAdvertisingParameters) Len() int { return 25 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetExtendedAdvertisingParameters) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetExtendedAdvertisingParametersRP returns the return parameter of LE Set Extended Advertising Parameters
+type LESetExtendedAdvertisingParametersRP struct {
+	Status          uint8
+	SelectedTxPower int8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedAdvertisingParametersRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetExtendedAdvertisingData implements LE Set Extended Advertising Data (0x08|0x0037) [Vol 2, Part E, 7.8.54]
+type LESetExtendedAdvertisingData struct {
+	AdvertisingHandle  uint8
+	Operation          uint8
+	FragmentPreference uint8
+	AdvertisingData    []byte
+}
+
+func (c *LESetExtendedAdvertisingData) String() string {
+	return "LE Set Extended Advertising Data (0x08|0x0037)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedAdvertisingData) OpCode() int { return 0x08<<10 | 0x0037 }
+
+// LESetExtendedAdvertisingDataRP returns the return parameter of LE Set Extended Advertising Data
+type LESetExtendedAdvertisingDataRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedAdvertisingDataRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetExtendedScanResponseData implements LE Set Extended Scan Response Data (0x08|0x0038) [Vol 2, Part E, 7.8.55]
+type LESetExtendedScanResponseData struct {
+	AdvertisingHandle  uint8
+	Operation          uint8
+	FragmentPreference uint8
+	ScanResponseData   []byte
+}
+
+func (c *LESetExtendedScanResponseData) String() string {
+	return "LE Set Extended Scan Response Data (0x08|0x0038)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedScanResponseData) OpCode() int { return 0x08<<10 | 0x0038 }
+
+// LESetExtendedScanResponseDataRP returns the return parameter of LE Set Extended Scan Response Data
+type LESetExtendedScanResponseDataRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedScanResponseDataRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetExtendedAdvertisingEnable implements LE Set Extended Advertising Enable (0x08|0x0039) [Vol 2, Part E, 7.8.56]
+type LESetExtendedAdvertisingEnable struct {
+	Enable                       uint8
+	AdvertisingHandle            []uint8
+	Duration                     []uint16
+	MaxExtendedAdvertisingEvents []uint8
+}
+
+func (c *LESetExtendedAdvertisingEnable) String() string {
+	return "LE Set Extended Advertising Enable (0x08|0x0039)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedAdvertisingEnable) OpCode() int { return 0x08<<10 | 0x0039 }
+
+// LESetExtendedAdvertisingEnableRP returns the return parameter of LE Set Extended Advertising Enable
+type LESetExtendedAdvertisingEnableRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedAdvertisingEnableRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEReadMaximumAdvertisingDataLength implements LE Read Maximum Advertising Data Length (0x08|0x003A) [Vol 2, Part E, 7.8.57]
+type LEReadMaximumAdvertisingDataLength struct {
+}
+
+func (c *LEReadMaximumAdvertisingDataLength) String() string {
+	return "LE Read Maximum Advertising Data Length (0x08|0x003A)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEReadMaximumAdvertisingDataLength) OpCode() int { return 0x08<<10 | 0x003A }
+
+// Len returns the length of the command.
+func (c *LEReadMaximumAdvertisingDataLength) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEReadMaximumAdvertisingDataLength) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEReadMaximumAdvertisingDataLengthRP returns the return parameter of LE Read Maximum Advertising Data Length
+type LEReadMaximumAdvertisingDataLengthRP struct {
+	Status                       uint8
+	MaximumAdvertisingDataLength uint16
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEReadMaximumAdvertisingDataLengthRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEReadNumberOfSupportedAdvertisingSets implements LE Read Number Of Supported Advertising Sets (0x08|0x003B) [Vol 2, Part E, 7.8.58]
+type LEReadNumberOfSupportedAdvertisingSets struct {
+}
+
+func (c *LEReadNumberOfSupportedAdvertisingSets) String() string {
+	return "LE Read Number Of Supported Advertising Sets (0x08|0x003B)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEReadNumberOfSupportedAdvertisingSets) OpCode() int { return 0x08<<10 | 0x003B }
+
+// Len returns the length of the command.
+func (c *LEReadNumberOfSupportedAdvertisingSets) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEReadNumberOfSupportedAdvertisingSets) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEReadNumberOfSupportedAdvertisingSetsRP returns the return parameter of LE Read Number Of Supported Advertising Sets
+type LEReadNumberOfSupportedAdvertisingSetsRP struct {
+	Status                      uint8
+	NumSupportedAdvertisingSets uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEReadNumberOfSupportedAdvertisingSetsRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LERemoveAdvertisingSet implements LE Remove Advertising Set (0x08|0x003C) [Vol 2, Part E, 7.8.59]
+type LERemoveAdvertisingSet struct {
+	AdvertisingHandle uint8
+}
+
+func (c *LERemoveAdvertisingSet) String() string {
+	return "LE Remove Advertising Set (0x08|0x003C)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LERemoveAdvertisingSet) OpCode() int { return 0x08<<10 | 0x003C }
+
+// Len returns the length of the command.
+func (c *LERemoveAdvertisingSet) Len() int { return 1 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LERemoveAdvertisingSet) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LERemoveAdvertisingSetRP returns the return parameter of LE Remove Advertising Set
+type LERemoveAdvertisingSetRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LERemoveAdvertisingSetRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEClearAdvertisingSets implements LE Clear Advertising Sets (0x08|0x003D) [Vol 2, Part E, 7.8.60]
+type LEClearAdvertisingSets struct {
+}
+
+func (c *LEClearAdvertisingSets) String() string {
+	return "LE Clear Advertising Sets (0x08|0x003D)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEClearAdvertisingSets) OpCode() int { return 0x08<<10 | 0x003D }
+
+// Len returns the length of the command.
+func (c *LEClearAdvertisingSets) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEClearAdvertisingSets) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEClearAdvertisingSetsRP returns the return parameter of LE Clear Advertising Sets
+type LEClearAdvertisingSetsRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEClearAdvertisingSetsRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetPeriodicAdvertisingParameters implements LE Set Periodic Advertising Parameters (0x08|0x003E) [Vol 2, Part E, 7.8.61]
+type LESetPeriodicAdvertisingParameters struct {
+	AdvertisingHandle              uint8
+	PeriodicAdvertisingIntervalMin uint16
+	PeriodicAdvertisingIntervalMax uint16
+	PeriodicAdvertisingProperties  uint16
+}
+
+func (c *LESetPeriodicAdvertisingParameters) String() string {
+	return "LE Set Periodic Advertising Parameters (0x08|0x003E)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetPeriodicAdvertisingParameters) OpCode() int { return 0x08<<10 | 0x003E }
+
+// Len returns the length of the command.
+func (c *LESetPeriodicAdvertisingParameters) Len() int { return 7 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetPeriodicAdvertisingParameters) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetPeriodicAdvertisingParametersRP returns the return parameter of LE Set Periodic Advertising Parameters
+type LESetPeriodicAdvertisingParametersRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetPeriodicAdvertisingParametersRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetPeriodicAdvertisingData implements LE Set Periodic Advertising Data (0x08|0x003F) [Vol 2, Part E, 7.8.62]
+type LESetPeriodicAdvertisingData struct {
+	AdvertisingHandle uint8
+	Operation         uint8
+	AdvertisingData   []byte
+}
+
+func (c *LESetPeriodicAdvertisingData) String() string {
+	return "LE Set Periodic Advertising Data (0x08|0x003F)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetPeriodicAdvertisingData) OpCode() int { return 0x08<<10 | 0x003F }
+
+// LESetPeriodicAdvertisingDataRP returns the return parameter of LE Set Periodic Advertising Data
+type LESetPeriodicAdvertisingDataRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetPeriodicAdvertisingDataRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetPeriodicAdvertisingEnable implements LE Set Periodic Advertising Enable (0x08|0x0040) [Vol 2, Part E, 7.8.63]
+type LESetPeriodicAdvertisingEnable struct {
+	Enable            uint8
+	AdvertisingHandle uint8
+}
+
+func (c *LESetPeriodicAdvertisingEnable) String() string {
+	return "LE Set Periodic Advertising Enable (0x08|0x0040)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetPeriodicAdvertisingEnable) OpCode() int { return 0x08<<10 | 0x0040 }
+
+// Len returns the length of the command.
+func (c *LESetPeriodicAdvertisingEnable) Len() int { return 2 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetPeriodicAdvertisingEnable) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetPeriodicAdvertisingEnableRP returns the return parameter of LE Set Periodic Advertising Enable
+type LESetPeriodicAdvertisingEnableRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetPeriodicAdvertisingEnableRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetExtendedScanParameters implements LE Set Extended Scan Parameters (0x08|0x0041) [Vol 2, Part E, 7.8.64]
+type LESetExtendedScanParameters struct {
+	OwnAddressType       uint8
+	ScanningFilterPolicy uint8
+	ScanningPHYs         uint8
+	ScanType             []uint8
+	ScanInterval         []uint16
+	ScanWindow           []uint16
+}
+
+func (c *LESetExtendedScanParameters) String() string {
+	return "LE Set Extended Scan Parameters (0x08|0x0041)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedScanParameters) OpCode() int { return 0x08<<10 | 0x0041 }
+
+// LESetExtendedScanParametersRP returns the return parameter of LE Set Extended Scan Parameters
+type LESetExtendedScanParametersRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedScanParametersRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetExtendedScanEnable implements LE Set Extended Scan Enable (0x08|0x0042) [Vol 2, Part E, 7.8.65]
+type LESetExtendedScanEnable struct {
+	Enable           uint8
+	FilterDuplicates uint8
+	Duration         uint16
+	Period           uint16
+}
+
+func (c *LESetExtendedScanEnable) String() string {
+	return "LE Set Extended Scan Enable (0x08|0x0042)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedScanEnable) OpCode() int { return 0x08<<10 | 0x0042 }
+
+// Len returns the length of the command.
+func (c *LESetExtendedScanEnable) Len() int { return 6 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetExtendedScanEnable) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetExtendedScanEnableRP returns the return parameter of LE Set Extended Scan Enable
+type LESetExtendedScanEnableRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedScanEnableRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEExtendedCreateConnection implements LE Extended Create Connection (0x08|0x0043) [Vol 2, Part E, 7.8.66]
+type LEExtendedCreateConnection struct {
+	InitiatorFilterPolicy uint8
+	OwnAddressType        uint8
+	PeerAddressType       uint8
+	PeerAddress           [6]byte
+	InitiatingPHYs        uint8
+	ScanInterval          []uint16
+	ScanWindow            []uint16
+	ConnIntervalMin       []uint16
+	ConnIntervalMax       []uint16
+	ConnLatency           []uint16
+	SupervisionTimeout    []uint16
+	MinimumCELength       []uint16
+	MaximumCELength       []uint16
+}
+
+func (c *LEExtendedCreateConnection) String() string {
+	return "LE Extended Create Connection (0x08|0x0043)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEExtendedCreateConnection) OpCode() int { return 0x08<<10 | 0x0043 }
+
+// LEPeriodicAdvertisingCreateSync implements LE Periodic Advertising Create Sync (0x08|0x0044) [Vol 2, Part E, 7.8.67]
+type LEPeriodicAdvertisingCreateSync struct {
+	Options               uint8
+	AdvertisingSID        uint8
+	AdvertiserAddressType uint8
+	AdvertiserAddress     [6]byte
+	Skip                  uint16
+	SyncTimeout           uint16
+	SyncCTEType           uint8
+}
+
+func (c *LEPeriodicAdvertisingCreateSync) String() string {
+	return "LE Periodic Advertising Create Sync (0x08|0x0044)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEPeriodicAdvertisingCreateSync) OpCode() int { return 0x08<<10 | 0x0044 }
+
+// Len returns the length of the command.
+func (c *LEPeriodicAdvertisingCreateSync) Len() int { return 14 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEPeriodicAdvertisingCreateSync) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEPeriodicAdvertisingCreateSyncCancel implements LE Periodic Advertising Create Sync Cancel (0x08|0x0045) [Vol 2, Part E, 7.8.68]
+type LEPeriodicAdvertisingCreateSyncCancel struct {
+}
+
+func (c *LEPeriodicAdvertisingCreateSyncCancel) String() string {
+	return "LE Periodic Advertising Create Sync Cancel (0x08|0x0045)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEPeriodicAdvertisingCreateSyncCancel) OpCode() int { return 0x08<<10 | 0x0045 }
+
+// Len returns the length of the command.
+func (c *LEPeriodicAdvertisingCreateSyncCancel) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEPeriodicAdvertisingCreateSyncCancel) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEPeriodicAdvertisingCreateSyncCancelRP returns the return parameter of LE Periodic Advertising Create Sync Cancel
+type LEPeriodicAdvertisingCreateSyncCancelRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEPeriodicAdvertisingCreateSyncCancelRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEPeriodicAdvertisingTerminateSync implements LE Periodic Advertising Terminate Sync (0x08|0x0046) [Vol 2, Part E, 7.8.69]
+type LEPeriodicAdvertisingTerminateSync struct {
+	SyncHandle uint16
+}
+
+func (c *LEPeriodicAdvertisingTerminateSync) String() string {
+	return "LE Periodic Advertising Terminate Sync (0x08|0x0046)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEPeriodicAdvertisingTerminateSync) OpCode() int { return 0x08<<10 | 0x0046 }
+
+// Len returns the length of the command.
+func (c *LEPeriodicAdvertisingTerminateSync) Len() int { return 2 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEPeriodicAdvertisingTerminateSync) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEPeriodicAdvertisingTerminateSyncRP returns the return parameter of LE Periodic Advertising Terminate Sync
+type LEPeriodicAdvertisingTerminateSyncRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEPeriodicAdvertisingTerminateSyncRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetPrivacyMode implements LE Set Privacy Mode (0x08|0x004E) [Vol 2, Part E, 7.8.77]
+type LESetPrivacyMode struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+	PrivacyMode             uint8
+}
+
+func (c *LESetPrivacyMode) String() string {
+	return "LE Set Privacy Mode (0x08|0x004E)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetPrivacyMode) OpCode() int { return 0x08<<10 | 0x004E }
+
+// Len returns the length of the command.
+func (c *LESetPrivacyMode) Len() int { return 8 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetPrivacyMode) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetPrivacyModeRP returns the return parameter of LE Set Privacy Mode
+type LESetPrivacyModeRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetPrivacyModeRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
@@ -6,7 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
+	"sync"
 
 	"github.com/trustasia-com/ble"
 	"github.com/trustasia-com/ble/linux/hci/cmd"
@@ -44,7 +44,6 @@ type Conn struct {
 	sigRxMTU int
 	sigTxMTU int
 
-	sigSent chan []byte
 	// smpSent chan []byte
 
 	chInPkt chan packet
@@ -59,10 +58,52 @@ type Conn struct {
 	// The requesting device sets this field and the responding device uses the
 	// same value in its response. Within each signalling channel a different
 	// Identifier shall be used for each successive command. [Vol 3, Part A, 4]
-	sigID uint8
+	// sigReqs are the pending signaling requests, keyed by identifier.
+	sigID   uint8
+	sigReqs map[uint8]*sigReq
 
 	// leFrame is set to be true when the LE Credit based flow control is used.
 	leFrame bool
+
+	// muSig guards sigID, sigReqs and sigTxMTU.
+	muSig sync.Mutex
+
+	// muConnUpdate serializes the connection parameter updates, which wait
+	// for LE Connection Update Complete on chConnUpdate.
+	muConnUpdate sync.Mutex
+	chConnUpdate chan connUpdate
+
+	// params are the current connection parameters, which are updated by
+	// LE Connection Update Complete, and reported to paramsHandler.
+	muParams      sync.Mutex
+	params        connParams
+	paramsHandler ble.ConnParamsHandler
+
+	// dataLength is the data length of the link layer data packets, which is
+	// updated by LE Data Length Change.
+	muDataLength sync.Mutex
+	dataLength   ble.DataLength
+
+	// muPHY serializes the PHY updates, which wait for the status of
+	// LE PHY Update Complete on chPHYUpdate.
+	muPHY       sync.Mutex
+	chPHYUpdate chan uint8
+
+	// cocs are the L2CAP connection-oriented channels, keyed by local CID.
+	muCOC sync.Mutex
+	cocs  map[uint16]*coc
+
+	// smp runs the Security Manager Protocol on this connection.
+	smp *smp
+
+	// remoteAddr is the address of the remote device, resolved to its
+	// identity address if possible.
+	remoteAddr ble.Addr
+
+	// localAddr is the address, in wire order, which the local device used
+	// to establish the connection.
+	localAddrType uint8
+	localAddr     [6]byte
 }
 
 func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
@@ -85,7 +126,30 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 		txBuffer: NewClient(h.pool),
 
 		chDone: make(chan struct{}),
+
+		sigReqs: make(map[uint8]*sigReq),
+
+		chConnUpdate: make(chan connUpdate, 1),
+		chPHYUpdate:  make(chan uint8, 1),
+		params: connParams{
+			intervalMin: param.ConnInterval(),
+			intervalMax: param.ConnInterval(),
+			latency:     param.ConnLatency(),
+			timeout:     param.SupervisionTimeout(),
+		},
+
+		cocs: make(map[uint16]*coc),
+
+		dataLength: ble.DataLength{
+			TxOctets: defaultDataOctets,
+			TxTime:   defaultDataTime,
+			RxOctets: defaultDataOctets,
+			RxTime:   defaultDataTime,
+		},
 	}
+	c.smp = newSMP(c)
+	c.remoteAddr = h.resolveAddr(param.PeerAddressType(), param.PeerAddress())
+	c.localAddrType, c.localAddr = h.ownAddress()
 
 	go func() {
 		for {
@@ -96,6 +160,8 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 					_ = logger.Error("recombine failed: ", "err", err)
 				}
 				close(c.chInPDU)
+				c.smp.close()
+				c.closeCOCs()
 				return
 			}
 		}
@@ -206,6 +272,8 @@ func (c *Conn) writePDU(pdu []byte) (int, error) {
 
 	for len(pdu) > 0 {
 		// Get a buffer from our pre-allocated and flow-controlled pool.
+		// The buffers are sized by the HC_LE_ACL_Data_Packet_Length of the
+		// controller, which doesn't depend on the LL data length.
 		pkt := c.txBuffer.Get() // ACL pkt
 		flen := len(pdu)        // fragment length
 		if flen > pkt.Cap()-1-4 {
@@ -287,6 +355,10 @@ func (c *Conn) recombine() error {
 	case cidSMP:
 		c.handleSMP(p)
 	default:
+		if ch := c.coc(p.cid()); ch != nil {
+			ch.handleCOC(p)
+			break
+		}
 		logger.Info("recombine()", "unrecognized CID", fmt.Sprintf("%04X, [%X]", p.cid(), p))
 	}
 	return nil
@@ -321,15 +393,26 @@ func (c *Conn) Close() error {
 	}
 }
 
-// LocalAddr returns local device's MAC address.
-func (c *Conn) LocalAddr() ble.Addr { return c.hci.Addr() }
+// LocalAddr returns the address which the local device used to establish the
+// connection.
+func (c *Conn) LocalAddr() ble.Addr {
+	if c.localAddrType == 0x01 {
+		return RandomAddress{hwAddr(c.localAddr)}
+	}
+	return hwAddr(c.localAddr)
+}
 
-// RemoteAddr returns remote device's MAC address.
-func (c *Conn) RemoteAddr() ble.Addr {
-	a := c.param.PeerAddress()
-	return net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]})
+// localAddress returns the type and the address, in wire order, which the
+// local device uses on this connection.
+func (c *Conn) localAddress() (uint8, [6]byte) {
+	return c.localAddrType, c.localAddr
 }
 
+// RemoteAddr returns remote device's MAC address. If the remote device uses a
+// Resolvable Private Address which can be resolved with an IRK in the bond
+// store, its identity address is returned as a ResolvedAddress.
+func (c *Conn) RemoteAddr() ble.Addr { return c.remoteAddr }
+
 // RxMTU returns the MTU which the upper layer is capable of accepting.
 func (c *Conn) RxMTU() int { return c.rxMTU }
 
@@ -0,0 +1,253 @@
+package hci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// Ranges of the connection parameters [Vol 2, Part E, 7.8.18].
+const (
+	connIntervalMin       = 0x0006 // 7.5 ms
+	connIntervalMax       = 0x0C80 // 4 s
+	connLatencyMax        = 0x01F3 // 499 connection events
+	supervisionTimeoutMin = 0x000A // 100 ms
+	supervisionTimeoutMax = 0x0C80 // 32 s
+
+	connIntervalUnit       = 1250 * time.Microsecond
+	supervisionTimeoutUnit = 10 * time.Millisecond
+)
+
+// connParams are the connection parameters, in the units of the controller.
+type connParams struct {
+	intervalMin uint16
+	intervalMax uint16
+	latency     uint16
+	timeout     uint16
+}
+
+func newConnParams(min, max time.Duration, latency int, timeout time.Duration) connParams {
+	return connParams{
+		intervalMin: uint16(min / connIntervalUnit),
+		intervalMax: uint16(max / connIntervalUnit),
+		latency:     uint16(latency),
+		timeout:     uint16(timeout / supervisionTimeoutUnit),
+	}
+}
+
+// valid reports if the parameters are in range, and the supervision timeout
+// is larger than (1 + latency) * max interval * 2 [Vol 2, Part E, 7.8.18].
+func (p connParams) valid() bool {
+	return p.intervalMin >= connIntervalMin && p.intervalMax <= connIntervalMax &&
+		p.intervalMin <= p.intervalMax && p.latency <= connLatencyMax &&
+		p.timeout >= supervisionTimeoutMin && p.timeout <= supervisionTimeoutMax &&
+		int(p.timeout)*4 > (1+int(p.latency))*int(p.intervalMax)
+}
+
+// connUpdate is the status and the parameters of LE Connection Update Complete.
+type connUpdate struct {
+	status uint8
+	params connParams
+}
+
+// match reports if the parameters p, in use after an update, are the ones
+// requested by r.
+func (p connParams) match(r connParams) bool {
+	return p.intervalMin >= r.intervalMin && p.intervalMax <= r.intervalMax &&
+		p.latency == r.latency && p.timeout == r.timeout
+}
+
+func (p connParams) params() ble.ConnParams {
+	return ble.ConnParams{
+		IntervalMin: time.Duration(p.intervalMin) * connIntervalUnit,
+		IntervalMax: time.Duration(p.intervalMax) * connIntervalUnit,
+		Latency:     int(p.latency),
+		Timeout:     time.Duration(p.timeout) * supervisionTimeoutUnit,
+	}
+}
+
+// acceptConnParams applies the policy to the connection parameters requested
+// by the remote device, and returns the ones to use. It reports false, if the
+// request is invalid or rejected.
+func (c *Conn) acceptConnParams(req connParams) (connParams, bool) {
+	if !req.valid() {
+		return req, false
+	}
+	policy := c.hci.connParamPolicy
+	if policy == nil {
+		return req, true
+	}
+	acc, ok := policy(c, req.params())
+	if !ok {
+		return req, false
+	}
+	p := newConnParams(acc.IntervalMin, acc.IntervalMax, acc.Latency, acc.Timeout)
+	if acc.Latency < 0 || !p.valid() {
+		_ = logger.Error("invalid connection parameters from policy", "params", acc)
+		return req, false
+	}
+	return p, true
+}
+
+// UpdateConnParams requests the connection interval between min and max, the
+// peripheral latency in connection events, and the supervision timeout.
+// As a central, it updates the connection with the controller. As a peripheral,
+// it uses the Connection Parameters Request procedure of the link layer, if the
+// controllers support it, or sends the L2CAP Connection Parameter Update Request
+// otherwise. It returns ble.ErrConnParamsRejected, if the central rejects them.
+func (c *Conn) UpdateConnParams(ctx context.Context, min, max time.Duration, latency int, timeout time.Duration) error {
+	p := newConnParams(min, max, latency, timeout)
+	if latency < 0 || !p.valid() {
+		return fmt.Errorf("invalid connection parameters: interval %v-%v, latency %d, timeout %v", min, max, latency, timeout)
+	}
+	c.muConnUpdate.Lock()
+	defer c.muConnUpdate.Unlock()
+
+	if c.param.Role() == roleMaster {
+		return c.connectionUpdate(ctx, p)
+	}
+	if c.hci.leFeatures&leFeatureConnParamsRequest != 0 {
+		// Fall back to L2CAP, if the remote controller doesn't support it.
+		if err := c.connectionUpdate(ctx, p); err != ErrUnsupportedLMP {
+			return err
+		}
+	}
+
+	// Connection Parameter Update Request [Vol 3, Part A, 4.20].
+	var rsp ConnectionParameterUpdateResponse
+	err := c.signal(ctx, &ConnectionParameterUpdateRequest{
+		IntervalMin:       p.intervalMin,
+		IntervalMax:       p.intervalMax,
+		SlaveLatency:      p.latency,
+		TimeoutMultiplier: p.timeout,
+	}, &rsp)
+	if err != nil {
+		return errors.Wrap(err, "can't request connection parameters")
+	}
+	if rsp.Result != 0 {
+		return ble.ErrConnParamsRejected
+	}
+	return nil
+}
+
+// ConnParams returns the current interval, peripheral latency and supervision
+// timeout of the connection.
+func (c *Conn) ConnParams() ble.ConnParams {
+	c.muParams.Lock()
+	defer c.muParams.Unlock()
+	return c.params.params()
+}
+
+// SetConnParamsHandler sets the handler, which is called when the parameters
+// of the connection change. The handler is called from the event loop of the
+// HCI, and should not block.
+func (c *Conn) SetConnParamsHandler(h ble.ConnParamsHandler) {
+	c.muParams.Lock()
+	defer c.muParams.Unlock()
+	c.paramsHandler = h
+}
+
+// setParams updates the current connection parameters, and reports them to
+// the handler if they changed.
+func (c *Conn) setParams(p connParams) {
+	c.muParams.Lock()
+	changed := p != c.params
+	c.params = p
+	h := c.paramsHandler
+	c.muParams.Unlock()
+	if changed && h != nil {
+		h(p.params())
+	}
+}
+
+// connectionUpdate updates the connection parameters with the LE Connection
+// Update command, and waits for the LE Connection Update Complete event [Vol 2, Part E, 7.8.18].
+// As a central, the completions of the updates started by the remote device,
+// whose parameters don't match, are ignored. As a peripheral, the central may
+// choose other parameters, so any completion, as well as a failure, ends the
+// wait, even if it's the result of an update started by the central.
+func (c *Conn) connectionUpdate(ctx context.Context, p connParams) error {
+	select {
+	case <-c.chConnUpdate:
+	default:
+	}
+	err := c.hci.Send(&cmd.LEConnectionUpdate{
+		ConnectionHandle:   c.param.ConnectionHandle(),
+		ConnIntervalMin:    p.intervalMin,
+		ConnIntervalMax:    p.intervalMax,
+		ConnLatency:        p.latency,
+		SupervisionTimeout: p.timeout,
+		MinimumCELength:    0, // Informational, and spec doesn't specify the use.
+		MaximumCELength:    0, // Informational, and spec doesn't specify the use.
+	}, nil)
+	if err != nil {
+		return errors.Wrap(err, "can't update connection")
+	}
+	for {
+		select {
+		case u := <-c.chConnUpdate:
+			switch ErrCommand(u.status) {
+			case 0:
+				if c.param.Role() == roleMaster && !u.params.match(p) {
+					continue
+				}
+				return nil
+			case ErrConnParams:
+				return ble.ErrConnParamsRejected
+			default:
+				return ErrCommand(u.status)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.chDone:
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+// handleLERemoteConnectionParameterRequest handles the Connection Parameters
+// Request procedure of the link layer initiated by the remote device, and
+// replies with the parameters accepted by the policy [Vol 2, Part E, 7.7.65.6].
+func (h *HCI) handleLERemoteConnectionParameterRequest(b []byte) error {
+	e := evt.LERemoteConnectionParameterRequest(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		return nil
+	}
+	req := connParams{
+		intervalMin: e.IntervalMin(),
+		intervalMax: e.IntervalMax(),
+		latency:     e.Latency(),
+		timeout:     e.Timeout(),
+	}
+
+	// The policy may block, and the reply can't be sent from the event loop.
+	go func() {
+		p, ok := c.acceptConnParams(req)
+		if !ok {
+			h.Send(&cmd.LERemoteConnectionParameterRequestNegativeReply{
+				ConnectionHandle: c.param.ConnectionHandle(),
+				Reason:           uint8(ErrConnParams),
+			}, nil)
+			return
+		}
+		h.Send(&cmd.LERemoteConnectionParameterRequestReply{
+			ConnectionHandle: c.param.ConnectionHandle(),
+			IntervalMin:      p.intervalMin,
+			IntervalMax:      p.intervalMax,
+			Latency:          p.latency,
+			Timeout:          p.timeout,
+			MinimumCELength:  0, // Informational, and spec doesn't specify the use.
+			MaximumCELength:  0, // Informational, and spec doesn't specify the use.
+		}, nil)
+	}()
+	return nil
+}
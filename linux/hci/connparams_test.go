@@ -0,0 +1,108 @@
+package hci
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trustasia-com/ble"
+)
+
+func TestConnParamsValid(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		min, max time.Duration
+		latency  int
+		timeout  time.Duration
+		valid    bool
+	}{
+		{7500 * time.Microsecond, 15 * ms, 0, 100 * ms, true},
+		{30 * ms, 50 * ms, 4, 6 * time.Second, true},
+		{5 * ms, 15 * ms, 0, 1 * time.Second, false},     // Interval below 7.5 ms.
+		{50 * ms, 30 * ms, 0, 1 * time.Second, false},    // Min above max.
+		{30 * ms, 50 * ms, 500, 32 * time.Second, false}, // Latency above 499.
+		{30 * ms, 50 * ms, 0, 50 * ms, false},            // Timeout below 100 ms.
+		{30 * ms, 50 * ms, 9, 1 * time.Second, false},    // Timeout not above (1+9)*50ms*2.
+		{4 * time.Second, 4 * time.Second, 0, 32 * time.Second, true},
+	}
+	for _, tt := range tests {
+		p := newConnParams(tt.min, tt.max, tt.latency, tt.timeout)
+		if got := p.valid(); got != tt.valid {
+			t.Errorf("interval %v-%v, latency %d, timeout %v: valid() = %v, want %v",
+				tt.min, tt.max, tt.latency, tt.timeout, got, tt.valid)
+		}
+	}
+}
+
+func TestAcceptConnParams(t *testing.T) {
+	ms := time.Millisecond
+	req := newConnParams(7500*time.Microsecond, 15*ms, 0, 1*time.Second)
+	c := &Conn{hci: &HCI{}}
+	if p, ok := c.acceptConnParams(req); !ok || p != req {
+		t.Errorf("without policy: %+v, %v, want %+v, true", p, ok, req)
+	}
+
+	// The policy clamps the interval to at least 30 ms.
+	c.hci.connParamPolicy = func(_ ble.Conn, r ble.ConnParams) (ble.ConnParams, bool) {
+		if r.IntervalMax < 30*ms {
+			r.IntervalMin, r.IntervalMax = 30*ms, 30*ms
+		}
+		return r, r.Latency == 0
+	}
+	want := newConnParams(30*ms, 30*ms, 0, 1*time.Second)
+	if p, ok := c.acceptConnParams(req); !ok || p != want {
+		t.Errorf("clamped: %+v, %v, want %+v, true", p, ok, want)
+	}
+	if _, ok := c.acceptConnParams(newConnParams(30*ms, 50*ms, 2, 1*time.Second)); ok {
+		t.Error("rejected by policy: ok")
+	}
+	if _, ok := c.acceptConnParams(newConnParams(5*ms, 15*ms, 0, 1*time.Second)); ok {
+		t.Error("invalid request: ok")
+	}
+
+	// Invalid parameters from the policy reject the request.
+	c.hci.connParamPolicy = func(_ ble.Conn, r ble.ConnParams) (ble.ConnParams, bool) {
+		r.Timeout = 0
+		return r, true
+	}
+	if _, ok := c.acceptConnParams(req); ok {
+		t.Error("invalid policy result: ok")
+	}
+}
+
+func TestSetParams(t *testing.T) {
+	c := &Conn{params: connParams{24, 24, 0, 400}}
+	var got []ble.ConnParams
+	c.SetConnParamsHandler(func(p ble.ConnParams) { got = append(got, p) })
+	c.setParams(connParams{24, 24, 0, 400})
+	c.setParams(connParams{40, 40, 4, 600})
+	want := ble.ConnParams{
+		IntervalMin: 50 * time.Millisecond,
+		IntervalMax: 50 * time.Millisecond,
+		Latency:     4,
+		Timeout:     6 * time.Second,
+	}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("handler called with %+v, want [%+v]", got, want)
+	}
+	if p := c.ConnParams(); p != want {
+		t.Errorf("ConnParams() = %+v, want %+v", p, want)
+	}
+}
+
+func TestConnParamsMatch(t *testing.T) {
+	req := connParams{24, 40, 0, 400}
+	for _, tt := range []struct {
+		p    connParams
+		want bool
+	}{
+		{connParams{24, 24, 0, 400}, true},
+		{connParams{40, 40, 0, 400}, true},
+		{connParams{48, 48, 0, 400}, false}, // Interval out of range.
+		{connParams{30, 30, 4, 400}, false}, // Other latency.
+		{connParams{30, 30, 0, 600}, false}, // Other timeout.
+	} {
+		if got := tt.p.match(req); got != tt.want {
+			t.Errorf("%+v.match(%+v) = %v, want %v", tt.p, req, got, tt.want)
+		}
+	}
+}
@@ -24,7 +24,35 @@ const (
 	cidSMP      uint16 = 0x06 // SecurityManager Protocol [Vol 3, Part H].
 )
 
+// cmdBufSize is the size of the HCI command packets, which carry up to 255
+// bytes of parameters [Vol 2, Part E, 5.4.1].
+const cmdBufSize = 1 + 2 + 1 + 255
+
 const (
 	roleMaster = 0x00
 	roleSlave  = 0x01
 )
+
+// LE features supported by the controller [Vol 6, Part B, 4.6].
+const (
+	leFeatureConnParamsRequest   uint64 = 1 << 1  // Connection Parameters Request Procedure.
+	leFeatureDataLengthExtension uint64 = 1 << 5  // LE Data Packet Length Extension.
+	leFeatureLLPrivacy           uint64 = 1 << 6  // LL Privacy.
+	leFeature2MPHY               uint64 = 1 << 8  // LE 2M PHY.
+	leFeatureCodedPHY            uint64 = 1 << 11 // LE Coded PHY.
+	leFeatureExtendedAdvertising uint64 = 1 << 12 // LE Extended Advertising.
+	leFeaturePeriodicAdvertising uint64 = 1 << 13 // LE Periodic Advertising.
+)
+
+// LE events enabled in addition to the default ones [Vol 2, Part E, 7.8.1].
+const (
+	leEventRemoteConnParamsRequest    uint64 = 1 << 5
+	leEventDataLengthChange           uint64 = 1 << 6
+	leEventEnhancedConnectionComplete uint64 = 1 << 9
+	leEventPHYUpdateComplete          uint64 = 1 << 11
+	leEventExtendedAdvertisingReport  uint64 = 1 << 12
+	leEventPeriodicSyncEstablished    uint64 = 1 << 13
+	leEventPeriodicAdvertisingReport  uint64 = 1 << 14
+	leEventPeriodicSyncLost           uint64 = 1 << 15
+	leEventAdvertisingSetTerminated   uint64 = 1 << 17
+)
@@ -0,0 +1,59 @@
+package hci
+
+import (
+	"time"
+
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// Data length of the link layer data packets, before it's changed by the
+// Data Length Update procedure [Vol 6, Part B, 4.5.10].
+const (
+	defaultDataOctets = 27
+	defaultDataTime   = 328 * time.Microsecond
+)
+
+// DataLength returns the maximum payload octets and transmission time of the
+// link layer data packets in each direction.
+func (c *Conn) DataLength() ble.DataLength {
+	c.muDataLength.Lock()
+	defer c.muDataLength.Unlock()
+	return c.dataLength
+}
+
+// setMaxDataLength requests the maximum data length supported by the
+// controller with LE Set Data Length [Vol 2, Part E, 7.8.33].
+func (c *Conn) setMaxDataLength() {
+	if c.hci.maxTxOctets == 0 {
+		return
+	}
+	err := c.hci.Send(&cmd.LESetDataLength{
+		ConnectionHandle: c.param.ConnectionHandle(),
+		TxOctets:         c.hci.maxTxOctets,
+		TxTime:           c.hci.maxTxTime,
+	}, nil)
+	if err != nil {
+		_ = logger.Error("can't set data length", "err", err)
+	}
+}
+
+func (h *HCI) handleLEDataLengthChange(b []byte) error {
+	e := evt.LEDataLengthChange(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		return nil
+	}
+	c.muDataLength.Lock()
+	c.dataLength = ble.DataLength{
+		TxOctets: int(e.MaxTxOctets()),
+		TxTime:   time.Duration(e.MaxTxTime()) * time.Microsecond,
+		RxOctets: int(e.MaxRxOctets()),
+		RxTime:   time.Duration(e.MaxRxTime()) * time.Microsecond,
+	}
+	c.muDataLength.Unlock()
+	return nil
+}
@@ -0,0 +1,45 @@
+package hci
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trustasia-com/ble"
+)
+
+func TestDataLengthChange(t *testing.T) {
+	c := &Conn{dataLength: ble.DataLength{
+		TxOctets: defaultDataOctets,
+		TxTime:   defaultDataTime,
+		RxOctets: defaultDataOctets,
+		RxTime:   defaultDataTime,
+	}}
+	h := &HCI{muConns: &sync.Mutex{}, conns: map[uint16]*Conn{0x0040: c}}
+	c.hci = h
+
+	// Without the Data Length Extension, no LE Set Data Length is sent.
+	c.setMaxDataLength()
+
+	// Handle 0x0040: 251 octets, 2120 us to send; 100 octets, 1064 us to receive.
+	if err := h.handleLEDataLengthChange([]byte{0x07, 0x40, 0x00, 0xFB, 0x00, 0x48, 0x08, 0x64, 0x00, 0x28, 0x04}); err != nil {
+		t.Fatal(err)
+	}
+	want := ble.DataLength{
+		TxOctets: 251,
+		TxTime:   2120 * time.Microsecond,
+		RxOctets: 100,
+		RxTime:   1064 * time.Microsecond,
+	}
+	if got := c.DataLength(); got != want {
+		t.Errorf("DataLength() = %+v, want %+v", got, want)
+	}
+
+	// Events of unknown connections are ignored.
+	if err := h.handleLEDataLengthChange([]byte{0x07, 0x41, 0x00, 0x1B, 0x00, 0x48, 0x01, 0x1B, 0x00, 0x48, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.DataLength(); got != want {
+		t.Errorf("DataLength() = %+v after another connection changed, want %+v", got, want)
+	}
+}
@@ -9,6 +9,12 @@ var (
 	ErrBusyDialing     = errors.New("busy dialing")
 	ErrBusyListening   = errors.New("busy listening")
 	ErrInvalidAddr     = errors.New("invalid address")
+
+	ErrExtAdvNotSupported = errors.New("extended advertising not supported")
+	ErrLegacyMode         = errors.New("extended commands not enabled, use OptExtendedScan")
+	ErrNoAdvertisingSet   = errors.New("no free advertising set")
+
+	ErrPeriodicAdvNotSupported = errors.New("periodic advertising not supported")
 )
 
 // HCI Command Errors  [Vol2, Part D, 1.3 ]
@@ -159,3 +165,30 @@ var errCmd = map[ErrCommand]string{
 	0x3F: "MAC Connection Failed",
 	0x40: "Coarse Clock Adjustment Rejected but Will Try to Adjust Using Clock Dragging",
 }
+
+// ErrPairing is the reason of a failed pairing [Vol 3, Part H, 3.5.5].
+type ErrPairing byte
+
+func (e ErrPairing) Error() string {
+	if s, ok := errPairing[e]; ok {
+		return "pairing failed: " + s
+	}
+	return "pairing failed: reserved reason"
+}
+
+var errPairing = map[ErrPairing]string{
+	0x01: "Passkey Entry Failed",
+	0x02: "OOB Not Available",
+	0x03: "Authentication Requirements",
+	0x04: "Confirm Value Failed",
+	0x05: "Pairing Not Supported",
+	0x06: "Encryption Key Size",
+	0x07: "Command Not Supported",
+	0x08: "Unspecified Reason",
+	0x09: "Repeated Attempts",
+	0x0A: "Invalid Parameters",
+	0x0B: "DHKey Check Failed",
+	0x0C: "Numeric Comparison Failed",
+	0x0D: "BR/EDR pairing in progress",
+	0x0E: "Cross-transport Key Derivation/Generation not allowed",
+}
@@ -53,3 +53,62 @@ func (e LEAdvertisingReport) RSSI(i int) int8 {
 	}
 	return int8(e[2+int(e.NumReports())*9+l+i])
 }
+
+// The reports of LE Extended Advertising Report are laid out one after another,
+// each with 24 bytes of fixed fields followed by its data [Vol 2, Part E, 7.7.65.13].
+
+func (e LEExtendedAdvertisingReport) SubeventCode() uint8 { return e[0] }
+func (e LEExtendedAdvertisingReport) NumReports() uint8   { return e[1] }
+
+// Valid reports whether the event holds all of its reports. The accessors of
+// the reports panic on an event, which isn't valid.
+func (e LEExtendedAdvertisingReport) Valid() bool {
+	if len(e) < 2 {
+		return false
+	}
+	r := e[2:]
+	for i := 0; i < int(e.NumReports()); i++ {
+		if len(r) < 24 || len(r) < 24+int(r[23]) {
+			return false
+		}
+		r = r[24+int(r[23]):]
+	}
+	return true
+}
+
+func (e LEExtendedAdvertisingReport) report(i int) []byte {
+	r := e[2:]
+	for j := 0; j < i; j++ {
+		r = r[24+int(r[23]):]
+	}
+	return r
+}
+
+func (e LEExtendedAdvertisingReport) EventType(i int) uint16 {
+	return binary.LittleEndian.Uint16(e.report(i))
+}
+func (e LEExtendedAdvertisingReport) AddressType(i int) uint8 { return e.report(i)[2] }
+func (e LEExtendedAdvertisingReport) Address(i int) [6]byte {
+	b := [6]byte{}
+	copy(b[:], e.report(i)[3:])
+	return b
+}
+func (e LEExtendedAdvertisingReport) PrimaryPHY(i int) uint8     { return e.report(i)[9] }
+func (e LEExtendedAdvertisingReport) SecondaryPHY(i int) uint8   { return e.report(i)[10] }
+func (e LEExtendedAdvertisingReport) AdvertisingSID(i int) uint8 { return e.report(i)[11] }
+func (e LEExtendedAdvertisingReport) TXPower(i int) int8         { return int8(e.report(i)[12]) }
+func (e LEExtendedAdvertisingReport) RSSI(i int) int8            { return int8(e.report(i)[13]) }
+func (e LEExtendedAdvertisingReport) PeriodicAdvertisingInterval(i int) uint16 {
+	return binary.LittleEndian.Uint16(e.report(i)[14:])
+}
+func (e LEExtendedAdvertisingReport) DirectAddressType(i int) uint8 { return e.report(i)[16] }
+func (e LEExtendedAdvertisingReport) DirectAddress(i int) [6]byte {
+	b := [6]byte{}
+	copy(b[:], e.report(i)[17:])
+	return b
+}
+func (e LEExtendedAdvertisingReport) DataLength(i int) uint8 { return e.report(i)[23] }
+func (e LEExtendedAdvertisingReport) Data(i int) []byte {
+	r := e.report(i)
+	return r[24 : 24+int(r[23])]
+}
@@ -0,0 +1,150 @@
+package hci
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// maxExtFrags is the number of advertisers, whose fragmented data is being
+// reassembled at the same time.
+const maxExtFrags = 16
+
+// extFragKey identifies the advertising set of the fragments.
+type extFragKey struct {
+	addrType uint8
+	addr     [6]byte
+	sid      uint8
+}
+
+// scanExtended starts the extended scanning on the PHYs, with the scanning
+// parameters of the legacy scanning [Vol 2, Part E, 7.8.64].
+func (h *HCI) scanExtended(allowDup bool) error {
+	h.params.Lock()
+	sp := h.params.scanParams
+	c := cmd.LESetExtendedScanParameters{
+		OwnAddressType:       h.ownAddressType(sp.OwnAddressType),
+		ScanningFilterPolicy: sp.ScanningFilterPolicy,
+		ScanningPHYs:         uint8(h.extScanPHYs),
+	}
+	for _, p := range []ble.PHY{ble.PHY1M, ble.PHYCoded} {
+		if h.extScanPHYs&p != 0 {
+			c.ScanType = append(c.ScanType, sp.LEScanType)
+			c.ScanInterval = append(c.ScanInterval, sp.LEScanInterval)
+			c.ScanWindow = append(c.ScanWindow, sp.LEScanWindow)
+		}
+	}
+	h.params.extScanEnable.FilterDuplicates = 1
+	if allowDup {
+		h.params.extScanEnable.FilterDuplicates = 0
+	}
+	h.params.extScanEnable.Enable = 1
+	enable := h.params.extScanEnable
+	h.params.Unlock()
+
+	h.advCache.reset()
+	if err := h.Send(&c, nil); err != nil {
+		return err
+	}
+	return h.Send(&enable, nil)
+}
+
+// stopScanningExtended stops the extended scanning.
+func (h *HCI) stopScanningExtended() error {
+	h.params.Lock()
+	h.params.extScanEnable.Enable = 0
+	enable := h.params.extScanEnable
+	h.params.Unlock()
+	return h.Send(&enable, nil)
+}
+
+// extendedCreateConnection returns the LE Extended Create Connection command,
+// which initiates the connection with the parameters on the PHYs of the
+// extended scanning [Vol 2, Part E, 7.8.66].
+func (h *HCI) extendedCreateConnection(cp cmd.LECreateConnection) *cmd.LEExtendedCreateConnection {
+	c := &cmd.LEExtendedCreateConnection{
+		InitiatorFilterPolicy: cp.InitiatorFilterPolicy,
+		OwnAddressType:        cp.OwnAddressType,
+		PeerAddressType:       cp.PeerAddressType,
+		PeerAddress:           cp.PeerAddress,
+		InitiatingPHYs:        uint8(h.extScanPHYs),
+	}
+	for _, p := range []ble.PHY{ble.PHY1M, ble.PHYCoded} {
+		if h.extScanPHYs&p == 0 {
+			continue
+		}
+		c.ScanInterval = append(c.ScanInterval, cp.LEScanInterval)
+		c.ScanWindow = append(c.ScanWindow, cp.LEScanWindow)
+		c.ConnIntervalMin = append(c.ConnIntervalMin, cp.ConnIntervalMin)
+		c.ConnIntervalMax = append(c.ConnIntervalMax, cp.ConnIntervalMax)
+		c.ConnLatency = append(c.ConnLatency, cp.ConnLatency)
+		c.SupervisionTimeout = append(c.SupervisionTimeout, cp.SupervisionTimeout)
+		c.MinimumCELength = append(c.MinimumCELength, cp.MinimumCELength)
+		c.MaximumCELength = append(c.MaximumCELength, cp.MaximumCELength)
+	}
+	return c
+}
+
+// reassemble returns the i-th report of the event, with the data reassembled
+// from the fragments of the previous reports. It returns nil, if more
+// fragments are to come [Vol 6, Part B, 4.4.2.2].
+func (h *HCI) reassemble(e evt.LEExtendedAdvertisingReport, i int) *extReport {
+	k := extFragKey{e.AddressType(i), e.Address(i), e.AdvertisingSID(i)}
+	r, ok := h.extFrags[k]
+	if !ok {
+		r = &extReport{}
+	}
+	*r = extReport{
+		eventType:    e.EventType(i),
+		addrType:     k.addrType,
+		addr:         k.addr,
+		primaryPHY:   e.PrimaryPHY(i),
+		secondaryPHY: e.SecondaryPHY(i),
+		sid:          k.sid,
+		txPower:      e.TXPower(i),
+		rssi:         e.RSSI(i),
+		interval:     e.PeriodicAdvertisingInterval(i),
+		data:         append(r.data, e.Data(i)...),
+	}
+	if r.eventType&extEvtTypDataStatus != extEvtTypDataIncomplete {
+		delete(h.extFrags, k)
+		return r
+	}
+	if len(r.data) > maxExtAdvDataLength {
+		// The advertiser sent more than an advertising set can hold.
+		delete(h.extFrags, k)
+		r.eventType = r.eventType&^extEvtTypDataStatus | extEvtTypDataTruncated
+		return r
+	}
+	if !ok && len(h.extFrags) >= maxExtFrags {
+		// Forget the fragments, whose remaining ones have been lost.
+		h.extFrags = make(map[extFragKey]*extReport)
+	}
+	h.extFrags[k] = r
+	return nil
+}
+
+func (h *HCI) handleLEExtendedAdvertisingReport(b []byte) error {
+	if !h.advQueue.handled() {
+		return nil
+	}
+
+	e := evt.LEExtendedAdvertisingReport(b)
+	if !e.Valid() {
+		return fmt.Errorf("invalid LE extended advertising report: % X", b)
+	}
+	now := time.Now()
+	for i := 0; i < int(e.NumReports()); i++ {
+		r := h.reassemble(e, i)
+		if r == nil {
+			continue
+		}
+		a := newExtAdvertisement(r)
+		a.addr = h.resolveAddr(a.AddressType(), a.address())
+		h.advQueue.push(h.advCache.add(a, now))
+	}
+	return nil
+}
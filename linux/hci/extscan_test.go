@@ -0,0 +1,170 @@
+package hci
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// extReportEvent returns an LE Extended Advertising Report event with a single
+// report of the advertiser 11:22:33:44:55:66 in the set 3.
+func extReportEvent(eventType uint16, data []byte) evt.LEExtendedAdvertisingReport {
+	b := []byte{
+		evt.LEExtendedAdvertisingReportSubCode, 1,
+		byte(eventType), byte(eventType >> 8),
+		0x01,                               // Address Type: random
+		0x66, 0x55, 0x44, 0x33, 0x22, 0x11, // Address
+		0x01, 0x03, // Primary PHY: 1M, Secondary PHY: Coded
+		0x03,       // Advertising SID
+		0xf6,       // TX Power: -10 dBm
+		0xc4,       // RSSI: -60 dBm
+		0x50, 0x00, // Periodic Advertising Interval: 100 ms
+		0x00, 0, 0, 0, 0, 0, 0, // Direct Address Type, Direct Address
+		byte(len(data)),
+	}
+	return evt.LEExtendedAdvertisingReport(append(b, data...))
+}
+
+func TestExtendedAdvertisement(t *testing.T) {
+	data := []byte{0x02, 0x01, 0x06}
+	e := extReportEvent(extEvtTypConnectable|extEvtTypScannable, data)
+	if e.NumReports() != 1 {
+		t.Fatalf("NumReports() = %d, want 1", e.NumReports())
+	}
+
+	h := &HCI{extFrags: make(map[extFragKey]*extReport)}
+	a := newExtAdvertisement(h.reassemble(e, 0))
+	if !a.Connectable() || a.Truncated() {
+		t.Errorf("Connectable() = %v, Truncated() = %v, want true, false", a.Connectable(), a.Truncated())
+	}
+	if got := a.Addr().String(); got != "11:22:33:44:55:66" {
+		t.Errorf("Addr() = %s, want 11:22:33:44:55:66", got)
+	}
+	if a.PrimaryPHY() != ble.PHY1M || a.SecondaryPHY() != ble.PHYCoded {
+		t.Errorf("PHYs = %v, %v, want 1M, Coded", a.PrimaryPHY(), a.SecondaryPHY())
+	}
+	if a.SID() != 3 || a.TxPower() != -10 || a.RSSI() != -60 {
+		t.Errorf("SID() = %d, TxPower() = %d, RSSI() = %d, want 3, -10, -60", a.SID(), a.TxPower(), a.RSSI())
+	}
+	if a.PeriodicInterval() != 100*time.Millisecond {
+		t.Errorf("PeriodicInterval() = %v, want 100ms", a.PeriodicInterval())
+	}
+	if !bytes.Equal(a.Data(), data) {
+		t.Errorf("Data() = %x, want %x", a.Data(), data)
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	h := &HCI{extFrags: make(map[extFragKey]*extReport)}
+
+	if r := h.reassemble(extReportEvent(extEvtTypDataIncomplete, []byte{1, 2}), 0); r != nil {
+		t.Fatalf("reassemble(incomplete) = %v, want nil", r)
+	}
+	if r := h.reassemble(extReportEvent(extEvtTypDataIncomplete, []byte{3}), 0); r != nil {
+		t.Fatalf("reassemble(incomplete) = %v, want nil", r)
+	}
+	r := h.reassemble(extReportEvent(0, []byte{4, 5}), 0)
+	if r == nil || !bytes.Equal(r.data, []byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("reassemble(complete) = %v, want data 0102030405", r)
+	}
+	if len(h.extFrags) != 0 {
+		t.Errorf("%d advertisers left, want 0", len(h.extFrags))
+	}
+
+	h.reassemble(extReportEvent(extEvtTypDataIncomplete, []byte{1}), 0)
+	r = h.reassemble(extReportEvent(extEvtTypDataTruncated, []byte{2}), 0)
+	if r == nil || !newExtAdvertisement(r).Truncated() || !bytes.Equal(r.data, []byte{1, 2}) {
+		t.Errorf("reassemble(truncated) = %v, want truncated data 0102", r)
+	}
+
+	big := make([]byte, 255-24)
+	for n := 0; ; n += len(big) {
+		r = h.reassemble(extReportEvent(extEvtTypDataIncomplete, big), 0)
+		if r != nil {
+			break
+		}
+		if n > maxExtAdvDataLength {
+			t.Fatalf("reassembled %d bytes, want at most %d", n, maxExtAdvDataLength)
+		}
+	}
+	if !newExtAdvertisement(r).Truncated() {
+		t.Errorf("oversized data isn't truncated")
+	}
+}
+
+func TestInvalidExtendedAdvertisingReport(t *testing.T) {
+	e := extReportEvent(0, []byte{0x02, 0x01, 0x06})
+	if !e.Valid() {
+		t.Fatalf("Valid() = false, want true")
+	}
+	h := &HCI{advQueue: newAdvQueue(1, ble.AdvDropOldest)}
+	h.advQueue.setHandler(func(a ble.Advertisement) {
+		t.Errorf("invalid report delivered: %v", a)
+	})
+	for _, b := range [][]byte{
+		e[:1],        // No Num_Reports
+		e[:20],       // Fixed fields cut short
+		e[:len(e)-1], // Data cut short
+	} {
+		if evt.LEExtendedAdvertisingReport(b).Valid() {
+			t.Errorf("Valid() = true for % X, want false", b)
+		}
+	}
+	b := append([]byte{}, e...)
+	b[1] = 2
+	if err := h.handleLEExtendedAdvertisingReport(b); err == nil {
+		t.Errorf("handleLEExtendedAdvertisingReport() = nil for a missing report, want error")
+	}
+}
+
+func TestExtendedScanParameters(t *testing.T) {
+	c := cmd.LESetExtendedScanParameters{
+		OwnAddressType: 1,
+		ScanningPHYs:   uint8(ble.PHY1M | ble.PHYCoded),
+		ScanType:       []uint8{1, 0},
+		ScanInterval:   []uint16{0x0010, 0x0020},
+		ScanWindow:     []uint16{0x0008, 0x0018},
+	}
+	b := make([]byte, c.Len())
+	if err := c.Marshal(b); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x01, 0x00, 0x05, 0x01, 0x10, 0x00, 0x08, 0x00, 0x00, 0x20, 0x00, 0x18, 0x00}
+	if !bytes.Equal(b, want) {
+		t.Errorf("Marshal() = %x, want %x", b, want)
+	}
+}
+
+func TestExtendedCreateConnection(t *testing.T) {
+	h := &HCI{extScanPHYs: ble.PHY1M | ble.PHYCoded}
+	c := h.extendedCreateConnection(cmd.LECreateConnection{
+		LEScanInterval:     0x0060,
+		LEScanWindow:       0x0030,
+		PeerAddressType:    1,
+		PeerAddress:        [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0xC6},
+		OwnAddressType:     1,
+		ConnIntervalMin:    0x0018,
+		ConnIntervalMax:    0x0028,
+		ConnLatency:        0x0001,
+		SupervisionTimeout: 0x0190,
+	})
+	b := make([]byte, c.Len())
+	if err := c.Marshal(b); err != nil {
+		t.Fatal(err)
+	}
+	phy := []byte{0x60, 0x00, 0x30, 0x00, 0x18, 0x00, 0x28, 0x00, 0x01, 0x00, 0x90, 0x01, 0x00, 0x00, 0x00, 0x00}
+	want := append([]byte{0x00, 0x01, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05, 0xC6, 0x05}, phy...)
+	want = append(want, phy...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("Marshal() = %x, want %x", b, want)
+	}
+
+	c.ScanWindow = c.ScanWindow[:1]
+	if err := c.Marshal(b); err == nil {
+		t.Error("Marshal() of mismatched PHY parameters: no error")
+	}
+}
@@ -12,29 +12,52 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Addr ...
-func (h *HCI) Addr() ble.Addr { return h.addr }
+// Addr returns the identity address of the local device, which is the static
+// random address if one is configured, or the public address otherwise.
+func (h *HCI) Addr() ble.Addr {
+	if isStaticAddr(h.randAddr) {
+		return RandomAddress{hwAddr(h.randAddr)}
+	}
+	return h.addr
+}
+
+// identityAddress returns the type and the address, in wire order, of the
+// identity address of the local device.
+func (h *HCI) identityAddress() (uint8, [6]byte) {
+	if isStaticAddr(h.randAddr) {
+		return 0x01, h.randAddr
+	}
+	a := h.addr
+	return 0x00, [6]byte{a[5], a[4], a[3], a[2], a[1], a[0]}
+}
 
 // SetAdvHandler ...
 func (h *HCI) SetAdvHandler(ah ble.AdvHandler) error {
-	h.advHandler = ah
+	h.advQueue.setHandler(ah)
 	return nil
 }
 
 // Scan starts scanning.
 func (h *HCI) Scan(allowDup bool) error {
+	if h.extended {
+		return h.scanExtended(allowDup)
+	}
 	h.params.scanEnable.FilterDuplicates = 1
 	if allowDup {
 		h.params.scanEnable.FilterDuplicates = 0
 	}
 	h.params.scanEnable.LEScanEnable = 1
-	h.adHist = make([]*Advertisement, 128)
-	h.adLast = 0
+	h.advCache.reset()
 	return h.Send(&h.params.scanEnable, nil)
 }
 
 // StopScanning stops scanning.
 func (h *HCI) StopScanning() error {
+	// The reports, which came before the scanning stopped, aren't passed on.
+	defer h.advQueue.flush()
+	if h.extended {
+		return h.stopScanningExtended()
+	}
 	h.params.scanEnable.LEScanEnable = 0
 	return h.Send(&h.params.scanEnable, nil)
 }
@@ -194,6 +217,10 @@ func (h *HCI) Accept() (ble.Conn, error) {
 
 // Dial ...
 func (h *HCI) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
+	if r, ok := a.(ResolvedAddress); ok {
+		// Connect to the address the device is currently using.
+		a = r.RPA
+	}
 	b, err := net.ParseMAC(a.String())
 	if err != nil {
 		return nil, ErrInvalidAddr
@@ -202,7 +229,14 @@ func (h *HCI) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	if _, ok := a.(RandomAddress); ok {
 		h.params.connParams.PeerAddressType = 1
 	}
-	if err = h.Send(&h.params.connParams, nil); err != nil {
+	h.params.connParams.OwnAddressType = h.ownAddressType(h.params.connParams.OwnAddressType)
+	var c Command = &h.params.connParams
+	if h.extended {
+		c = h.extendedCreateConnection(h.params.connParams)
+	}
+	h.startDial()
+	defer h.dialed()
+	if err = h.Send(c, nil); err != nil {
 		return nil, err
 	}
 	var tmo <-chan time.Time
@@ -1,6 +1,7 @@
 package hci
 
 import (
+	"crypto/ecdh"
 	"fmt"
 	"io"
 	"log"
@@ -53,9 +54,31 @@ func NewHCI(opts ...ble.Option) (*HCI, error) {
 		chMasterConn: make(chan *Conn),
 		chSlaveConn:  make(chan *Conn),
 
+		smpIOCap:  ioCapNoInputNoOutput,
+		oobRemote: make(map[string]oobData),
+
+		rpaTimeout: defaultRPATimeout,
+		rpaCache:   make(map[[6]byte]ble.Addr),
+
+		l2capListeners: make(map[uint16]*l2capListener),
+		sigRTX:         defaultSigRTX,
+
+		advSets:       make(map[uint8]*AdvertisingSet),
+		pendingSlaves: make(map[uint16]*Conn),
+
+		advCache: newAdvCache(defaultAdvCacheSize, defaultAdvCacheTTL),
+		advQueue: newAdvQueue(defaultAdvQueueDepth, ble.AdvDropOldest),
+		extFrags: make(map[extFragKey]*extReport),
+		syncs:    make(map[uint16]*periodicSync),
+
 		done: make(chan bool),
 	}
 	h.params.init()
+	irk, err := smpRand16()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't generate IRK")
+	}
+	h.irk = irk
 	if err := h.Option(opts...); err != nil {
 		return nil, errors.Wrap(err, "can't set options")
 	}
@@ -90,16 +113,70 @@ type HCI struct {
 	addr    net.HardwareAddr
 	txPwrLv int
 
-	// adHist and adLast track the history of past scannable advertising packets.
+	// Security Manager configuration.
+	// irk is the Identity Resolving Key distributed to the bonded devices.
+	// scOnly rejects the pairing with the devices, which don't support LE
+	// Secure Connections.
+	irk      [16]byte
+	smpIOCap uint8
+	scOnly   bool
+	agent    ble.PairingAgent
+
+	// bonds persists the keys of bonded peers, if set.
+	bonds ble.BondStore
+
+	// Privacy [Vol 3, Part C, 10.7].
+	// rpa is the Resolvable Private Address in use, if privacy is enabled.
+	// rpaCache maps the RPAs of remote devices to their identity addresses,
+	// or nil if they can't be resolved.
+	// addrResolution is set if the controller resolves the addresses.
+	// filterPolicy selects the operations, which use the white list.
+	// muRadio serializes the changes which pause advertising and scanning.
+	// dialing is set while a connection is being created, and radioDeferred
+	// are the changes deferred until it's done.
+	// randAddr is the static or non-resolvable private address, if set.
+	// ownAddrType is the type of the address used for advertising, scanning
+	// and initiating connections.
+	privacy        bool
+	ctrlPrivacy    bool
+	addrResolution bool
+	filterPolicy   ble.FilterPolicy
+	rpaTimeout     time.Duration
+	muRadio        sync.Mutex
+	dialing        bool
+	radioDeferred  []func() error
+	muAddr         sync.Mutex
+	rpa            [6]byte
+	randAddr       [6]byte
+	ownAddrType    uint8
+	muRPA          sync.Mutex
+	rpaCache       map[[6]byte]ble.Addr
+
+	// LE features supported by the controller [Vol 6, Part B, 4.6].
+	leFeatures uint64
+
+	// l2capListeners listen on the LE_PSMs for L2CAP channels.
+	muL2CAP        sync.Mutex
+	l2capListeners map[uint16]*l2capListener
+
+	// eatt is set if the GATT server accepts the Enhanced ATT bearers.
+	eatt bool
+
+	// OOB data of LE Secure Connections.
+	muOOB     sync.Mutex
+	oobKey    *ecdh.PrivateKey
+	oobRand   [16]byte
+	oobRemote map[string]oobData
+
+	// advCache caches the advertisements of the recently seen devices.
 	// Controller delivers AD(Advertising Data) and SR(Scan Response) separately
-	// through HCI. Upon receiving an AD, no matter it's scannable or not, we
-	// pass a Advertisement (AD only) to advHandler immediately.
-	// Upon receiving a SR, we search the AD history for the AD from the same
-	// device, and pass the Advertisiement (AD+SR) to advHandler.
-	// The adHist and adLast are allocated in the Scan().
-	advHandler ble.AdvHandler
-	adHist     []*Advertisement
-	adLast     int
+	// through HCI. Upon receiving either of them, we merge it with the cached
+	// one of the same device, and pass the Advertisement (AD+SR) to the
+	// AdvHandler. A SR of a device, whose AD isn't cached, is passed as it is.
+	// The advCache is reset in the Scan(). The Advertisements are passed to
+	// the AdvHandler, which advQueue holds, in order through advQueue.
+	advCache *advCache
+	advQueue *advQueue
 
 	// Host to Controller Data Flow Control Packet-based Data flow control for LE-U [Vol 2, Part E, 4.1.1]
 	// Minimum 27 bytes. 4 bytes of L2CAP Header, and 23 bytes Payload from upper layer (ATT)
@@ -116,6 +193,50 @@ type HCI struct {
 
 	dialerTmo   time.Duration
 	listenerTmo time.Duration
+	sigRTX      time.Duration
+
+	connParamPolicy ble.ConnParamPolicy
+
+	// autoDataLength requests the maximum data length, maxTxOctets and
+	// maxTxTime supported by the controller, on each new connection.
+	autoDataLength bool
+	maxTxOctets    uint16
+	maxTxTime      uint16
+
+	// defaultTxPHY and defaultRxPHY are the preferred PHYs of new connections.
+	defaultTxPHY ble.PHY
+	defaultRxPHY ble.PHY
+
+	// advSets are the extended advertising sets, keyed by handle. The
+	// controller supports numAdvSets sets, with up to maxAdvDataLen bytes of
+	// advertising data each.
+	muAdvSets     sync.Mutex
+	advSets       map[uint8]*AdvertisingSet
+	numAdvSets    int
+	maxAdvDataLen int
+
+	// pendingSlaves are the connections created by advertising sets, which
+	// are accepted once LE Advertising Set Terminated reports the address
+	// of the set. They are guarded by muConns.
+	pendingSlaves map[uint16]*Conn
+
+	// extScanPHYs are the PHYs of the extended scanning, if it's used.
+	// extended is set once the extended scanning is enabled in init, in which
+	// case the extended advertising, scanning and initiating commands are used
+	// instead of the legacy ones. The controller rejects either kind, once
+	// the other is used [Vol 4, Part E, 3.1.1].
+	// extFrags are the reports, whose data is being reassembled.
+	extScanPHYs ble.PHY
+	extended    bool
+	extFrags    map[extFragKey]*extReport
+
+	// syncs are the synchronizations to periodic advertising, keyed by sync
+	// handle. pendingSync is being established, and muSync serializes the
+	// establishment.
+	muSync      sync.Mutex
+	muSyncs     sync.Mutex
+	syncs       map[uint16]*periodicSync
+	pendingSync *periodicSync
 
 	err  error
 	done chan bool
@@ -128,19 +249,27 @@ func (h *HCI) Init() error {
 	h.evth[evt.CommandStatusCode] = h.handleCommandStatus
 	h.evth[evt.DisconnectionCompleteCode] = h.handleDisconnectionComplete
 	h.evth[evt.NumberOfCompletedPacketsCode] = h.handleNumberOfCompletedPackets
+	h.evth[evt.EncryptionChangeCode] = h.handleEncryptionChange
+	h.evth[evt.EncryptionKeyRefreshCompleteCode] = h.handleEncryptionKeyRefreshComplete
 
 	h.subh[evt.LEAdvertisingReportSubCode] = h.handleLEAdvertisingReport
 	h.subh[evt.LEConnectionCompleteSubCode] = h.handleLEConnectionComplete
 	h.subh[evt.LEConnectionUpdateCompleteSubCode] = h.handleLEConnectionUpdateComplete
 	h.subh[evt.LELongTermKeyRequestSubCode] = h.handleLELongTermKeyRequest
-	// evt.EncryptionChangeCode:                     todo),
+	h.subh[evt.LEEnhancedConnectionCompleteSubCode] = h.handleLEEnhancedConnectionComplete
+	h.subh[evt.LERemoteConnectionParameterRequestSubCode] = h.handleLERemoteConnectionParameterRequest
+	h.subh[evt.LEDataLengthChangeSubCode] = h.handleLEDataLengthChange
+	h.subh[evt.LEPHYUpdateCompleteSubCode] = h.handleLEPHYUpdateComplete
+	h.subh[evt.LEAdvertisingSetTerminatedSubCode] = h.handleLEAdvertisingSetTerminated
+	h.subh[evt.LEExtendedAdvertisingReportSubCode] = h.handleLEExtendedAdvertisingReport
+	h.subh[evt.LEPeriodicAdvertisingSyncEstablishedSubCode] = h.handleLEPeriodicAdvertisingSyncEstablished
+	h.subh[evt.LEPeriodicAdvertisingReportSubCode] = h.handleLEPeriodicAdvertisingReport
+	h.subh[evt.LEPeriodicAdvertisingSyncLostSubCode] = h.handleLEPeriodicAdvertisingSyncLost
 	// evt.ReadRemoteVersionInformationCompleteCode: todo),
 	// evt.HardwareErrorCode:                        todo),
 	// evt.DataBufferOverflowCode:                   todo),
-	// evt.EncryptionKeyRefreshCompleteCode:         todo),
 	// evt.AuthenticatedPayloadTimeoutExpiredCode:   todo),
 	// evt.LEReadRemoteUsedFeaturesCompleteSubCode:   todo),
-	// evt.LERemoteConnectionParameterRequestSubCode: todo),
 
 	skt, err := socket.NewSocket(h.id)
 	if err != nil {
@@ -151,6 +280,7 @@ func (h *HCI) Init() error {
 	h.setAllowedCommands(1)
 
 	go h.sktLoop()
+	go h.advLoop()
 	if err := h.init(); err != nil {
 		return err
 	}
@@ -159,6 +289,28 @@ func (h *HCI) Init() error {
 	// HCI header (1 Byte) + ACL Data Header (4 bytes) + L2CAP PDU (or fragment)
 	h.pool = NewPool(1+4+h.bufSize, h.bufCnt-1)
 
+	if err := h.initPrivacy(); err != nil {
+		return err
+	}
+	h.params.Lock()
+	if h.filterPolicy&ble.FilterScan != 0 {
+		h.params.scanParams.ScanningFilterPolicy = 0x01
+	}
+	if h.filterPolicy&ble.FilterAdvertise != 0 {
+		h.params.advParams.AdvertisingFilterPolicy = 0x03
+	}
+	if h.filterPolicy&ble.FilterInitiate != 0 {
+		h.params.connParams.InitiatorFilterPolicy = 0x01
+	}
+	h.params.Unlock()
+	if h.extended {
+		// The legacy commands would disallow the extended ones.
+		return nil
+	}
+	h.params.Lock()
+	h.params.advParams.OwnAddressType = h.ownAddressType(h.params.advParams.OwnAddressType)
+	h.params.scanParams.OwnAddressType = h.ownAddressType(h.params.scanParams.OwnAddressType)
+	h.params.Unlock()
 	h.Send(&h.params.advParams, nil)
 	h.Send(&h.params.scanParams, nil)
 	return nil
@@ -213,8 +365,66 @@ func (h *HCI) init() error {
 
 	h.txPwrLv = int(LEReadAdvertisingChannelTxPowerRP.TransmitPowerLevel)
 
+	LEReadLocalSupportedFeaturesRP := cmd.LEReadLocalSupportedFeaturesRP{}
+	h.Send(&cmd.LEReadLocalSupportedFeatures{}, &LEReadLocalSupportedFeaturesRP)
+
+	h.leFeatures = LEReadLocalSupportedFeaturesRP.LEFeatures
+	if h.extScanPHYs != 0 {
+		if h.leFeatures&leFeatureExtendedAdvertising == 0 {
+			return ErrExtAdvNotSupported
+		}
+		h.extended = true
+	}
+
+	leEventMask := uint64(0x000000000000001F) | leEventRemoteConnParamsRequest
+	if h.leFeatures&leFeatureDataLengthExtension != 0 {
+		LEReadMaximumDataLengthRP := cmd.LEReadMaximumDataLengthRP{}
+		h.Send(&cmd.LEReadMaximumDataLength{}, &LEReadMaximumDataLengthRP)
+
+		h.maxTxOctets = LEReadMaximumDataLengthRP.SupportedMaxTxOctets
+		h.maxTxTime = LEReadMaximumDataLengthRP.SupportedMaxTxTime
+		leEventMask |= leEventDataLengthChange
+	}
+	if h.leFeatures&leFeatureExtendedAdvertising != 0 {
+		LEReadNumberOfSupportedAdvertisingSetsRP := cmd.LEReadNumberOfSupportedAdvertisingSetsRP{}
+		h.Send(&cmd.LEReadNumberOfSupportedAdvertisingSets{}, &LEReadNumberOfSupportedAdvertisingSetsRP)
+
+		LEReadMaximumAdvertisingDataLengthRP := cmd.LEReadMaximumAdvertisingDataLengthRP{}
+		h.Send(&cmd.LEReadMaximumAdvertisingDataLength{}, &LEReadMaximumAdvertisingDataLengthRP)
+
+		h.numAdvSets = int(LEReadNumberOfSupportedAdvertisingSetsRP.NumSupportedAdvertisingSets)
+		h.maxAdvDataLen = int(LEReadMaximumAdvertisingDataLengthRP.MaximumAdvertisingDataLength)
+		if h.maxAdvDataLen > maxExtAdvDataLength {
+			h.maxAdvDataLen = maxExtAdvDataLength
+		}
+		leEventMask |= leEventAdvertisingSetTerminated | leEventExtendedAdvertisingReport
+	}
+	if h.leFeatures&leFeaturePeriodicAdvertising != 0 {
+		leEventMask |= leEventPeriodicSyncEstablished | leEventPeriodicAdvertisingReport | leEventPeriodicSyncLost
+	}
+	if h.leFeatures&(leFeature2MPHY|leFeatureCodedPHY) != 0 {
+		leEventMask |= leEventPHYUpdateComplete
+		if h.defaultTxPHY != 0 || h.defaultRxPHY != 0 {
+			if err := h.Send(&cmd.LESetDefaultPHY{
+				AllPHYs: allPHYs(h.defaultTxPHY, h.defaultRxPHY),
+				TXPHYs:  uint8(h.defaultTxPHY),
+				RXPHYs:  uint8(h.defaultRxPHY),
+			}, nil); err != nil {
+				_ = logger.Error("can't set default PHY", "err", err)
+			}
+		}
+	}
+	if h.ctrlPrivacy {
+		if h.leFeatures&leFeatureLLPrivacy != 0 {
+			h.addrResolution = true
+			leEventMask |= leEventEnhancedConnectionComplete
+		} else {
+			logger.Info("privacy", "controller", "address resolution not supported")
+		}
+	}
+
 	LESetEventMaskRP := cmd.LESetEventMaskRP{}
-	h.Send(&cmd.LESetEventMask{LEEventMask: 0x000000000000001F}, &LESetEventMaskRP)
+	h.Send(&cmd.LESetEventMask{LEEventMask: leEventMask}, &LESetEventMaskRP)
 
 	SetEventMaskRP := cmd.SetEventMaskRP{}
 	h.Send(&cmd.SetEventMask{EventMask: 0x3dbff807fffbffff}, &SetEventMaskRP)
@@ -296,6 +506,7 @@ func (h *HCI) send(c Command) ([]byte, error) {
 func (h *HCI) sktLoop() {
 	b := make([]byte, 4096)
 	defer close(h.done)
+	defer h.advQueue.close()
 	for {
 		n, err := h.skt.Read(b)
 		if n == 0 || err != nil {
@@ -393,46 +604,16 @@ func (h *HCI) handleLEMeta(b []byte) error {
 }
 
 func (h *HCI) handleLEAdvertisingReport(b []byte) error {
-	if h.advHandler == nil {
+	if !h.advQueue.handled() {
 		return nil
 	}
 
 	e := evt.LEAdvertisingReport(b)
+	now := time.Now()
 	for i := 0; i < int(e.NumReports()); i++ {
-		var a *Advertisement
-		switch e.EventType(i) {
-		case evtTypAdvInd:
-			fallthrough
-		case evtTypAdvScanInd:
-			a = newAdvertisement(e, i)
-			h.adHist[h.adLast] = a
-			h.adLast++
-			if h.adLast == len(h.adHist) {
-				h.adLast = 0
-			}
-		case evtTypScanRsp:
-			sr := newAdvertisement(e, i)
-			for idx := h.adLast - 1; idx != h.adLast; idx-- {
-				if idx == -1 {
-					idx = len(h.adHist) - 1
-				}
-				if h.adHist[idx] == nil {
-					break
-				}
-				if h.adHist[idx].Addr().String() == sr.Addr().String() {
-					h.adHist[idx].setScanResponse(sr)
-					a = h.adHist[idx]
-					break
-				}
-			}
-			// Got a SR without having received an associated AD before?
-			if a == nil {
-				return fmt.Errorf("received scan response %s with no associated Advertising Data packet", sr.Addr())
-			}
-		default:
-			a = newAdvertisement(e, i)
-		}
-		go h.advHandler(a)
+		a := newAdvertisement(e, i)
+		a.addr = h.resolveAddr(a.AddressType(), a.address())
+		h.advQueue.push(h.advCache.add(a, now))
 	}
 
 	return nil
@@ -472,15 +653,31 @@ func (h *HCI) handleCommandStatus(b []byte) error {
 }
 
 func (h *HCI) handleLEConnectionComplete(b []byte) error {
-	e := evt.LEConnectionComplete(b)
+	return h.connected(evt.LEConnectionComplete(b), nil, [6]byte{})
+}
+
+// connected handles a new connection. If the controller has resolved the
+// address of the remote device, id is its identity address. If the controller
+// has generated a Resolvable Private Address for the local device, rpa is
+// the address.
+func (h *HCI) connected(e evt.LEConnectionComplete, id ble.Addr, rpa [6]byte) error {
 	if e.Role() == roleMaster && ErrCommand(e.Status()) == ErrConnID {
 		// The connection was canceled successfully.
 		return nil
 	}
 	c := newConn(h, e)
+	if id != nil {
+		c.remoteAddr = id
+	}
+	if rpa != ([6]byte{}) {
+		c.localAddrType, c.localAddr = 0x01, rpa
+	}
 	h.muConns.Lock()
 	h.conns[e.ConnectionHandle()] = c
 	h.muConns.Unlock()
+	if e.Status() == 0x00 && h.autoDataLength {
+		go c.setMaxDataLength()
+	}
 	if e.Role() == roleMaster {
 		if e.Status() == 0x00 {
 			select {
@@ -493,21 +690,18 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 		return nil
 	}
 	if e.Status() == 0x00 {
-		h.chSlaveConn <- c
-		// When a controller accepts a connection, it moves from advertising
-		// state to idle/ready state. Host needs to explicitly ask the
-		// controller to re-enable advertising. Note that the host was most
-		// likely in advertising state. Otherwise it couldn't accept the
-		// connection in the first place. The only exception is that user
-		// asked the host to stop advertising during this tiny window.
-		// The re-enabling might failed or ignored by the controller, if
-		// it had reached the maximum number of concurrent connections.
-		// So we also re-enable the advertising when a connection disconnected
-		h.params.RLock()
-		if h.params.advEnable.AdvertisingEnable == 1 {
-			go h.Send(&cmd.LESetAdvertiseEnable{AdvertisingEnable: 0}, nil)
+		h.muAdvSets.Lock()
+		sets := len(h.advSets)
+		h.muAdvSets.Unlock()
+		if sets == 0 {
+			h.accepted(c)
+		} else {
+			// The connection is created by an advertising set, whose address
+			// is reported by LE Advertising Set Terminated, which follows.
+			h.muConns.Lock()
+			h.pendingSlaves[e.ConnectionHandle()] = c
+			h.muConns.Unlock()
 		}
-		h.params.RUnlock()
 	}
 	if h.connectedHandler != nil {
 		h.connectedHandler(e)
@@ -515,7 +709,46 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 	return nil
 }
 
+// accepted hands a connection created as a slave to Accept.
+func (h *HCI) accepted(c *Conn) {
+	h.chSlaveConn <- c
+	// When a controller accepts a connection, it moves from advertising
+	// state to idle/ready state. Host needs to explicitly ask the
+	// controller to re-enable advertising. Note that the host was most
+	// likely in advertising state. Otherwise it couldn't accept the
+	// connection in the first place. The only exception is that user
+	// asked the host to stop advertising during this tiny window.
+	// The re-enabling might failed or ignored by the controller, if
+	// it had reached the maximum number of concurrent connections.
+	// So we also re-enable the advertising when a connection disconnected
+	h.params.RLock()
+	if h.params.advEnable.AdvertisingEnable == 1 {
+		go h.Send(&cmd.LESetAdvertiseEnable{AdvertisingEnable: 0}, nil)
+	}
+	h.params.RUnlock()
+}
+
 func (h *HCI) handleLEConnectionUpdateComplete(b []byte) error {
+	e := evt.LEConnectionUpdateComplete(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		return nil
+	}
+	p := connParams{
+		intervalMin: e.ConnInterval(),
+		intervalMax: e.ConnInterval(),
+		latency:     e.ConnLatency(),
+		timeout:     e.SupervisionTimeout(),
+	}
+	if e.Status() == 0 {
+		c.setParams(p)
+	}
+	select {
+	case c.chConnUpdate <- connUpdate{e.Status(), p}:
+	default:
+	}
 	return nil
 }
 
@@ -524,6 +757,7 @@ func (h *HCI) handleDisconnectionComplete(b []byte) error {
 	h.muConns.Lock()
 	c, found := h.conns[e.ConnectionHandle()]
 	delete(h.conns, e.ConnectionHandle())
+	delete(h.pendingSlaves, e.ConnectionHandle())
 	h.muConns.Unlock()
 	if !found {
 		return fmt.Errorf("disconnecting an invalid handle %04X", e.ConnectionHandle())
@@ -579,9 +813,45 @@ func (h *HCI) handleNumberOfCompletedPackets(b []byte) error {
 
 func (h *HCI) handleLELongTermKeyRequest(b []byte) error {
 	e := evt.LELongTermKeyRequest(b)
-	return h.Send(&cmd.LELongTermKeyRequestNegativeReply{
-		ConnectionHandle: e.ConnectionHandle(),
-	}, nil)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		go h.Send(&cmd.LELongTermKeyRequestNegativeReply{
+			ConnectionHandle: e.ConnectionHandle(),
+		}, nil)
+		return nil
+	}
+	ediv, rand := e.EncryptionDiversifier(), e.RandomNumber()
+	c.smp.post(func() { c.smp.longTermKey(ediv, rand) })
+	return nil
+}
+
+func (h *HCI) handleEncryptionChange(b []byte) error {
+	e := evt.EncryptionChange(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		return fmt.Errorf("encryption changed on an invalid handle %04X", e.ConnectionHandle())
+	}
+	status, enabled := e.Status(), e.EncryptionEnabled() != 0
+	c.smp.post(func() { c.smp.encryptionChanged(status, enabled) })
+	return nil
+}
+
+func (h *HCI) handleEncryptionKeyRefreshComplete(b []byte) error {
+	e := evt.EncryptionKeyRefreshComplete(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		return fmt.Errorf("encryption key refreshed on an invalid handle %04X", e.ConnectionHandle())
+	}
+	// The link has been re-encrypted, possibly with a different key.
+	status := e.Status()
+	c.smp.post(func() { c.smp.encryptionChanged(status, true) })
+	return nil
 }
 
 func (h *HCI) setAllowedCommands(n int) {
@@ -594,6 +864,6 @@ func (h *HCI) setAllowedCommands(n int) {
 	}
 
 	for len(h.chCmdBufs) < n {
-		h.chCmdBufs <- make([]byte, 64) // TODO make buffer size a constant
+		h.chCmdBufs <- make([]byte, cmdBufSize)
 	}
 }
@@ -0,0 +1,558 @@
+package hci
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+)
+
+// LE Credit Based Flow Control Mode [Vol 3, Part A, 10.2].
+const (
+	cocMinMTU  = 23     // Minimum MTU and MPS.
+	cocMaxMPS  = 65533  // Maximum MPS.
+	cocMaxCred = 0xFFFF // Maximum credits of a channel.
+
+	// Dynamically allocated CIDs and LE_PSMs [Vol 3, Part A, 2.1 & 4.22].
+	cidDynamicFirst uint16 = 0x0040
+	cidDynamicLast  uint16 = 0x007F
+	psmDynamicFirst uint16 = 0x0080
+	psmDynamicLast  uint16 = 0x00FF
+
+	// Local configuration of the channels. The MPS fits a K-frame in a
+	// single LE-U packet, when the Data Length Extension is in use.
+	cocRxMTU     = 2048
+	cocRxMPS     = 247
+	cocRxCredits = 32
+)
+
+// coc is an L2CAP connection-oriented channel in the LE Credit Based Flow
+// Control Mode [Vol 3, Part A, 3.4].
+type coc struct {
+	c   *Conn
+	psm uint16
+
+	// scid is the local CID, and dcid is the CID of the remote device.
+	scid uint16
+	dcid uint16
+
+	// enhanced reports if the channel is in the Enhanced Credit Based Flow
+	// Control Mode, which allows the MTU and MPS to be reconfigured.
+	enhanced bool
+
+	// rxMTU and rxMPS are guarded by muRx, and muMTU guards txMTU and txMPS.
+	rxMTU int
+	rxMPS int
+	muMTU sync.Mutex
+	txMTU int
+	txMPS int
+
+	// rxCredits is the number of K-frames the remote device can send.
+	// sdu is the SDU being reassembled, and frames is the number of the
+	// K-frames it has been received with.
+	muRx      sync.Mutex
+	rxCredits int
+	sdu       []byte
+	sduLen    int
+	frames    int
+
+	// chSDU holds the reassembled SDUs until they are read. As each SDU
+	// takes at least a credit, it never holds more than rxCredits SDUs.
+	chSDU   chan cocSDU
+	pending cocSDU
+
+	// txCredits is the number of K-frames the local device can send.
+	muTx      sync.Mutex
+	muCredits sync.Mutex
+	txCredits int
+	chCredits chan struct{}
+
+	closeOnce sync.Once
+	chClosed  chan struct{}
+}
+
+type cocSDU struct {
+	data   []byte
+	frames int
+}
+
+func newCOC(c *Conn, psm uint16) *coc {
+	return &coc{
+		c:         c,
+		psm:       psm,
+		rxMTU:     cocRxMTU,
+		rxMPS:     cocRxMPS,
+		rxCredits: cocRxCredits,
+		chSDU:     make(chan cocSDU, cocRxCredits),
+		chCredits: make(chan struct{}, 1),
+		chClosed:  make(chan struct{}),
+	}
+}
+
+// DialL2CAP opens an L2CAP connection-oriented channel to the LE_PSM of the
+// remote device, in the LE Credit Based Flow Control Mode [Vol 3, Part A, 4.22].
+func (c *Conn) DialL2CAP(psm uint16) (ble.L2CAPChannel, error) {
+	if psm == 0 || psm > psmDynamicLast {
+		return nil, fmt.Errorf("invalid LE_PSM 0x%04X", psm)
+	}
+	ch := newCOC(c, psm)
+	if err := c.addCOC(ch); err != nil {
+		return nil, err
+	}
+	var rsp LECreditBasedConnectionResponse
+	err := c.Signal(&LECreditBasedConnectionRequest{
+		LEPSM:          psm,
+		SourceCID:      ch.scid,
+		MTU:            uint16(ch.rxMTU),
+		MPS:            uint16(ch.rxMPS),
+		InitialCredits: uint16(ch.rxCredits),
+	}, &rsp)
+	switch {
+	case err != nil:
+	case rsp.Result != 0:
+		err = ble.L2CAPError(rsp.Result)
+	case rsp.DestinationCID < cidDynamicFirst || rsp.DestinationCID > cidDynamicLast,
+		rsp.MTU < cocMinMTU, rsp.MPS < cocMinMTU, rsp.MPS > cocMaxMPS:
+		err = fmt.Errorf("invalid LE Credit Based Connection Response %+v", rsp)
+	}
+	if err != nil {
+		c.removeCOC(ch)
+		return nil, errors.Wrap(err, "can't open L2CAP channel")
+	}
+	ch.txMTU = int(rsp.MTU)
+	ch.txMPS = int(rsp.MPS)
+	ch.addCredits(int(rsp.InitialCreditsCID))
+	c.muCOC.Lock()
+	ch.dcid = rsp.DestinationCID
+	c.muCOC.Unlock()
+	return ch, nil
+}
+
+// addCOC allocates a local CID for the channel, and registers it.
+func (c *Conn) addCOC(ch *coc) error {
+	c.muCOC.Lock()
+	defer c.muCOC.Unlock()
+	for cid := cidDynamicFirst; cid <= cidDynamicLast; cid++ {
+		if _, ok := c.cocs[cid]; !ok {
+			ch.scid = cid
+			c.cocs[cid] = ch
+			return nil
+		}
+	}
+	return ble.ErrL2CAPNoResources
+}
+
+func (c *Conn) removeCOC(ch *coc) {
+	c.muCOC.Lock()
+	if c.cocs[ch.scid] == ch {
+		delete(c.cocs, ch.scid)
+	}
+	c.muCOC.Unlock()
+}
+
+// coc returns the channel with the local CID.
+func (c *Conn) coc(scid uint16) *coc {
+	c.muCOC.Lock()
+	defer c.muCOC.Unlock()
+	return c.cocs[scid]
+}
+
+// cocByDCID returns the channel with the CID of the remote device.
+func (c *Conn) cocByDCID(dcid uint16) *coc {
+	c.muCOC.Lock()
+	defer c.muCOC.Unlock()
+	for _, ch := range c.cocs {
+		if ch.dcid == dcid {
+			return ch
+		}
+	}
+	return nil
+}
+
+// closeCOCs closes all the channels, when the link is disconnected.
+func (c *Conn) closeCOCs() {
+	c.muCOC.Lock()
+	cocs := c.cocs
+	c.cocs = make(map[uint16]*coc)
+	c.muCOC.Unlock()
+	for _, ch := range cocs {
+		ch.closed()
+	}
+}
+
+// handleLECreditBasedConnectionRequest handles LE Credit Based Connection
+// Request (0x14) [Vol 3, Part A, 4.22].
+func (c *Conn) handleLECreditBasedConnectionRequest(s sigCmd) {
+	var req LECreditBasedConnectionRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	reply := func(rsp *LECreditBasedConnectionResponse) {
+		c.sendResponse(SignalLECreditBasedConnectionResponse, s.id(), rsp)
+	}
+	refuse := func(e ble.L2CAPError) {
+		reply(&LECreditBasedConnectionResponse{Result: uint16(e)})
+	}
+
+	l := c.hci.l2capListener(req.LEPSM)
+	switch {
+	case l == nil:
+		refuse(ble.ErrL2CAPPSMNotSupported)
+		return
+	case req.SourceCID < cidDynamicFirst || req.SourceCID > cidDynamicLast:
+		refuse(ble.ErrL2CAPInvalidSourceCID)
+		return
+	case c.cocByDCID(req.SourceCID) != nil:
+		refuse(ble.ErrL2CAPSourceCIDAllocated)
+		return
+	case req.MTU < cocMinMTU || req.MPS < cocMinMTU || req.MPS > cocMaxMPS:
+		refuse(ble.ErrL2CAPUnacceptableParams)
+		return
+	case len(l.chAccept) == cap(l.chAccept):
+		refuse(ble.ErrL2CAPNoResources)
+		return
+	}
+
+	ch := newCOC(c, req.LEPSM)
+	ch.dcid = req.SourceCID
+	ch.txMTU = int(req.MTU)
+	ch.txMPS = int(req.MPS)
+	ch.addCredits(int(req.InitialCredits))
+	if err := c.addCOC(ch); err != nil {
+		refuse(ble.ErrL2CAPNoResources)
+		return
+	}
+	reply(&LECreditBasedConnectionResponse{
+		DestinationCID:    ch.scid,
+		MTU:               uint16(ch.rxMTU),
+		MPS:               uint16(ch.rxMPS),
+		InitialCreditsCID: uint16(ch.rxCredits),
+	})
+	if !l.push(ch) {
+		go ch.Close()
+	}
+}
+
+// handleLEFlowControlCredit handles LE Flow Control Credit (0x16) [Vol 3, Part A, 4.24].
+func (c *Conn) handleLEFlowControlCredit(s sigCmd) {
+	var req LEFlowControlCredit
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	ch := c.cocByDCID(req.CID)
+	if ch == nil {
+		return
+	}
+	if !ch.addCredits(int(req.Credits)) {
+		// The credit count exceeds 65535 [Vol 3, Part A, 10.1].
+		go ch.Close()
+	}
+}
+
+// handleCOC handles a K-frame received on a channel [Vol 3, Part A, 3.4.3].
+func (ch *coc) handleCOC(p pdu) {
+	if err := ch.receive(p); err != nil {
+		_ = logger.Error("l2cap", "cid", fmt.Sprintf("0x%04X", ch.scid), "err", err)
+		go ch.Close()
+	}
+}
+
+func (ch *coc) receive(p pdu) error {
+	ch.muRx.Lock()
+	defer ch.muRx.Unlock()
+	if ch.rxCredits == 0 {
+		return errors.New("K-frame received without credits")
+	}
+	ch.rxCredits--
+
+	data := p.payload()
+	if ch.sdu == nil {
+		if len(data) < 2 {
+			return errors.New("K-frame without SDU length")
+		}
+		ch.sduLen = leFrameHdr(p).slen()
+		data = leFrameHdr(p).payload()
+		if ch.sduLen > ch.rxMTU {
+			return fmt.Errorf("SDU length %d exceeds MTU %d", ch.sduLen, ch.rxMTU)
+		}
+		ch.sdu = make([]byte, 0, ch.sduLen)
+		ch.frames = 0
+	}
+	if len(p.payload()) > ch.rxMPS {
+		return fmt.Errorf("K-frame size %d exceeds MPS %d", len(p.payload()), ch.rxMPS)
+	}
+	if len(ch.sdu)+len(data) > ch.sduLen {
+		return fmt.Errorf("SDU exceeds its length %d", ch.sduLen)
+	}
+	ch.sdu = append(ch.sdu, data...)
+	ch.frames++
+	if len(ch.sdu) < ch.sduLen {
+		return nil
+	}
+	select {
+	case ch.chSDU <- cocSDU{data: ch.sdu, frames: ch.frames}:
+	default:
+		return errors.New("SDU queue overflow")
+	}
+	ch.sdu = nil
+	return nil
+}
+
+// Read reads the data of the received SDUs. The credits of an SDU are given
+// back to the remote device once it has been read.
+func (ch *coc) Read(b []byte) (int, error) {
+	if len(ch.pending.data) == 0 {
+		select {
+		case sdu := <-ch.chSDU:
+			ch.pending = sdu
+			ch.giveCredits(sdu.frames)
+		case <-ch.chClosed:
+			select {
+			case sdu := <-ch.chSDU:
+				ch.pending = sdu
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+	n := copy(b, ch.pending.data)
+	ch.pending.data = ch.pending.data[n:]
+	return n, nil
+}
+
+// Conn returns the connection the channel is opened on.
+func (ch *coc) Conn() ble.Conn { return ch.c }
+
+// PSM returns the LE_PSM the channel is connected to.
+func (ch *coc) PSM() uint16 { return ch.psm }
+
+// RxMTU returns the MTU of the SDUs the local device can receive.
+func (ch *coc) RxMTU() int {
+	ch.muRx.Lock()
+	defer ch.muRx.Unlock()
+	return ch.rxMTU
+}
+
+// TxMTU returns the MTU of the SDUs the remote device can receive.
+func (ch *coc) TxMTU() int {
+	mtu, _ := ch.txParams()
+	return mtu
+}
+
+func (ch *coc) txParams() (mtu, mps int) {
+	ch.muMTU.Lock()
+	defer ch.muMTU.Unlock()
+	return ch.txMTU, ch.txMPS
+}
+
+// giveCredits gives the remote device credits to send more K-frames.
+func (ch *coc) giveCredits(n int) {
+	ch.muRx.Lock()
+	ch.rxCredits += n
+	ch.muRx.Unlock()
+	ch.c.Signal(&LEFlowControlCredit{
+		CID:     ch.scid,
+		Credits: uint16(n),
+	}, nil)
+}
+
+// addCredits adds the credits given by the remote device. It reports false
+// if the credit count overflows.
+func (ch *coc) addCredits(n int) bool {
+	ch.muCredits.Lock()
+	defer ch.muCredits.Unlock()
+	if ch.txCredits+n > cocMaxCred {
+		return false
+	}
+	ch.txCredits += n
+	select {
+	case ch.chCredits <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// takeCredit waits for a credit to send a K-frame.
+func (ch *coc) takeCredit() error {
+	for {
+		ch.muCredits.Lock()
+		if ch.txCredits > 0 {
+			ch.txCredits--
+			ch.muCredits.Unlock()
+			return nil
+		}
+		ch.muCredits.Unlock()
+		select {
+		case <-ch.chCredits:
+		case <-ch.chClosed:
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+// Write sends b as an SDU, which is segmented into K-frames of the MPS of the
+// remote device [Vol 3, Part A, 7.3.1].
+func (ch *coc) Write(b []byte) (int, error) {
+	mtu, mps := ch.txParams()
+	if len(b) > mtu {
+		return 0, errors.Wrap(io.ErrShortWrite, "payload exceeds mtu")
+	}
+	ch.muTx.Lock()
+	defer ch.muTx.Unlock()
+
+	sent := 0
+	for first := true; first || sent < len(b); first = false {
+		var f []byte
+		n := len(b) - sent
+		if first {
+			if n > mps-2 {
+				n = mps - 2
+			}
+			f = make([]byte, 6, 6+n)
+			binary.LittleEndian.PutUint16(f[4:6], uint16(len(b)))
+		} else {
+			if n > mps {
+				n = mps
+			}
+			f = make([]byte, 4, 4+n)
+		}
+		f = append(f, b[sent:sent+n]...)
+		binary.LittleEndian.PutUint16(f[0:2], uint16(len(f)-4))
+		binary.LittleEndian.PutUint16(f[2:4], ch.dcid)
+
+		if err := ch.takeCredit(); err != nil {
+			return sent, err
+		}
+		if _, err := ch.c.writePDU(f); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+// Close disconnects the channel [Vol 3, Part A, 4.6].
+func (ch *coc) Close() error {
+	select {
+	case <-ch.chClosed:
+		return nil
+	case <-ch.c.chDone:
+		ch.closed()
+		return nil
+	default:
+	}
+	var rsp DisconnectResponse
+	err := ch.c.Signal(&DisconnectRequest{DestinationCID: ch.dcid, SourceCID: ch.scid}, &rsp)
+	ch.closed()
+	return err
+}
+
+// closed releases the channel, once it's disconnected.
+func (ch *coc) closed() {
+	ch.closeOnce.Do(func() {
+		ch.c.removeCOC(ch)
+		close(ch.chClosed)
+	})
+}
+
+// l2capListener listens on an LE_PSM of the local device.
+type l2capListener struct {
+	h        *HCI
+	psm      uint16
+	chAccept chan *coc
+	chClosed chan struct{}
+}
+
+// ListenL2CAP listens on the LE_PSM for the L2CAP connection-oriented channels
+// opened by remote devices. If psm is zero, a dynamic LE_PSM is allocated.
+func (h *HCI) ListenL2CAP(psm uint16) (ble.L2CAPListener, error) {
+	h.muL2CAP.Lock()
+	defer h.muL2CAP.Unlock()
+	if psm == 0 {
+		for p := psmDynamicFirst; p <= psmDynamicLast; p++ {
+			if _, ok := h.l2capListeners[p]; !ok {
+				psm = p
+				break
+			}
+		}
+		if psm == 0 {
+			return nil, errors.New("no LE_PSM available")
+		}
+	}
+	if psm > psmDynamicLast {
+		return nil, fmt.Errorf("invalid LE_PSM 0x%04X", psm)
+	}
+	if _, ok := h.l2capListeners[psm]; ok {
+		return nil, fmt.Errorf("LE_PSM 0x%04X is in use", psm)
+	}
+	l := &l2capListener{
+		h:        h,
+		psm:      psm,
+		chAccept: make(chan *coc, 16),
+		chClosed: make(chan struct{}),
+	}
+	h.l2capListeners[psm] = l
+	return l, nil
+}
+
+func (h *HCI) l2capListener(psm uint16) *l2capListener {
+	h.muL2CAP.Lock()
+	defer h.muL2CAP.Unlock()
+	return h.l2capListeners[psm]
+}
+
+// Accept waits for and returns the next channel opened to the LE_PSM.
+func (l *l2capListener) Accept() (ble.L2CAPChannel, error) {
+	select {
+	case ch := <-l.chAccept:
+		return ch, nil
+	case <-l.chClosed:
+		return nil, errors.Wrap(io.ErrClosedPipe, "listener closed")
+	case <-l.h.done:
+		return nil, l.h.err
+	}
+}
+
+// push queues the channel for Accept, unless the listener is closed or the
+// queue is full.
+func (l *l2capListener) push(ch *coc) bool {
+	l.h.muL2CAP.Lock()
+	defer l.h.muL2CAP.Unlock()
+	select {
+	case <-l.chClosed:
+		return false
+	default:
+	}
+	select {
+	case l.chAccept <- ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops listening on the LE_PSM, and closes the channels which haven't
+// been accepted yet.
+func (l *l2capListener) Close() error {
+	l.h.muL2CAP.Lock()
+	defer l.h.muL2CAP.Unlock()
+	if l.h.l2capListeners[l.psm] != l {
+		return nil
+	}
+	delete(l.h.l2capListeners, l.psm)
+	close(l.chClosed)
+	for {
+		select {
+		case ch := <-l.chAccept:
+			go ch.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// PSM returns the LE_PSM the listener listens on.
+func (l *l2capListener) PSM() uint16 { return l.psm }
@@ -0,0 +1,307 @@
+package hci
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+)
+
+// Enhanced Credit Based Flow Control Mode [Vol 3, Part A, 10.2].
+const (
+	ecocMinMTU      = 64 // Minimum MTU and MPS.
+	ecocMaxChannels = 5  // Maximum channels of a request.
+)
+
+// Results of Credit Based Reconfigure Response [Vol 3, Part A, 4.28].
+const (
+	reconfigureSuccess            = 0x0000
+	reconfigureMTUReduced         = 0x0001
+	reconfigureMPSReduced         = 0x0002
+	reconfigureInvalidCID         = 0x0003
+	reconfigureUnacceptableParams = 0x0004
+)
+
+var reconfigureResultName = map[uint16]string{
+	reconfigureMTUReduced:         "reduction in size of MTU not allowed",
+	reconfigureMPSReduced:         "reduction in size of MPS not allowed for more than one channel",
+	reconfigureInvalidCID:         "one or more destination CIDs invalid",
+	reconfigureUnacceptableParams: "other unacceptable parameters",
+}
+
+// DialL2CAPEnhanced opens up to five L2CAP connection-oriented channels to the
+// LE_PSM of the remote device with a single request, in the Enhanced Credit
+// Based Flow Control Mode [Vol 3, Part A, 4.25]. The channels refused by the
+// remote device are left out.
+func (c *Conn) DialL2CAPEnhanced(psm uint16, n int) ([]ble.L2CAPChannel, error) {
+	if psm == 0 || psm > psmDynamicLast {
+		return nil, fmt.Errorf("invalid LE_PSM 0x%04X", psm)
+	}
+	if n < 1 || n > ecocMaxChannels {
+		return nil, fmt.Errorf("invalid number of channels %d", n)
+	}
+	chs := make([]*coc, 0, n)
+	scids := make([]uint16, 0, n)
+	for i := 0; i < n; i++ {
+		ch := newCOC(c, psm)
+		ch.enhanced = true
+		if err := c.addCOC(ch); err != nil {
+			for _, ch := range chs {
+				c.removeCOC(ch)
+			}
+			return nil, errors.Wrap(err, "can't open L2CAP channels")
+		}
+		chs = append(chs, ch)
+		scids = append(scids, ch.scid)
+	}
+
+	var rsp CreditBasedConnectionResponse
+	err := c.Signal(&CreditBasedConnectionRequest{
+		SPSM:           psm,
+		MTU:            cocRxMTU,
+		MPS:            cocRxMPS,
+		InitialCredits: cocRxCredits,
+		SourceCID:      scids,
+	}, &rsp)
+	accepted := 0
+	if err == nil && len(rsp.DestinationCID) == n {
+		for _, dcid := range rsp.DestinationCID {
+			if dcid != 0 {
+				accepted++
+			}
+		}
+	}
+	switch {
+	case err != nil:
+	case len(rsp.DestinationCID) != n:
+		err = fmt.Errorf("invalid Credit Based Connection Response %+v", rsp)
+	case accepted == 0 && rsp.Result != 0:
+		err = ble.L2CAPError(rsp.Result)
+	case accepted == 0, rsp.MTU < ecocMinMTU, rsp.MPS < ecocMinMTU, rsp.MPS > cocMaxMPS:
+		err = fmt.Errorf("invalid Credit Based Connection Response %+v", rsp)
+	}
+	for _, dcid := range rsp.DestinationCID {
+		if dcid != 0 && (dcid < cidDynamicFirst || dcid > cidDynamicLast) {
+			err = fmt.Errorf("invalid Credit Based Connection Response %+v", rsp)
+		}
+	}
+	if err != nil {
+		for _, ch := range chs {
+			c.removeCOC(ch)
+		}
+		return nil, errors.Wrap(err, "can't open L2CAP channels")
+	}
+
+	opened := make([]ble.L2CAPChannel, 0, accepted)
+	for i, ch := range chs {
+		dcid := rsp.DestinationCID[i]
+		if dcid == 0 {
+			c.removeCOC(ch)
+			continue
+		}
+		ch.txMTU = int(rsp.MTU)
+		ch.txMPS = int(rsp.MPS)
+		ch.addCredits(int(rsp.InitialCredits))
+		c.muCOC.Lock()
+		ch.dcid = dcid
+		c.muCOC.Unlock()
+		opened = append(opened, ch)
+	}
+	return opened, nil
+}
+
+// ReconfigureL2CAP changes the MTU and MPS of the channels opened in the
+// Enhanced Credit Based Flow Control Mode [Vol 3, Part A, 4.27]. The MTU can't
+// be decreased, and the MPS can only be decreased for a single channel.
+func (c *Conn) ReconfigureL2CAP(chs []ble.L2CAPChannel, mtu, mps int) error {
+	if len(chs) < 1 || len(chs) > ecocMaxChannels {
+		return fmt.Errorf("invalid number of channels %d", len(chs))
+	}
+	if mtu < ecocMinMTU || mtu > 0xFFFF || mps < ecocMinMTU || mps > cocMaxMPS {
+		return fmt.Errorf("invalid MTU %d or MPS %d", mtu, mps)
+	}
+	cocs := make([]*coc, 0, len(chs))
+	cids := make([]uint16, 0, len(chs))
+	for _, l := range chs {
+		ch, ok := l.(*coc)
+		if !ok || ch.c != c || !ch.enhanced {
+			return errors.New("not an enhanced channel of the connection")
+		}
+		cocs = append(cocs, ch)
+		cids = append(cids, ch.scid)
+	}
+
+	// Accept the larger SDUs and K-frames before the remote device is told
+	// about them. A smaller MPS only takes effect once it's accepted.
+	type params struct{ mtu, mps int }
+	old := make([]params, len(cocs))
+	for i, ch := range cocs {
+		ch.muRx.Lock()
+		old[i] = params{ch.rxMTU, ch.rxMPS}
+		ch.muRx.Unlock()
+		if mtu < old[i].mtu {
+			return fmt.Errorf("can't reduce MTU %d to %d", old[i].mtu, mtu)
+		}
+		if len(cocs) > 1 && mps < old[i].mps {
+			return fmt.Errorf("can't reduce MPS %d to %d for more than one channel", old[i].mps, mps)
+		}
+	}
+	setRx := func(f func(i int, ch *coc)) {
+		for i, ch := range cocs {
+			ch.muRx.Lock()
+			f(i, ch)
+			ch.muRx.Unlock()
+		}
+	}
+	setRx(func(i int, ch *coc) {
+		ch.rxMTU = mtu
+		if mps > ch.rxMPS {
+			ch.rxMPS = mps
+		}
+	})
+
+	var rsp CreditBasedReconfigureResponse
+	err := c.Signal(&CreditBasedReconfigureRequest{
+		MTU:            uint16(mtu),
+		MPS:            uint16(mps),
+		DestinationCID: cids,
+	}, &rsp)
+	if err == nil && rsp.Result != reconfigureSuccess {
+		name, ok := reconfigureResultName[rsp.Result]
+		if !ok {
+			name = fmt.Sprintf("result 0x%04X", rsp.Result)
+		}
+		err = errors.New(name)
+	}
+	if err != nil {
+		setRx(func(i int, ch *coc) { ch.rxMTU, ch.rxMPS = old[i].mtu, old[i].mps })
+		return errors.Wrap(err, "can't reconfigure L2CAP channels")
+	}
+	setRx(func(i int, ch *coc) { ch.rxMPS = mps })
+	return nil
+}
+
+// handleCreditBasedConnectionRequest handles Credit Based Connection Request
+// (0x17) [Vol 3, Part A, 4.25].
+func (c *Conn) handleCreditBasedConnectionRequest(s sigCmd) {
+	var req CreditBasedConnectionRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	dcids := make([]uint16, len(req.SourceCID))
+	refuse := func(e ble.L2CAPError) {
+		c.sendResponse(SignalCreditBasedConnectionResponse, s.id(), &CreditBasedConnectionResponse{
+			Result:         uint16(e),
+			DestinationCID: dcids,
+		})
+	}
+
+	l := c.hci.l2capListener(req.SPSM)
+	switch {
+	case len(req.SourceCID) < 1 || len(req.SourceCID) > ecocMaxChannels:
+		refuse(ble.ErrL2CAPInvalidParams)
+		return
+	case l == nil:
+		refuse(ble.ErrL2CAPPSMNotSupported)
+		return
+	case req.MTU < ecocMinMTU || req.MPS < ecocMinMTU || req.MPS > cocMaxMPS:
+		refuse(ble.ErrL2CAPUnacceptableParams)
+		return
+	}
+
+	// Each channel is accepted or refused on its own, and the result is the
+	// reason of the last refused one.
+	var result ble.L2CAPError
+	var chs []*coc
+	for i, scid := range req.SourceCID {
+		switch {
+		case scid < cidDynamicFirst || scid > cidDynamicLast:
+			result = ble.ErrL2CAPInvalidSourceCID
+			continue
+		case c.cocByDCID(scid) != nil:
+			result = ble.ErrL2CAPSourceCIDAllocated
+			continue
+		case len(l.chAccept)+len(chs) >= cap(l.chAccept):
+			result = ble.ErrL2CAPNoResources
+			continue
+		}
+		ch := newCOC(c, req.SPSM)
+		ch.enhanced = true
+		ch.dcid = scid
+		ch.txMTU = int(req.MTU)
+		ch.txMPS = int(req.MPS)
+		ch.addCredits(int(req.InitialCredits))
+		if err := c.addCOC(ch); err != nil {
+			result = ble.ErrL2CAPNoResources
+			continue
+		}
+		dcids[i] = ch.scid
+		chs = append(chs, ch)
+	}
+	if len(chs) == 0 {
+		refuse(result)
+		return
+	}
+	c.sendResponse(SignalCreditBasedConnectionResponse, s.id(), &CreditBasedConnectionResponse{
+		MTU:            cocRxMTU,
+		MPS:            cocRxMPS,
+		InitialCredits: cocRxCredits,
+		Result:         uint16(result),
+		DestinationCID: dcids,
+	})
+	for _, ch := range chs {
+		select {
+		case l.chAccept <- ch:
+		default:
+			go ch.Close()
+		}
+	}
+}
+
+// handleCreditBasedReconfigureRequest handles Credit Based Reconfigure Request
+// (0x19) [Vol 3, Part A, 4.27].
+func (c *Conn) handleCreditBasedReconfigureRequest(s sigCmd) {
+	var req CreditBasedReconfigureRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	reply := func(result uint16) {
+		c.sendResponse(SignalCreditBasedReconfigureResponse, s.id(), &CreditBasedReconfigureResponse{
+			Result: result,
+		})
+	}
+	if len(req.DestinationCID) < 1 || len(req.DestinationCID) > ecocMaxChannels ||
+		req.MTU < ecocMinMTU || req.MPS < ecocMinMTU || req.MPS > cocMaxMPS {
+		reply(reconfigureUnacceptableParams)
+		return
+	}
+
+	// The CIDs are the endpoints of the remote device.
+	chs := make([]*coc, 0, len(req.DestinationCID))
+	for _, cid := range req.DestinationCID {
+		ch := c.cocByDCID(cid)
+		if ch == nil || !ch.enhanced {
+			reply(reconfigureInvalidCID)
+			return
+		}
+		chs = append(chs, ch)
+	}
+	for _, ch := range chs {
+		mtu, mps := ch.txParams()
+		if int(req.MTU) < mtu {
+			reply(reconfigureMTUReduced)
+			return
+		}
+		if len(chs) > 1 && int(req.MPS) < mps {
+			reply(reconfigureMPSReduced)
+			return
+		}
+	}
+	for _, ch := range chs {
+		ch.muMTU.Lock()
+		ch.txMTU = int(req.MTU)
+		ch.txMPS = int(req.MPS)
+		ch.muMTU.Unlock()
+	}
+	reply(reconfigureSuccess)
+}
@@ -0,0 +1,143 @@
+package hci
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// kFrame returns a K-frame on the CID, with the SDU length if sduLen >= 0.
+func kFrame(cid uint16, sduLen int, data []byte) pdu {
+	var p []byte
+	if sduLen >= 0 {
+		p = make([]byte, 6)
+		binary.LittleEndian.PutUint16(p[4:], uint16(sduLen))
+	} else {
+		p = make([]byte, 4)
+	}
+	p = append(p, data...)
+	binary.LittleEndian.PutUint16(p[0:], uint16(len(p)-4))
+	binary.LittleEndian.PutUint16(p[2:], cid)
+	return p
+}
+
+func TestCOCReassembly(t *testing.T) {
+	ch := newCOC(&Conn{}, 0x80)
+	ch.scid = 0x40
+	ch.rxMPS = 23
+
+	sdu := bytes.Repeat([]byte{0x5A}, 50)
+	frames := []pdu{
+		kFrame(ch.scid, len(sdu), sdu[:21]),
+		kFrame(ch.scid, -1, sdu[21:44]),
+		kFrame(ch.scid, -1, sdu[44:]),
+	}
+	for i, f := range frames {
+		if err := ch.receive(f); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	select {
+	case got := <-ch.chSDU:
+		if !bytes.Equal(got.data, sdu) || got.frames != len(frames) {
+			t.Errorf("SDU = %X (%d frames), want %X (%d frames)", got.data, got.frames, sdu, len(frames))
+		}
+	default:
+		t.Fatal("SDU not reassembled")
+	}
+	if want := cocRxCredits - len(frames); ch.rxCredits != want {
+		t.Errorf("credits = %d, want %d", ch.rxCredits, want)
+	}
+}
+
+func TestCOCReceiveErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		f     pdu
+		setup func(ch *coc)
+	}{
+		{"no credits", kFrame(0x40, 1, []byte{1}), func(ch *coc) { ch.rxCredits = 0 }},
+		{"exceeds MTU", kFrame(0x40, cocRxMTU+1, []byte{1}), nil},
+		{"exceeds MPS", kFrame(0x40, 30, make([]byte, 30)), func(ch *coc) { ch.rxMPS = 23 }},
+		{"exceeds SDU length", kFrame(0x40, 1, []byte{1, 2}), nil},
+		{"no SDU length", pdu{1, 0, 0x40, 0, 1}, nil},
+	}
+	for _, tt := range tests {
+		ch := newCOC(&Conn{}, 0x80)
+		if tt.setup != nil {
+			tt.setup(ch)
+		}
+		if err := ch.receive(tt.f); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestCreditBasedConnectionRequest(t *testing.T) {
+	req := CreditBasedConnectionRequest{
+		SPSM:           0x0027,
+		MTU:            512,
+		MPS:            247,
+		InitialCredits: 10,
+		SourceCID:      []uint16{0x0040, 0x0041, 0x0042},
+	}
+	b, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x27, 0x00, 0x00, 0x02, 0xF7, 0x00, 0x0A, 0x00, 0x40, 0x00, 0x41, 0x00, 0x42, 0x00}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("Marshal() = %X, want %X", b, want)
+	}
+	var got CreditBasedConnectionRequest
+	if err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.SPSM != req.SPSM || got.MTU != req.MTU || got.MPS != req.MPS ||
+		got.InitialCredits != req.InitialCredits || len(got.SourceCID) != len(req.SourceCID) {
+		t.Fatalf("Unmarshal() = %+v, want %+v", got, req)
+	}
+	for i := range req.SourceCID {
+		if got.SourceCID[i] != req.SourceCID[i] {
+			t.Errorf("SourceCID[%d] = 0x%04X, want 0x%04X", i, got.SourceCID[i], req.SourceCID[i])
+		}
+	}
+	if err := got.Unmarshal(b[:7]); err == nil {
+		t.Error("Unmarshal() of a truncated packet: no error")
+	}
+}
+
+func TestL2CAPListenerClose(t *testing.T) {
+	p := newSMPPeer(t, roleSlave, smpSlaveAddr, smpMasterAddr)
+	ln, err := p.h.ListenL2CAP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ln.(*l2capListener)
+	ch := newCOC(p.c, l.psm)
+	ch.dcid = 0x0080
+	if err := p.c.addCOC(ch); err != nil {
+		t.Fatal(err)
+	}
+	if !l.push(ch) {
+		t.Fatal("channel not queued")
+	}
+
+	// The channel which isn't accepted is disconnected.
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := p.expect(t, SignalDisconnectRequest)
+	if dcid := binary.LittleEndian.Uint16(b[4:]); dcid != ch.dcid {
+		t.Errorf("disconnected CID 0x%04X, want 0x%04X", dcid, ch.dcid)
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept() on a closed listener: no error")
+	}
+	if l.push(newCOC(p.c, l.psm)) {
+		t.Error("channel queued on a closed listener")
+	}
+	if p.h.l2capListener(l.psm) != nil {
+		t.Error("closed listener still listens")
+	}
+}
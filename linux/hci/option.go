@@ -2,7 +2,10 @@ package hci
 
 import (
 	"errors"
+	"fmt"
+	"github.com/trustasia-com/ble"
 	"github.com/trustasia-com/ble/linux/hci/evt"
+	"net"
 	"time"
 
 	"github.com/trustasia-com/ble/linux/hci/cmd"
@@ -26,6 +29,74 @@ func (h *HCI) SetListenerTimeout(d time.Duration) error {
 	return nil
 }
 
+// SetSignalTimeout sets the RTX timer of the L2CAP signaling requests, which
+// is between 1 and 60 seconds [Vol 3, Part A, 6.2.1].
+func (h *HCI) SetSignalTimeout(d time.Duration) error {
+	if d < minSigRTX || d > maxSigRTX {
+		return fmt.Errorf("invalid signaling timeout %v", d)
+	}
+	h.sigRTX = d
+	return nil
+}
+
+// SetConnParamPolicy sets the policy, which accepts, rejects or clamps the
+// connection parameters requested by the remote devices.
+func (h *HCI) SetConnParamPolicy(p ble.ConnParamPolicy) error {
+	h.connParamPolicy = p
+	return nil
+}
+
+// SetAutoDataLength sets whether the maximum data length supported by the
+// controller is requested on each new connection.
+func (h *HCI) SetAutoDataLength(auto bool) error {
+	h.autoDataLength = auto
+	return nil
+}
+
+// SetDefaultPHY sets the preferred PHYs for transmitting and receiving on the
+// new connections. Either tx or rx may be 0, if there is no preference.
+func (h *HCI) SetDefaultPHY(tx, rx ble.PHY) error {
+	if !validPHYs(tx) || !validPHYs(rx) {
+		return fmt.Errorf("invalid PHYs %v, %v", tx, rx)
+	}
+	h.defaultTxPHY, h.defaultRxPHY = tx, rx
+	return nil
+}
+
+// SetExtendedScan sets the PHYs, ble.PHY1M and ble.PHYCoded, which the
+// extended scanning uses. If phys is 0, the legacy scanning is used.
+// Otherwise the extended commands are used for advertising, scanning and
+// initiating connections, since they can't be mixed with the legacy ones,
+// and the advertising sets are used for advertising.
+func (h *HCI) SetExtendedScan(phys ble.PHY) error {
+	if phys&^(ble.PHY1M|ble.PHYCoded) != 0 {
+		return fmt.Errorf("invalid scanning PHYs %v", phys)
+	}
+	h.extScanPHYs = phys
+	return nil
+}
+
+// SetScanCache sets the number of devices, whose advertising data and scan
+// response are cached and merged while scanning, and how long they are cached
+// since they're last seen. If ttl is 0, they don't expire.
+func (h *HCI) SetScanCache(size int, ttl time.Duration) error {
+	if size < 1 || ttl < 0 {
+		return fmt.Errorf("invalid scan cache size %d, TTL %v", size, ttl)
+	}
+	h.advCache.setLimits(size, ttl)
+	return nil
+}
+
+// SetAdvQueue sets the number of advertisements, which are queued for the
+// AdvHandler, and what is done once the queue is full.
+func (h *HCI) SetAdvQueue(depth int, policy ble.AdvDropPolicy) error {
+	if depth < 1 || policy < ble.AdvDropOldest || policy > ble.AdvBlock {
+		return fmt.Errorf("invalid advertisement queue depth %d, policy %d", depth, policy)
+	}
+	h.advQueue.setLimits(depth, policy)
+	return nil
+}
+
 // SetConnParams overrides default connection parameters.
 func (h *HCI) SetConnParams(param cmd.LECreateConnection) error {
 	h.params.connParams = param
@@ -56,6 +127,117 @@ func (h *HCI) SetAdvParams(param cmd.LESetAdvertisingParameters) error {
 	return nil
 }
 
+// SetBondStore sets the store which persists the keys of bonded peers.
+func (h *HCI) SetBondStore(s ble.BondStore) error {
+	h.bonds = s
+	return nil
+}
+
+// SetPairingAgent sets the agent which takes part in pairing on behalf of the user.
+func (h *HCI) SetPairingAgent(a ble.PairingAgent) error {
+	h.agent = a
+	return nil
+}
+
+// SetIOCapability sets the input and output capabilities of the device.
+func (h *HCI) SetIOCapability(c ble.IOCapability) error {
+	if c > ble.IOCapKeyboardDisplay {
+		return fmt.Errorf("invalid IO capability 0x%02X", uint8(c))
+	}
+	h.smpIOCap = uint8(c)
+	return nil
+}
+
+// SetSecureConnectionsOnly sets whether LE Legacy Pairing is rejected.
+func (h *HCI) SetSecureConnectionsOnly(enable bool) error {
+	h.scOnly = enable
+	return nil
+}
+
+// SetPrivacy enables privacy, and sets the interval of regenerating the
+// Resolvable Private Address.
+func (h *HCI) SetPrivacy(interval time.Duration) error {
+	if interval <= 0 {
+		interval = defaultRPATimeout
+	}
+	h.privacy = true
+	h.rpaTimeout = interval
+	return nil
+}
+
+// SetRandomAddress sets the static or non-resolvable private address, which
+// is used instead of the public address.
+func (h *HCI) SetRandomAddress(a ble.Addr) error {
+	mac, err := net.ParseMAC(a.String())
+	if err != nil || len(mac) != 6 {
+		return fmt.Errorf("invalid random address %s", a)
+	}
+	w := [6]byte{mac[5], mac[4], mac[3], mac[2], mac[1], mac[0]}
+
+	// The random part of the address shall not be all zeros or all ones.
+	r := w
+	r[5] &= 0x3F
+	switch {
+	case r == [6]byte{}, r == [6]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x3F}:
+		return fmt.Errorf("invalid random address %s", a)
+	case w[5]>>6 != 0x03 && w[5]>>6 != 0x00:
+		return fmt.Errorf("%s is neither a static nor a non-resolvable private address", a)
+	}
+	h.randAddr = w
+	return nil
+}
+
+// SetStaticRandomAddress generates a static random address, which is used
+// instead of the public address.
+func (h *HCI) SetStaticRandomAddress() error {
+	a, err := genStaticAddr()
+	if err != nil {
+		return err
+	}
+	h.randAddr = a
+	return nil
+}
+
+// SetEnhancedATT sets whether the GATT server accepts the Enhanced ATT bearers.
+func (h *HCI) SetEnhancedATT(enable bool) error {
+	h.eatt = enable
+	return nil
+}
+
+// EnhancedATT reports whether the GATT server accepts the Enhanced ATT bearers.
+func (h *HCI) EnhancedATT() bool {
+	return h.eatt
+}
+
+// SetControllerPrivacy sets whether the controller resolves the addresses.
+func (h *HCI) SetControllerPrivacy(enable bool) error {
+	h.ctrlPrivacy = enable
+	return nil
+}
+
+// SetFilterPolicy sets the operations, which only accept the devices in the
+// white list, which is loaded with the bonds.
+func (h *HCI) SetFilterPolicy(p ble.FilterPolicy) error {
+	if p&^(ble.FilterScan|ble.FilterAdvertise|ble.FilterInitiate) != 0 {
+		return fmt.Errorf("invalid filter policy %d", p)
+	}
+	h.filterPolicy = p
+	return nil
+}
+
+// SetLocalIRK sets the Identity Resolving Key of the device.
+func (h *HCI) SetLocalIRK(irk ble.Key) error {
+	h.irk = irk
+	return nil
+}
+
+// LocalIRK returns the Identity Resolving Key of the device, which is
+// distributed to the bonded peers. Unless it's set with OptLocalIRK, it's
+// generated at random, and should be persisted along with the bonds.
+func (h *HCI) LocalIRK() ble.Key {
+	return h.irk
+}
+
 // SetPeripheralRole is not supported
 func (h *HCI) SetPeripheralRole() error {
 	return errors.New("Not supported")
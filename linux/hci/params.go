@@ -13,6 +13,8 @@ type params struct {
 	scanEnable cmd.LESetScanEnable
 	connCancel cmd.LECreateConnectionCancel
 
+	extScanEnable cmd.LESetExtendedScanEnable
+
 	advData    cmd.LESetAdvertisingData
 	scanResp   cmd.LESetScanResponseData
 	advParams  cmd.LESetAdvertisingParameters
@@ -0,0 +1,309 @@
+package hci
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+const (
+	periodicIntervalUnit       = 1250 * time.Microsecond
+	minPeriodicInterval        = 0x0006 // 7.5 ms
+	periodicFragmentLength     = 252    // Largest periodic advertising data of a command.
+	periodicPropIncludeTxPower = 1 << 6
+	defaultSyncTimeout         = 1000 // 10 s, in units of 10 ms.
+)
+
+// Data Status of the periodic advertising reports [Vol 2, Part E, 7.7.65.15].
+const (
+	periodicDataComplete   = 0x00
+	periodicDataIncomplete = 0x01
+	periodicDataTruncated  = 0x02
+)
+
+// SetPeriodicParams sets the range of the periodic advertising interval of the
+// set, and whether the transmit power is put in the periodic advertising PDUs.
+// The set must neither use the legacy PDUs nor be connectable or scannable.
+func (s *AdvertisingSet) SetPeriodicParams(intervalMin, intervalMax time.Duration, includeTxPower bool) error {
+	if s.h.leFeatures&leFeaturePeriodicAdvertising == 0 {
+		return ErrPeriodicAdvNotSupported
+	}
+	if s.legacy {
+		return errors.New("legacy advertising can't be periodic")
+	}
+	min, max := intervalMin/periodicIntervalUnit, intervalMax/periodicIntervalUnit
+	if max == 0 {
+		max = min
+	}
+	if min < minPeriodicInterval || max > 0xFFFF || min > max {
+		return fmt.Errorf("invalid periodic advertising interval %v-%v", intervalMin, intervalMax)
+	}
+	var props uint16
+	if includeTxPower {
+		props |= periodicPropIncludeTxPower
+	}
+	if err := s.h.Send(&cmd.LESetPeriodicAdvertisingParameters{
+		AdvertisingHandle:              s.handle,
+		PeriodicAdvertisingIntervalMin: uint16(min),
+		PeriodicAdvertisingIntervalMax: uint16(max),
+		PeriodicAdvertisingProperties:  props,
+	}, nil); err != nil {
+		return errors.Wrap(err, "can't set periodic advertising parameters")
+	}
+	return nil
+}
+
+// SetPeriodicData sets the periodic advertising data, which is up to 1650
+// bytes. The data is sent to the controller in fragments. The data of an
+// enabled periodic advertising can only be changed with a single fragment of
+// up to 252 bytes.
+func (s *AdvertisingSet) SetPeriodicData(b []byte) error {
+	if len(b) > s.h.maxAdvDataLen {
+		return ble.ErrEIRPacketTooLong
+	}
+	frags, ops := fragmentData(b, periodicFragmentLength)
+	for i := range frags {
+		if err := s.h.Send(&cmd.LESetPeriodicAdvertisingData{
+			AdvertisingHandle: s.handle,
+			Operation:         ops[i],
+			AdvertisingData:   frags[i],
+		}, nil); err != nil {
+			return errors.Wrap(err, "can't set periodic advertising data")
+		}
+	}
+	return nil
+}
+
+// EnablePeriodic starts the periodic advertising, which is sent while the set
+// is enabled.
+func (s *AdvertisingSet) EnablePeriodic() error {
+	if err := s.h.Send(&cmd.LESetPeriodicAdvertisingEnable{
+		Enable:            1,
+		AdvertisingHandle: s.handle,
+	}, nil); err != nil {
+		return errors.Wrap(err, "can't enable periodic advertising")
+	}
+	return nil
+}
+
+// DisablePeriodic stops the periodic advertising.
+func (s *AdvertisingSet) DisablePeriodic() error {
+	if err := s.h.Send(&cmd.LESetPeriodicAdvertisingEnable{
+		Enable:            0,
+		AdvertisingHandle: s.handle,
+	}, nil); err != nil {
+		return errors.Wrap(err, "can't disable periodic advertising")
+	}
+	return nil
+}
+
+// periodicSync is a synchronization to a periodic advertising train.
+type periodicSync struct {
+	handle uint16
+
+	// chEstablished receives the result of the LE Periodic Advertising Create
+	// Sync command.
+	chEstablished chan error
+
+	// ch receives the reports, and done is closed along with ch, when the
+	// synchronization is terminated or lost.
+	ch   chan ble.PeriodicReport
+	done chan struct{}
+
+	// data is the data being reassembled, and overflow is set if it's longer
+	// than the periodic advertising data can be.
+	data     []byte
+	overflow bool
+}
+
+// SyncPeriodic synchronizes to the periodic advertising of the advertising set
+// sid of the device a, and returns the channel of its reports. The channel is
+// closed when the synchronization is lost or ctx is done. The device must be
+// scanning with the extended scanning, until the synchronization is
+// established. The reports are dropped, if they aren't received in time.
+func (h *HCI) SyncPeriodic(ctx context.Context, a ble.Addr, sid int) (<-chan ble.PeriodicReport, error) {
+	if h.leFeatures&leFeaturePeriodicAdvertising == 0 {
+		return nil, ErrPeriodicAdvNotSupported
+	}
+	if !h.extended {
+		return nil, ErrLegacyMode
+	}
+	if sid < 0 || sid > 0x0F {
+		return nil, fmt.Errorf("invalid advertising SID %d", sid)
+	}
+	if r, ok := a.(ResolvedAddress); ok {
+		// Synchronize to the address the device is currently using.
+		a = r.RPA
+	}
+	b, err := net.ParseMAC(a.String())
+	if err != nil {
+		return nil, ErrInvalidAddr
+	}
+	c := &cmd.LEPeriodicAdvertisingCreateSync{
+		AdvertisingSID:    uint8(sid),
+		AdvertiserAddress: [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]},
+		SyncTimeout:       defaultSyncTimeout,
+	}
+	if _, ok := a.(RandomAddress); ok {
+		c.AdvertiserAddressType = 1
+	}
+
+	// The controller establishes one synchronization at a time.
+	h.muSync.Lock()
+	defer h.muSync.Unlock()
+
+	s := &periodicSync{
+		chEstablished: make(chan error, 1),
+		ch:            make(chan ble.PeriodicReport, 16),
+		done:          make(chan struct{}),
+	}
+	h.muSyncs.Lock()
+	h.pendingSync = s
+	h.muSyncs.Unlock()
+	if err := h.Send(c, nil); err != nil {
+		h.muSyncs.Lock()
+		h.pendingSync = nil
+		h.muSyncs.Unlock()
+		return nil, err
+	}
+
+	select {
+	case err = <-s.chEstablished:
+	case <-ctx.Done():
+		// The cancelled synchronization is reported as established with an
+		// error, unless it has been established meanwhile.
+		if err := h.Send(&cmd.LEPeriodicAdvertisingCreateSyncCancel{}, nil); err != nil {
+			logger.Debug("can't cancel periodic advertising sync", "err", err)
+		}
+		select {
+		case err = <-s.chEstablished:
+			if err == nil {
+				h.terminateSync(s)
+			}
+		case <-h.done:
+		}
+		return nil, ctx.Err()
+	case <-h.done:
+		return nil, h.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.terminateSync(s)
+		case <-s.done:
+		}
+	}()
+	return s.ch, nil
+}
+
+// terminateSync terminates the synchronization, unless it's lost.
+func (h *HCI) terminateSync(s *periodicSync) {
+	h.muSyncs.Lock()
+	found := h.syncs[s.handle] == s
+	if found {
+		s.close()
+		delete(h.syncs, s.handle)
+	}
+	h.muSyncs.Unlock()
+	if !found {
+		return
+	}
+	if err := h.Send(&cmd.LEPeriodicAdvertisingTerminateSync{SyncHandle: s.handle}, nil); err != nil {
+		_ = logger.Error("can't terminate periodic advertising sync", "err", err)
+	}
+}
+
+// close closes the channels of the synchronization. It's called with
+// h.muSyncs held.
+func (s *periodicSync) close() {
+	close(s.ch)
+	close(s.done)
+}
+
+// report reassembles the data of the periodic advertising report, and returns
+// the report, once all of its data is received.
+func (s *periodicSync) report(e evt.LEPeriodicAdvertisingReport) (ble.PeriodicReport, bool) {
+	if !s.overflow {
+		s.data = append(s.data, e.Data()...)
+		if len(s.data) > maxExtAdvDataLength {
+			s.data = s.data[:maxExtAdvDataLength]
+			s.overflow = true
+		}
+	}
+	if e.DataStatus() == periodicDataIncomplete {
+		return ble.PeriodicReport{}, false
+	}
+	r := ble.PeriodicReport{
+		TxPower:   int(e.TXPower()),
+		RSSI:      int(e.RSSI()),
+		Data:      s.data,
+		Truncated: s.overflow || e.DataStatus() == periodicDataTruncated,
+	}
+	s.data, s.overflow = nil, false
+	return r, true
+}
+
+func (h *HCI) handleLEPeriodicAdvertisingSyncEstablished(b []byte) error {
+	e := evt.LEPeriodicAdvertisingSyncEstablished(b)
+	h.muSyncs.Lock()
+	s := h.pendingSync
+	h.pendingSync = nil
+	if s != nil && e.Status() == 0x00 {
+		s.handle = e.SyncHandle()
+		h.syncs[s.handle] = s
+	}
+	h.muSyncs.Unlock()
+
+	switch {
+	case s == nil && e.Status() == 0x00:
+		// Nobody waits for the synchronization.
+		go h.Send(&cmd.LEPeriodicAdvertisingTerminateSync{SyncHandle: e.SyncHandle()}, nil)
+	case s == nil:
+	case e.Status() != 0x00:
+		s.chEstablished <- ErrCommand(e.Status())
+	default:
+		s.chEstablished <- nil
+	}
+	return nil
+}
+
+func (h *HCI) handleLEPeriodicAdvertisingReport(b []byte) error {
+	e := evt.LEPeriodicAdvertisingReport(b)
+	h.muSyncs.Lock()
+	defer h.muSyncs.Unlock()
+	s, found := h.syncs[e.SyncHandle()]
+	if !found {
+		return nil
+	}
+	r, ok := s.report(e)
+	if !ok {
+		return nil
+	}
+	select {
+	case s.ch <- r:
+	default:
+		logger.Debug("periodic advertising report dropped", "handle", s.handle)
+	}
+	return nil
+}
+
+func (h *HCI) handleLEPeriodicAdvertisingSyncLost(b []byte) error {
+	e := evt.LEPeriodicAdvertisingSyncLost(b)
+	h.muSyncs.Lock()
+	defer h.muSyncs.Unlock()
+	if s, found := h.syncs[e.SyncHandle()]; found {
+		s.close()
+		delete(h.syncs, s.handle)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package hci
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// periodicReportEvent returns an LE Periodic Advertising Report event of the
+// sync handle 0x0001.
+func periodicReportEvent(status uint8, data []byte) []byte {
+	b := []byte{
+		evt.LEPeriodicAdvertisingReportSubCode,
+		0x01, 0x00, // Sync Handle
+		0xf6,   // TX Power: -10 dBm
+		0xc4,   // RSSI: -60 dBm
+		0xff,   // CTE Type: no Constant Tone Extension
+		status, // Data Status
+		byte(len(data)),
+	}
+	return append(b, data...)
+}
+
+func TestPeriodicReport(t *testing.T) {
+	h := &HCI{syncs: make(map[uint16]*periodicSync)}
+	s := &periodicSync{
+		handle: 0x0001,
+		ch:     make(chan ble.PeriodicReport, 16),
+		done:   make(chan struct{}),
+	}
+	h.syncs[s.handle] = s
+
+	h.handleLEPeriodicAdvertisingReport(periodicReportEvent(periodicDataIncomplete, []byte{1, 2}))
+	h.handleLEPeriodicAdvertisingReport(periodicReportEvent(periodicDataComplete, []byte{3}))
+	h.handleLEPeriodicAdvertisingReport(periodicReportEvent(periodicDataTruncated, []byte{4}))
+	h.handleLEPeriodicAdvertisingSyncLost([]byte{evt.LEPeriodicAdvertisingSyncLostSubCode, 0x01, 0x00})
+
+	want := []ble.PeriodicReport{
+		{TxPower: -10, RSSI: -60, Data: []byte{1, 2, 3}},
+		{TxPower: -10, RSSI: -60, Data: []byte{4}, Truncated: true},
+	}
+	var got []ble.PeriodicReport
+	for r := range s.ch {
+		got = append(got, r)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d reports, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].TxPower != want[i].TxPower || got[i].RSSI != want[i].RSSI ||
+			!bytes.Equal(got[i].Data, want[i].Data) || got[i].Truncated != want[i].Truncated {
+			t.Errorf("report %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if len(h.syncs) != 0 {
+		t.Errorf("%d syncs left after the sync is lost, want 0", len(h.syncs))
+	}
+}
+
+func TestPeriodicAdvertisingData(t *testing.T) {
+	frags, ops := fragmentData(make([]byte, 300), periodicFragmentLength)
+	if len(frags) != 2 || len(frags[0]) != 252 || !bytes.Equal(ops, []uint8{advDataFirst, advDataLast}) {
+		t.Errorf("300 bytes: %d fragments, ops %v, want 2, [1 2]", len(frags), ops)
+	}
+
+	c := cmd.LESetPeriodicAdvertisingData{AdvertisingHandle: 2, Operation: advDataComplete, AdvertisingData: []byte{0xaa, 0xbb}}
+	b := make([]byte, c.Len())
+	if err := c.Marshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x02, 0x03, 0x02, 0xaa, 0xbb}; !bytes.Equal(b, want) {
+		t.Errorf("Marshal() = %x, want %x", b, want)
+	}
+	c.AdvertisingData = make([]byte, 253)
+	if err := c.Marshal(make([]byte, c.Len())); err == nil {
+		t.Errorf("Marshal() of 253 bytes succeeded")
+	}
+}
@@ -0,0 +1,122 @@
+package hci
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// validPHYs reports if p is a set of PHYs, or 0 for no preference.
+func validPHYs(p ble.PHY) bool {
+	return p&^(ble.PHY1M|ble.PHY2M|ble.PHYCoded) == 0
+}
+
+// allPHYs returns the ALL_PHYS parameter, which tells the controller that the
+// host has no preference of the PHYs for transmitting or receiving, if either
+// is 0 [Vol 2, Part E, 7.8.48].
+func allPHYs(tx, rx ble.PHY) uint8 {
+	var all uint8
+	if tx == 0 {
+		all |= 0x01
+	}
+	if rx == 0 {
+		all |= 0x02
+	}
+	return all
+}
+
+// phy returns the PHY of a TX_PHY or RX_PHY return parameter, which is 0x01
+// for LE 1M, 0x02 for LE 2M, and 0x03 for LE Coded [Vol 2, Part E, 7.8.47].
+func phy(v uint8) ble.PHY {
+	if v == 0 || v > 3 {
+		return 0
+	}
+	return ble.PHY(1 << (v - 1))
+}
+
+// SetPHY sets the preferred PHYs of the connection for transmitting and
+// receiving, and waits for the LE PHY Update Complete event [Vol 2, Part E, 7.8.49].
+// The controller might choose a PHY other than the preferred ones, so the
+// completion of an update started by the remote device at the same time can't
+// be told apart, and ends the wait as well.
+func (c *Conn) SetPHY(ctx context.Context, tx, rx ble.PHY, opts ble.PHYOptions) error {
+	if !validPHYs(tx) || !validPHYs(rx) {
+		return fmt.Errorf("invalid PHYs %v, %v", tx, rx)
+	}
+	c.muPHY.Lock()
+	defer c.muPHY.Unlock()
+
+	select {
+	case <-c.chPHYUpdate:
+	default:
+	}
+	err := c.hci.Send(&cmd.LESetPHY{
+		ConnectionHandle: c.param.ConnectionHandle(),
+		AllPHYs:          allPHYs(tx, rx),
+		TXPHYs:           uint8(tx),
+		RXPHYs:           uint8(rx),
+		PHYOptions:       uint16(opts),
+	}, nil)
+	if err != nil {
+		return errors.Wrap(err, "can't set PHY")
+	}
+	select {
+	case status := <-c.chPHYUpdate:
+		if status != 0 {
+			return ErrCommand(status)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.chDone:
+		return io.ErrClosedPipe
+	}
+}
+
+// ReadPHY returns the current PHYs of the connection for transmitting and
+// receiving [Vol 2, Part E, 7.8.47].
+func (c *Conn) ReadPHY() (tx, rx ble.PHY, err error) {
+	rp := cmd.LEReadPHYRP{}
+	if err := c.hci.Send(&cmd.LEReadPHY{ConnectionHandle: c.param.ConnectionHandle()}, &rp); err != nil {
+		return 0, 0, errors.Wrap(err, "can't read PHY")
+	}
+	return phy(rp.TXPHY), phy(rp.RXPHY), nil
+}
+
+// handleLEPHYUpdateComplete handles the PHY updates, which are initiated by
+// either the local or the remote device [Vol 2, Part E, 7.7.65.12].
+func (h *HCI) handleLEPHYUpdateComplete(b []byte) error {
+	e := evt.LEPHYUpdateComplete(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		return nil
+	}
+	if e.Status() == 0 {
+		logger.Debug("PHY updated", "tx", phy(e.TXPHY()), "rx", phy(e.RXPHY()))
+	}
+	select {
+	case c.chPHYUpdate <- e.Status():
+	default:
+	}
+	return nil
+}
+
+// phyValue returns the value of a PHY parameter of the advertising and
+// scanning commands, which is 0x01 for LE 1M, 0x02 for LE 2M, and 0x03 for
+// LE Coded [Vol 2, Part E, 7.8.53]. It's LE 1M, if p is 0.
+func phyValue(p ble.PHY) uint8 {
+	switch p {
+	case ble.PHY2M:
+		return 0x02
+	case ble.PHYCoded:
+		return 0x03
+	}
+	return 0x01
+}
@@ -0,0 +1,24 @@
+package hci
+
+import (
+	"testing"
+
+	"github.com/trustasia-com/ble"
+)
+
+func TestPHY(t *testing.T) {
+	for v, want := range map[uint8]ble.PHY{0: 0, 1: ble.PHY1M, 2: ble.PHY2M, 3: ble.PHYCoded, 4: 0} {
+		if got := phy(v); got != want {
+			t.Errorf("phy(%d) = %v, want %v", v, got, want)
+		}
+	}
+	if got := allPHYs(0, ble.PHY2M|ble.PHYCoded); got != 0x01 {
+		t.Errorf("allPHYs(0, 2M|Coded) = 0x%02X, want 0x01", got)
+	}
+	if validPHYs(ble.PHY(0x08)) {
+		t.Error("validPHYs(0x08) = true")
+	}
+	if s := (ble.PHY1M | ble.PHYCoded).String(); s != "LE 1M|LE Coded" {
+		t.Errorf("String() = %q", s)
+	}
+}
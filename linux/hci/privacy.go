@@ -0,0 +1,451 @@
+package hci
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// defaultRPATimeout is the recommended interval of regenerating the
+// Resolvable Private Address [Vol 3, Part C, Appendix A].
+const defaultRPATimeout = 15 * time.Minute
+
+// ResolvedAddress is the identity address of a remote device, which has been
+// resolved from its Resolvable Private Address with an IRK in the bond store.
+type ResolvedAddress struct {
+	ble.Addr
+
+	// RPA is the Resolvable Private Address the device is currently using.
+	RPA RandomAddress
+}
+
+// genRPA generates a Resolvable Private Address from the IRK, in wire order
+// [Vol 6, Part B, 1.3.2.2].
+func genRPA(irk [16]byte) ([6]byte, error) {
+	var a [6]byte
+	var prand [3]byte
+	if _, err := rand.Read(prand[:]); err != nil {
+		return a, err
+	}
+	// The two most significant bits of prand are 0b01.
+	prand[2] = prand[2]&0x3F | 0x40
+	hash := smpAh(irk, prand)
+	copy(a[0:3], hash[:])
+	copy(a[3:6], prand[:])
+	return a, nil
+}
+
+// isRPA reports whether the random address a, in wire order, is a Resolvable
+// Private Address [Vol 6, Part B, 1.3.2].
+func isRPA(a [6]byte) bool { return a[5]>>6 == 0x01 }
+
+// resolveRPA reports whether the Resolvable Private Address a, in wire order,
+// was generated from the IRK [Vol 6, Part B, 1.3.2.3].
+func resolveRPA(irk [16]byte, a [6]byte) bool {
+	hash := smpAh(irk, [3]byte{a[3], a[4], a[5]})
+	return hash == [3]byte{a[0], a[1], a[2]}
+}
+
+// resolveAddr returns the address of a remote device, which is resolved to
+// its identity address if it's a Resolvable Private Address generated by an
+// IRK in the bond store.
+func (h *HCI) resolveAddr(typ uint8, a [6]byte) ble.Addr {
+	addr := hwAddr(a)
+	if typ&0x01 == 0 {
+		return addr
+	}
+	ra := RandomAddress{addr}
+	if !isRPA(a) || h.bonds == nil {
+		return ra
+	}
+
+	h.muRPA.Lock()
+	defer h.muRPA.Unlock()
+	if id, ok := h.rpaCache[a]; ok {
+		if id == nil {
+			return ra
+		}
+		return ResolvedAddress{Addr: id, RPA: ra}
+	}
+	if len(h.rpaCache) >= 256 {
+		h.rpaCache = make(map[[6]byte]ble.Addr)
+	}
+	h.rpaCache[a] = nil
+
+	bonds, err := h.bonds.Bonds()
+	if err != nil {
+		return ra
+	}
+	for _, b := range bonds {
+		if b.IRK.IsZero() || !resolveRPA(b.IRK, a) {
+			continue
+		}
+		var id ble.Addr = ble.NewAddr(b.Address)
+		if mac, err := net.ParseMAC(b.Address); err == nil {
+			id = mac
+			if b.AddressType == 0x01 {
+				id = RandomAddress{mac}
+			}
+		}
+		h.rpaCache[a] = id
+		return ResolvedAddress{Addr: id, RPA: ra}
+	}
+	return ra
+}
+
+// ReloadBonds brings the device up to date with the bond store. It should be
+// called after bonds are deleted from the store, or the store is modified
+// out of band. Bonds saved by the device itself are picked up automatically.
+func (h *HCI) ReloadBonds() error {
+	h.muRPA.Lock()
+	h.rpaCache = make(map[[6]byte]ble.Addr)
+	h.muRPA.Unlock()
+	if h.filterPolicy != 0 {
+		if err := h.syncWhiteList(); err != nil {
+			return err
+		}
+	}
+	if !h.addrResolution {
+		return nil
+	}
+	return h.syncResolvingList()
+}
+
+// pauseRadio runs f with advertising, including the advertising sets, and
+// scanning paused, since some settings, such as the random address or the
+// resolving list, can't be changed while either is enabled. They can't be
+// changed while a connection is being created either [Vol 2, Part E, 7.8.38],
+// so f is deferred until it's done.
+func (h *HCI) pauseRadio(f func() error) error {
+	h.muRadio.Lock()
+	defer h.muRadio.Unlock()
+	if h.dialing {
+		h.radioDeferred = append(h.radioDeferred, f)
+		return nil
+	}
+
+	h.params.RLock()
+	advertising := h.params.advEnable.AdvertisingEnable == 1
+	scanning := h.params.scanEnable.LEScanEnable == 1
+	scanEnable := h.params.scanEnable
+	extScanning := h.params.extScanEnable.Enable == 1
+	extScanEnable := h.params.extScanEnable
+	h.params.RUnlock()
+
+	if advertising {
+		h.Send(&cmd.LESetAdvertiseEnable{AdvertisingEnable: 0}, nil)
+	}
+	if scanning {
+		h.Send(&cmd.LESetScanEnable{LEScanEnable: 0}, nil)
+	}
+	if extScanning {
+		h.Send(&cmd.LESetExtendedScanEnable{Enable: 0}, nil)
+	}
+	resumeAdvSets := h.pauseAdvSets()
+	err := f()
+	resumeAdvSets()
+	if extScanning {
+		h.Send(&extScanEnable, nil)
+	}
+	if scanning {
+		h.Send(&scanEnable, nil)
+	}
+	if advertising {
+		h.Send(&cmd.LESetAdvertiseEnable{AdvertisingEnable: 1}, nil)
+	}
+	return err
+}
+
+// startDial marks a connection as being created, which defers the changes
+// of pauseRadio until dialed is called.
+func (h *HCI) startDial() {
+	h.muRadio.Lock()
+	h.dialing = true
+	h.muRadio.Unlock()
+}
+
+// dialed runs the changes deferred while the connection was being created.
+func (h *HCI) dialed() {
+	h.muRadio.Lock()
+	h.dialing = false
+	fs := h.radioDeferred
+	h.radioDeferred = nil
+	h.muRadio.Unlock()
+	for _, f := range fs {
+		if err := h.pauseRadio(f); err != nil {
+			_ = logger.Error("privacy: deferred change failed", "err", err)
+		}
+	}
+}
+
+// setRPA generates a new Resolvable Private Address, and sets it as the random
+// address of the controller and of the advertising sets, which use it. The
+// random address can't be changed while advertising or scanning
+// [Vol 2, Part E, 7.8.4 & 7.8.52], so they are paused.
+func (h *HCI) setRPA() error {
+	rpa, err := genRPA(h.irk)
+	if err != nil {
+		return errors.Wrap(err, "can't generate RPA")
+	}
+	err = h.pauseRadio(func() error {
+		if err := h.Send(&cmd.LESetRandomAddress{RandomAddress: rpa}, nil); err != nil {
+			return err
+		}
+		if err := h.setAdvSetsRPA(rpa); err != nil {
+			return err
+		}
+		h.muAddr.Lock()
+		h.rpa = rpa
+		h.muAddr.Unlock()
+		return nil
+	})
+	return errors.Wrap(err, "can't set RPA")
+}
+
+// rotateRPA regenerates the Resolvable Private Address periodically.
+func (h *HCI) rotateRPA() {
+	t := time.NewTicker(h.rpaTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := h.setRPA(); err != nil {
+				_ = logger.Error("privacy: can't rotate RPA", "err", err)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// initPrivacy sets up the local address for advertising, scanning and
+// initiating connections, which is either the configured random address or a
+// Resolvable Private Address if privacy is enabled. It also loads the bonds
+// into the white list if it's used, and into the resolving list if the
+// controller resolves the addresses.
+func (h *HCI) initPrivacy() error {
+	if h.filterPolicy != 0 {
+		if err := h.syncWhiteList(); err != nil {
+			return err
+		}
+	}
+	if h.addrResolution {
+		if err := h.syncResolvingList(); err != nil {
+			return err
+		}
+	}
+	if h.randAddr != ([6]byte{}) {
+		if err := h.Send(&cmd.LESetRandomAddress{RandomAddress: h.randAddr}, nil); err != nil {
+			return errors.Wrap(err, "can't set random address")
+		}
+	}
+	if h.randAddr == ([6]byte{}) && !h.privacy {
+		return nil
+	}
+	h.ownAddrType = 0x01
+	if !h.privacy {
+		return nil
+	}
+	if err := h.setRPA(); err != nil {
+		return err
+	}
+	go h.rotateRPA()
+	return nil
+}
+
+// ownAddressType returns the type of the address set up by initPrivacy, which
+// overrides the type t of the parameters when they are sent, or t otherwise.
+func (h *HCI) ownAddressType(t uint8) uint8 {
+	if h.ownAddrType != 0 {
+		return h.ownAddrType
+	}
+	return t
+}
+
+// genStaticAddr generates a static random address in wire order
+// [Vol 6, Part B, 1.3.2.1].
+func genStaticAddr() ([6]byte, error) {
+	var a [6]byte
+	for {
+		if _, err := rand.Read(a[:]); err != nil {
+			return a, err
+		}
+		// The two most significant bits are 0b11, and the random part
+		// shall not be all ones.
+		a[5] |= 0xC0
+		if a != [6]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF} {
+			return a, nil
+		}
+	}
+}
+
+// isStaticAddr reports whether the random address a, in wire order, is a
+// static address [Vol 6, Part B, 1.3.2].
+func isStaticAddr(a [6]byte) bool { return a[5]>>6 == 0x03 }
+
+// ownAddress returns the type and the address, in wire order, which the local
+// device currently uses for advertising, scanning and initiating connections.
+func (h *HCI) ownAddress() (uint8, [6]byte) {
+	h.muAddr.Lock()
+	defer h.muAddr.Unlock()
+	switch {
+	case h.privacy && h.rpa != [6]byte{}:
+		return 0x01, h.rpa
+	case h.randAddr != [6]byte{}:
+		return 0x01, h.randAddr
+	}
+	return h.identityAddress()
+}
+
+// syncResolvingList loads the bonded devices into the resolving list of the
+// controller, and enables the address resolution in the controller
+// [Vol 6, Part B, 4.7].
+func (h *HCI) syncResolvingList() error {
+	var bonds []*ble.Bond
+	if h.bonds != nil {
+		var err error
+		if bonds, err = h.bonds.Bonds(); err != nil {
+			return errors.Wrap(err, "can't load bonds")
+		}
+	}
+	return h.pauseRadio(func() error {
+		if err := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 0}, nil); err != nil {
+			return errors.Wrap(err, "can't disable address resolution")
+		}
+		if err := h.Send(&cmd.LEClearResolvingList{}, nil); err != nil {
+			return errors.Wrap(err, "can't clear resolving list")
+		}
+		rlSize := cmd.LEReadResolvingListSizeRP{}
+		h.Send(&cmd.LEReadResolvingListSize{}, &rlSize)
+
+		rl := 0
+		for _, b := range bonds {
+			typ, a, ok := bondIdentity(b)
+			if !ok {
+				continue
+			}
+			if b.IRK.IsZero() || rl >= int(rlSize.ResolvingListSize) {
+				continue
+			}
+			if err := h.Send(&cmd.LEAddDeviceToResolvingList{
+				PeerIdentityAddressType: typ,
+				PeerIdentityAddress:     a,
+				PeerIRK:                 b.IRK,
+				LocalIRK:                h.irk,
+			}, nil); err != nil {
+				_ = logger.Error("privacy: can't add device to resolving list", "addr", b.Address, "err", err)
+				continue
+			}
+			rl++
+			// Accept the identity address, in case the device doesn't use an
+			// RPA. Controllers prior to 5.0 don't support it, and always
+			// behave as in the network privacy mode.
+			h.Send(&cmd.LESetPrivacyMode{
+				PeerIdentityAddressType: typ,
+				PeerIdentityAddress:     a,
+				PrivacyMode:             0x01,
+			}, nil)
+		}
+		logger.Info("privacy", "resolving list", rl)
+
+		// The timeout ranges from 1 second to 11.5 hours [Vol 2, Part E, 7.8.45].
+		tmo := h.rpaTimeout / time.Second
+		if tmo < 1 {
+			tmo = 1
+		} else if tmo > 0xA1B8 {
+			tmo = 0xA1B8
+		}
+		h.Send(&cmd.LESetResolvablePrivateAddressTimeout{RPATimeout: uint16(tmo)}, nil)
+		if err := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 1}, nil); err != nil {
+			return errors.Wrap(err, "can't enable address resolution")
+		}
+		return nil
+	})
+}
+
+// syncWhiteList loads the identity addresses of the bonded devices into the
+// white list of the controller [Vol 6, Part B, 4.3.1].
+func (h *HCI) syncWhiteList() error {
+	var bonds []*ble.Bond
+	if h.bonds != nil {
+		var err error
+		if bonds, err = h.bonds.Bonds(); err != nil {
+			return errors.Wrap(err, "can't load bonds")
+		}
+	}
+	return h.pauseRadio(func() error {
+		if err := h.Send(&cmd.LEClearWhiteList{}, nil); err != nil {
+			return errors.Wrap(err, "can't clear white list")
+		}
+		wlSize := cmd.LEReadWhiteListSizeRP{}
+		h.Send(&cmd.LEReadWhiteListSize{}, &wlSize)
+
+		wl := 0
+		for _, b := range bonds {
+			typ, a, ok := bondIdentity(b)
+			if !ok || wl >= int(wlSize.WhiteListSize) {
+				continue
+			}
+			if err := h.Send(&cmd.LEAddDeviceToWhiteList{AddressType: typ, Address: a}, nil); err != nil {
+				_ = logger.Error("privacy: can't add device to white list", "addr", b.Address, "err", err)
+				continue
+			}
+			wl++
+		}
+		logger.Info("privacy", "white list", wl)
+		return nil
+	})
+}
+
+// bondIdentity returns the identity address of the bonded device in wire order.
+func bondIdentity(b *ble.Bond) (uint8, [6]byte, bool) {
+	var a [6]byte
+	mac, err := net.ParseMAC(b.Address)
+	if err != nil || len(mac) != 6 {
+		return 0, a, false
+	}
+	for i := range a {
+		a[i] = mac[5-i]
+	}
+	return b.AddressType & 0x01, a, true
+}
+
+// hwAddr converts the address in wire order to a net.HardwareAddr.
+func hwAddr(a [6]byte) net.HardwareAddr {
+	return net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]})
+}
+
+func (h *HCI) handleLEEnhancedConnectionComplete(b []byte) error {
+	e := evt.LEEnhancedConnectionComplete(b)
+	if len(e) < 31 {
+		return fmt.Errorf("invalid LE Enhanced Connection Complete: % X", b)
+	}
+
+	// Convert it to the LE Connection Complete, with the addresses used to
+	// establish the connection, and report the resolved identity address.
+	le := make([]byte, 19)
+	copy(le, e[:12])
+	copy(le[12:], e[24:31])
+	le[0] = evt.LEConnectionCompleteSubCode
+
+	var id ble.Addr
+	if typ := e.PeerAddressType(); typ&0x02 != 0 {
+		le[5] = typ & 0x01
+		id = hwAddr(e.PeerAddress())
+		if typ&0x01 != 0 {
+			id = RandomAddress{id}
+		}
+		if rpa := e.PeerResolvablePrivateAddress(); rpa != [6]byte{} {
+			le[5] = 0x01
+			copy(le[6:12], rpa[:])
+			id = ResolvedAddress{Addr: id, RPA: RandomAddress{hwAddr(rpa)}}
+		}
+	}
+	return h.connected(evt.LEConnectionComplete(le), id, e.LocalResolvablePrivateAddress())
+}
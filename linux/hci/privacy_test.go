@@ -0,0 +1,272 @@
+package hci
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+func TestSyncWhiteList(t *testing.T) {
+	h, err := NewHCI(ble.OptFilterPolicy(ble.FilterScan | ble.FilterInitiate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.setAllowedCommands(16)
+	h.bonds = ble.NewMemoryBondStore()
+	h.bonds.Save(&ble.Bond{Address: "11:22:33:44:55:66"})
+	h.bonds.Save(&ble.Bond{Address: "C1:22:33:44:55:66", AddressType: 0x01})
+
+	var ops []int
+	added := map[string]bool{}
+	h.skt = &testSocket{
+		h: h,
+		cmd: func(op int, b []byte) {
+			ops = append(ops, op)
+			if op == (&cmd.LEAddDeviceToWhiteList{}).OpCode() {
+				added[string(b)] = true
+			}
+		},
+		rp: func(op int) []byte {
+			if op == (&cmd.LEReadWhiteListSize{}).OpCode() {
+				return []byte{0x08}
+			}
+			return nil
+		},
+	}
+	if err := h.syncWhiteList(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{
+		(&cmd.LEClearWhiteList{}).OpCode(),
+		(&cmd.LEReadWhiteListSize{}).OpCode(),
+		(&cmd.LEAddDeviceToWhiteList{}).OpCode(),
+		(&cmd.LEAddDeviceToWhiteList{}).OpCode(),
+	}
+	if len(ops) != len(want) {
+		t.Fatalf("sent commands %04X, want %04X", ops, want)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Fatalf("sent commands %04X, want %04X", ops, want)
+		}
+	}
+	for _, a := range [][]byte{
+		{0x00, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11},
+		{0x01, 0x66, 0x55, 0x44, 0x33, 0x22, 0xC1},
+	} {
+		if !added[string(a)] {
+			t.Errorf("device % X not added to white list", a)
+		}
+	}
+}
+
+func TestFilterPolicyParams(t *testing.T) {
+	h, err := NewHCI(ble.OptFilterPolicy(ble.FilterAdvertise))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := h.advSetParams(AdvertisingSetParams{Connectable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AdvertisingFilterPolicy != 0x03 {
+		t.Errorf("advertising filter policy 0x%02X, want 0x03", c.AdvertisingFilterPolicy)
+	}
+	if err := h.SetFilterPolicy(0x08); err == nil {
+		t.Error("invalid filter policy accepted")
+	}
+}
+
+// newPrivacyTestHCI returns an HCI, whose bond store holds the bond of a
+// device with the random identity address C1:22:33:44:55:66 and the IRK.
+func newPrivacyTestHCI(t *testing.T, irk ble.Key) *HCI {
+	h := &HCI{
+		muConns:      &sync.Mutex{},
+		conns:        make(map[uint16]*Conn),
+		chMasterConn: make(chan *Conn, 1),
+		pool:         NewPool(32, 2),
+		addr:         net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		bonds:        ble.NewMemoryBondStore(),
+		rpaCache:     make(map[[6]byte]ble.Addr),
+	}
+	if err := h.bonds.Save(&ble.Bond{Address: "c1:22:33:44:55:66", AddressType: 0x01, IRK: irk}); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// enhancedConnectionComplete returns an LE Enhanced Connection Complete of
+// the master connection 0x0040, with the addresses in wire order.
+func enhancedConnectionComplete(peerType uint8, peer, localRPA, peerRPA [6]byte) []byte {
+	e := []byte{evt.LEEnhancedConnectionCompleteSubCode, 0x00, 0x40, 0x00, roleMaster, peerType}
+	e = append(e, peer[:]...)
+	e = append(e, localRPA[:]...)
+	e = append(e, peerRPA[:]...)
+	return append(e, 0x18, 0x00, 0x00, 0x00, 0x90, 0x01, 0x00)
+}
+
+// checkResolved checks that a is the RPA resolved to the random identity
+// address C1:22:33:44:55:66.
+func checkResolved(t *testing.T, a ble.Addr, rpa [6]byte) {
+	t.Helper()
+	r, ok := a.(ResolvedAddress)
+	if !ok {
+		t.Fatalf("address %v is %T, want ResolvedAddress", a, a)
+	}
+	if _, ok := r.Addr.(RandomAddress); !ok || r.String() != "c1:22:33:44:55:66" {
+		t.Errorf("identity address = %v (%T), want random c1:22:33:44:55:66", r.Addr, r.Addr)
+	}
+	if r.RPA.String() != hwAddr(rpa).String() {
+		t.Errorf("RPA = %v, want %v", r.RPA, hwAddr(rpa))
+	}
+}
+
+func TestConnectionResolvedByController(t *testing.T) {
+	h := newPrivacyTestHCI(t, ble.Key{1, 2, 3})
+	id := [6]byte{0x66, 0x55, 0x44, 0x33, 0x22, 0xC1}
+	localRPA := [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x46}
+	peerRPA := [6]byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x56}
+
+	// The controller reports the identity address of the peer, which is
+	// random (0x03), and the RPAs used to create the connection.
+	if err := h.handleLEEnhancedConnectionComplete(enhancedConnectionComplete(0x03, id, localRPA, peerRPA)); err != nil {
+		t.Fatal(err)
+	}
+	c := <-h.chMasterConn
+	defer close(c.chInPkt)
+	checkResolved(t, c.RemoteAddr(), peerRPA)
+	if typ, a := c.localAddress(); typ != 0x01 || a != localRPA {
+		t.Errorf("local address = %d %X, want 1 %X", typ, a, localRPA)
+	}
+	// The connection is established with the RPA.
+	if c.param.PeerAddressType() != 0x01 || c.param.PeerAddress() != peerRPA {
+		t.Errorf("peer address = %d %X, want 1 %X", c.param.PeerAddressType(), c.param.PeerAddress(), peerRPA)
+	}
+
+	// A public identity address (0x02) without an RPA, as the peer used its
+	// identity address.
+	pub := [6]byte{0x66, 0x55, 0x44, 0x33, 0x22, 0x11}
+	if err := h.handleLEEnhancedConnectionComplete(enhancedConnectionComplete(0x02, pub, localRPA, [6]byte{})); err != nil {
+		t.Fatal(err)
+	}
+	c = <-h.chMasterConn
+	defer close(c.chInPkt)
+	if a, ok := c.RemoteAddr().(net.HardwareAddr); !ok || a.String() != "11:22:33:44:55:66" {
+		t.Errorf("remote address = %v (%T), want public 11:22:33:44:55:66", c.RemoteAddr(), c.RemoteAddr())
+	}
+}
+
+func TestConnectionResolvedByHost(t *testing.T) {
+	irk := ble.Key{1, 2, 3}
+	h := newPrivacyTestHCI(t, irk)
+	rpa, err := genRPA(irk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without address resolution in the controller, the peer address is
+	// the RPA (0x01), which the host resolves with the IRK of the bond.
+	if err := h.handleLEEnhancedConnectionComplete(enhancedConnectionComplete(0x01, rpa, [6]byte{}, [6]byte{})); err != nil {
+		t.Fatal(err)
+	}
+	c := <-h.chMasterConn
+	defer close(c.chInPkt)
+	checkResolved(t, c.RemoteAddr(), rpa)
+	if _, ok := h.rpaCache[rpa]; !ok {
+		t.Error("resolved RPA not cached")
+	}
+
+	// An RPA of another IRK isn't resolved.
+	other, err := genRPA(ble.Key{4, 5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := h.resolveAddr(0x01, other).(RandomAddress); !ok || a.String() != hwAddr(other).String() {
+		t.Errorf("resolveAddr = %v (%T), want random %v", a, a, hwAddr(other))
+	}
+}
+
+func TestSetRPAAdvertisingSets(t *testing.T) {
+	h, err := NewHCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.setAllowedCommands(1)
+	h.privacy = true
+	h.irk = [16]byte{1, 2, 3}
+	static := [6]byte{1, 2, 3, 4, 5, 0xC6}
+	old := [6]byte{1, 2, 3, 4, 5, 0x46}
+
+	// The set 1 advertises with the RPA of the device, and the set 3 will.
+	// The set 2 advertises with its own address.
+	enabled := &AdvertisingSet{h: h, handle: 1, ownAddrType: 0x01, ownAddr: old, privacy: true,
+		enabled: true, chDone: make(chan struct{}), duration: 0x0100, maxEvents: 5}
+	own := &AdvertisingSet{h: h, handle: 2, ownAddrType: 0x01, ownAddr: static, chDone: make(chan struct{})}
+	disabled := &AdvertisingSet{h: h, handle: 3, ownAddrType: 0x01, ownAddr: old, privacy: true, chDone: make(chan struct{})}
+	for _, s := range []*AdvertisingSet{enabled, own, disabled} {
+		h.advSets[s.handle] = s
+	}
+
+	var cmds []testCmd
+	h.skt = &testSocket{h: h, cmd: func(op int, b []byte) { cmds = append(cmds, testCmd{op, b}) }}
+	if err := h.setRPA(); err != nil {
+		t.Fatal(err)
+	}
+	rpa := h.rpa
+	if !isRPA(rpa) || !resolveRPA(h.irk, rpa) {
+		t.Fatalf("RPA %X not generated with the IRK", rpa)
+	}
+
+	// The enabled set is paused while the addresses are set, and then
+	// enabled again with its duration and number of events.
+	enable := (&cmd.LESetExtendedAdvertisingEnable{}).OpCode()
+	setAddr := (&cmd.LESetAdvertisingSetRandomAddress{}).OpCode()
+	want := []testCmd{
+		{enable, []byte{0x00, 0x01, 0x01, 0x00, 0x00, 0x00}},
+		{(&cmd.LESetRandomAddress{}).OpCode(), rpa[:]},
+		{setAddr, nil},
+		{setAddr, nil},
+		{enable, []byte{0x01, 0x01, 0x01, 0x00, 0x01, 0x05}},
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("sent %d commands %v, want %d", len(cmds), cmds, len(want))
+	}
+	handles := map[byte]bool{}
+	for i, c := range cmds {
+		if c.op != want[i].op {
+			t.Fatalf("command %d is 0x%04X, want 0x%04X", i, c.op, want[i].op)
+		}
+		if c.op == setAddr {
+			if !bytes.Equal(c.b[1:], rpa[:]) {
+				t.Errorf("random address of set %d = %X, want %X", c.b[0], c.b[1:], rpa)
+			}
+			handles[c.b[0]] = true
+			continue
+		}
+		if !bytes.Equal(c.b, want[i].b) {
+			t.Errorf("command 0x%04X = %X, want %X", c.op, c.b, want[i].b)
+		}
+	}
+	if !handles[enabled.handle] || !handles[disabled.handle] {
+		t.Errorf("random address set for the sets %v, want 1 and 3", handles)
+	}
+	for _, s := range []*AdvertisingSet{enabled, disabled} {
+		if s.ownAddr != rpa {
+			t.Errorf("address of set %d = %X, want %X", s.handle, s.ownAddr, rpa)
+		}
+	}
+	if own.ownAddr != static {
+		t.Errorf("address of set 2 = %X, want %X", own.ownAddr, static)
+	}
+	select {
+	case <-enabled.Done():
+		t.Error("paused set reported as stopped")
+	default:
+	}
+}
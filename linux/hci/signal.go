@@ -2,11 +2,14 @@ package hci
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
+	"github.com/trustasia-com/ble"
 	"github.com/trustasia-com/ble/linux/hci/cmd"
 )
 
@@ -24,57 +27,232 @@ func (s sigCmd) id() uint8    { return s[1] }
 func (s sigCmd) len() int     { return int(binary.LittleEndian.Uint16(s[2:4])) }
 func (s sigCmd) data() []byte { return s[4 : 4+s.len()] }
 
-// Signal ...
-func (c *Conn) Signal(req Signal, rsp Signal) error {
-	data, err := req.Marshal()
-	if err != nil {
-		return err
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedConnectionRequest) Marshal() ([]byte, error) {
+	return marshalCIDs([]uint16{s.SPSM, s.MTU, s.MPS, s.InitialCredits}, s.SourceCID)
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedConnectionRequest) Unmarshal(b []byte) error {
+	cids, err := unmarshalCIDs(b, &s.SPSM, &s.MTU, &s.MPS, &s.InitialCredits)
+	s.SourceCID = cids
+	return err
+}
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedConnectionResponse) Marshal() ([]byte, error) {
+	return marshalCIDs([]uint16{s.MTU, s.MPS, s.InitialCredits, s.Result}, s.DestinationCID)
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedConnectionResponse) Unmarshal(b []byte) error {
+	cids, err := unmarshalCIDs(b, &s.MTU, &s.MPS, &s.InitialCredits, &s.Result)
+	s.DestinationCID = cids
+	return err
+}
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedReconfigureRequest) Marshal() ([]byte, error) {
+	return marshalCIDs([]uint16{s.MTU, s.MPS}, s.DestinationCID)
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedReconfigureRequest) Unmarshal(b []byte) error {
+	cids, err := unmarshalCIDs(b, &s.MTU, &s.MPS)
+	s.DestinationCID = cids
+	return err
+}
+
+// marshalCIDs serializes the fixed fields, followed by the list of CIDs.
+func marshalCIDs(fields []uint16, cids []uint16) ([]byte, error) {
+	b := make([]byte, 2*(len(fields)+len(cids)))
+	for i, v := range append(fields, cids...) {
+		binary.LittleEndian.PutUint16(b[2*i:], v)
 	}
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, uint16(4+len(data))); err != nil {
-		return err
+	return b, nil
+}
+
+// unmarshalCIDs de-serializes the fixed fields, and returns the list of CIDs
+// that follows them.
+func unmarshalCIDs(b []byte, fields ...*uint16) ([]uint16, error) {
+	if len(b) < 2*len(fields) || len(b)%2 != 0 {
+		return nil, errors.New("invalid signaling packet length")
 	}
-	if err := binary.Write(buf, binary.LittleEndian, cidLESignal); err != nil {
-		return err
+	for i, f := range fields {
+		*f = binary.LittleEndian.Uint16(b[2*i:])
 	}
+	b = b[2*len(fields):]
+	cids := make([]uint16, len(b)/2)
+	for i := range cids {
+		cids[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return cids, nil
+}
 
-	if err := binary.Write(buf, binary.LittleEndian, uint8(req.Code())); err != nil {
-		return err
+// Marshal serializes the command parameters into binary form.
+func (s *CommandReject) Marshal() ([]byte, error) {
+	b := make([]byte, 2, 2+len(s.Data))
+	binary.LittleEndian.PutUint16(b, s.Reason)
+	return append(b, s.Data...), nil
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CommandReject) Unmarshal(b []byte) error {
+	if len(b) < 2 {
+		return errors.New("invalid signaling packet length")
 	}
-	if err := binary.Write(buf, binary.LittleEndian, uint8(c.sigID)); err != nil {
-		return err
+	s.Reason = binary.LittleEndian.Uint16(b)
+	s.Data = append([]byte(nil), b[2:]...)
+	return nil
+}
+
+// Reasons of Command Reject [Vol 3, Part A, 4.1].
+const (
+	rejectNotUnderstood = 0x0000
+	rejectMTUExceeded   = 0x0001
+	rejectInvalidCID    = 0x0002
+)
+
+var rejectReasonName = map[uint16]string{
+	rejectNotUnderstood: "command not understood",
+	rejectMTUExceeded:   "signaling MTU exceeded",
+	rejectInvalidCID:    "invalid CID in request",
+}
+
+// Error returns the reason, for which the remote device rejected a request.
+func (s *CommandReject) Error() string {
+	if name, ok := rejectReasonName[s.Reason]; ok {
+		return "signaling command rejected: " + name
 	}
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(data))); err != nil {
+	return fmt.Sprintf("signaling command rejected: reason 0x%04X", s.Reason)
+}
+
+// The RTX timer of the signaling requests [Vol 3, Part A, 6.2.1].
+const (
+	minSigRTX     = 1 * time.Second
+	maxSigRTX     = 60 * time.Second
+	defaultSigRTX = 30 * time.Second
+)
+
+var errSigTimeout = errors.New("signaling request timed out")
+
+// sigReq is a pending signaling request, which waits for the response with
+// the code and its identifier.
+type sigReq struct {
+	code int
+	ch   chan sigCmd
+}
+
+// Signal sends a signaling command to the remote device, and waits for the
+// response into rsp, until the RTX timer expires. If rsp is nil, the command
+// has no response, and Signal returns once it's sent. A request rejected by the
+// remote device returns the *CommandReject. Signal is safe to be called from
+// multiple goroutines, and the requests are outstanding at the same time.
+func (c *Conn) Signal(req Signal, rsp Signal) error {
+	return c.signal(context.Background(), req, rsp)
+}
+
+// signal is like Signal, but stops waiting for the response once ctx is done.
+func (c *Conn) signal(ctx context.Context, req Signal, rsp Signal) error {
+	data, err := req.Marshal()
+	if err != nil {
 		return err
 	}
-	if err := binary.Write(buf, binary.LittleEndian, data); err != nil {
-		return err
+
+	c.muSig.Lock()
+	if 4+len(data) > c.sigTxMTU {
+		c.muSig.Unlock()
+		return fmt.Errorf("signaling command exceeds MTUsig %d", c.sigTxMTU)
+	}
+	id, ok := c.nextSigID()
+	if !ok {
+		c.muSig.Unlock()
+		return errors.New("no signaling identifier available")
 	}
+	var r *sigReq
+	if rsp != nil {
+		r = &sigReq{code: rsp.Code(), ch: make(chan sigCmd, 1)}
+		c.sigReqs[id] = r
+	}
+	c.muSig.Unlock()
 
-	c.sigSent = make(chan []byte)
-	defer close(c.sigSent)
-	if _, err := c.writePDU(buf.Bytes()); err != nil {
+	if _, err := c.sendResponse(uint8(req.Code()), id, req); err != nil {
+		c.removeSigReq(id)
 		return err
 	}
+	if r == nil {
+		return nil
+	}
+
+	tmo := time.NewTimer(c.hci.sigRTX)
+	defer tmo.Stop()
 	var s sigCmd
 	select {
-	case s = <-c.sigSent:
-	case <-time.After(time.Second):
-		// TODO: Find the proper timed out defined in spec, if any.
-		return errors.New("signaling request timed out")
+	case s = <-r.ch:
+	case <-tmo.C:
+		c.removeSigReq(id)
+		return errSigTimeout
+	case <-c.chDone:
+		c.removeSigReq(id)
+		return io.ErrClosedPipe
+	case <-ctx.Done():
+		c.removeSigReq(id)
+		return ctx.Err()
 	}
 
-	if s.code() != req.Code() {
-		return errors.New("mismatched signaling response")
+	if s.code() == SignalCommandReject {
+		var rej CommandReject
+		if err := rej.Unmarshal(s.data()); err != nil {
+			return err
+		}
+		// Use the actual MTUsig of the remote device from now on.
+		if rej.Reason == rejectMTUExceeded && len(rej.Data) >= 2 {
+			if mtu := int(binary.LittleEndian.Uint16(rej.Data)); mtu >= ble.DefaultMTU {
+				c.muSig.Lock()
+				c.sigTxMTU = mtu
+				c.muSig.Unlock()
+			}
+		}
+		return &rej
 	}
-	if s.id() != c.sigID {
-		return errors.New("mismatched signaling id")
+	return rsp.Unmarshal(s.data())
+}
+
+// nextSigID returns the identifier of a new signaling command, which is never
+// zero, nor used by a pending request [Vol 3, Part A, 4]. muSig must be held.
+func (c *Conn) nextSigID() (uint8, bool) {
+	for i := 0; i < 255; i++ {
+		c.sigID++
+		if c.sigID == 0 {
+			c.sigID++
+		}
+		if _, ok := c.sigReqs[c.sigID]; !ok {
+			return c.sigID, true
+		}
 	}
-	c.sigID++
-	if rsp == nil {
-		return nil
+	return 0, false
+}
+
+func (c *Conn) removeSigReq(id uint8) {
+	c.muSig.Lock()
+	delete(c.sigReqs, id)
+	c.muSig.Unlock()
+}
+
+// handleSigResponse passes a response to the pending request with the same
+// identifier. Responses to no pending request are silently discarded [Vol 3, Part A, 4].
+func (c *Conn) handleSigResponse(s sigCmd) {
+	c.muSig.Lock()
+	r, ok := c.sigReqs[s.id()]
+	if ok && (s.code() == r.code || s.code() == SignalCommandReject) {
+		delete(c.sigReqs, s.id())
+	} else {
+		ok = false
+	}
+	c.muSig.Unlock()
+	if ok {
+		r.ch <- append(sigCmd(nil), s[:4+s.len()]...)
 	}
-	return rsp.Unmarshal(s.data())
 }
 
 func (c *Conn) sendResponse(code uint8, id uint8, r Signal) (int, error) {
@@ -117,7 +295,7 @@ func (c *Conn) handleSignal(p pdu) error {
 			SignalCommandReject,
 			sigCmd(p.payload()).id(),
 			&CommandReject{
-				Reason: 0x0001,                                            // Signaling MTU exceeded.
+				Reason: rejectMTUExceeded,
 				Data:   []byte{uint8(c.sigRxMTU), uint8(c.sigRxMTU >> 8)}, // Actual MTUsig.
 			})
 		if err != nil {
@@ -127,34 +305,36 @@ func (c *Conn) handleSignal(p pdu) error {
 	}
 
 	s := sigCmd(p.payload())
-	for len(s) > 0 {
-		// Check if it's a supported request.
+	for len(s) >= 4 && len(s) >= 4+s.len() {
 		switch s.code() {
 		case SignalDisconnectRequest:
 			c.handleDisconnectRequest(s)
 		case SignalConnectionParameterUpdateRequest:
 			c.handleConnectionParameterUpdateRequest(s)
 		case SignalLECreditBasedConnectionRequest:
-			c.LECreditBasedConnectionRequest(s)
+			c.handleLECreditBasedConnectionRequest(s)
 		case SignalLEFlowControlCredit:
-			c.LEFlowControlCredit(s)
+			c.handleLEFlowControlCredit(s)
+		case SignalCreditBasedConnectionRequest:
+			c.handleCreditBasedConnectionRequest(s)
+		case SignalCreditBasedReconfigureRequest:
+			c.handleCreditBasedReconfigureRequest(s)
+		case SignalCommandReject,
+			SignalDisconnectResponse,
+			SignalConnectionParameterUpdateResponse,
+			SignalLECreditBasedConnectionResponse,
+			SignalCreditBasedConnectionResponse,
+			SignalCreditBasedReconfigureResponse:
+			c.handleSigResponse(s)
 		default:
-			// Check if it's a response to a sent command.
-			select {
-			case c.sigSent <- s:
-				continue
-			default:
-			}
-
 			c.sendResponse(
 				SignalCommandReject,
 				s.id(),
 				&CommandReject{
-					Reason: 0x0000, // Command not understood.
+					Reason: rejectNotUnderstood,
 				})
 		}
 		s = s[4+s.len():] // advance to next the packet.
-
 	}
 	return nil
 }
@@ -166,16 +346,33 @@ func (c *Conn) handleDisconnectRequest(s sigCmd) {
 		return
 	}
 
+	// Disconnect the connection-oriented channel, if the endpoints match.
+	if ch := c.coc(req.DestinationCID); ch != nil {
+		if ch.dcid != req.SourceCID {
+			return
+		}
+		c.sendResponse(
+			SignalDisconnectResponse,
+			s.id(),
+			&DisconnectResponse{
+				DestinationCID: req.DestinationCID,
+				SourceCID:      req.SourceCID,
+			})
+		ch.closed()
+		return
+	}
+
 	// Send Command Reject when the DCID is unrecognized.
 	if req.DestinationCID != cidLEAtt {
+		// The local endpoint, followed by the remote one.
 		endpoints := make([]byte, 4)
-		binary.LittleEndian.PutUint16(endpoints, req.SourceCID)
 		binary.LittleEndian.PutUint16(endpoints, req.DestinationCID)
+		binary.LittleEndian.PutUint16(endpoints[2:], req.SourceCID)
 		c.sendResponse(
 			SignalCommandReject,
 			s.id(),
 			&CommandReject{
-				Reason: 0x0002, // Invalid CID in request
+				Reason: rejectInvalidCID,
 				Data:   endpoints,
 			})
 		return
@@ -219,36 +416,43 @@ func (c *Conn) handleConnectionParameterUpdateRequest(s sigCmd) {
 		return
 	}
 
-	// LE Connection Update (0x08|0x0013) [Vol 2, Part E, 7.8.18]
-	c.hci.Send(&cmd.LEConnectionUpdate{
-		ConnectionHandle:   c.param.ConnectionHandle(),
-		ConnIntervalMin:    req.IntervalMin,
-		ConnIntervalMax:    req.IntervalMax,
-		ConnLatency:        req.SlaveLatency,
-		SupervisionTimeout: req.TimeoutMultiplier,
-		MinimumCELength:    0, // Informational, and spec doesn't specify the use.
-		MaximumCELength:    0, // Informational, and spec doesn't specify the use.
-	}, nil)
-
-	// Currently, we (as a slave host) accept all the parameters and forward
-	// it to the controller. The controller might update all, partial or even
-	// none (ignore) of the parameters. The slave(remote) host will be indicated
-	// by its controller if the update actually happens.
-	// TODO: allow users to implement what parameters to accept.
-	c.sendResponse(
-		SignalConnectionParameterUpdateResponse,
-		s.id(),
-		&ConnectionParameterUpdateResponse{
-			Result: 0, // Accept.
+	// The policy accepts, rejects or clamps the parameters, and the accepted
+	// ones are forwarded to the controller. The controller might update all,
+	// partial or even none (ignore) of the parameters. The slave(remote) host
+	// will be indicated by its controller if the update actually happens.
+	// The policy may block, and runs off the signaling channel.
+	go func() {
+		p, ok := c.acceptConnParams(connParams{
+			intervalMin: req.IntervalMin,
+			intervalMax: req.IntervalMax,
+			latency:     req.SlaveLatency,
+			timeout:     req.TimeoutMultiplier,
 		})
-}
-
-// LECreditBasedConnectionRequest ...
-func (c *Conn) LECreditBasedConnectionRequest(s sigCmd) {
-	// TODO:
-}
+		if !ok {
+			c.sendResponse(
+				SignalConnectionParameterUpdateResponse,
+				s.id(),
+				&ConnectionParameterUpdateResponse{
+					Result: 1, // Reject.
+				})
+			return
+		}
+		c.sendResponse(
+			SignalConnectionParameterUpdateResponse,
+			s.id(),
+			&ConnectionParameterUpdateResponse{
+				Result: 0, // Accept.
+			})
 
-// LEFlowControlCredit ...
-func (c *Conn) LEFlowControlCredit(s sigCmd) {
-	// TODO:
+		// LE Connection Update (0x08|0x0013) [Vol 2, Part E, 7.8.18]
+		c.hci.Send(&cmd.LEConnectionUpdate{
+			ConnectionHandle:   c.param.ConnectionHandle(),
+			ConnIntervalMin:    p.intervalMin,
+			ConnIntervalMax:    p.intervalMax,
+			ConnLatency:        p.latency,
+			SupervisionTimeout: p.timeout,
+			MinimumCELength:    0, // Informational, and spec doesn't specify the use.
+			MaximumCELength:    0, // Informational, and spec doesn't specify the use.
+		}, nil)
+	}()
 }
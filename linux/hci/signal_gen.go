@@ -17,20 +17,6 @@ type CommandReject struct {
 // Code returns the event code of the command.
 func (s CommandReject) Code() int { return 0x01 }
 
-// Marshal serializes the command parameters into binary form.
-func (s *CommandReject) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-// Unmarshal de-serializes the binary data and stores the result in the receiver.
-func (s *CommandReject) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
-}
-
 // SignalDisconnectRequest is the code of Disconnect Request signaling packet.
 const SignalDisconnectRequest = 0x06
 
@@ -219,3 +205,71 @@ func (s *LEFlowControlCredit) Marshal() ([]byte, error) {
 func (s *LEFlowControlCredit) Unmarshal(b []byte) error {
 	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
 }
+
+// SignalCreditBasedConnectionRequest is the code of Credit Based Connection Request signaling packet.
+const SignalCreditBasedConnectionRequest = 0x17
+
+// CreditBasedConnectionRequest implements Credit Based Connection Request (0x17) [Vol 3, Part A, 4.25].
+type CreditBasedConnectionRequest struct {
+	SPSM           uint16
+	MTU            uint16
+	MPS            uint16
+	InitialCredits uint16
+	SourceCID      []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedConnectionRequest) Code() int { return 0x17 }
+
+// SignalCreditBasedConnectionResponse is the code of Credit Based Connection Response signaling packet.
+const SignalCreditBasedConnectionResponse = 0x18
+
+// CreditBasedConnectionResponse implements Credit Based Connection Response (0x18) [Vol 3, Part A, 4.26].
+type CreditBasedConnectionResponse struct {
+	MTU            uint16
+	MPS            uint16
+	InitialCredits uint16
+	Result         uint16
+	DestinationCID []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedConnectionResponse) Code() int { return 0x18 }
+
+// SignalCreditBasedReconfigureRequest is the code of Credit Based Reconfigure Request signaling packet.
+const SignalCreditBasedReconfigureRequest = 0x19
+
+// CreditBasedReconfigureRequest implements Credit Based Reconfigure Request (0x19) [Vol 3, Part A, 4.27].
+type CreditBasedReconfigureRequest struct {
+	MTU            uint16
+	MPS            uint16
+	DestinationCID []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedReconfigureRequest) Code() int { return 0x19 }
+
+// SignalCreditBasedReconfigureResponse is the code of Credit Based Reconfigure Response signaling packet.
+const SignalCreditBasedReconfigureResponse = 0x1A
+
+// CreditBasedReconfigureResponse implements Credit Based Reconfigure Response (0x1A) [Vol 3, Part A, 4.28].
+type CreditBasedReconfigureResponse struct {
+	Result uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedReconfigureResponse) Code() int { return 0x1A }
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedReconfigureResponse) Marshal() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedReconfigureResponse) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+}
@@ -0,0 +1,76 @@
+package hci
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSigResponseMatching(t *testing.T) {
+	c := &Conn{sigReqs: make(map[uint8]*sigReq)}
+	var reqs []*sigReq
+	for i := 0; i < 2; i++ {
+		id, ok := c.nextSigID()
+		if !ok || id == 0 {
+			t.Fatalf("nextSigID() = %d, %v", id, ok)
+		}
+		r := &sigReq{code: SignalDisconnectResponse, ch: make(chan sigCmd, 1)}
+		c.sigReqs[id] = r
+		reqs = append(reqs, r)
+	}
+
+	// Responses with an unknown identifier, or a mismatched code, are discarded.
+	c.handleSigResponse(sigCmd{SignalDisconnectResponse, 9, 4, 0, 0x40, 0, 0x40, 0})
+	c.handleSigResponse(sigCmd{SignalConnectionParameterUpdateResponse, 1, 2, 0, 0, 0})
+	if len(c.sigReqs) != 2 {
+		t.Fatalf("%d pending requests, want 2", len(c.sigReqs))
+	}
+
+	// The responses are matched out of order.
+	c.handleSigResponse(sigCmd{SignalCommandReject, 2, 2, 0, rejectNotUnderstood, 0})
+	c.handleSigResponse(sigCmd{SignalDisconnectResponse, 1, 4, 0, 0x40, 0, 0x41, 0})
+	if s := <-reqs[0].ch; s.code() != SignalDisconnectResponse || s.id() != 1 {
+		t.Errorf("request 1 got code 0x%02X, id %d", s.code(), s.id())
+	}
+	if s := <-reqs[1].ch; s.code() != SignalCommandReject || s.id() != 2 {
+		t.Errorf("request 2 got code 0x%02X, id %d", s.code(), s.id())
+	}
+	if len(c.sigReqs) != 0 {
+		t.Errorf("%d pending requests, want 0", len(c.sigReqs))
+	}
+}
+
+func TestNextSigIDSkipsPending(t *testing.T) {
+	c := &Conn{sigReqs: make(map[uint8]*sigReq), sigID: 0xFE}
+	c.sigReqs[0xFF] = &sigReq{}
+	c.sigReqs[1] = &sigReq{}
+	if id, ok := c.nextSigID(); !ok || id != 2 {
+		t.Errorf("nextSigID() = %d, %v, want 2, true", id, ok)
+	}
+	for i := 1; i < 256; i++ {
+		c.sigReqs[uint8(i)] = &sigReq{}
+	}
+	if _, ok := c.nextSigID(); ok {
+		t.Error("nextSigID() with all identifiers pending: ok")
+	}
+}
+
+func TestCommandReject(t *testing.T) {
+	rej := CommandReject{Reason: rejectInvalidCID, Data: []byte{0x40, 0x00, 0x41, 0x00}}
+	b, err := rej.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x02, 0x00, 0x40, 0x00, 0x41, 0x00}; !bytes.Equal(b, want) {
+		t.Fatalf("Marshal() = %X, want %X", b, want)
+	}
+	var got CommandReject
+	if err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.Reason != rej.Reason || !bytes.Equal(got.Data, rej.Data) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, rej)
+	}
+	if got.Error() != "signaling command rejected: invalid CID in request" {
+		t.Errorf("Error() = %q", got.Error())
+	}
+}
@@ -0,0 +1,113 @@
+package hci
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+)
+
+var (
+	errNoCSRK        = errors.New("no CSRK")
+	errBadSignature  = errors.New("invalid signature")
+	errSignCntReplay = errors.New("sign counter replayed")
+)
+
+// SignData signs m, typically an ATT PDU, with the CSRK the local device has
+// distributed to the remote device, and returns the signature [Vol 3, Part H, 2.4.5].
+func (c *Conn) SignData(m []byte) ([12]byte, error) {
+	var sig [12]byte
+	var err error
+	if !c.smp.call(func() { sig, err = c.smp.sign(m) }) {
+		return sig, errors.Wrap(io.ErrClosedPipe, "connection closed")
+	}
+	return sig, err
+}
+
+// VerifySignedData verifies the signature of m with the CSRK distributed by the
+// remote device, and rejects replayed sign counters. It returns the security
+// level of the CSRK [Vol 3, Part C, 10.2.2].
+func (c *Conn) VerifySignedData(m []byte, sig [12]byte) (ble.SecurityLevel, error) {
+	var level ble.SecurityLevel
+	var err error
+	if !c.smp.call(func() { level, err = c.smp.verify(m, sig) }) {
+		return ble.SecurityNone, errors.Wrap(io.ErrClosedPipe, "connection closed")
+	}
+	return level, err
+}
+
+// call runs f on the SMP goroutine, and waits for it to return.
+func (s *smp) call(f func()) bool {
+	done := make(chan struct{})
+	if !s.post(func() { f(); close(done) }) {
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-s.chQuit:
+		return false
+	}
+}
+
+// sign signs m with the local CSRK. The sign counters of bonded keys are
+// persisted in the bond store.
+func (s *smp) sign(m []byte) ([12]byte, error) {
+	if b := s.bond(); b != nil && !b.LocalCSRK.IsZero() {
+		cnt := b.LocalSignCounter
+		b.LocalSignCounter++
+		if err := s.c.hci.bonds.Save(b); err != nil {
+			return [12]byte{}, errors.Wrap(err, "can't save sign counter")
+		}
+		return smpSign(b.LocalCSRK, m, cnt), nil
+	}
+	if k := s.keys; k != nil && k.localDist&keyDistSign != 0 {
+		cnt := k.localSignCounter
+		k.localSignCounter++
+		return smpSign(k.localCSRK, m, cnt), nil
+	}
+	return [12]byte{}, errNoCSRK
+}
+
+// verify verifies the signature of m with the remote CSRK.
+func (s *smp) verify(m []byte, sig [12]byte) (ble.SecurityLevel, error) {
+	cnt := binary.LittleEndian.Uint32(sig[:])
+	if b := s.bond(); b != nil && !b.CSRK.IsZero() {
+		if cnt < b.SignCounter {
+			return ble.SecurityNone, errSignCntReplay
+		}
+		if smpSign(b.CSRK, m, cnt) != sig {
+			return ble.SecurityNone, errBadSignature
+		}
+		b.SignCounter = cnt + 1
+		if err := s.c.hci.bonds.Save(b); err != nil {
+			return ble.SecurityNone, errors.Wrap(err, "can't save sign counter")
+		}
+		return keysFromBond(b).level(), nil
+	}
+	if k := s.keys; k != nil && k.remoteDist&keyDistSign != 0 {
+		if cnt < k.signCounter {
+			return ble.SecurityNone, errSignCntReplay
+		}
+		if smpSign(k.csrk, m, cnt) != sig {
+			return ble.SecurityNone, errBadSignature
+		}
+		k.signCounter = cnt + 1
+		return k.level(), nil
+	}
+	return ble.SecurityNone, errNoCSRK
+}
+
+// bond returns the bond of the remote device, if any.
+func (s *smp) bond() *ble.Bond {
+	h := s.c.hci
+	if h.bonds == nil {
+		return nil
+	}
+	b, err := h.bonds.Find(s.c.RemoteAddr())
+	if err != nil {
+		return nil
+	}
+	return b
+}
@@ -2,8 +2,20 @@ package hci
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
 )
 
 const (
@@ -23,45 +35,1591 @@ const (
 	pairingKeypress          = 0x0E // Pairing Keypress Notification LE-U
 )
 
-func (c *Conn) sendSMP(p pdu) error {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, uint16(4+len(p))); err != nil {
-		return err
+// Pairing Failed reasons [Vol 3, Part H, 3.5.5]
+const (
+	smpPasskeyEntryFailed         = 0x01 // Passkey Entry Failed
+	smpOOBNotAvailable            = 0x02 // OOB Not Available
+	smpAuthenticationRequirements = 0x03 // Authentication Requirements
+	smpConfirmValueFailed         = 0x04 // Confirm Value Failed
+	smpPairingNotSupported        = 0x05 // Pairing Not Supported
+	smpEncryptionKeySize          = 0x06 // Encryption Key Size
+	smpCommandNotSupported        = 0x07 // Command Not Supported
+	smpUnspecifiedReason          = 0x08 // Unspecified Reason
+	smpRepeatedAttempts           = 0x09 // Repeated Attempts
+	smpInvalidParameters          = 0x0A // Invalid Parameters
+	smpDHKeyCheckFailed           = 0x0B // DHKey Check Failed
+	smpNumericComparisonFailed    = 0x0C // Numeric Comparison Failed
+)
+
+// IO Capability [Vol 3, Part H, 3.5.1]
+const (
+	ioCapDisplayOnly     = 0x00
+	ioCapDisplayYesNo    = 0x01
+	ioCapKeyboardOnly    = 0x02
+	ioCapNoInputNoOutput = 0x03
+	ioCapKeyboardDisplay = 0x04
+)
+
+// AuthReq flags [Vol 3, Part H, 3.5.1]
+const (
+	authReqBonding  = 0x01 // Bonding_Flags: Bonding
+	authReqMITM     = 0x04 // MITM protection requested
+	authReqSC       = 0x08 // LE Secure Connections
+	authReqKeypress = 0x10 // Keypress notifications
+	authReqCT2      = 0x20 // h7 supported
+)
+
+// Key Distribution flags [Vol 3, Part H, 3.6.1]
+const (
+	keyDistEnc  = 0x01 // LTK, EDIV and Rand (LE Legacy Pairing only)
+	keyDistID   = 0x02 // IRK and Identity Address
+	keyDistSign = 0x04 // CSRK
+)
+
+// Encryption key size limits [Vol 3, Part H, 2.3.4]
+const (
+	smpMinKeySize = 7
+	smpMaxKeySize = 16
+)
+
+// smpTimeout is the timeout of the SMP procedure [Vol 3, Part H, 3.4].
+const smpTimeout = 30 * time.Second
+
+var errPairingTimeout = errors.New("smp: pairing timed out")
+
+// Pairing methods, or association models [Vol 3, Part H, 2.3.5.1].
+const (
+	justWorks           = iota
+	passkeyRespDisplays // Passkey Entry: responder displays, initiator inputs
+	passkeyInitDisplays // Passkey Entry: initiator displays, responder inputs
+	passkeyBothInput    // Passkey Entry: initiator and responder inputs
+	numericComparison   // Numeric Comparison (LE Secure Connections only)
+	outOfBand           // Out of Band (LE Secure Connections only)
+)
+
+// legacyMethods maps the IO capabilities to the pairing method used by LE
+// Legacy Pairing, indexed by [responder][initiator] [Vol 3, Part H, 2.3.5.1].
+var legacyMethods = [5][5]int{
+	ioCapDisplayOnly:     {justWorks, justWorks, passkeyRespDisplays, justWorks, passkeyRespDisplays},
+	ioCapDisplayYesNo:    {justWorks, justWorks, passkeyRespDisplays, justWorks, passkeyRespDisplays},
+	ioCapKeyboardOnly:    {passkeyInitDisplays, passkeyInitDisplays, passkeyBothInput, justWorks, passkeyInitDisplays},
+	ioCapNoInputNoOutput: {justWorks, justWorks, justWorks, justWorks, justWorks},
+	ioCapKeyboardDisplay: {passkeyInitDisplays, passkeyInitDisplays, passkeyRespDisplays, justWorks, passkeyInitDisplays},
+}
+
+// scMethods maps the IO capabilities to the pairing method used by LE Secure
+// Connections, indexed by [responder][initiator] [Vol 3, Part H, 2.3.5.1].
+var scMethods = [5][5]int{
+	ioCapDisplayOnly:     {justWorks, justWorks, passkeyRespDisplays, justWorks, passkeyRespDisplays},
+	ioCapDisplayYesNo:    {justWorks, numericComparison, passkeyRespDisplays, justWorks, numericComparison},
+	ioCapKeyboardOnly:    {passkeyInitDisplays, passkeyInitDisplays, passkeyBothInput, justWorks, passkeyInitDisplays},
+	ioCapNoInputNoOutput: {justWorks, justWorks, justWorks, justWorks, justWorks},
+	ioCapKeyboardDisplay: {passkeyInitDisplays, numericComparison, passkeyRespDisplays, justWorks, numericComparison},
+}
+
+// scPasskeyRounds is the number of rounds of the Passkey Entry protocol of
+// LE Secure Connections, one for each bit of the passkey [Vol 3, Part H, 2.3.5.6.3].
+const scPasskeyRounds = 20
+
+// smpKeys holds the keys exchanged during the Transport Specific Key
+// Distribution phase of a pairing [Vol 3, Part H, 3.6].
+// All the keys are stored in wire (little-endian) order.
+type smpKeys struct {
+	// Keys distributed by the local device.
+	localDist uint8
+	localLTK  [16]byte
+	localEDIV uint16
+	localRand uint64
+	localCSRK [16]byte
+
+	// Keys distributed by the remote device.
+	remoteDist uint8
+	ltk        [16]byte
+	ediv       uint16
+	rand       uint64
+	irk        [16]byte
+	idAddrType uint8
+	idAddr     [6]byte
+	csrk       [16]byte
+
+	// Sign counters of the CSRKs, if the keys are not bonded.
+	signCounter      uint32
+	localSignCounter uint32
+
+	keySize       int
+	authenticated bool
+
+	// sc is true if the keys were generated by LE Secure Connections, in
+	// which case ltk and localLTK are the same key, with zero EDIV and Rand.
+	sc bool
+}
+
+// pairing is the state of a pairing procedure in progress.
+type pairing struct {
+	initiator bool
+	method    int
+
+	// bonding is true if both devices requested bonding, in which case the
+	// keys are saved to the bond store.
+	bonding bool
+
+	// Pairing Request and Pairing Response commands, including the opcode.
+	preq []byte
+	pres []byte
+
+	tk       [16]byte
+	lrand    [16]byte // Random value (nonce) generated by the local device.
+	rrand    [16]byte // Random value (nonce) received from the remote device.
+	rconfirm [16]byte // Confirm value received from the remote device.
+
+	// stk is the key used to encrypt the link during the pairing: the STK
+	// for LE Legacy Pairing, or the LTK for LE Secure Connections.
+	stk [16]byte
+
+	// LE Secure Connections [Vol 3, Part H, 2.3.5.6].
+	sc     bool
+	key    *ecdh.PrivateKey
+	lpk    [64]byte // Public key of the local device.
+	rpk    [64]byte // Public key of the remote device.
+	dhkey  [32]byte
+	macKey [16]byte
+	round  int // Round of the Passkey Entry protocol.
+
+	// lr and rr are the values r of the local and the remote devices used in
+	// the check values: the passkey for Passkey Entry, the random values
+	// exchanged out of band for OOB, and zero otherwise.
+	lr [16]byte
+	rr [16]byte
+
+	// expect is the opcode of the next command expected from the remote
+	// device. It is zero while waiting for the link to be encrypted.
+	expect uint8
+
+	// received records the keys that have been distributed by the remote device.
+	received uint8
+
+	// asking is true while the pairing agent is asked for an answer, and
+	// deferred are the commands received meanwhile.
+	asking   bool
+	deferred [][]byte
+
+	keys smpKeys
+	tmo  *time.Timer
+}
+
+// smp implements the Security Manager Protocol of a connection [Vol 3, Part H].
+// The protocol is run serially on its own goroutine, so the pairing procedure
+// can wait for user interaction without blocking other channels of the link.
+type smp struct {
+	c *Conn
+
+	// evts are the events to be run on the SMP goroutine in order, and chEvt
+	// is signaled when they are queued. The queue is unbounded, so posting
+	// never blocks the HCI event loop or the ACL data.
+	muEvt  sync.Mutex
+	evts   []func()
+	chEvt  chan struct{}
+	chQuit chan struct{}
+
+	// pairing is the pairing procedure in progress, if any.
+	pairing *pairing
+
+	// authorizing is true while the pairing agent is asked to authorize the
+	// pairing requested by a Security Request.
+	authorizing bool
+
+	// timedOut is true once a pairing has timed out. No further commands are
+	// sent or handled on the link [Vol 3, Part H, 3.4].
+	timedOut bool
+
+	// rekeying is true while the link is encrypted with the bonded keys upon
+	// a Security Request, which is paired instead if the slave has lost them.
+	rekeying bool
+
+	// waiters are notified with the result of the current (or the next) pairing.
+	waiters []chan error
+
+	// keys are the keys of the current bond with the remote device: the
+	// keys distributed during the last successful pairing, or the bonded
+	// keys the link has been encrypted with.
+	keys *smpKeys
+
+	// encKeys are the keys the link is being encrypted with.
+	encKeys *smpKeys
+
+	// encWaiters are notified when the link is encrypted.
+	encWaiters []chan error
+
+	// Security level of the link, which is read from other goroutines.
+	mu      sync.Mutex
+	level   ble.SecurityLevel
+	keySize int
+	handler ble.SecurityHandler
+}
+
+// level returns the security level provided by the keys [Vol 3, Part C, 10.2.1].
+func (k *smpKeys) level() ble.SecurityLevel {
+	switch {
+	case !k.authenticated:
+		return ble.SecurityUnauthenticated
+	case k.sc && k.keySize == smpMaxKeySize:
+		return ble.SecuritySC
 	}
-	if err := binary.Write(buf, binary.LittleEndian, cidSMP); err != nil {
-		return err
+	return ble.SecurityAuthenticated
+}
+
+// keysFromBond returns the keys of a bond.
+func keysFromBond(b *ble.Bond) *smpKeys {
+	k := &smpKeys{
+		ltk:           b.LTK,
+		ediv:          b.EDIV,
+		rand:          b.Rand,
+		irk:           b.IRK,
+		csrk:          b.CSRK,
+		localLTK:      b.LocalLTK,
+		localEDIV:     b.LocalEDIV,
+		localRand:     b.LocalRand,
+		localCSRK:     b.LocalCSRK,
+		keySize:       b.KeySize,
+		authenticated: b.Authenticated,
+		sc:            b.SecureConnections,
 	}
-	if err := binary.Write(buf, binary.LittleEndian, p); err != nil {
+	if !b.LTK.IsZero() {
+		k.remoteDist |= keyDistEnc
+	}
+	if !b.IRK.IsZero() {
+		k.remoteDist |= keyDistID
+	}
+	if !b.CSRK.IsZero() {
+		k.remoteDist |= keyDistSign
+	}
+	if !b.LocalLTK.IsZero() {
+		k.localDist |= keyDistEnc
+	}
+	if !b.LocalCSRK.IsZero() {
+		k.localDist |= keyDistSign
+	}
+	return k
+}
+
+func newSMP(c *Conn) *smp {
+	s := &smp{
+		c:      c,
+		chEvt:  make(chan struct{}, 1),
+		chQuit: make(chan struct{}),
+		level:  ble.SecurityNone,
+	}
+	go s.loop()
+	return s
+}
+
+func (s *smp) loop() {
+	for {
+		select {
+		case <-s.chEvt:
+			for f := s.next(); f != nil; f = s.next() {
+				f()
+			}
+		case <-s.chQuit:
+			if s.authorizing {
+				s.cancelPrompt()
+			}
+			s.finish(errors.Wrap(io.ErrClosedPipe, "connection closed"))
+			s.encrypted(errors.Wrap(io.ErrClosedPipe, "connection closed"))
+			return
+		}
+	}
+}
+
+// post schedules f to be run on the SMP goroutine, after the events posted
+// before it. It returns false if the connection is closed.
+func (s *smp) post(f func()) bool {
+	select {
+	case <-s.chQuit:
+		return false
+	default:
+	}
+	s.muEvt.Lock()
+	s.evts = append(s.evts, f)
+	s.muEvt.Unlock()
+	select {
+	case s.chEvt <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// next returns the next event, or nil if there is none.
+func (s *smp) next() func() {
+	s.muEvt.Lock()
+	defer s.muEvt.Unlock()
+	if len(s.evts) == 0 {
+		return nil
+	}
+	f := s.evts[0]
+	s.evts[0] = nil
+	s.evts = s.evts[1:]
+	return f
+}
+
+// close stops the SMP goroutine, and fails the pairing in progress, if any.
+func (s *smp) close() {
+	close(s.chQuit)
+}
+
+// pair starts a pairing, or joins the one in progress, and waits for its result.
+func (s *smp) pair(ctx context.Context) error {
+	ch := make(chan error, 1)
+	if !s.post(func() { s.start(ch) }) {
+		return errors.Wrap(io.ErrClosedPipe, "connection closed")
+	}
+	select {
+	case err := <-ch:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	_, err := c.writePDU(buf.Bytes())
-	logger.Debug("smp", "send", fmt.Sprintf("[%X]", buf.Bytes()))
-	return err
 }
 
-func (c *Conn) handleSMP(p pdu) error {
-	logger.Debug("smp", "recv", fmt.Sprintf("[%X]", p))
-	code := p[0]
-	switch code {
+func (s *smp) start(ch chan error) {
+	if s.timedOut {
+		ch <- errPairingTimeout
+		return
+	}
+	s.waiters = append(s.waiters, ch)
+	if s.pairing != nil {
+		return
+	}
+	if s.c.param.Role() == roleMaster {
+		if err := s.sendPairingRequest(); err != nil {
+			s.finish(err)
+		}
+		return
+	}
+	// A slave can only request the master to initiate the pairing [Vol 3, Part H, 2.4.6].
+	if err := s.send(securityRequest, s.authReq()); err != nil {
+		s.finish(err)
+	}
+}
+
+// finish completes the pairing in progress, and notifies the waiters.
+func (s *smp) finish(err error) {
+	if p := s.pairing; p != nil {
+		p.tmo.Stop()
+		if p.asking {
+			s.cancelPrompt()
+		}
+		if err == nil {
+			k := p.keys
+			s.keys = &k
+			if p.bonding {
+				s.saveBond(&k)
+			}
+		}
+		s.pairing = nil
+	}
+	for _, ch := range s.waiters {
+		ch <- err
+	}
+	s.waiters = nil
+	if err != nil {
+		// The link won't be encrypted by a failed pairing.
+		s.encrypted(err)
+	}
+}
+
+// encrypt starts encrypting the link with the bonded keys, or waits for the
+// link to be encrypted, and notifies ch with the result.
+func (s *smp) encrypt(ch chan error) {
+	if s.securityLevel() != ble.SecurityNone {
+		ch <- nil
+		return
+	}
+	if s.pairing != nil {
+		// The link is encrypted by the pairing in progress.
+		s.waiters = append(s.waiters, ch)
+		return
+	}
+	if s.c.param.Role() != roleMaster {
+		if s.timedOut {
+			ch <- errPairingTimeout
+			return
+		}
+		// Ask the master to encrypt the link, or to pair [Vol 3, Part H, 2.4.6].
+		s.encWaiters = append(s.encWaiters, ch)
+		if err := s.send(securityRequest, s.authReq()); err != nil {
+			s.encrypted(err)
+		}
+		return
+	}
+
+	k := s.bondedKeys()
+	if k == nil {
+		ch <- ble.ErrNotBonded
+		return
+	}
+	s.encWaiters = append(s.encWaiters, ch)
+	if err := s.startEncryption(k); err != nil {
+		s.encrypted(err)
+	}
+}
+
+// bondedKeys returns the keys, which the master encrypts the link with: the
+// keys of the current bond, or the bonded keys of the identity address of the
+// remote device. It returns nil if there is no LTK.
+func (s *smp) bondedKeys() *smpKeys {
+	if k := s.keys; k != nil && (k.remoteDist&keyDistEnc != 0 || k.sc) {
+		return k
+	}
+	if h := s.c.hci; h.bonds != nil {
+		if b, err := h.bonds.Find(s.c.RemoteAddr()); err == nil && !b.LTK.IsZero() {
+			return keysFromBond(b)
+		}
+	}
+	return nil
+}
+
+// startEncryption starts encrypting the link with the LTK of the keys.
+func (s *smp) startEncryption(k *smpKeys) error {
+	s.encKeys = k
+	err := s.c.hci.Send(&cmd.LEStartEncryption{
+		ConnectionHandle:     s.c.param.ConnectionHandle(),
+		RandomNumber:         k.rand,
+		EncryptedDiversifier: k.ediv,
+		LongTermKey:          k.ltk,
+	}, nil)
+	return errors.Wrap(err, "can't start encryption")
+}
+
+// meets returns true, if the keys provide the authentication requested by the
+// AuthReq of a Security Request.
+func (k *smpKeys) meets(authReq uint8) bool {
+	return authReq&authReqMITM == 0 || k.authenticated
+}
+
+// encrypted notifies the waiters of the encryption of the link.
+func (s *smp) encrypted(err error) {
+	for _, ch := range s.encWaiters {
+		ch <- err
+	}
+	s.encWaiters = nil
+}
+
+// setSecurity updates the security level of the link, and calls the handler
+// if it has changed.
+func (s *smp) setSecurity(level ble.SecurityLevel, keySize int) {
+	s.mu.Lock()
+	changed := s.level != level || s.keySize != keySize
+	s.level, s.keySize = level, keySize
+	h := s.handler
+	s.mu.Unlock()
+	if changed && h != nil {
+		h(level, keySize)
+	}
+}
+
+// securityLevel returns the current security level of the link.
+func (s *smp) securityLevel() ble.SecurityLevel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.level
+}
+
+// fail aborts the pairing in progress with the specified reason.
+func (s *smp) fail(reason uint8) {
+	logger.Debug("smp", "fail", fmt.Sprintf("reason 0x%02X", reason))
+	s.send(pairingFailed, reason)
+	s.finish(ErrPairing(reason))
+}
+
+func (s *smp) newPairing(initiator bool) *pairing {
+	p := &pairing{initiator: initiator}
+	p.tmo = time.AfterFunc(smpTimeout, func() {
+		s.post(func() {
+			if s.pairing == p {
+				// No further SMP commands shall be sent once timed out [Vol 3, Part H, 3.4].
+				s.timedOut = true
+				s.finish(errPairingTimeout)
+			}
+		})
+	})
+	s.pairing = p
+	return p
+}
+
+func (s *smp) ioCap() uint8 { return s.c.hci.smpIOCap }
+
+func (s *smp) authReq() uint8 {
+	a := uint8(authReqBonding | authReqSC)
+	if s.ioCap() != ioCapNoInputNoOutput {
+		a |= authReqMITM
+	}
+	return a
+}
+
+// oobFlag returns the OOB data flag, which indicates whether the OOB data
+// of the remote device is present [Vol 3, Part H, 3.5.1].
+func (s *smp) oobFlag() uint8 {
+	h := s.c.hci
+	h.muOOB.Lock()
+	defer h.muOOB.Unlock()
+	if _, ok := h.oobRemote[strings.ToLower(s.c.RemoteAddr().String())]; ok {
+		return 0x01
+	}
+	return 0x00
+}
+
+// keyDist returns the keys the local device offers to distribute.
+func (s *smp) keyDist() uint8 {
+	return keyDistEnc | keyDistID | keyDistSign
+}
+
+func (s *smp) send(code uint8, data ...uint8) error {
+	return s.c.sendSMP(append([]byte{code}, data...))
+}
+
+func (s *smp) sendPairingRequest() error {
+	p := s.newPairing(true)
+	p.preq = []byte{pairingRequest, s.ioCap(), s.oobFlag(), s.authReq(), smpMaxKeySize, s.keyDist(), s.keyDist()}
+	p.expect = pairingResponse
+	return s.c.sendSMP(p.preq)
+}
+
+func (s *smp) handle(p pdu) {
+	b := p.payload()
+	if len(b) == 0 || s.timedOut {
+		return
+	}
+	logger.Debug("smp", "recv", fmt.Sprintf("[%X]", b))
+	s.handleCommand(b)
+}
+
+func (s *smp) handleCommand(b []byte) {
+	switch code := b[0]; code {
 	case pairingRequest:
-	case pairingResponse:
-	case pairingConfirm:
-	case pairingRandom:
+		s.handlePairingRequest(b)
+	case securityRequest:
+		s.handleSecurityRequest(b)
 	case pairingFailed:
+		// The master may also reject a Security Request, when no pairing is in progress.
+		if len(b) == 2 {
+			s.finish(ErrPairing(b[1]))
+		}
+	case pairingResponse,
+		pairingConfirm,
+		pairingRandom,
+		encryptionInformation,
+		masterIdentification,
+		identiInformation,
+		identityAddreInformation,
+		signingInformation,
+		pairingPublicKey,
+		pairingDHKeyCheck:
+		if p := s.pairing; p != nil && p.asking {
+			// Go on with the pairing once the user has answered.
+			p.deferred = append(p.deferred, b)
+			return
+		}
+		if s.pairing == nil || s.pairing.expect == 0 {
+			// Not expecting any command at this point.
+			s.send(pairingFailed, smpUnspecifiedReason)
+			return
+		}
+		s.handlePairing(s.pairing, b)
+	case pairingKeypress:
+		// Keypress notifications are informational only.
+	default:
+		// If a packet is received with a reserved Code it shall be ignored. [Vol 3, Part H, 3.3]
+	}
+}
+
+// handleSecurityRequest handles Security Request from a slave [Vol 3, Part H, 3.6.7].
+func (s *smp) handleSecurityRequest(b []byte) {
+	if s.c.param.Role() != roleMaster {
+		s.send(pairingFailed, smpCommandNotSupported)
+		return
+	}
+	if len(b) != 2 {
+		s.send(pairingFailed, smpInvalidParameters)
+		return
+	}
+	if s.pairing != nil || s.authorizing || s.rekeying {
+		return
+	}
+	// A bonded slave is encrypted with the LTK, if it's good enough for the
+	// slave, instead of being paired again [Vol 3, Part H, 2.4.6].
+	if k := s.bondedKeys(); k != nil && k.meets(b[1]) && (k.sc || !s.c.hci.scOnly) {
+		if s.securityLevel() != ble.SecurityNone {
+			// The link is already encrypted.
+			return
+		}
+		s.rekeying = true
+		if err := s.startEncryption(k); err != nil {
+			s.rekeying = false
+			s.encrypted(err)
+		}
+		return
+	}
+	s.requestPairing()
+}
+
+// requestPairing starts the pairing requested by a Security Request, once the
+// pairing agent, if any, has authorized it.
+func (s *smp) requestPairing() {
+	a := s.c.hci.agent
+	if a == nil {
+		if err := s.sendPairingRequest(); err != nil {
+			s.finish(err)
+		}
+		return
+	}
+	s.authorizing = true
+	go func() {
+		ok := a.AuthorizePairing(s.c)
+		s.post(func() {
+			s.authorizing = false
+			if s.pairing != nil {
+				// The pairing has been started meanwhile.
+				return
+			}
+			if !ok {
+				s.send(pairingFailed, smpPairingNotSupported)
+				return
+			}
+			if err := s.sendPairingRequest(); err != nil {
+				s.finish(err)
+			}
+		})
+	}()
+}
+
+// handlePairingRequest handles Pairing Request from a master [Vol 3, Part H, 3.5.1].
+func (s *smp) handlePairingRequest(b []byte) {
+	if s.c.param.Role() != roleSlave {
+		s.send(pairingFailed, smpCommandNotSupported)
+		return
+	}
+	if len(b) != 7 {
+		s.send(pairingFailed, smpInvalidParameters)
+		return
+	}
+	if s.pairing != nil {
+		// The master restarted the pairing; drop the current one.
+		s.pairing.tmo.Stop()
+		if s.pairing.asking {
+			s.cancelPrompt()
+		}
+		s.pairing = nil
+	}
+	p := s.newPairing(false)
+	p.preq = append([]byte(nil), b...)
+
+	maxKeySize := b[4]
+	if maxKeySize < smpMinKeySize || maxKeySize > smpMaxKeySize {
+		s.fail(smpInvalidParameters)
+		return
+	}
+	if len(s.waiters) != 0 {
+		// The pairing is requested locally.
+		s.respond(p)
+		return
+	}
+	s.authorize(p, func(ok bool) {
+		if !ok {
+			// The pairing is requested by the master, and rejected by the user.
+			s.fail(smpPairingNotSupported)
+			return
+		}
+		s.respond(p)
+	})
+}
+
+// respond sends the Pairing Response, once the pairing has been authorized.
+func (s *smp) respond(p *pairing) {
+	b := p.preq
+	if b[3]&authReqMITM != 0 && s.ioCap() == ioCapNoInputNoOutput {
+		// The master requires MITM protection, which we can't provide.
+		s.fail(smpAuthenticationRequirements)
+		return
+	}
+	if b[3]&authReqSC == 0 && s.c.hci.scOnly {
+		// LE Legacy Pairing is rejected in Secure Connections Only mode [Vol 3, Part C, 10.2.4].
+		s.fail(smpAuthenticationRequirements)
+		return
+	}
+	initDist := b[5] & s.keyDist()
+	respDist := b[6] & s.keyDist()
+	p.pres = []byte{pairingResponse, s.ioCap(), s.oobFlag(), s.authReq(), smpMaxKeySize, initDist, respDist}
+	if err := s.c.sendSMP(p.pres); err != nil {
+		s.finish(err)
+		return
+	}
+	s.negotiate(p, func() {
+		p.expect = pairingConfirm
+		if p.sc {
+			p.expect = pairingPublicKey
+		}
+	})
+}
+
+// negotiate determines the pairing method, and the encryption key size, once
+// the Pairing Request and Pairing Response have been exchanged. It calls next
+// once the user has entered the passkey, if needed, or fails the pairing.
+func (s *smp) negotiate(p *pairing, next func()) {
+	req, rsp := p.preq, p.pres
+	p.keys.keySize = int(req[4])
+	if int(rsp[4]) < p.keys.keySize {
+		p.keys.keySize = int(rsp[4])
+	}
+	if p.keys.keySize < smpMinKeySize {
+		s.fail(smpEncryptionKeySize)
+		return
+	}
+
+	p.bonding = req[3]&rsp[3]&authReqBonding != 0
+
+	// LE Secure Connections is used if both devices support it [Vol 3, Part H, 2.3].
+	p.sc = req[3]&authReqSC != 0 && rsp[3]&authReqSC != 0
+	p.keys.sc = p.sc
+	if !p.sc && s.c.hci.scOnly {
+		s.fail(smpAuthenticationRequirements)
+		return
+	}
+
+	p.method = justWorks
+	switch {
+	case p.sc && (req[2] != 0 || rsp[2] != 0):
+		p.method = outOfBand
+	case !p.sc && req[2] != 0 && rsp[2] != 0:
+		// The OOB data of LE Legacy Pairing (TK) is not supported.
+		s.fail(smpOOBNotAvailable)
+		return
+	case (req[3]|rsp[3])&authReqMITM != 0 && req[1] <= ioCapKeyboardDisplay && rsp[1] <= ioCapKeyboardDisplay:
+		if p.sc {
+			p.method = scMethods[rsp[1]][req[1]]
+		} else {
+			p.method = legacyMethods[rsp[1]][req[1]]
+		}
+	}
+	p.keys.authenticated = p.method != justWorks
+
+	// Keys distributed by the initiator and the responder.
+	if p.initiator {
+		p.keys.localDist, p.keys.remoteDist = rsp[5], rsp[6]
+	} else {
+		p.keys.localDist, p.keys.remoteDist = rsp[6], rsp[5]
+	}
+	if p.sc {
+		// The LTK is generated, instead of distributed, by LE Secure Connections.
+		p.keys.localDist &^= keyDistEnc
+		p.keys.remoteDist &^= keyDistEnc
+	}
+
+	// TK is zero for Just Works, and the passkey for Passkey Entry [Vol 3, Part H, 2.3.5].
+	// For LE Secure Connections, the passkey is used as the value r in the
+	// confirm and check values [Vol 3, Part H, 2.3.5.6.3].
+	switch p.method {
+	case passkeyRespDisplays, passkeyInitDisplays, passkeyBothInput:
+		display := (p.method == passkeyRespDisplays && !p.initiator) ||
+			(p.method == passkeyInitDisplays && p.initiator)
+		s.passkey(p, display, func(passkey uint32) {
+			binary.LittleEndian.PutUint32(p.tk[:], passkey)
+			p.lr, p.rr = p.tk, p.tk
+			s.prepare(p, next)
+		})
+		return
+	case outOfBand:
+		if err := s.outOfBand(p); err != nil {
+			s.fail(smpOOBNotAvailable)
+			return
+		}
+	}
+	s.prepare(p, next)
+}
+
+// prepare generates the random value, and the key pair of LE Secure
+// Connections, and calls next.
+func (s *smp) prepare(p *pairing, next func()) {
+	var err error
+	if p.lrand, err = smpRand16(); err != nil {
+		s.fail(smpUnspecifiedReason)
+		return
+	}
+	if p.sc && p.key == nil {
+		if p.key, err = ecdh.P256().GenerateKey(rand.Reader); err != nil {
+			s.fail(smpUnspecifiedReason)
+			return
+		}
+	}
+	if p.sc {
+		p.lpk = smpPublicKey(p.key)
+	}
+	next()
+}
+
+// ask calls q, which asks the pairing agent, on its own goroutine, as the
+// agent may block while waiting for the user. Then done is called on the SMP
+// goroutine, unless the pairing has finished meanwhile, for instance with a
+// timeout or a Pairing Failed. The commands received meanwhile are handled
+// after done.
+func (s *smp) ask(p *pairing, q func(), done func()) {
+	p.asking = true
+	go func() {
+		q()
+		s.post(func() {
+			if s.pairing != p {
+				return
+			}
+			p.asking = false
+			done()
+			for s.pairing == p && !p.asking && len(p.deferred) > 0 {
+				b := p.deferred[0]
+				p.deferred = p.deferred[1:]
+				s.handleCommand(b)
+			}
+		})
+	}()
+}
+
+// cancelPrompt tells the pairing agent, if it can be told, that the pairing
+// it is asking the user about has been canceled.
+func (s *smp) cancelPrompt() {
+	if a, ok := s.c.hci.agent.(ble.PairingCanceler); ok {
+		go a.CancelPairing(s.c)
+	}
+}
+
+// authorize asks the pairing agent whether to accept the pairing requested by
+// the remote device, and calls done with the answer. Without an agent,
+// pairing is always accepted.
+func (s *smp) authorize(p *pairing, done func(ok bool)) {
+	a := s.c.hci.agent
+	if a == nil {
+		done(true)
+		return
+	}
+	var ok bool
+	s.ask(p, func() { ok = a.AuthorizePairing(s.c) }, func() { done(ok) })
+}
+
+// passkey calls done with a newly generated passkey to display to the user,
+// or the passkey entered by the user.
+func (s *smp) passkey(p *pairing, display bool, done func(passkey uint32)) {
+	a := s.c.hci.agent
+	if !display {
+		if a == nil {
+			logger.Debug("smp", "passkey", "no means to input passkey")
+			s.fail(smpPasskeyEntryFailed)
+			return
+		}
+		var passkey uint32
+		var err error
+		s.ask(p, func() { passkey, err = a.RequestPasskey(s.c) }, func() {
+			if err != nil || passkey > 999999 {
+				logger.Debug("smp", "passkey", fmt.Sprintf("invalid passkey %d: %v", passkey, err))
+				s.fail(smpPasskeyEntryFailed)
+				return
+			}
+			done(passkey)
+		})
+		return
+	}
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		s.fail(smpPasskeyEntryFailed)
+		return
+	}
+	passkey := binary.LittleEndian.Uint32(b[:]) % 1000000
+	if a == nil {
+		logger.Info("smp", "passkey", fmt.Sprintf("%06d", passkey))
+	} else {
+		go a.DisplayPasskey(s.c, passkey)
+	}
+	done(passkey)
+}
+
+// compare asks the user to confirm that the number displayed on both devices
+// matches, for Numeric Comparison, and calls done if confirmed.
+func (s *smp) compare(p *pairing, n uint32, done func()) {
+	a := s.c.hci.agent
+	if a == nil {
+		logger.Debug("smp", "compare", "no means to confirm numeric comparison")
+		s.fail(smpNumericComparisonFailed)
+		return
+	}
+	var ok bool
+	s.ask(p, func() { ok = a.ConfirmNumericComparison(s.c, n%1000000) }, func() {
+		if !ok {
+			s.fail(smpNumericComparisonFailed)
+			return
+		}
+		done()
+	})
+}
+
+// outOfBand sets up the OOB data of LE Secure Connections [Vol 3, Part H, 2.3.5.6.4].
+// The local key pair must be the one the local OOB data was generated with.
+func (s *smp) outOfBand(p *pairing) error {
+	h := s.c.hci
+	h.muOOB.Lock()
+	defer h.muOOB.Unlock()
+
+	// The remote device indicates whether it has received our OOB data.
+	rflag := p.pres[2]
+	if !p.initiator {
+		rflag = p.preq[2]
+	}
+	if rflag != 0 {
+		if h.oobKey == nil {
+			return errors.New("smp: no local OOB data")
+		}
+		p.key = h.oobKey
+		p.lr = h.oobRand
+	}
+	if d, ok := h.oobRemote[strings.ToLower(s.c.RemoteAddr().String())]; ok {
+		p.rconfirm, p.rr = d.confirm, d.rand
+	}
+	return nil
+}
+
+// confirm returns the confirm value of the random number r.
+func (s *smp) confirm(p *pairing, r [16]byte) [16]byte {
+	lt, la := s.c.localAddress()
+	rt, ra := s.c.param.PeerAddressType(), s.c.param.PeerAddress()
+	if p.initiator {
+		return smpC1(p.tk, r, p.preq, p.pres, lt&0x01, rt&0x01, la, ra)
+	}
+	return smpC1(p.tk, r, p.preq, p.pres, rt&0x01, lt&0x01, ra, la)
+}
+
+func (s *smp) handlePairing(p *pairing, b []byte) {
+	code := b[0]
+	if code != p.expect {
+		// Key distribution commands may arrive in any order.
+		if p.expect != encryptionInformation || code < encryptionInformation || code > signingInformation {
+			s.fail(smpUnspecifiedReason)
+			return
+		}
+	}
+	switch code {
+	case pairingResponse:
+		if len(b) != 7 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		p.pres = append([]byte(nil), b...)
+		s.negotiate(p, func() {
+			if p.sc {
+				p.expect = pairingPublicKey
+				s.send(pairingPublicKey, p.lpk[:]...)
+				return
+			}
+			c := s.confirm(p, p.lrand)
+			p.expect = pairingConfirm
+			s.send(pairingConfirm, c[:]...)
+		})
+
+	case pairingPublicKey, pairingDHKeyCheck:
+		s.handleSC(p, b)
+
+	case pairingConfirm, pairingRandom:
+		if p.sc {
+			s.handleSC(p, b)
+			return
+		}
+		s.handleLegacy(p, b)
+
 	case encryptionInformation:
+		if len(b) != 17 || p.keys.remoteDist&keyDistEnc == 0 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		copy(p.keys.ltk[:], b[1:])
 	case masterIdentification:
+		if len(b) != 11 || p.keys.remoteDist&keyDistEnc == 0 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		p.keys.ediv = binary.LittleEndian.Uint16(b[1:])
+		p.keys.rand = binary.LittleEndian.Uint64(b[3:])
+		s.received(p, keyDistEnc)
 	case identiInformation:
+		if len(b) != 17 || p.keys.remoteDist&keyDistID == 0 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		copy(p.keys.irk[:], b[1:])
 	case identityAddreInformation:
+		if len(b) != 8 || p.keys.remoteDist&keyDistID == 0 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		p.keys.idAddrType = b[1]
+		copy(p.keys.idAddr[:], b[2:])
+		s.received(p, keyDistID)
 	case signingInformation:
-	case securityRequest:
+		if len(b) != 17 || p.keys.remoteDist&keyDistSign == 0 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		copy(p.keys.csrk[:], b[1:])
+		s.received(p, keyDistSign)
+	}
+}
+
+// handleLegacy handles the Pairing Confirm and Pairing Random commands of LE
+// Legacy Pairing [Vol 3, Part H, 2.3.5.5].
+func (s *smp) handleLegacy(p *pairing, b []byte) {
+	if len(b) != 17 {
+		s.fail(smpInvalidParameters)
+		return
+	}
+	switch b[0] {
+	case pairingConfirm:
+		copy(p.rconfirm[:], b[1:])
+		p.expect = pairingRandom
+		if p.initiator {
+			s.send(pairingRandom, p.lrand[:]...)
+			return
+		}
+		c := s.confirm(p, p.lrand)
+		s.send(pairingConfirm, c[:]...)
+
+	case pairingRandom:
+		copy(p.rrand[:], b[1:])
+		if s.confirm(p, p.rrand) != p.rconfirm {
+			s.fail(smpConfirmValueFailed)
+			return
+		}
+		mrand, srand := p.lrand, p.rrand
+		if !p.initiator {
+			mrand, srand = p.rrand, p.lrand
+			s.send(pairingRandom, p.lrand[:]...)
+		}
+		p.stk = smpS1(p.tk, srand, mrand)
+		maskKey(&p.stk, p.keys.keySize)
+		s.encryptPairing(p)
+	}
+}
+
+// handleSC handles the commands of the pairing phase 2 of LE Secure
+// Connections [Vol 3, Part H, 2.3.5.6].
+func (s *smp) handleSC(p *pairing, b []byte) {
+	switch b[0] {
 	case pairingPublicKey:
+		if len(b) != 65 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		copy(p.rpk[:], b[1:])
+		if p.rpk == p.lpk {
+			// Reflected public key.
+			s.fail(smpInvalidParameters)
+			return
+		}
+		dhkey, err := smpDHKey(p.key, p.rpk)
+		if err != nil {
+			// The public key is not a valid point on the curve [Vol 3, Part H, 2.3.5.6.1].
+			s.fail(smpDHKeyCheckFailed)
+			return
+		}
+		p.dhkey = dhkey
+		if !p.initiator {
+			s.send(pairingPublicKey, p.lpk[:]...)
+		}
+		s.authStage1(p)
+
+	case pairingConfirm:
+		if len(b) != 17 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		copy(p.rconfirm[:], b[1:])
+		p.expect = pairingRandom
+		if p.initiator {
+			s.send(pairingRandom, p.lrand[:]...)
+			return
+		}
+		// Passkey Entry: the responder replies with its own commitment.
+		c := smpF4(x(p.lpk), x(p.rpk), p.lrand, passkeyBit(p))
+		s.send(pairingConfirm, c[:]...)
+
+	case pairingRandom:
+		if len(b) != 17 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		copy(p.rrand[:], b[1:])
+		switch p.method {
+		case justWorks, numericComparison:
+			if p.initiator && smpF4(x(p.rpk), x(p.lpk), p.rrand, 0) != p.rconfirm {
+				s.fail(smpConfirmValueFailed)
+				return
+			}
+		case outOfBand:
+			// The commitment of the remote device has been checked in stage 1.
+		default:
+			if smpF4(x(p.rpk), x(p.lpk), p.rrand, passkeyBit(p)) != p.rconfirm {
+				s.fail(smpConfirmValueFailed)
+				return
+			}
+		}
+		if !p.initiator {
+			s.send(pairingRandom, p.lrand[:]...)
+		}
+		if p.method == passkeyRespDisplays || p.method == passkeyInitDisplays || p.method == passkeyBothInput {
+			if p.round++; p.round < scPasskeyRounds {
+				s.passkeyRound(p)
+				return
+			}
+		}
+		if p.method == numericComparison {
+			na, nb := p.lrand, p.rrand
+			pka, pkb := p.lpk, p.rpk
+			if !p.initiator {
+				na, nb = nb, na
+				pka, pkb = pkb, pka
+			}
+			s.compare(p, smpG2(x(pka), x(pkb), na, nb), func() { s.authStage2(p) })
+			return
+		}
+		s.authStage2(p)
+
 	case pairingDHKeyCheck:
-	case pairingKeypress:
+		if len(b) != 17 {
+			s.fail(smpInvalidParameters)
+			return
+		}
+		var e [16]byte
+		copy(e[:], b[1:])
+		if e != s.check(p, false) {
+			s.fail(smpDHKeyCheckFailed)
+			return
+		}
+		if !p.initiator {
+			e := s.check(p, true)
+			s.send(pairingDHKeyCheck, e[:]...)
+		}
+		s.encryptPairing(p)
+	}
+}
+
+// authStage1 starts the authentication stage 1 of LE Secure Connections,
+// once the public keys have been exchanged [Vol 3, Part H, 2.3.5.6.2-4].
+func (s *smp) authStage1(p *pairing) {
+	switch p.method {
+	case justWorks, numericComparison:
+		// The responder commits to its nonce, and the initiator replies
+		// with its own nonce.
+		if p.initiator {
+			p.expect = pairingConfirm
+			return
+		}
+		c := smpF4(x(p.lpk), x(p.rpk), p.lrand, 0)
+		p.expect = pairingRandom
+		s.send(pairingConfirm, c[:]...)
+
+	case outOfBand:
+		// Check the commitment of the remote device, if we have received its
+		// OOB data, and exchange the nonces.
+		if p.rr != ([16]byte{}) && smpF4(x(p.rpk), x(p.rpk), p.rr, 0) != p.rconfirm {
+			s.fail(smpConfirmValueFailed)
+			return
+		}
+		p.expect = pairingRandom
+		if p.initiator {
+			s.send(pairingRandom, p.lrand[:]...)
+		}
+
 	default:
-		// If a packet is received with a reserved Code it shall be ignored. [Vol 3, Part H, 3.3]
-		return nil
+		p.round = 0
+		s.passkeyRound(p)
+	}
+}
+
+// passkeyRound starts a round of the Passkey Entry protocol, in which one
+// bit of the passkey is committed to by both devices [Vol 3, Part H, 2.3.5.6.3].
+func (s *smp) passkeyRound(p *pairing) {
+	var err error
+	if p.lrand, err = smpRand16(); err != nil {
+		s.fail(smpUnspecifiedReason)
+		return
+	}
+	p.expect = pairingConfirm
+	if p.initiator {
+		c := smpF4(x(p.lpk), x(p.rpk), p.lrand, passkeyBit(p))
+		s.send(pairingConfirm, c[:]...)
+	}
+}
+
+// passkeyBit returns the value z of the confirm values of the current round
+// of the Passkey Entry protocol.
+func passkeyBit(p *pairing) uint8 {
+	passkey := binary.LittleEndian.Uint32(p.tk[:])
+	return 0x80 | uint8(passkey>>uint(p.round))&0x01
+}
+
+// authStage2 generates the LTK, and starts the DHKey check [Vol 3, Part H, 2.3.5.6.5].
+func (s *smp) authStage2(p *pairing) {
+	na, nb := p.lrand, p.rrand
+	if !p.initiator {
+		na, nb = nb, na
+	}
+	at, a, bt, b := s.addresses(p)
+	p.macKey, p.stk = smpF5(p.dhkey, na, nb, at, a, bt, b)
+	maskKey(&p.stk, p.keys.keySize)
+	p.keys.ltk, p.keys.localLTK = p.stk, p.stk
+
+	p.expect = pairingDHKeyCheck
+	if p.initiator {
+		e := s.check(p, true)
+		s.send(pairingDHKeyCheck, e[:]...)
+	}
+}
+
+// check returns the DHKey check value of the local device, or the one
+// expected from the remote device.
+func (s *smp) check(p *pairing, local bool) [16]byte {
+	lt, la := s.c.localAddress()
+	rt, ra := s.c.param.PeerAddressType(), s.c.param.PeerAddress()
+	lcmd, rcmd := p.preq, p.pres
+	if !p.initiator {
+		lcmd, rcmd = rcmd, lcmd
+	}
+	var lcap, rcap [3]byte
+	copy(lcap[:], lcmd[1:4])
+	copy(rcap[:], rcmd[1:4])
+	if local {
+		return smpF6(p.macKey, p.lrand, p.rrand, p.rr, lcap, lt, la, rt, ra)
+	}
+	return smpF6(p.macKey, p.rrand, p.lrand, p.lr, rcap, rt, ra, lt, la)
+}
+
+// addresses returns the addresses of the initiator and the responder.
+func (s *smp) addresses(p *pairing) (uint8, [6]byte, uint8, [6]byte) {
+	lt, la := s.c.localAddress()
+	rt, ra := s.c.param.PeerAddressType(), s.c.param.PeerAddress()
+	if p.initiator {
+		return lt, la, rt, ra
+	}
+	return rt, ra, lt, la
+}
+
+// x returns the X coordinate of a public key.
+func x(pk [64]byte) [32]byte {
+	var r [32]byte
+	copy(r[:], pk[0:32])
+	return r
+}
+
+// encryptPairing waits for the link to be encrypted with the key generated by
+// the pairing. The master starts the encryption, and the slave provides the
+// key upon the Long Term Key Request from its controller.
+func (s *smp) encryptPairing(p *pairing) {
+	p.expect = 0
+	s.encKeys = &p.keys
+	if !p.initiator {
+		return
+	}
+	err := s.c.hci.Send(&cmd.LEStartEncryption{
+		ConnectionHandle: s.c.param.ConnectionHandle(),
+		LongTermKey:      p.stk,
+	}, nil)
+	if err != nil {
+		s.finish(errors.Wrap(err, "can't start encryption"))
+	}
+}
+
+// maskKey shortens the key to the negotiated encryption key size by zeroing
+// its most significant octets.
+func maskKey(k *[16]byte, size int) {
+	for i := size; i < len(k); i++ {
+		k[i] = 0
+	}
+}
+
+// pending returns the keys the remote device is yet to distribute.
+func (p *pairing) pending() uint8 {
+	return p.keys.remoteDist &^ p.received
+}
+
+// received records the keys distributed by the remote device, and completes
+// the pairing once all of them have been exchanged.
+func (s *smp) received(p *pairing, dist uint8) {
+	p.received |= dist
+	if p.pending() != 0 {
+		return
+	}
+	if p.initiator {
+		// The responder has distributed all of its keys; it's our turn.
+		if err := s.distribute(p); err != nil {
+			s.finish(err)
+			return
+		}
+	}
+	s.finish(nil)
+}
+
+// encryptionChanged is called when the encryption of the link has changed.
+func (s *smp) encryptionChanged(status uint8, enabled bool) {
+	if s.rekeying {
+		s.rekeying = false
+		if ErrCommand(status) == ErrPINMissing {
+			// The slave has lost the keys of the bond; pair again.
+			s.encrypted(errors.Wrap(ErrCommand(status), "can't encrypt the link"))
+			s.requestPairing()
+			return
+		}
+	}
+	switch {
+	case status != 0x00:
+		s.encrypted(errors.Wrap(ErrCommand(status), "can't encrypt the link"))
+	case !enabled:
+		s.setSecurity(ble.SecurityNone, 0)
+	default:
+		k := s.encKeys
+		if k == nil {
+			// Encrypted with a key we don't know about.
+			k = &smpKeys{keySize: smpMaxKeySize}
+		}
+		if s.pairing == nil && s.encKeys != nil {
+			s.keys = s.encKeys
+		}
+		s.setSecurity(k.level(), k.keySize)
+		s.encrypted(nil)
+	}
+
+	p := s.pairing
+	if p == nil || p.expect != 0 {
+		return
+	}
+	if status != 0x00 || !enabled {
+		s.finish(errors.Wrap(ErrCommand(status), "can't encrypt the link"))
+		return
+	}
+	// Transport Specific Key Distribution [Vol 3, Part H, 3.6.1].
+	// The responder distributes its keys first.
+	p.expect = encryptionInformation
+	if !p.initiator {
+		if err := s.distribute(p); err != nil {
+			s.finish(err)
+			return
+		}
+	}
+	if p.pending() == 0 {
+		if p.initiator {
+			s.received(p, 0)
+			return
+		}
+		s.finish(nil)
+	}
+}
+
+// distribute sends the keys of the local device.
+func (s *smp) distribute(p *pairing) error {
+	k := &p.keys
+	if k.localDist&keyDistEnc != 0 {
+		ltk, err := smpRand16()
+		if err != nil {
+			return err
+		}
+		maskKey(&ltk, k.keySize)
+		r, err := smpRand16()
+		if err != nil {
+			return err
+		}
+		k.localLTK = ltk
+		k.localEDIV = binary.LittleEndian.Uint16(r[0:])
+		k.localRand = binary.LittleEndian.Uint64(r[2:])
+		if err := s.send(encryptionInformation, k.localLTK[:]...); err != nil {
+			return err
+		}
+		if err := s.send(masterIdentification, r[0:10]...); err != nil {
+			return err
+		}
+	}
+	if k.localDist&keyDistID != 0 {
+		irk := s.c.hci.irk
+		if err := s.send(identiInformation, irk[:]...); err != nil {
+			return err
+		}
+		t, a := s.c.hci.identityAddress()
+		if err := s.send(identityAddreInformation, append([]byte{t}, a[:]...)...); err != nil {
+			return err
+		}
+	}
+	if k.localDist&keyDistSign != 0 {
+		csrk, err := smpRand16()
+		if err != nil {
+			return err
+		}
+		k.localCSRK = csrk
+		if err := s.send(signingInformation, csrk[:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// longTermKey replies to the Long Term Key Request of the controller, with
+// the STK during pairing, or with the LTK distributed to the remote master.
+func (s *smp) longTermKey(ediv uint16, rand uint64) {
+	h := s.c.hci
+	handle := s.c.param.ConnectionHandle()
+	if p := s.pairing; p != nil && p.expect == 0 && !p.initiator && ediv == 0 && rand == 0 {
+		s.encKeys = &p.keys
+		h.Send(&cmd.LELongTermKeyRequestReply{ConnectionHandle: handle, LongTermKey: p.stk}, nil)
+		return
+	}
+	if k := s.keys; k != nil && (k.sc || k.localDist&keyDistEnc != 0) && k.localEDIV == ediv && k.localRand == rand {
+		s.encKeys = k
+		h.Send(&cmd.LELongTermKeyRequestReply{ConnectionHandle: handle, LongTermKey: k.localLTK}, nil)
+		return
+	}
+	if h.bonds != nil {
+		b, err := h.bonds.Find(s.c.RemoteAddr())
+		if err == nil && !b.LocalLTK.IsZero() && b.LocalEDIV == ediv && b.LocalRand == rand {
+			s.encKeys = keysFromBond(b)
+			h.Send(&cmd.LELongTermKeyRequestReply{ConnectionHandle: handle, LongTermKey: b.LocalLTK}, nil)
+			return
+		}
+	}
+	h.Send(&cmd.LELongTermKeyRequestNegativeReply{ConnectionHandle: handle}, nil)
+}
+
+// saveBond saves the keys of a pairing to the bond store, if any.
+func (s *smp) saveBond(k *smpKeys) {
+	h := s.c.hci
+	if h.bonds == nil {
+		return
+	}
+	b := &ble.Bond{
+		Address:           s.c.RemoteAddr().String(),
+		AddressType:       s.c.param.PeerAddressType() & 0x01,
+		IRK:               k.irk,
+		CSRK:              k.csrk,
+		LocalCSRK:         k.localCSRK,
+		KeySize:           k.keySize,
+		Authenticated:     k.authenticated,
+		SecureConnections: k.sc,
 	}
-	// FIXME: work aound to the lack of SMP implementation - always return non-supported.
-	// C.5.1 Pairing Not Supported by Slave
-	return c.sendSMP([]byte{pairingFailed, 0x05})
+	if k.remoteDist&keyDistID != 0 {
+		a := k.idAddr
+		b.Address = net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]}).String()
+		b.AddressType = k.idAddrType
+	}
+	if k.sc || k.remoteDist&keyDistEnc != 0 {
+		b.LTK, b.EDIV, b.Rand = k.ltk, k.ediv, k.rand
+	}
+	if k.sc || k.localDist&keyDistEnc != 0 {
+		b.LocalLTK, b.LocalEDIV, b.LocalRand = k.localLTK, k.localEDIV, k.localRand
+	}
+	if err := h.bonds.Save(b); err != nil {
+		_ = logger.Error("smp: can't save bond", "err", err)
+	}
+	if err := h.ReloadBonds(); err != nil {
+		_ = logger.Error("smp: can't reload bonds", "err", err)
+	}
+}
+
+// oobData is the OOB data of LE Secure Connections [Vol 3, Part H, 2.3.5.6.4].
+type oobData struct {
+	confirm [16]byte
+	rand    [16]byte
+}
+
+// LocalOOBData generates a new key pair for LE Secure Connections, and returns
+// the confirm and random values to be sent out of band to the remote devices.
+// The values are in wire (little-endian) order, as carried by the LE Secure
+// Connections Confirmation Value and Random Value AD types.
+// The key pair is used for all the subsequent pairings until the next call.
+func (h *HCI) LocalOOBData() (confirm, random [16]byte, err error) {
+	k, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return confirm, random, err
+	}
+	if random, err = smpRand16(); err != nil {
+		return confirm, random, err
+	}
+	pk := smpPublicKey(k)
+	confirm = smpF4(x(pk), x(pk), random, 0)
+
+	h.muOOB.Lock()
+	h.oobKey, h.oobRand = k, random
+	h.muOOB.Unlock()
+	return confirm, random, nil
+}
+
+// SetRemoteOOBData sets the confirm and random values received out of band
+// from the remote device a, in wire (little-endian) order, to be used by LE
+// Secure Connections pairings with it.
+func (h *HCI) SetRemoteOOBData(a ble.Addr, confirm, random [16]byte) {
+	h.muOOB.Lock()
+	defer h.muOOB.Unlock()
+	h.oobRemote[strings.ToLower(a.String())] = oobData{confirm: confirm, rand: random}
+}
+
+func (c *Conn) sendSMP(p pdu) error {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := binary.Write(buf, binary.LittleEndian, uint16(len(p))); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, cidSMP); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, p); err != nil {
+		return err
+	}
+	_, err := c.writePDU(buf.Bytes())
+	logger.Debug("smp", "send", fmt.Sprintf("[%X]", buf.Bytes()))
+	return err
+}
+
+func (c *Conn) handleSMP(p pdu) error {
+	c.smp.post(func() { c.smp.handle(p) })
+	return nil
+}
+
+// Encrypt encrypts the link, and returns when it's encrypted. As a master, it
+// starts the encryption with the LTK of the bonded slave, and fails with
+// ble.ErrNotBonded if there is none. As a slave, it sends a Security Request,
+// asking the master to encrypt the link or to pair [Vol 3, Part H, 2.4.6].
+func (c *Conn) Encrypt(ctx context.Context) error {
+	ch := make(chan error, 1)
+	if !c.smp.post(func() { c.smp.encrypt(ch) }) {
+		return errors.Wrap(io.ErrClosedPipe, "connection closed")
+	}
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SecurityLevel returns the current security level of the link.
+func (c *Conn) SecurityLevel() ble.SecurityLevel { return c.smp.securityLevel() }
+
+// KeySize returns the encryption key size in octets, or 0 if the link is not encrypted.
+func (c *Conn) KeySize() int {
+	c.smp.mu.Lock()
+	defer c.smp.mu.Unlock()
+	return c.smp.keySize
+}
+
+// SetSecurityHandler sets the handler, which is called when the security level
+// or the key size of the link changes. The handler is called from the Security
+// Manager of the connection, and should not block.
+func (c *Conn) SetSecurityHandler(h ble.SecurityHandler) {
+	c.smp.mu.Lock()
+	defer c.smp.mu.Unlock()
+	c.smp.handler = h
+}
+
+// Pair initiates pairing with the remote device, and waits for it to complete
+// [Vol 3, Part H, 2.4]. As a master, it sends a Pairing Request. As a slave,
+// it sends a Security Request, asking the remote master to start the pairing.
+// If the remote device has already started a pairing, Pair waits for its result.
+func (c *Conn) Pair(ctx context.Context) error {
+	return c.smp.pair(ctx)
 }
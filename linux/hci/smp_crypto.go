@@ -0,0 +1,265 @@
+package hci
+
+import (
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// The cryptographic toolbox of the Security Manager [Vol 3, Part H, 2.2].
+//
+// The specification describes the functions with the most significant octet
+// first, while keys, random numbers and confirm values are transmitted (over
+// SMP and HCI) with the least significant octet first. All the values handled
+// here are kept in the wire (little-endian) order, and are only swapped around
+// the AES block cipher.
+
+// swap returns a copy of b with the order of octets reversed.
+func swap(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// smpE implements the security function e, AES-128 [Vol 3, Part H, 2.2.1].
+func smpE(key, plaintext [16]byte) [16]byte {
+	blk, err := aes.NewCipher(swap(key[:]))
+	if err != nil {
+		// Unreachable; the key size is always valid.
+		panic(err)
+	}
+	var out [16]byte
+	blk.Encrypt(out[:], swap(plaintext[:]))
+	copy(out[:], swap(out[:]))
+	return out
+}
+
+func xor16(a, b [16]byte) [16]byte {
+	var r [16]byte
+	for i := range r {
+		r[i] = a[i] ^ b[i]
+	}
+	return r
+}
+
+// smpC1 implements the confirm value generation function c1 for LE Legacy
+// Pairing [Vol 3, Part H, 2.2.3].
+// preq and pres are the 7-octet Pairing Request and Pairing Response commands,
+// including the opcode. ia and ra are the initiating and responding device
+// addresses, and iat and rat are their address types.
+func smpC1(k, r [16]byte, preq, pres []byte, iat, rat uint8, ia, ra [6]byte) [16]byte {
+	var p1, p2 [16]byte
+	p1[0] = iat
+	p1[1] = rat
+	copy(p1[2:9], preq)
+	copy(p1[9:16], pres)
+	copy(p2[0:6], ra[:])
+	copy(p2[6:12], ia[:])
+	return smpE(k, xor16(smpE(k, xor16(r, p1)), p2))
+}
+
+// smpS1 implements the key generation function s1 for LE Legacy Pairing
+// [Vol 3, Part H, 2.2.4]. r1 is the responder's random number (Srand), and
+// r2 is the initiator's (Mrand).
+func smpS1(k, r1, r2 [16]byte) [16]byte {
+	var r [16]byte
+	copy(r[0:8], r2[0:8])
+	copy(r[8:16], r1[0:8])
+	return smpE(k, r)
+}
+
+// aesCMAC implements the AES-CMAC function [RFC 4493], which is used by the
+// functions of LE Secure Connections [Vol 3, Part H, 2.2.5].
+// Unlike the other functions here, k and m are in the order of the RFC, with
+// the most significant octet first, and so is the returned MAC.
+func aesCMAC(k, m []byte) [16]byte {
+	blk, err := aes.NewCipher(k)
+	if err != nil {
+		// Unreachable; the key size is always valid.
+		panic(err)
+	}
+
+	// Generate the subkeys K1 and K2.
+	var l, k1, k2 [16]byte
+	blk.Encrypt(l[:], l[:])
+	shift1(&k1, l)
+	shift1(&k2, k1)
+
+	n := (len(m) + 15) / 16
+	var last [16]byte
+	if n > 0 && len(m)%16 == 0 {
+		copy(last[:], m[(n-1)*16:])
+		last = xor16(last, k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rem := m[(n-1)*16:]
+		copy(last[:], rem)
+		last[len(rem)] = 0x80
+		last = xor16(last, k2)
+	}
+
+	var x, y [16]byte
+	for i := 0; i < n-1; i++ {
+		copy(y[:], m[i*16:(i+1)*16])
+		y = xor16(x, y)
+		blk.Encrypt(x[:], y[:])
+	}
+	y = xor16(x, last)
+	blk.Encrypt(x[:], y[:])
+	return x
+}
+
+// shift1 generates a CMAC subkey from k [RFC 4493, 2.3].
+func shift1(dst *[16]byte, k [16]byte) {
+	var carry byte
+	for i := 15; i >= 0; i-- {
+		dst[i] = k[i]<<1 | carry
+		carry = k[i] >> 7
+	}
+	if carry != 0 {
+		dst[15] ^= 0x87
+	}
+}
+
+// smpF4 implements the confirm value generation function f4 for LE Secure
+// Connections [Vol 3, Part H, 2.2.6]. u and v are the X coordinates of the
+// public keys.
+func smpF4(u, v [32]byte, x [16]byte, z uint8) [16]byte {
+	m := make([]byte, 0, 65)
+	m = append(m, swap(u[:])...)
+	m = append(m, swap(v[:])...)
+	m = append(m, z)
+	out := aesCMAC(swap(x[:]), m)
+	copy(out[:], swap(out[:]))
+	return out
+}
+
+// smpSalt is the SALT of f5 [Vol 3, Part H, 2.2.7], most significant octet first.
+var smpSalt = []byte{
+	0x6C, 0x88, 0x83, 0x91, 0xAA, 0xF5, 0xA5, 0x38,
+	0x60, 0x37, 0x0B, 0xDB, 0x5A, 0x60, 0x83, 0xBE,
+}
+
+// smpF5 implements the key generation function f5 for LE Secure Connections
+// [Vol 3, Part H, 2.2.7]. w is the DHKey, n1 and n2 are the nonces of the
+// initiator and the responder, and a1 and a2 their addresses, with a1t and
+// a2t the address types.
+func smpF5(w [32]byte, n1, n2 [16]byte, a1t uint8, a1 [6]byte, a2t uint8, a2 [6]byte) (macKey, ltk [16]byte) {
+	t := aesCMAC(smpSalt, swap(w[:]))
+
+	m := make([]byte, 0, 53)
+	m = append(m, 0x00)                   // Counter
+	m = append(m, 0x62, 0x74, 0x6C, 0x65) // keyID "btle"
+	m = append(m, swap(n1[:])...)
+	m = append(m, swap(n2[:])...)
+	m = append(m, a1t&0x01)
+	m = append(m, swap(a1[:])...)
+	m = append(m, a2t&0x01)
+	m = append(m, swap(a2[:])...)
+	m = append(m, 0x01, 0x00) // Length: 256
+
+	macKey = aesCMAC(t[:], m)
+	m[0] = 0x01
+	ltk = aesCMAC(t[:], m)
+	copy(macKey[:], swap(macKey[:]))
+	copy(ltk[:], swap(ltk[:]))
+	return macKey, ltk
+}
+
+// smpF6 implements the check value generation function f6 for LE Secure
+// Connections [Vol 3, Part H, 2.2.8]. ioCap holds the IO Capability, OOB data
+// flag and AuthReq fields, as in the Pairing Request and Pairing Response.
+func smpF6(w, n1, n2, r [16]byte, ioCap [3]byte, a1t uint8, a1 [6]byte, a2t uint8, a2 [6]byte) [16]byte {
+	m := make([]byte, 0, 65)
+	m = append(m, swap(n1[:])...)
+	m = append(m, swap(n2[:])...)
+	m = append(m, swap(r[:])...)
+	m = append(m, swap(ioCap[:])...)
+	m = append(m, a1t&0x01)
+	m = append(m, swap(a1[:])...)
+	m = append(m, a2t&0x01)
+	m = append(m, swap(a2[:])...)
+	out := aesCMAC(swap(w[:]), m)
+	copy(out[:], swap(out[:]))
+	return out
+}
+
+// smpG2 implements the numeric comparison value generation function g2 for
+// LE Secure Connections [Vol 3, Part H, 2.2.9]. The returned value is to be
+// displayed as the six least significant decimal digits.
+func smpG2(u, v [32]byte, x, y [16]byte) uint32 {
+	m := make([]byte, 0, 80)
+	m = append(m, swap(u[:])...)
+	m = append(m, swap(v[:])...)
+	m = append(m, swap(y[:])...)
+	out := aesCMAC(swap(x[:]), m)
+	return binary.BigEndian.Uint32(out[12:])
+}
+
+// smpPublicKey returns the public key of k in the format of the Pairing
+// Public Key command: X and Y coordinates, least significant octet first.
+func smpPublicKey(k *ecdh.PrivateKey) [64]byte {
+	b := k.PublicKey().Bytes() // 0x04 || X || Y, most significant octet first.
+	var pk [64]byte
+	copy(pk[0:32], swap(b[1:33]))
+	copy(pk[32:64], swap(b[33:65]))
+	return pk
+}
+
+// smpDHKey computes the DHKey of the local private key and the remote public
+// key, in the format of the Pairing Public Key command. It fails if the
+// remote public key is not a valid point on the P-256 curve.
+func smpDHKey(k *ecdh.PrivateKey, pk [64]byte) ([32]byte, error) {
+	b := make([]byte, 0, 65)
+	b = append(b, 0x04)
+	b = append(b, swap(pk[0:32])...)
+	b = append(b, swap(pk[32:64])...)
+	var dhkey [32]byte
+	rpk, err := ecdh.P256().NewPublicKey(b)
+	if err != nil {
+		return dhkey, err
+	}
+	s, err := k.ECDH(rpk)
+	if err != nil {
+		return dhkey, err
+	}
+	copy(dhkey[:], swap(s))
+	return dhkey, nil
+}
+
+// smpAh implements the random address hash function ah [Vol 3, Part H, 2.2.2].
+// r is the 24-bit prand of a Resolvable Private Address, and the returned
+// value is its 24-bit hash.
+func smpAh(k [16]byte, r [3]byte) [3]byte {
+	var rp [16]byte
+	copy(rp[:], r[:])
+	e := smpE(k, rp)
+	return [3]byte{e[0], e[1], e[2]}
+}
+
+// smpSign implements the data signing algorithm [Vol 3, Part H, 2.4.5]. It
+// returns the signature of m, which consists of the sign counter followed by
+// the 64 most significant bits of the MAC, in wire order.
+func smpSign(csrk [16]byte, m []byte, cnt uint32) [12]byte {
+	b := make([]byte, len(m)+4)
+	copy(b, m)
+	binary.LittleEndian.PutUint32(b[len(m):], cnt)
+	mac := aesCMAC(swap(csrk[:]), swap(b))
+
+	var sig [12]byte
+	binary.LittleEndian.PutUint32(sig[:], cnt)
+	copy(sig[4:], swap(mac[:8]))
+	return sig
+}
+
+// smpRand16 returns a 128-bit random number.
+func smpRand16() ([16]byte, error) {
+	var r [16]byte
+	_, err := rand.Read(r[:])
+	return r, err
+}
@@ -0,0 +1,226 @@
+package hci
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// le decodes a value written most significant octet first, as in the
+// specification, into wire (little-endian) order.
+func le(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return swap(b)
+}
+
+func le16(t *testing.T, s string) [16]byte {
+	var r [16]byte
+	copy(r[:], le(t, s))
+	return r
+}
+
+func le6(t *testing.T, s string) [6]byte {
+	var r [6]byte
+	copy(r[:], le(t, s))
+	return r
+}
+
+// Sample data of c1 [Vol 3, Part H, 2.2.3].
+func TestSMPC1(t *testing.T) {
+	k := [16]byte{}
+	r := le16(t, "5783D52156AD6F0E6388274EC6702EE0")
+	preq := le(t, "07071000000101")
+	pres := le(t, "05000800000302")
+	ia := le6(t, "A1A2A3A4A5A6")
+	ra := le6(t, "B1B2B3B4B5B6")
+
+	want := le16(t, "1E1E3FEF878988EAD2A74DC5BEF13B86")
+	if got := smpC1(k, r, preq, pres, 0x01, 0x00, ia, ra); got != want {
+		t.Errorf("c1 = %X, want %X", swap(got[:]), swap(want[:]))
+	}
+}
+
+// Sample data of s1 [Vol 3, Part H, 2.2.4].
+func TestSMPS1(t *testing.T) {
+	k := [16]byte{}
+	r1 := le16(t, "000F0E0D0C0B0A091122334455667788")
+	r2 := le16(t, "010203040506070899AABBCCDDEEFF00")
+
+	want := le16(t, "9A1FE1F0E8B0F49B5B4216AE796DA062")
+	if got := smpS1(k, r1, r2); got != want {
+		t.Errorf("s1 = %X, want %X", swap(got[:]), swap(want[:]))
+	}
+}
+
+func le32(t *testing.T, s string) [32]byte {
+	var r [32]byte
+	copy(r[:], le(t, s))
+	return r
+}
+
+// Sample data of ah [Vol 3, Part H, D.7].
+func TestSMPAh(t *testing.T) {
+	irk := le16(t, "EC0234A357C8AD05341010A60A397D9B")
+	var r, want [3]byte
+	copy(r[:], le(t, "708194"))
+	copy(want[:], le(t, "0DFBAA"))
+	if got := smpAh(irk, r); got != want {
+		t.Errorf("ah = %X, want %X", swap(got[:]), swap(want[:]))
+	}
+}
+
+// Sample data of AES-CMAC [Vol 3, Part H, D.1], with the sign counter as the
+// first 4 octets of M, which is signed as m || SignCounter [Vol 3, Part H, 2.4.5].
+func TestSMPSign(t *testing.T) {
+	csrk := le16(t, "2B7E151628AED2A6ABF7158809CF4F3C")
+	for _, tc := range []struct {
+		m   string
+		mac string
+	}{
+		{
+			"6BC1BEE22E409F96E93D7E117393172A",
+			"070A16B46B4D4144F79BDD9DD04A287C",
+		},
+		{
+			"6BC1BEE22E409F96E93D7E117393172A" +
+				"AE2D8A571E03AC9C9EB76FAC45AF8E51" +
+				"30C81C46A35CE411",
+			"DFA66747DE9AE63030CA32611497C827",
+		},
+		{
+			"6BC1BEE22E409F96E93D7E117393172A" +
+				"AE2D8A571E03AC9C9EB76FAC45AF8E51" +
+				"30C81C46A35CE411E5FBC1191A0A52EF" +
+				"F69F2445DF4F9B17AD2B417BE66C3710",
+			"51F0BEBF7E3B9D92FC49741779363CFE",
+		},
+	} {
+		m := le(t, tc.m[8:])
+		cnt := binary.LittleEndian.Uint32(le(t, tc.m[:8]))
+
+		// The signature is the sign counter, and the 64 most significant
+		// bits of the MAC, in little-endian order.
+		var want [12]byte
+		binary.LittleEndian.PutUint32(want[:], cnt)
+		copy(want[4:], le(t, tc.mac[:16]))
+		if got := smpSign(csrk, m, cnt); got != want {
+			t.Errorf("signature of %d octets = % X, want % X", len(m), got, want)
+		}
+	}
+}
+
+// Examples of AES-CMAC [RFC 4493, 4].
+func TestAESCMAC(t *testing.T) {
+	k, _ := hex.DecodeString("2B7E151628AED2A6ABF7158809CF4F3C")
+	m, _ := hex.DecodeString("6BC1BEE22E409F96E93D7E117393172A" +
+		"AE2D8A571E03AC9C9EB76FAC45AF8E51" +
+		"30C81C46A35CE411E5FBC1191A0A52EF" +
+		"F69F2445DF4F9B17AD2B417BE66C3710")
+	for _, tc := range []struct {
+		n    int
+		want string
+	}{
+		{0, "BB1D6929E95937287FA37D129B756746"},
+		{16, "070A16B46B4D4144F79BDD9DD04A287C"},
+		{40, "DFA66747DE9AE63030CA32611497C827"},
+		{64, "51F0BEBF7E3B9D92FC49741779363CFE"},
+	} {
+		got := aesCMAC(k, m[:tc.n])
+		if s := hex.EncodeToString(got[:]); s != strings.ToLower(tc.want) {
+			t.Errorf("AES-CMAC(%d octets) = %s, want %s", tc.n, s, tc.want)
+		}
+	}
+}
+
+// Sample data of f4 [Vol 3, Part H, D.2].
+func TestSMPF4(t *testing.T) {
+	u := le32(t, "20B003D2F297BE2C5E2C83A7E9F9A5B9EFF49111ACF4FDDBCC0301480E359DE6")
+	v := le32(t, "55188B3D32F6BB9A900AFCFBEED4E72A59CB9AC2F19D7CFB6B4FDD49F47FC5FD")
+	x := le16(t, "D5CB8454D177733EFFFFB2EC712BAEAB")
+
+	want := le16(t, "F2C916F107A9BD1CF1EDA1BEA974872D")
+	if got := smpF4(u, v, x, 0x00); got != want {
+		t.Errorf("f4 = %X, want %X", swap(got[:]), swap(want[:]))
+	}
+}
+
+// Sample data of f5 [Vol 3, Part H, D.3].
+func TestSMPF5(t *testing.T) {
+	w := le32(t, "EC0234A357C8AD05341010A60A397D9B99796B13B4F866F1868D34F373BFA698")
+	n1 := le16(t, "D5CB8454D177733EFFFFB2EC712BAEAB")
+	n2 := le16(t, "A6E8E7CC25A75F6E216583F7FF3DC4CF")
+	a1 := le6(t, "56123737BFCE")
+	a2 := le6(t, "A713702DCFC1")
+
+	wantMacKey := le16(t, "2965F176A1084A02FD3F6A20CE636E20")
+	wantLTK := le16(t, "6986791169D7CD23980522B594750A38")
+	macKey, ltk := smpF5(w, n1, n2, 0x00, a1, 0x00, a2)
+	if macKey != wantMacKey {
+		t.Errorf("f5 MacKey = %X, want %X", swap(macKey[:]), swap(wantMacKey[:]))
+	}
+	if ltk != wantLTK {
+		t.Errorf("f5 LTK = %X, want %X", swap(ltk[:]), swap(wantLTK[:]))
+	}
+}
+
+// Sample data of f6 [Vol 3, Part H, D.4].
+func TestSMPF6(t *testing.T) {
+	w := le16(t, "2965F176A1084A02FD3F6A20CE636E20")
+	n1 := le16(t, "D5CB8454D177733EFFFFB2EC712BAEAB")
+	n2 := le16(t, "A6E8E7CC25A75F6E216583F7FF3DC4CF")
+	r := le16(t, "12A3343BB453BB5408DA42D20C2D0FC8")
+	var ioCap [3]byte
+	copy(ioCap[:], le(t, "010102"))
+	a1 := le6(t, "56123737BFCE")
+	a2 := le6(t, "A713702DCFC1")
+
+	want := le16(t, "E3C473989CD0E8C5D26C0B09DA958F61")
+	if got := smpF6(w, n1, n2, r, ioCap, 0x00, a1, 0x00, a2); got != want {
+		t.Errorf("f6 = %X, want %X", swap(got[:]), swap(want[:]))
+	}
+}
+
+// Sample data of g2 [Vol 3, Part H, D.5].
+func TestSMPG2(t *testing.T) {
+	u := le32(t, "20B003D2F297BE2C5E2C83A7E9F9A5B9EFF49111ACF4FDDBCC0301480E359DE6")
+	v := le32(t, "55188B3D32F6BB9A900AFCFBEED4E72A59CB9AC2F19D7CFB6B4FDD49F47FC5FD")
+	x := le16(t, "D5CB8454D177733EFFFFB2EC712BAEAB")
+	y := le16(t, "A6E8E7CC25A75F6E216583F7FF3DC4CF")
+
+	if got, want := smpG2(u, v, x, y), uint32(0x2F9ED5BA); got != want {
+		t.Errorf("g2 = %08X, want %08X", got, want)
+	}
+}
+
+// The debug key pair of LE Secure Connections [Vol 3, Part H, 2.3.5.6.1].
+func TestSMPDebugKey(t *testing.T) {
+	priv, _ := hex.DecodeString("3F49F6D4A3C55F3874C9B3E3D2103F504AFF607BEB40B7995899B8A6CD3C1ABD")
+	k, err := ecdh.P256().NewPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := le32(t, "20B003D2F297BE2C5E2C83A7E9F9A5B9EFF49111ACF4FDDBCC0301480E359DE6")
+	pk := smpPublicKey(k)
+	if !bytes.Equal(pk[0:32], want[:]) {
+		t.Errorf("public key X = %X, want %X", swap(pk[0:32]), swap(want[:]))
+	}
+	want = le32(t, "DC809C49652AEB6D63329ABF5A52155C766345C28FED3024741C8ED01589D28B")
+	if !bytes.Equal(pk[32:64], want[:]) {
+		t.Errorf("public key Y = %X, want %X", swap(pk[32:64]), swap(want[:]))
+	}
+
+	// Public keys which are not on the curve are rejected.
+	if _, err := smpDHKey(k, pk); err != nil {
+		t.Errorf("DHKey: %v", err)
+	}
+	pk[0] ^= 0x01
+	if _, err := smpDHKey(k, pk); err == nil {
+		t.Errorf("DHKey of an invalid public key succeeded")
+	}
+}
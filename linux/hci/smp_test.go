@@ -0,0 +1,501 @@
+package hci
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/trustasia-com/ble"
+	"github.com/trustasia-com/ble/linux/hci/cmd"
+	"github.com/trustasia-com/ble/linux/hci/evt"
+)
+
+// testSocket is the HCI socket of a controller, which completes the commands
+// at once. The commands are passed to cmd, and the ACL data to acl. If rp is
+// set, it returns the return parameters of the commands other than status.
+type testSocket struct {
+	h   *HCI
+	cmd func(op int, b []byte)
+	acl func(b []byte)
+	rp  func(op int) []byte
+}
+
+func (s *testSocket) Read(b []byte) (int, error) { return 0, io.EOF }
+func (s *testSocket) Close() error               { return nil }
+
+func (s *testSocket) Write(b []byte) (int, error) {
+	b = append([]byte(nil), b...)
+	switch b[0] {
+	case pktTypeCommand:
+		op := int(binary.LittleEndian.Uint16(b[1:]))
+		s.h.muSent.Lock()
+		p := s.h.sent[op]
+		s.h.muSent.Unlock()
+		rp := []byte{0x00}
+		if s.rp != nil {
+			rp = append(rp, s.rp(op)...)
+		}
+		go func() { p.done <- rp }()
+		// The controller allows another command, as Command Complete does.
+		s.h.setAllowedCommands(1)
+		s.cmd(op, b[4:])
+	case pktTypeACLData:
+		// The ACL and the L2CAP headers precede the data.
+		s.acl(b[9:])
+	}
+	return len(b), nil
+}
+
+// testCmd is an HCI command sent by an smpPeer.
+type testCmd struct {
+	op int
+	b  []byte
+}
+
+// smpPeer is one end of a connection, whose SMP commands and HCI commands
+// are passed to the test, unless it's linked to the other end.
+type smpPeer struct {
+	h    *HCI
+	c    *Conn
+	pdus chan []byte
+	cmds chan testCmd
+}
+
+// newSMPPeer returns an end of the connection with the handle 0x0040 in the
+// role, between the public addresses local and remote in wire order.
+func newSMPPeer(t *testing.T, role uint8, local, remote [6]byte) *smpPeer {
+	h, err := NewHCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.addr = net.HardwareAddr{local[5], local[4], local[3], local[2], local[1], local[0]}
+	h.pool = NewPool(128, 4)
+	h.setAllowedCommands(16)
+	h.bonds = ble.NewMemoryBondStore()
+
+	p := &smpPeer{h: h, pdus: make(chan []byte, 64), cmds: make(chan testCmd, 16)}
+	h.skt = &testSocket{
+		h:   h,
+		cmd: func(op int, b []byte) { p.cmds <- testCmd{op, b} },
+		acl: func(b []byte) {
+			p.c.txBuffer.Put()
+			p.pdus <- b
+		},
+	}
+	e := []byte{evt.LEConnectionCompleteSubCode, 0x00, 0x40, 0x00, role, 0x00}
+	e = append(e, remote[:]...)
+	e = append(e, 0x18, 0x00, 0x00, 0x00, 0x90, 0x01, 0x00)
+	p.c = newConn(h, evt.LEConnectionComplete(e))
+	t.Cleanup(func() { close(p.c.chInPkt) })
+	return p
+}
+
+// recv passes an SMP command from the remote device.
+func (p *smpPeer) recv(code uint8, data ...byte) {
+	p.c.handleSMP(kFrame(cidSMP, -1, append([]byte{code}, data...)))
+}
+
+// expect returns the next SMP command, which must have the code.
+func (p *smpPeer) expect(t *testing.T, code uint8) []byte {
+	t.Helper()
+	select {
+	case b := <-p.pdus:
+		if b[0] != code {
+			t.Fatalf("sent SMP command %X, want code 0x%02X", b, code)
+		}
+		return b
+	case <-time.After(time.Second):
+		t.Fatalf("no SMP command 0x%02X sent", code)
+	}
+	return nil
+}
+
+// expectCmd returns the parameters of the next HCI command, which must have
+// the opcode.
+func (p *smpPeer) expectCmd(t *testing.T, c Command) []byte {
+	t.Helper()
+	select {
+	case tc := <-p.cmds:
+		if tc.op != c.OpCode() {
+			t.Fatalf("sent HCI command 0x%04X, want 0x%04X", tc.op, c.OpCode())
+		}
+		return tc.b
+	case <-time.After(time.Second):
+		t.Fatalf("no HCI command 0x%04X sent", c.OpCode())
+	}
+	return nil
+}
+
+// idle checks that no SMP command is sent.
+func (p *smpPeer) idle(t *testing.T) {
+	t.Helper()
+	p.sync()
+	select {
+	case b := <-p.pdus:
+		t.Fatalf("sent SMP command %X, want none", b)
+	default:
+	}
+}
+
+// sync waits for the SMP events posted so far to be handled.
+func (p *smpPeer) sync() {
+	done := make(chan struct{})
+	p.c.smp.post(func() { close(done) })
+	<-done
+}
+
+// encrypt reports the link encrypted, as the controller does.
+func (p *smpPeer) encrypt(status uint8, enabled bool) {
+	p.c.smp.post(func() { p.c.smp.encryptionChanged(status, enabled) })
+}
+
+// link passes the SMP commands of the master m and the slave s to each other,
+// and encrypts the link, if both have the same LTK.
+func link(m, s *smpPeer) {
+	m.h.skt.(*testSocket).acl = func(b []byte) {
+		m.c.txBuffer.Put()
+		s.c.handleSMP(kFrame(cidSMP, -1, b))
+	}
+	s.h.skt.(*testSocket).acl = func(b []byte) {
+		s.c.txBuffer.Put()
+		m.c.handleSMP(kFrame(cidSMP, -1, b))
+	}
+	var ltk []byte
+	m.h.skt.(*testSocket).cmd = func(op int, b []byte) {
+		if op == (&cmd.LEStartEncryption{}).OpCode() {
+			// Connection_Handle, Random_Number, Encrypted_Diversifier, Long_Term_Key
+			ltk = b[12:28]
+			ediv, rand := binary.LittleEndian.Uint16(b[10:]), binary.LittleEndian.Uint64(b[2:])
+			s.c.smp.post(func() { s.c.smp.longTermKey(ediv, rand) })
+		}
+	}
+	s.h.skt.(*testSocket).cmd = func(op int, b []byte) {
+		switch op {
+		case (&cmd.LELongTermKeyRequestReply{}).OpCode():
+			if bytes.Equal(b[2:18], ltk) {
+				m.encrypt(0x00, true)
+				s.encrypt(0x00, true)
+				return
+			}
+			m.encrypt(uint8(ErrMIC), false)
+		case (&cmd.LELongTermKeyRequestNegativeReply{}).OpCode():
+			m.encrypt(uint8(ErrPINMissing), false)
+		}
+	}
+}
+
+// testAgent answers the pairing prompts.
+type testAgent struct {
+	passkey  uint32
+	compared chan uint32
+}
+
+func (a *testAgent) AuthorizePairing(c ble.Conn) bool          { return true }
+func (a *testAgent) DisplayPasskey(c ble.Conn, passkey uint32) {}
+func (a *testAgent) RequestPasskey(c ble.Conn) (uint32, error) { return a.passkey, nil }
+func (a *testAgent) ConfirmNumericComparison(c ble.Conn, n uint32) bool {
+	a.compared <- n
+	return true
+}
+
+var (
+	smpMasterAddr = [6]byte{0x66, 0x55, 0x44, 0x33, 0x22, 0x11}
+	smpSlaveAddr  = [6]byte{0xB6, 0xB5, 0xB4, 0xB3, 0xB2, 0xB1}
+)
+
+// legacyPairing pairs the slave s with a master, which is scripted by the
+// test, up to the encryption of the link with the STK. It returns the STK,
+// which is computed with the passkey of the master.
+func legacyPairing(t *testing.T, s *smpPeer, preq []byte, passkey uint32) (stk [16]byte, ok bool) {
+	t.Helper()
+	s.recv(preq[0], preq[1:]...)
+	pres := s.expect(t, pairingResponse)
+	if pres[3]&authReqSC == 0 || preq[3]&authReqSC != 0 {
+		t.Fatalf("Pairing Response %X to %X isn't for LE Legacy Pairing", pres, preq)
+	}
+
+	var tk [16]byte
+	binary.LittleEndian.PutUint32(tk[:], passkey)
+	mrand, _ := smpRand16()
+	mconfirm := smpC1(tk, mrand, preq, pres, 0x00, 0x00, smpMasterAddr, smpSlaveAddr)
+	s.recv(pairingConfirm, mconfirm[:]...)
+	sconfirm := s.expect(t, pairingConfirm)
+	s.recv(pairingRandom, mrand[:]...)
+	b := <-s.pdus
+	if b[0] == pairingFailed {
+		return stk, false
+	}
+	if b[0] != pairingRandom {
+		t.Fatalf("sent SMP command %X, want Pairing Random", b)
+	}
+	var srand [16]byte
+	copy(srand[:], b[1:])
+	if c := smpC1(tk, srand, preq, pres, 0x00, 0x00, smpMasterAddr, smpSlaveAddr); !bytes.Equal(c[:], sconfirm[1:]) {
+		t.Fatalf("slave confirm %X, want %X", sconfirm[1:], c)
+	}
+	return smpS1(tk, srand, mrand), true
+}
+
+func TestSMPLegacyJustWorks(t *testing.T) {
+	s := newSMPPeer(t, roleSlave, smpSlaveAddr, smpMasterAddr)
+	dist := uint8(keyDistEnc | keyDistID | keyDistSign)
+	preq := []byte{pairingRequest, ioCapNoInputNoOutput, 0x00, authReqBonding, 16, dist, dist}
+	stk, ok := legacyPairing(t, s, preq, 0)
+	if !ok {
+		t.Fatal("pairing failed")
+	}
+
+	// The controller asks for the STK, and encrypts the link with it.
+	s.c.smp.post(func() { s.c.smp.longTermKey(0, 0) })
+	if b := s.expectCmd(t, &cmd.LELongTermKeyRequestReply{}); !bytes.Equal(b[2:18], stk[:]) {
+		t.Fatalf("replied LTK %X, want STK %X", b[2:18], stk)
+	}
+	s.encrypt(0x00, true)
+
+	// The slave distributes its keys first.
+	ltk := s.expect(t, encryptionInformation)[1:]
+	ediv := s.expect(t, masterIdentification)[1:]
+	if irk, local := s.expect(t, identiInformation)[1:], s.h.LocalIRK(); !bytes.Equal(irk, local[:]) {
+		t.Errorf("distributed IRK %X, want %X", irk, local)
+	}
+	if a := s.expect(t, identityAddreInformation)[1:]; !bytes.Equal(a, append([]byte{0x00}, smpSlaveAddr[:]...)) {
+		t.Errorf("distributed identity address %X, want public %X", a, smpSlaveAddr)
+	}
+	csrk := s.expect(t, signingInformation)[1:]
+
+	mltk := bytes.Repeat([]byte{0x01}, 16)
+	mirk := bytes.Repeat([]byte{0x02}, 16)
+	mcsrk := bytes.Repeat([]byte{0x03}, 16)
+	s.recv(encryptionInformation, mltk...)
+	s.recv(masterIdentification, 0x34, 0x12, 1, 2, 3, 4, 5, 6, 7, 8)
+	s.recv(identiInformation, mirk...)
+	s.recv(identityAddreInformation, append([]byte{0x00}, smpMasterAddr[:]...)...)
+	s.recv(signingInformation, mcsrk...)
+	s.idle(t)
+
+	if lv := s.c.SecurityLevel(); lv != ble.SecurityUnauthenticated {
+		t.Errorf("security level %v, want %v", lv, ble.SecurityUnauthenticated)
+	}
+	b, err := s.h.bonds.Find(ble.NewAddr("11:22:33:44:55:66"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.LTK[:], mltk) || b.EDIV != 0x1234 || b.Rand != 0x0807060504030201 {
+		t.Errorf("bonded LTK %X, EDIV %04X, Rand %016X, want %X, 1234, 0807060504030201", b.LTK, b.EDIV, b.Rand, mltk)
+	}
+	if !bytes.Equal(b.IRK[:], mirk) || !bytes.Equal(b.CSRK[:], mcsrk) {
+		t.Errorf("bonded IRK %X, CSRK %X, want %X, %X", b.IRK, b.CSRK, mirk, mcsrk)
+	}
+	if !bytes.Equal(b.LocalLTK[:], ltk) || b.LocalEDIV != binary.LittleEndian.Uint16(ediv) || !bytes.Equal(b.LocalCSRK[:], csrk) {
+		t.Errorf("bonded local keys %X, %04X, %X, want %X, %X, %X", b.LocalLTK, b.LocalEDIV, b.LocalCSRK, ltk, ediv[:2], csrk)
+	}
+	if b.KeySize != 16 || b.Authenticated || b.SecureConnections {
+		t.Errorf("bond of %d octets, authenticated %v, SC %v, want 16, false, false", b.KeySize, b.Authenticated, b.SecureConnections)
+	}
+}
+
+func TestSMPLegacyPasskey(t *testing.T) {
+	for _, tt := range []struct {
+		passkey uint32
+		ok      bool
+	}{
+		{123456, true},
+		{654321, false},
+	} {
+		s := newSMPPeer(t, roleSlave, smpSlaveAddr, smpMasterAddr)
+		s.h.smpIOCap = ioCapKeyboardOnly
+		s.h.agent = &testAgent{passkey: 123456}
+
+		// The master displays the passkey, which the slave inputs.
+		preq := []byte{pairingRequest, ioCapDisplayOnly, 0x00, authReqBonding | authReqMITM, 16, 0x00, 0x00}
+		stk, ok := legacyPairing(t, s, preq, tt.passkey)
+		if ok != tt.ok {
+			t.Fatalf("passkey %d: paired %v, want %v", tt.passkey, ok, tt.ok)
+		}
+		if !ok {
+			// The last command sent is the Pairing Failed.
+			s.c.smp.post(func() {
+				if s.c.smp.pairing != nil {
+					t.Errorf("passkey %d: pairing still in progress", tt.passkey)
+				}
+			})
+			s.idle(t)
+			continue
+		}
+		s.c.smp.post(func() { s.c.smp.longTermKey(0, 0) })
+		if b := s.expectCmd(t, &cmd.LELongTermKeyRequestReply{}); !bytes.Equal(b[2:18], stk[:]) {
+			t.Fatalf("replied LTK %X, want STK %X", b[2:18], stk)
+		}
+		s.encrypt(0x00, true)
+		s.idle(t)
+		if lv := s.c.SecurityLevel(); lv != ble.SecurityAuthenticated {
+			t.Errorf("security level %v, want %v", lv, ble.SecurityAuthenticated)
+		}
+	}
+}
+
+func TestSMPConfirmValueFailed(t *testing.T) {
+	s := newSMPPeer(t, roleSlave, smpSlaveAddr, smpMasterAddr)
+	preq := []byte{pairingRequest, ioCapNoInputNoOutput, 0x00, authReqBonding, 16, 0x00, 0x00}
+	s.recv(preq[0], preq[1:]...)
+	s.expect(t, pairingResponse)
+
+	// The random value doesn't match the confirm value of the master.
+	s.recv(pairingConfirm, bytes.Repeat([]byte{0xAA}, 16)...)
+	s.expect(t, pairingConfirm)
+	s.recv(pairingRandom, bytes.Repeat([]byte{0x55}, 16)...)
+	if b := s.expect(t, pairingFailed); b[1] != smpConfirmValueFailed {
+		t.Errorf("Pairing Failed reason 0x%02X, want 0x%02X", b[1], smpConfirmValueFailed)
+	}
+	if _, err := s.h.bonds.Find(ble.NewAddr("11:22:33:44:55:66")); err != ble.ErrNotBonded {
+		t.Errorf("Find() = %v, want %v", err, ble.ErrNotBonded)
+	}
+}
+
+func TestSMPTimeout(t *testing.T) {
+	m := newSMPPeer(t, roleMaster, smpMasterAddr, smpSlaveAddr)
+	errc := make(chan error, 1)
+	go func() { errc <- m.c.Pair(context.Background()) }()
+	preq := m.expect(t, pairingRequest)
+
+	// The slave doesn't respond in time.
+	m.c.smp.post(func() { m.c.smp.pairing.tmo.Reset(time.Millisecond) })
+	if err := <-errc; err != errPairingTimeout {
+		t.Fatalf("Pair() = %v, want %v", err, errPairingTimeout)
+	}
+
+	// No further commands are sent, and no pairing is started on the link.
+	m.recv(pairingResponse, preq[1:]...)
+	m.idle(t)
+	if err := m.c.Pair(context.Background()); err != errPairingTimeout {
+		t.Errorf("Pair() = %v after the timeout, want %v", err, errPairingTimeout)
+	}
+	m.idle(t)
+}
+
+func TestSMPSecurityRequestBonded(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		authReq uint8
+		status  uint8
+		pair    bool
+	}{
+		{"encrypted", authReqBonding, 0x00, false},
+		{"slave lost the keys", authReqBonding, uint8(ErrPINMissing), true},
+		{"MITM requested", authReqBonding | authReqMITM, 0x00, true},
+	} {
+		m := newSMPPeer(t, roleMaster, smpMasterAddr, smpSlaveAddr)
+		ltk := ble.Key{0x01, 0x02, 0x03}
+		m.h.bonds.Save(&ble.Bond{Address: "b1:b2:b3:b4:b5:b6", LTK: ltk, EDIV: 0x1234, Rand: 0x42, KeySize: 16})
+
+		m.recv(securityRequest, tt.authReq)
+		if tt.authReq&authReqMITM != 0 {
+			// The bond doesn't provide the MITM protection.
+			m.expect(t, pairingRequest)
+			continue
+		}
+		b := m.expectCmd(t, &cmd.LEStartEncryption{})
+		if !bytes.Equal(b[12:28], ltk[:]) || binary.LittleEndian.Uint16(b[10:]) != 0x1234 || binary.LittleEndian.Uint64(b[2:]) != 0x42 {
+			t.Errorf("%s: started encryption with %X, want the bonded LTK", tt.name, b)
+		}
+		m.encrypt(tt.status, tt.status == 0x00)
+		if tt.pair {
+			m.expect(t, pairingRequest)
+			continue
+		}
+		m.idle(t)
+		if lv := m.c.SecurityLevel(); lv != ble.SecurityUnauthenticated {
+			t.Errorf("%s: security level %v, want %v", tt.name, lv, ble.SecurityUnauthenticated)
+		}
+
+		// Further Security Requests are ignored, as the link is encrypted.
+		m.recv(securityRequest, tt.authReq)
+		m.idle(t)
+		select {
+		case c := <-m.cmds:
+			t.Errorf("%s: sent HCI command 0x%04X, want none", tt.name, c.op)
+		default:
+		}
+	}
+}
+
+func TestSMPNumericComparison(t *testing.T) {
+	for _, tamper := range []bool{false, true} {
+		m := newSMPPeer(t, roleMaster, smpMasterAddr, smpSlaveAddr)
+		s := newSMPPeer(t, roleSlave, smpSlaveAddr, smpMasterAddr)
+		ma := &testAgent{compared: make(chan uint32, 1)}
+		sa := &testAgent{compared: make(chan uint32, 1)}
+		m.h.smpIOCap, m.h.agent = ioCapDisplayYesNo, ma
+		s.h.smpIOCap, s.h.agent = ioCapDisplayYesNo, sa
+		link(m, s)
+		if tamper {
+			// The DHKey check of the slave is corrupted on its way.
+			send := s.h.skt.(*testSocket).acl
+			s.h.skt.(*testSocket).acl = func(b []byte) {
+				if b[0] == pairingDHKeyCheck {
+					b[1] ^= 0xFF
+				}
+				send(b)
+			}
+		}
+
+		err := m.c.Pair(context.Background())
+		if tamper {
+			if err != ErrPairing(smpDHKeyCheckFailed) {
+				t.Errorf("Pair() = %v with a corrupted DHKey check, want %v", err, ErrPairing(smpDHKeyCheckFailed))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Pair() = %v", err)
+		}
+		if mn, sn := <-ma.compared, <-sa.compared; mn != sn || mn > 999999 {
+			t.Errorf("compared %d and %d, want the same 6 digits", mn, sn)
+		}
+		s.sync()
+		if ml, sl := m.c.SecurityLevel(), s.c.SecurityLevel(); ml != ble.SecuritySC || sl != ble.SecuritySC {
+			t.Errorf("security levels %v, %v, want %v", ml, sl, ble.SecuritySC)
+		}
+		mb, err := m.h.bonds.Find(ble.NewAddr("b1:b2:b3:b4:b5:b6"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := s.h.bonds.Find(ble.NewAddr("11:22:33:44:55:66"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mb.LTK.IsZero() || mb.LTK != sb.LTK || mb.LTK != sb.LocalLTK || !mb.SecureConnections || !mb.Authenticated {
+			t.Errorf("bonds %+v and %+v don't share an authenticated SC LTK", mb, sb)
+		}
+	}
+}
+
+func TestSMPSecureConnectionsOnly(t *testing.T) {
+	// A slave rejects the Pairing Request of a legacy master.
+	s := newSMPPeer(t, roleSlave, smpSlaveAddr, smpMasterAddr)
+	s.h.scOnly = true
+	s.recv(pairingRequest, ioCapNoInputNoOutput, 0x00, authReqBonding, 16, 0x00, 0x00)
+	if b := s.expect(t, pairingFailed); b[1] != smpAuthenticationRequirements {
+		t.Errorf("Pairing Failed reason 0x%02X, want 0x%02X", b[1], smpAuthenticationRequirements)
+	}
+
+	// A master rejects the Pairing Response of a legacy slave.
+	m := newSMPPeer(t, roleMaster, smpMasterAddr, smpSlaveAddr)
+	m.h.scOnly = true
+	errc := make(chan error, 1)
+	go func() { errc <- m.c.Pair(context.Background()) }()
+	if b := m.expect(t, pairingRequest); b[3]&authReqSC == 0 {
+		t.Errorf("Pairing Request %X without the SC flag", b)
+	}
+	m.recv(pairingResponse, ioCapNoInputNoOutput, 0x00, authReqBonding, 16, 0x00, 0x00)
+	if b := m.expect(t, pairingFailed); b[1] != smpAuthenticationRequirements {
+		t.Errorf("Pairing Failed reason 0x%02X, want 0x%02X", b[1], smpAuthenticationRequirements)
+	}
+	if err := <-errc; err != ErrPairing(smpAuthenticationRequirements) {
+		t.Errorf("Pair() = %v, want %v", err, ErrPairing(smpAuthenticationRequirements))
+	}
+}
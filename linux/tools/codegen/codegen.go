@@ -93,6 +93,9 @@ var funcMap = template.FuncMap{
 		case "uint8":
 			s = fmt.Sprintf("func (r %s) %s () %s { return r[%d]}\n", n, k, v, cnt)
 			cnt++
+		case "int8":
+			s = fmt.Sprintf("func (r %s) %s () %s { return int8(r[%d])}\n", n, k, v, cnt)
+			cnt++
 		case "uint16":
 			s = fmt.Sprintf("func (r %s) %s () %s { return binary.LittleEndian.Uint16(r[%d:])}\n", n, k, v, cnt)
 			cnt += 2
@@ -155,6 +158,8 @@ type cmd struct {
 	Param  []field  // Command Parameters
 	Return []field  // Return Parameters
 	Events []string // Relevant events
+
+	CustomMarshaller bool // Len and Marshal are hand-written
 }
 
 type commands struct {
@@ -220,6 +225,10 @@ type signal struct {
 	Code   string
 	Fields []field
 	Type   string
+
+	// CustomMarshaller skips the generated Marshal and Unmarshal, for the
+	// packets with variable length fields.
+	CustomMarshaller bool
 }
 
 type signals struct {
@@ -284,7 +293,7 @@ func main() {
 		}
 		genEvt(b, w, t)
 	case "signal":
-		fmt.Fprintf(w, "package l2cap\n")
+		fmt.Fprintf(w, "package hci\n")
 		t, err := template.New(*tmpl).Funcs(funcMap).Parse(string(input("signal.tmpl")))
 		if err != nil {
 			log.Fatalf("parsing: %s", err)
@@ -12,6 +12,7 @@ type DeviceOption interface {
 	SetDeviceID(int) error
 	SetDialerTimeout(time.Duration) error
 	SetListenerTimeout(time.Duration) error
+	SetSignalTimeout(time.Duration) error
 	SetConnParams(cmd.LECreateConnection) error
 	SetScanParams(cmd.LESetScanParameters) error
 	SetAdvParams(cmd.LESetAdvertisingParameters) error
@@ -19,6 +20,23 @@ type DeviceOption interface {
 	SetDisconnectedHandler(f func(evt.DisconnectionComplete)) error
 	SetPeripheralRole() error
 	SetCentralRole() error
+	SetBondStore(BondStore) error
+	SetPairingAgent(PairingAgent) error
+	SetIOCapability(IOCapability) error
+	SetSecureConnectionsOnly(bool) error
+	SetPrivacy(time.Duration) error
+	SetLocalIRK(Key) error
+	SetControllerPrivacy(bool) error
+	SetFilterPolicy(FilterPolicy) error
+	SetRandomAddress(Addr) error
+	SetStaticRandomAddress() error
+	SetConnParamPolicy(ConnParamPolicy) error
+	SetAutoDataLength(bool) error
+	SetDefaultPHY(tx, rx PHY) error
+	SetExtendedScan(phys PHY) error
+	SetScanCache(size int, ttl time.Duration) error
+	SetAdvQueue(depth int, policy AdvDropPolicy) error
+	SetEnhancedATT(bool) error
 }
 
 // An Option is a configuration function, which configures the device.
@@ -48,6 +66,14 @@ func OptListenerTimeout(d time.Duration) Option {
 	}
 }
 
+// OptSignalTimeout sets the RTX timer of the L2CAP signaling requests, which
+// is between 1 and 60 seconds.
+func OptSignalTimeout(d time.Duration) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetSignalTimeout(d)
+	}
+}
+
 // OptConnParams overrides default connection parameters.
 func OptConnParams(param cmd.LECreateConnection) Option {
 	return func(opt DeviceOption) error {
@@ -56,6 +82,71 @@ func OptConnParams(param cmd.LECreateConnection) Option {
 	}
 }
 
+// OptConnParamPolicy sets the policy, which accepts, rejects or clamps the
+// connection parameters requested by the remote devices. Without a policy,
+// the valid requests are accepted.
+func OptConnParamPolicy(p ConnParamPolicy) Option {
+	return func(opt DeviceOption) error {
+		opt.SetConnParamPolicy(p)
+		return nil
+	}
+}
+
+// OptAutoDataLength requests the maximum data length supported by the
+// controller on each new connection, if the controller supports the LE Data
+// Packet Length Extension.
+func OptAutoDataLength(auto bool) Option {
+	return func(opt DeviceOption) error {
+		opt.SetAutoDataLength(auto)
+		return nil
+	}
+}
+
+// OptDefaultPHY sets the preferred PHYs for transmitting and receiving on
+// the new connections. Either tx or rx may be 0, if there is no preference.
+func OptDefaultPHY(tx, rx PHY) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetDefaultPHY(tx, rx)
+	}
+}
+
+// OptScanCache sets the number of devices, whose advertising data and scan
+// response are cached and merged while scanning, and how long they are cached
+// since they're last seen. If ttl is 0, they don't expire.
+func OptScanCache(size int, ttl time.Duration) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetScanCache(size, ttl)
+	}
+}
+
+// OptAdvQueue sets the number of advertisements, which are queued for the
+// AdvHandler in order, and which of them are dropped once the queue is full.
+func OptAdvQueue(depth int, policy AdvDropPolicy) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetAdvQueue(depth, policy)
+	}
+}
+
+// OptEnhancedATT makes the GATT server accept the Enhanced ATT bearers, and
+// report them in its Server Supported Features.
+func OptEnhancedATT() Option {
+	return func(opt DeviceOption) error {
+		return opt.SetEnhancedATT(true)
+	}
+}
+
+// OptExtendedScan scans with the extended scanning on the PHYs, PHY1M and
+// PHYCoded, which reports the extended advertisements as well. The device
+// then uses the extended commands, which the advertising sets and the
+// periodic advertising require, and which can't be mixed with the legacy
+// ones. The legacy advertising can't be used along with it; use the
+// advertising sets instead.
+func OptExtendedScan(phys PHY) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetExtendedScan(phys)
+	}
+}
+
 // OptScanParams overrides default scanning parameters.
 func OptScanParams(param cmd.LESetScanParameters) Option {
 	return func(opt DeviceOption) error {
@@ -101,3 +192,100 @@ func OptCentralRole() Option {
 		return nil
 	}
 }
+
+// OptBondStore sets the store which persists the keys of bonded peers.
+// Without a store, the keys are forgotten when the connection is closed.
+func OptBondStore(s BondStore) Option {
+	return func(opt DeviceOption) error {
+		opt.SetBondStore(s)
+		return nil
+	}
+}
+
+// OptPairingAgent sets the agent which takes part in pairing on behalf of the user.
+func OptPairingAgent(a PairingAgent) Option {
+	return func(opt DeviceOption) error {
+		opt.SetPairingAgent(a)
+		return nil
+	}
+}
+
+// OptIOCapability sets the input and output capabilities of the device, used
+// to determine the pairing method. The default is IOCapNoInputNoOutput.
+func OptIOCapability(c IOCapability) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetIOCapability(c)
+	}
+}
+
+// OptSecureConnectionsOnly rejects the pairing with the remote devices, which
+// don't support LE Secure Connections, instead of falling back to LE Legacy
+// Pairing.
+func OptSecureConnectionsOnly() Option {
+	return func(opt DeviceOption) error {
+		return opt.SetSecureConnectionsOnly(true)
+	}
+}
+
+// OptPrivacy enables privacy. The device advertises, scans and initiates
+// connections with a Resolvable Private Address, which is regenerated every
+// interval. If interval is not positive, the recommended 15 minutes is used.
+func OptPrivacy(interval time.Duration) Option {
+	return func(opt DeviceOption) error {
+		opt.SetPrivacy(interval)
+		return nil
+	}
+}
+
+// OptLocalIRK sets the Identity Resolving Key of the device, which generates
+// its Resolvable Private Addresses and is distributed to bonded peers. It
+// should be persisted along with the bonds, so that the peers still resolve
+// the addresses after a restart. Without it, a random one is generated, which
+// the device reports with LocalIRK, so it can be persisted and set next time.
+func OptLocalIRK(irk Key) Option {
+	return func(opt DeviceOption) error {
+		opt.SetLocalIRK(irk)
+		return nil
+	}
+}
+
+// OptControllerPrivacy offloads the address resolution to the controller, if
+// it supports LL Privacy. The bonded devices are loaded into the resolving
+// list of the controller, which resolves the Resolvable Private Addresses of
+// the peers to their identity addresses.
+func OptControllerPrivacy() Option {
+	return func(opt DeviceOption) error {
+		opt.SetControllerPrivacy(true)
+		return nil
+	}
+}
+
+// OptFilterPolicy restricts scanning, advertising or initiating connections
+// to the bonded devices. The RPAs of the peers only match their identity
+// addresses in the white list if the controller resolves them, so it should
+// be used along with OptControllerPrivacy.
+func OptFilterPolicy(p FilterPolicy) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetFilterPolicy(p)
+	}
+}
+
+// OptRandomAddress sets the static or non-resolvable private address, which
+// the device uses instead of its public address to advertise, scan and
+// initiate connections. A static address is also the identity address of the
+// device, and should be kept unchanged across power cycles.
+func OptRandomAddress(a Addr) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetRandomAddress(a)
+	}
+}
+
+// OptStaticRandomAddress generates a static random address, which the device
+// uses instead of its public address. As the address is regenerated each time,
+// bonded peers won't recognize the device after a restart; use
+// OptRandomAddress with a persisted address instead if that matters.
+func OptStaticRandomAddress() Option {
+	return func(opt DeviceOption) error {
+		return opt.SetStaticRandomAddress()
+	}
+}
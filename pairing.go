@@ -0,0 +1,45 @@
+package ble
+
+// IOCapability is the input and output capabilities of a device, which
+// determine the pairing method [Vol 3, Part H, 2.3.2].
+type IOCapability uint8
+
+// IOCapability values [Vol 3, Part H, 3.5.1].
+const (
+	IOCapDisplayOnly     IOCapability = 0x00 // IOCapDisplayOnly can display a passkey.
+	IOCapDisplayYesNo    IOCapability = 0x01 // IOCapDisplayYesNo can display a number, and confirm it with yes or no.
+	IOCapKeyboardOnly    IOCapability = 0x02 // IOCapKeyboardOnly can input a passkey.
+	IOCapNoInputNoOutput IOCapability = 0x03 // IOCapNoInputNoOutput has no means for user interaction.
+	IOCapKeyboardDisplay IOCapability = 0x04 // IOCapKeyboardDisplay can input and display a passkey.
+)
+
+// A PairingAgent takes part in pairing on behalf of the user.
+//
+// The methods are called on their own goroutine, and may block while waiting
+// for the user. Meanwhile the pairing may time out, if it doesn't complete
+// within 30 seconds [Vol 3, Part H, 3.4], or fail, in which case the answer
+// is ignored.
+type PairingAgent interface {
+	// AuthorizePairing is called when the remote device requests pairing.
+	// The pairing is rejected if it returns false.
+	AuthorizePairing(c Conn) bool
+
+	// DisplayPasskey is called to display the passkey, which the user
+	// enters on the remote device.
+	DisplayPasskey(c Conn, passkey uint32)
+
+	// RequestPasskey is called to request the passkey, displayed on the
+	// remote device, from the user. The pairing fails if it returns an error.
+	RequestPasskey(c Conn) (uint32, error)
+
+	// ConfirmNumericComparison is called to display the number, which is also
+	// displayed on the remote device. It returns true if the user confirms
+	// that the numbers match.
+	ConfirmNumericComparison(c Conn, n uint32) bool
+}
+
+// A PairingCanceler is a PairingAgent, which is told when the pairing it's
+// asking the user about is canceled, so it can dismiss the prompt.
+type PairingCanceler interface {
+	CancelPairing(c Conn)
+}
@@ -0,0 +1,16 @@
+package ble
+
+// PeriodicReport is the data of a periodic advertising train, which the
+// device is synchronized to [Vol 2, Part E, 7.7.65.15].
+type PeriodicReport struct {
+	// TxPower is the transmit power in dBm, or TxPowerUnavailable.
+	TxPower int
+
+	// RSSI is the signal strength in dBm.
+	RSSI int
+
+	// Data is the periodic advertising data, which is reassembled from the
+	// fragments. Truncated is set if the controller didn't receive all of it.
+	Data      []byte
+	Truncated bool
+}
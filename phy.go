@@ -0,0 +1,41 @@
+package ble
+
+import "strings"
+
+// PHY is a physical layer of LE [Vol 6, Part A, 3.2]. The PHYs are bits,
+// which are combined into the set of the preferred PHYs.
+type PHY uint8
+
+// PHY values [Vol 2, Part E, 7.8.48].
+const (
+	PHY1M    PHY = 1 << 0 // PHY1M is the LE 1M PHY.
+	PHY2M    PHY = 1 << 1 // PHY2M is the LE 2M PHY.
+	PHYCoded PHY = 1 << 2 // PHYCoded is the LE Coded PHY.
+)
+
+func (p PHY) String() string {
+	var s []string
+	for _, v := range []struct {
+		phy  PHY
+		name string
+	}{{PHY1M, "LE 1M"}, {PHY2M, "LE 2M"}, {PHYCoded, "LE Coded"}} {
+		if p&v.phy != 0 {
+			s = append(s, v.name)
+		}
+	}
+	if len(s) == 0 || p&^(PHY1M|PHY2M|PHYCoded) != 0 {
+		return "unknown PHY"
+	}
+	return strings.Join(s, "|")
+}
+
+// PHYOptions is the preferred coding of the LE Coded PHY, when it's used for
+// transmitting [Vol 2, Part E, 7.8.49].
+type PHYOptions uint16
+
+// PHYOptions values [Vol 2, Part E, 7.8.49].
+const (
+	PHYOptionNone PHYOptions = 0 // PHYOptionNone means no preferred coding.
+	PHYOptionS2   PHYOptions = 1 // PHYOptionS2 prefers S=2 coding.
+	PHYOptionS8   PHYOptions = 2 // PHYOptionS8 prefers S=8 coding.
+)
@@ -30,6 +30,19 @@ const (
 	CharExtended    Property = 0x80 // supports extended properties
 )
 
+// Permission ...
+type Permission int
+
+// Attribute permission flags [Vol 3, Part F, 3.2.5].
+// Permissions of a service apply to the values of all of its characteristics.
+const (
+	PermReadEncrypted      Permission = 0x01 // may be read on an encrypted link
+	PermReadAuthenticated  Permission = 0x02 // may be read on an encrypted link with an authenticated key
+	PermWriteEncrypted     Permission = 0x04 // may be written on an encrypted link
+	PermWriteAuthenticated Permission = 0x08 // may be written on an encrypted link with an authenticated key
+	PermAuthorized         Permission = 0x10 // may be accessed if authorized by the AuthorizeHandler
+)
+
 // A Profile is composed of one or more services necessary to fulfill a use case.
 type Profile struct {
 	Services []*Service
@@ -91,6 +104,11 @@ type Service struct {
 	UUID            UUID
 	Characteristics []*Characteristic
 
+	// Permission and MinKeySize apply to the values of all the characteristics,
+	// in addition to their own. Descriptors only have their own.
+	Permission Permission
+	MinKeySize int
+
 	Handle    uint16
 	EndHandle uint16
 }
@@ -121,12 +139,19 @@ type Characteristic struct {
 	Descriptors []*Descriptor
 	CCCD        *Descriptor
 
+	// Permission is the security required to access the value.
+	// MinKeySize is the minimum encryption key size required by the accesses
+	// which require encryption.
+	Permission Permission
+	MinKeySize int
+
 	Value []byte
 
-	ReadHandler     ReadHandler
-	WriteHandler    WriteHandler
-	NotifyHandler   NotifyHandler
-	IndicateHandler NotifyHandler
+	ReadHandler      ReadHandler
+	WriteHandler     WriteHandler
+	NotifyHandler    NotifyHandler
+	IndicateHandler  NotifyHandler
+	AuthorizeHandler AuthorizeHandler
 
 	Handle      uint16
 	ValueHandle uint16
@@ -182,6 +207,13 @@ func (c *Characteristic) HandleWrite(h WriteHandler) {
 	c.WriteHandler = h
 }
 
+// HandleAuthorize makes accessing the characteristic value require authorization, which is granted by h.
+// HandleAuthorize must be called before the containing service is added to a server.
+func (c *Characteristic) HandleAuthorize(h AuthorizeHandler) {
+	c.Permission |= PermAuthorized
+	c.AuthorizeHandler = h
+}
+
 // HandleNotify makes the characteristic support notify requests, and routes notification requests to h.
 // HandleNotify must be called before the containing service is added to a server.
 func (c *Characteristic) HandleNotify(h NotifyHandler) {
@@ -201,11 +233,18 @@ type Descriptor struct {
 	UUID     UUID
 	Property Property
 
+	// Permission is the security required to access the descriptor.
+	// MinKeySize is the minimum encryption key size required by the accesses
+	// which require encryption.
+	Permission Permission
+	MinKeySize int
+
 	Handle uint16
 	Value  []byte
 
-	ReadHandler  ReadHandler
-	WriteHandler WriteHandler
+	ReadHandler      ReadHandler
+	WriteHandler     WriteHandler
+	AuthorizeHandler AuthorizeHandler
 }
 
 // SetValue makes the descriptor support read requests, and returns a static value.
@@ -238,3 +277,10 @@ func (d *Descriptor) HandleWrite(h WriteHandler) {
 	d.Property |= CharWrite | CharWriteNR
 	d.WriteHandler = h
 }
+
+// HandleAuthorize makes accessing the descriptor require authorization, which is granted by h.
+// HandleAuthorize must be called before the containing service is added to a server.
+func (d *Descriptor) HandleAuthorize(h AuthorizeHandler) {
+	d.Permission |= PermAuthorized
+	d.AuthorizeHandler = h
+}
@@ -0,0 +1,238 @@
+package ble
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ScanEventType is the type of a ScanEvent.
+type ScanEventType int
+
+// ScanEventType values.
+const (
+	DeviceAppeared ScanEventType = iota // DeviceAppeared is reported when a device is first seen.
+	DeviceUpdated                       // DeviceUpdated is reported when the data or RSSI of a device changed.
+	DeviceLost                          // DeviceLost is reported when a device isn't seen for the LostTimeout.
+)
+
+func (t ScanEventType) String() string {
+	switch t {
+	case DeviceAppeared:
+		return "appeared"
+	case DeviceUpdated:
+		return "updated"
+	case DeviceLost:
+		return "lost"
+	}
+	return "unknown"
+}
+
+// ScanEvent is a discovery event of ScanChan.
+type ScanEvent struct {
+	Type ScanEventType
+	Addr Addr
+
+	// Advertisement is the advertisement of the event, or the last one seen
+	// of a lost device.
+	Advertisement Advertisement
+}
+
+// ScanOptions are the options of ScanChan. Each device, identified by its
+// address, is reported once, unless the options tell it to be reported again.
+type ScanOptions struct {
+	// Filter selects the advertisements, which are reported, if it's set.
+	Filter AdvFilter
+
+	// ReportDataChange reports a device again, when its advertising data or
+	// scan response changes.
+	ReportDataChange bool
+
+	// RSSIDelta reports a device again, when its RSSI moves more than
+	// RSSIDelta dB since it was last reported, unless it's 0.
+	RSSIDelta int
+
+	// LostTimeout reports a device as lost, when it isn't seen for
+	// LostTimeout, unless it's 0. A lost device appears again once it's seen.
+	LostTimeout time.Duration
+
+	// Buffer is the capacity of the channel.
+	Buffer int
+}
+
+func (o ScanOptions) validate() error {
+	switch {
+	case o.RSSIDelta < 0:
+		return fmt.Errorf("invalid RSSI delta %d", o.RSSIDelta)
+	case o.LostTimeout < 0:
+		return fmt.Errorf("invalid lost timeout %v", o.LostTimeout)
+	case o.Buffer < 0:
+		return fmt.Errorf("invalid buffer %d", o.Buffer)
+	}
+	return nil
+}
+
+// scanStarter is a Device, which starts scanning without waiting for it to
+// stop, so that ScanChan learns whether scanning started.
+type scanStarter interface {
+	StartScan(allowDup bool, h AdvHandler) error
+	StopScan() error
+}
+
+// ScanChan starts scanning, and returns the channel of the discovery events.
+// Duplicated advertisements are reported as the options say. The channel is
+// closed, when ctx is done. An error is returned, if the options are invalid
+// or scanning doesn't start.
+func ScanChan(ctx context.Context, opts ScanOptions) (<-chan ScanEvent, error) {
+	if defaultDevice == nil {
+		return nil, ErrDefaultDevice
+	}
+	d, ok := defaultDevice.(scanStarter)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	t := newScanTracker(ctx, opts)
+	h := t.advertise
+	if f := opts.Filter; f != nil {
+		h = func(a Advertisement) {
+			if f(a) {
+				t.advertise(a)
+			}
+		}
+	}
+	sigs := trap(ctx)
+	if err := d.StartScan(true, h); err != nil {
+		untrap(sigs)
+		return nil, err
+	}
+	if opts.LostTimeout > 0 {
+		go t.expireLoop()
+	}
+	go func() {
+		defer untrap(sigs)
+		<-ctx.Done()
+		d.StopScan()
+		t.close()
+	}()
+	return t.ch, nil
+}
+
+// scanDevice is the state of a device seen by ScanChan.
+type scanDevice struct {
+	a    Advertisement
+	seen time.Time
+
+	// data and rssi are what was last reported.
+	data []byte
+	rssi int
+}
+
+// scanTracker tracks the devices of ScanChan, and reports their events.
+type scanTracker struct {
+	ctx  context.Context
+	opts ScanOptions
+	ch   chan ScanEvent
+
+	// mu guards the devices, and serializes the events.
+	mu     sync.Mutex
+	devs   map[string]*scanDevice
+	closed bool
+}
+
+func newScanTracker(ctx context.Context, opts ScanOptions) *scanTracker {
+	return &scanTracker{
+		ctx:  ctx,
+		opts: opts,
+		ch:   make(chan ScanEvent, opts.Buffer),
+		devs: make(map[string]*scanDevice),
+	}
+}
+
+// advertise handles an advertisement.
+func (t *scanTracker) advertise(a Advertisement) {
+	t.advertiseAt(a, time.Now())
+}
+
+// advertiseAt handles an advertisement, which is seen at now.
+func (t *scanTracker) advertiseAt(a Advertisement, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	k := a.Addr().String()
+	d, ok := t.devs[k]
+	if !ok {
+		d = &scanDevice{}
+		t.devs[k] = d
+	}
+	d.a, d.seen = a, now
+	typ := DeviceUpdated
+	switch {
+	case !ok:
+		typ = DeviceAppeared
+	case t.opts.ReportDataChange && !bytes.Equal(a.MergedData(), d.data):
+	case t.opts.RSSIDelta > 0 && (a.RSSI()-d.rssi > t.opts.RSSIDelta || d.rssi-a.RSSI() > t.opts.RSSIDelta):
+	default:
+		return
+	}
+	d.data, d.rssi = a.MergedData(), a.RSSI()
+	t.send(ScanEvent{Type: typ, Addr: a.Addr(), Advertisement: a})
+}
+
+// expireLoop reports the lost devices, until scanning stops.
+func (t *scanTracker) expireLoop() {
+	d := t.opts.LostTimeout / 4
+	if d == 0 {
+		d = t.opts.LostTimeout
+	}
+	tk := time.NewTicker(d)
+	defer tk.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-tk.C:
+			t.expire(now)
+		}
+	}
+}
+
+// expire reports the devices, which aren't seen for the LostTimeout at now.
+func (t *scanTracker) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	for k, d := range t.devs {
+		if now.Sub(d.seen) < t.opts.LostTimeout {
+			continue
+		}
+		delete(t.devs, k)
+		t.send(ScanEvent{Type: DeviceLost, Addr: d.a.Addr(), Advertisement: d.a})
+	}
+}
+
+// send reports the event, unless scanning stops meanwhile. It's called with
+// t.mu held.
+func (t *scanTracker) send(e ScanEvent) {
+	select {
+	case t.ch <- e:
+	case <-t.ctx.Done():
+	}
+}
+
+// close closes the channel, once scanning stops.
+func (t *scanTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	close(t.ch)
+}
@@ -0,0 +1,136 @@
+package ble
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testAdv is an advertisement with an address, RSSI and data.
+type testAdv struct {
+	Advertisement
+	addr string
+	rssi int
+	data string
+}
+
+func (a testAdv) Addr() Addr         { return NewAddr(a.addr) }
+func (a testAdv) RSSI() int          { return a.rssi }
+func (a testAdv) MergedData() []byte { return []byte(a.data) }
+
+func TestScanTracker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := newScanTracker(ctx, ScanOptions{
+		ReportDataChange: true,
+		RSSIDelta:        5,
+		LostTimeout:      time.Second,
+		Buffer:           16,
+	})
+	now := time.Now()
+
+	tr.advertiseAt(testAdv{addr: "a", rssi: -60, data: "x"}, now)
+	tr.advertiseAt(testAdv{addr: "a", rssi: -64, data: "x"}, now)                    // Duplicate.
+	tr.advertiseAt(testAdv{addr: "a", rssi: -66, data: "x"}, now)                    // RSSI moved 6 dB.
+	tr.advertiseAt(testAdv{addr: "a", rssi: -66, data: "y"}, now)                    // Data changed.
+	tr.advertiseAt(testAdv{addr: "b", rssi: -70, data: "z"}, now.Add(time.Second/2)) // Another device.
+	tr.expire(now.Add(time.Second))                                                  // a is lost.
+	tr.advertiseAt(testAdv{addr: "a", rssi: -60, data: "y"}, now.Add(time.Second))   // a appears again.
+	tr.close()
+
+	want := []struct {
+		typ  ScanEventType
+		addr string
+		rssi int
+	}{
+		{DeviceAppeared, "a", -60},
+		{DeviceUpdated, "a", -66},
+		{DeviceUpdated, "a", -66},
+		{DeviceAppeared, "b", -70},
+		{DeviceLost, "a", -66},
+		{DeviceAppeared, "a", -60},
+	}
+	var got []ScanEvent
+	for e := range tr.ch {
+		got = append(got, e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(got), len(want), got)
+	}
+	for i, e := range got {
+		w := want[i]
+		if e.Type != w.typ || e.Addr.String() != w.addr || e.Advertisement.RSSI() != w.rssi {
+			t.Errorf("event %d: %v %s %d, want %v %s %d", i, e.Type, e.Addr, e.Advertisement.RSSI(), w.typ, w.addr, w.rssi)
+		}
+	}
+}
+
+func TestScanTrackerStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := newScanTracker(ctx, ScanOptions{})
+
+	// The events aren't received, so the tracker waits until scanning stops.
+	done := make(chan struct{})
+	go func() {
+		tr.advertiseAt(testAdv{addr: "a"}, time.Now())
+		close(done)
+	}()
+	cancel()
+	<-done
+	tr.close()
+	tr.advertiseAt(testAdv{addr: "b"}, time.Now())
+	if _, ok := <-tr.ch; ok {
+		t.Errorf("event received after scanning stopped")
+	}
+}
+
+// testScanner is a device, which scans as the test says.
+type testScanner struct {
+	Device
+	err     error
+	h       AdvHandler
+	stopped chan struct{}
+}
+
+func (d *testScanner) StartScan(allowDup bool, h AdvHandler) error {
+	d.h = h
+	return d.err
+}
+
+func (d *testScanner) StopScan() error {
+	close(d.stopped)
+	return nil
+}
+
+func TestScanChan(t *testing.T) {
+	defer SetDefaultDevice(defaultDevice)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &testScanner{err: errors.New("scan failed"), stopped: make(chan struct{})}
+	SetDefaultDevice(d)
+	if _, err := ScanChan(ctx, ScanOptions{}); err != d.err {
+		t.Errorf("ScanChan() = %v, want %v", err, d.err)
+	}
+	for _, opts := range []ScanOptions{{Buffer: -1}, {RSSIDelta: -1}, {LostTimeout: -time.Second}} {
+		if _, err := ScanChan(ctx, opts); err == nil {
+			t.Errorf("ScanChan(%+v) = nil, want error", opts)
+		}
+	}
+
+	d.err = nil
+	ch, err := ScanChan(ctx, ScanOptions{Buffer: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.h(testAdv{addr: "a"})
+	if e := <-ch; e.Type != DeviceAppeared || e.Addr.String() != "a" {
+		t.Errorf("event %v %s, want appeared a", e.Type, e.Addr)
+	}
+	cancel()
+	<-d.stopped
+	if _, ok := <-ch; ok {
+		t.Errorf("event received after scanning stopped")
+	}
+}
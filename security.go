@@ -0,0 +1,31 @@
+package ble
+
+// SecurityLevel is the security level of a connection, as defined by the LE
+// security mode 1 [Vol 3, Part C, 10.2.1].
+type SecurityLevel int
+
+// SecurityLevel values [Vol 3, Part C, 10.2.1].
+const (
+	SecurityNone            SecurityLevel = 1 // SecurityNone means the link is not encrypted.
+	SecurityUnauthenticated SecurityLevel = 2 // SecurityUnauthenticated means the link is encrypted with a key from an unauthenticated pairing.
+	SecurityAuthenticated   SecurityLevel = 3 // SecurityAuthenticated means the link is encrypted with a key from an authenticated pairing.
+	SecuritySC              SecurityLevel = 4 // SecuritySC means the link is encrypted with a 128-bit key from an authenticated LE Secure Connections pairing.
+)
+
+func (l SecurityLevel) String() string {
+	switch l {
+	case SecurityNone:
+		return "no security"
+	case SecurityUnauthenticated:
+		return "unauthenticated encryption"
+	case SecurityAuthenticated:
+		return "authenticated encryption"
+	case SecuritySC:
+		return "authenticated LE Secure Connections encryption"
+	}
+	return "unknown security level"
+}
+
+// A SecurityHandler handles the changes of the security level of a connection.
+// keySize is the encryption key size in octets, or 0 if the link is not encrypted.
+type SecurityHandler func(level SecurityLevel, keySize int)
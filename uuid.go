@@ -212,4 +212,6 @@ var knownUUID = map[string]struct{ Name, Type string }{
 	"2a5b": {Name: "CSC Measurement", Type: "org.bluetooth.characteristic.csc_measurement"},
 	"2a5c": {Name: "CSC Feature", Type: "org.bluetooth.characteristic.csc_feature"},
 	"2a5d": {Name: "Sensor Location", Type: "org.bluetooth.characteristic.sensor_location"},
+	"2b29": {Name: "Client Supported Features", Type: "org.bluetooth.characteristic.gatt.client_supported_features"},
+	"2b3a": {Name: "Server Supported Features", Type: "org.bluetooth.characteristic.gatt.server_supported_features"},
 }